@@ -17,28 +17,43 @@ import (
 
 func main() {
 	var inventoryPath, playbookPath, resultPath string
+	var sshUser, sshPrivateKeyFile string
+	var sshPort int
+	var timeout time.Duration
 	flag.StringVar(&inventoryPath, "i", "", "inventory path")
 	flag.StringVar(&playbookPath, "p", "", "playbook yaml path")
 	flag.StringVar(&resultPath, "o", "", "store result path")
+	flag.StringVar(&sshUser, "ssh-user", "auser", "ssh user")
+	flag.IntVar(&sshPort, "ssh-port", 8513, "ssh port")
+	flag.StringVar(&sshPrivateKeyFile, "ssh-key", "/root/.ssh/id_rsa", "ssh private key file")
+	flag.DurationVar(&timeout, "timeout", 55*time.Minute, "maximum run time of the playbook")
 	flag.Parse()
+	if timeout <= 0 {
+		log.Printf("Warn: invalid -timeout %v, using %v", timeout, 55*time.Minute)
+		timeout = 55 * time.Minute
+	}
 
 	var err error
 	buff := new(bytes.Buffer)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 55*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	ansiblePlaybookOptions := &playbook.AnsiblePlaybookOptions{
 		Verbose: false,
 		Become:  false,
+		// every alias is set so inventory vars can't override the identity
 		ExtraVars: map[string]interface{}{
-			"ansible_ssh_private_key_file": "/root/.ssh/id_rsa",
-			"ansible_user":                 "auser",
-			"ansible_port":                 8513,
+			"ansible_private_key_file":     sshPrivateKeyFile,
+			"ansible_ssh_private_key_file": sshPrivateKeyFile,
+			"ansible_user":                 sshUser,
+			"ansible_ssh_user":             sshUser,
+			"ansible_port":                 sshPort,
+			"ansible_ssh_port":             sshPort,
 		},
 		Inventory:     inventoryPath,
 		SSHCommonArgs: "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null",
-		User:          "auser",
+		User:          sshUser,
 	}
 
 	cmd := playbook.NewAnsiblePlaybookCmd(
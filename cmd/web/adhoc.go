@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/apenella/go-ansible/v2/pkg/adhoc"
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+)
+
+// ad-hoc commands run against all hosts of the inventory, the task limit
+// narrows them down
+const ADHOC_PATTERN = "all"
+
+var errAdHocPlaybook = withStatus(http.StatusNotFound, errors.New("ad-hoc tasks have no playbook"))
+
+// module names are plain or fully qualified like ansible.builtin.shell
+var moduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// AdHoc reports whether the task runs a single module instead of a playbook.
+func (t *Task) AdHoc() bool {
+	return t.Module != ""
+}
+
+// checkAdHoc validates the ad-hoc fields of a task request, which can't be
+// combined with a playbook.
+func checkAdHoc(req *TaskRequest) error {
+	if !moduleNamePattern.MatchString(req.Module) {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("invalid module name %q", req.Module))
+	}
+	if strings.TrimSpace(req.Playbook) != "" || req.LibraryPlaybookID != 0 || req.ProjectID != 0 {
+		return withStatus(http.StatusBadRequest, errors.New("give either a module or a playbook, not both"))
+	}
+	if req.Tags != "" || req.SkipTags != "" {
+		return withStatus(http.StatusBadRequest, errors.New("tags only apply to playbooks"))
+	}
+	return nil
+}
+
+// adhocOptions carries the options resolved for the task over to the
+// ansible command.
+func adhocOptions(task *Task, options *playbook.AnsiblePlaybookOptions) *adhoc.AnsibleAdhocOptions {
+	return &adhoc.AnsibleAdhocOptions{
+		ModuleName:        task.Module,
+		Args:              task.ModuleArgs,
+		Become:            options.Become,
+		Check:             options.Check,
+		Diff:              options.Diff,
+		Limit:             options.Limit,
+		Verbose:           options.Verbose,
+		ExtraVars:         options.ExtraVars,
+		Inventory:         options.Inventory,
+		SSHCommonArgs:     options.SSHCommonArgs,
+		User:              options.User,
+		Timeout:           options.Timeout,
+		VaultPasswordFile: options.VaultPasswordFile,
+	}
+}
+
+// newAnsibleCmd is the ansible-playbook command of the task, or the ansible
+// command of an ad-hoc task.
+func newAnsibleCmd(task *Task, options *playbook.AnsiblePlaybookOptions) execute.Commander {
+	if task.AdHoc() {
+		return adhoc.NewAnsibleAdhocCmd(
+			adhoc.WithPattern(ADHOC_PATTERN),
+			adhoc.WithAdhocOptions(adhocOptions(task, options)),
+		)
+	}
+	return playbook.NewAnsiblePlaybookCmd(
+		playbook.WithPlaybooks(task.Playbook.Path),
+		playbook.WithPlaybookOptions(options),
+	)
+}
+
+// ansibleCmdEnv is needed by ad-hoc commands, ansible only uses the stdout
+// callback for them when told to.
+func ansibleCmdEnv(task *Task) map[string]string {
+	if !task.AdHoc() {
+		return nil
+	}
+	return map[string]string{"ANSIBLE_LOAD_CALLBACK_PLUGINS": "true"}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// statusError is an error with the HTTP status it should be answered with.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(code int, err error) error {
+	return &statusError{code: code, err: err}
+}
+
+// errorStatus is the status of a statusError, other errors are internal.
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return http.StatusInternalServerError
+}
+
+// APITask is a task as returned by the API, with its status spelled out.
+type APITask struct {
+	*Task
+	StatusText   string `json:"status_text"`
+	ExitCodeText string `json:"exit_code_text,omitempty"`
+}
+
+// requireAPILogin is requireLogin for clients that can't follow a redirect
+// to the login page.
+func requireAPILogin(c *gin.Context) {
+	user := sessionUser(c)
+	if user == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+		return
+	}
+	c.Set("user", user)
+	c.Next()
+}
+
+func apiCreateTask(c *gin.Context) {
+	var req TaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	task, created, err := newTaskFromRequest(c.Request.Context(), &req, currentUser(c), c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+		c.Header("Location", "/api/v1/tasks/"+task.TaskID)
+	}
+	c.IndentedJSON(code, APITask{Task: task, StatusText: statusText(task.Status), ExitCodeText: exitCodeText(task.ExitCode)})
+}
+
+func apiShowTask(c *gin.Context) {
+	var task Task
+	tx := db.Preload("Playbook").Preload("Inventory").Preload("User").Limit(1).Find(&task, "task_id = ?", c.Param("id"))
+	if tx.Error != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		return
+	}
+	if task.ID == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APITask{Task: &task, StatusText: statusText(task.Status), ExitCodeText: exitCodeText(task.ExitCode)})
+}
+
+// apiError answers with the status errorStatus gives err, in the same
+// {"error": ...} envelope as every other API error.
+func apiError(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(errorStatus(err), gin.H{"error": err.Error()})
+}
+
+var (
+	errAPINotFound  = withStatus(http.StatusNotFound, errors.New("not found"))
+	errTaskNotFound = withStatus(http.StatusNotFound, errors.New("task not found"))
+)
+
+func apiNotFound(c *gin.Context) {
+	apiError(c, errAPINotFound)
+}
+
+// apiPage is a page of a list endpoint.
+type apiPage struct {
+	Items    interface{} `json:"items"`
+	Total    int64       `json:"total"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"page_size"`
+	Pages    int         `json:"pages"`
+}
+
+// listPage loads the page of query asked for into items.
+func listPage(c *gin.Context, query *gorm.DB, items interface{}) (*apiPage, error) {
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, err
+	}
+	page, pageSize, pages := pagination(c, total)
+	if err := query.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(items).Error; err != nil {
+		return nil, err
+	}
+	return &apiPage{Items: items, Total: total, Page: page, PageSize: pageSize, Pages: pages}, nil
+}
+
+func apiListTasks(c *gin.Context) {
+	var tasks []Task
+	page, err := listPage(c, filterTasks(c, db.Model(&Task{}).Preload("Playbook").Preload("Inventory").Preload("User")), &tasks)
+	if err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	items := make([]APITask, len(tasks))
+	for i := range tasks {
+		items[i] = APITask{Task: &tasks[i], StatusText: statusText(tasks[i].Status), ExitCodeText: exitCodeText(tasks[i].ExitCode)}
+	}
+	page.Items = items
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// apiSearchTasks is apiListTasks for a q, which matches the name, task ID,
+// playbook name and error of tasks. The other filters apply as well.
+func apiSearchTasks(c *gin.Context) {
+	if strings.TrimSpace(c.Query("q")) == "" {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("missing q")))
+		return
+	}
+	apiListTasks(c)
+}
+
+var errPurgeNotAdmin = withStatus(http.StatusForbidden, errors.New("only admins can purge tasks"))
+
+// apiDeleteTask moves a task to the trash, with purge=true an admin removes
+// its rows and data directory right away instead.
+func apiDeleteTask(c *gin.Context) {
+	purge := c.Query("purge") == "true"
+	if purge && !currentUser(c).Admin {
+		apiError(c, errPurgeNotAdmin)
+		return
+	}
+	if err := trashTask(c.Param("id"), currentUser(c)); err != nil {
+		apiError(c, err)
+		return
+	}
+	if purge {
+		var task Task
+		if err := db.Unscoped().Limit(1).Find(&task, "task_id = ?", c.Param("id")).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+		// a failed purge leaves the task in the trash
+		if err := purgeTask(&task); err != nil {
+			requestLogger(c).Error("failed to purge task", "task_id", task.TaskID, "error", err)
+			apiError(c, err)
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// APIFile is a playbook or inventory along with its content.
+type APIFile struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	Creator string `json:"creator"`
+	Locked  bool   `json:"locked,omitempty"`
+	TaskID  string `json:"task_id"`
+	Content string `json:"content"`
+	// Spec is the structured inventory Content was rendered from
+	Spec *InventorySpec `json:"spec,omitempty"`
+}
+
+// FileRequest updates a playbook or inventory, a missing field is left as is.
+// Spec replaces an inventory with a structured one.
+type FileRequest struct {
+	Name    *string        `json:"name"`
+	Content *string        `json:"content"`
+	Spec    *InventorySpec `json:"spec"`
+}
+
+func apiListPlaybooks(c *gin.Context) {
+	var playbooks []Playbook
+	page, err := listPage(c, db.Model(&Playbook{}).Scopes(inTeams(c, "playbooks.team_id")), &playbooks)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiListInventories(c *gin.Context) {
+	var inventories []Inventory
+	page, err := listPage(c, db.Model(&Inventory{}).Scopes(inTeams(c, "inventories.team_id")), &inventories)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// fileTask loads the task a playbook or inventory belongs to, with both.
+// Trashed tasks are included, their files can still be restored.
+func fileTask(column string, id string) (*Task, error) {
+	var task Task
+	err := db.Unscoped().Preload("Playbook").Preload("Inventory").Preload("User").
+		Limit(1).Find(&task, column+" = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	if task.ID == 0 {
+		return nil, errAPINotFound
+	}
+	return &task, nil
+}
+
+func apiShowPlaybook(c *gin.Context) {
+	task, err := fileTask("playbook_id", c.Param("id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if task.AdHoc() {
+		apiError(c, errAdHocPlaybook)
+		return
+	}
+	content, err := readFile(task.Playbook.Path)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIFile{
+		ID:      task.Playbook.ID,
+		Name:    task.Playbook.Name,
+		Creator: task.Playbook.Creator,
+		TaskID:  task.TaskID,
+		Content: content,
+	})
+}
+
+func apiShowInventory(c *gin.Context) {
+	task, err := fileTask("inventory_id", c.Param("id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	content, err := readFile(task.Inventory.Path)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	spec, err := readInventorySpec(task)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, APIFile{
+		ID:      task.Inventory.ID,
+		Name:    task.Inventory.Name,
+		Creator: task.Inventory.Creator,
+		Locked:  task.Inventory.Locked,
+		TaskID:  task.TaskID,
+		Content: strings.TrimPrefix(content, INVENTORY_HEADER),
+		Spec:    spec,
+	})
+}
+
+var errTaskBusy = withStatus(http.StatusConflict, errors.New("task is queued or running"))
+
+// apiUpdatePlaybook replaces the playbook of a task. The content is a whole
+// playbook, stored as it is like a raw playbook.
+func apiUpdatePlaybook(c *gin.Context) {
+	var req FileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	task, err := fileTask("playbook_id", c.Param("id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if task.AdHoc() {
+		apiError(c, errAdHocPlaybook)
+		return
+	}
+	if task.Queued || task.Status == STATUS_RUNNING {
+		apiError(c, errTaskBusy)
+		return
+	}
+	if req.Content != nil {
+		site, err := renderPlaybook(*req.Content, true, "")
+		if err != nil {
+			apiError(c, withStatus(http.StatusBadRequest, err))
+			return
+		}
+		if err := replaceTaskFile(c.Request.Context(), task, &task.Playbook.Path, site); err != nil {
+			apiError(c, err)
+			return
+		}
+		updates := map[string]interface{}{"raw_playbook": true}
+		if lintPlaybooks {
+			lintTask(task)
+			updates["lint_status"] = task.LintStatus
+			updates["lint_output"] = task.LintOutput
+		}
+		if err := db.Model(&Task{}).Where("id = ?", task.ID).Updates(updates).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	if req.Name != nil {
+		if err := db.Model(&task.Playbook).Update("name", *req.Name).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	apiShowPlaybook(c)
+}
+
+func apiUpdateInventory(c *gin.Context) {
+	var req FileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	task, err := fileTask("inventory_id", c.Param("id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	user := currentUser(c)
+	if task.Inventory.Locked && !user.Admin {
+		apiError(c, withStatus(http.StatusForbidden, errInventoryLocked))
+		return
+	}
+	if task.Queued || task.Status == STATUS_RUNNING {
+		apiError(c, errTaskBusy)
+		return
+	}
+	if req.Content != nil && req.Spec != nil {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("give either content or a spec, not both")))
+		return
+	}
+	if (req.Content != nil || req.Spec != nil) && isDynamicInventory(task.Inventory.Path) {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("the inventory is dynamic, its library inventory has the plugin config")))
+		return
+	}
+	if req.Spec != nil {
+		if err := checkInventorySpec(req.Spec, task.Environment, user); err != nil {
+			apiError(c, err)
+			return
+		}
+		if err := replaceInventorySpec(c.Request.Context(), task, req.Spec); err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	if req.Content != nil {
+		if isSpecInventory(task.Inventory.Path) {
+			apiError(c, withStatus(http.StatusBadRequest, errors.New("the inventory is structured, update its spec")))
+			return
+		}
+		if err := checkInventory(*req.Content, task.Environment, user); err != nil {
+			apiError(c, err)
+			return
+		}
+		if err := replaceTaskFile(c.Request.Context(), task, &task.Inventory.Path, renderInventory(*req.Content)); err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	if req.Content != nil || req.Spec != nil {
+		registerTaskHosts(task)
+	}
+	if req.Name != nil {
+		if err := db.Model(&task.Inventory).Update("name", *req.Name).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	apiShowInventory(c)
+}
+
+// replaceTaskFile swaps the file at *path for content once the task still
+// validates with it. An approval of the task is revoked.
+func replaceTaskFile(ctx context.Context, task *Task, path *string, content string) error {
+	final := *path
+	// inventory plugins go by the extension
+	ext := filepath.Ext(final)
+	tmp := strings.TrimSuffix(final, ext) + ".new" + ext
+	if err := writeFile(tmp, content); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if validateTasks {
+		*path = tmp
+		err := validateTask(ctx, task)
+		*path = final
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		return err
+	}
+	return revokeApproval(task)
+}
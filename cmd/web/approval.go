@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const APPROVAL_CHECK_INTERVAL = time.Minute
+
+var (
+	errApprovalExpired = withStatus(http.StatusConflict, errors.New("task was not approved in time"))
+	errSelfApproval    = withStatus(http.StatusForbidden, errors.New("a task can't be approved by the user who created it"))
+	errNotApproved     = withStatus(http.StatusConflict, errors.New("task requires approval before it can run"))
+)
+
+// approvalExpired reports whether task has waited for approval longer than
+// the approval_sla of its environment.
+func approvalExpired(task *Task, now time.Time) bool {
+	if task.Approved || task.Status != STATUS_WAITING || task.ApprovalRequestedAt.IsZero() {
+		return false
+	}
+	env, ok := config.environment(task.Environment)
+	if !ok || !env.RequireApproval || env.approvalSLA <= 0 {
+		return false
+	}
+	return now.Sub(task.ApprovalRequestedAt) > env.approvalSLA
+}
+
+// revokeApproval takes back the approval of task once its playbook or
+// inventory changed, in an environment that requires approval it has to be
+// approved again before it runs what was swapped in.
+func revokeApproval(task *Task) error {
+	env, ok := config.environment(task.Environment)
+	if !ok || !env.RequireApproval {
+		return nil
+	}
+	task.Approved = false
+	task.ApprovalRequestedAt = time.Now()
+	return db.Model(&Task{}).Where("id = ?", task.ID).
+		Updates(map[string]interface{}{"approved": false, "approval_requested_at": task.ApprovalRequestedAt}).Error
+}
+
+// expireApproval marks task expired unless it was approved or queued in the
+// meantime, and lets the requester know.
+func expireApproval(task *Task) bool {
+	env, _ := config.environment(task.Environment)
+	now := time.Now()
+	task.Status = STATUS_EXPIRED
+	task.Error = fmt.Sprintf("not approved within %v", env.approvalSLA)
+	task.FinishedAt = now
+	tx := db.Model(&Task{}).
+		Where("id = ? AND status = ? AND approved = ? AND queued = ?", task.ID, STATUS_WAITING, false, false).
+		Updates(map[string]interface{}{
+			"status":      task.Status,
+			"error":       task.Error,
+			"finished_at": now,
+			"updated_at":  now,
+		})
+	if tx.Error != nil {
+		taskLogger("approval", task.TaskID).Error("failed to expire", "error", tx.Error)
+		return false
+	}
+	if tx.RowsAffected == 0 {
+		return false
+	}
+	taskLogger("approval", task.TaskID).Warn("approval expired", "error", task.Error)
+	if task.User.ID == 0 {
+		db.Limit(1).Find(&task.User, task.UserID)
+	}
+	if task.Playbook.ID == 0 {
+		db.Limit(1).Find(&task.Playbook, task.PlaybookID)
+	}
+	notifyFinished(task)
+	return true
+}
+
+// expireApprovals expires the tasks that have waited too long for approval
+// and returns how many it expired.
+func expireApprovals() int {
+	var tasks []Task
+	err := db.Preload("User").
+		Where("status = ? AND approved = ? AND queued = ? AND approval_requested_at > ?",
+			STATUS_WAITING, false, false, time.Time{}).
+		Find(&tasks).Error
+	if err != nil {
+		logger("approval").Error("failed to list tasks waiting for approval", "error", err)
+		return 0
+	}
+	now := time.Now()
+	expired := 0
+	for i := range tasks {
+		if approvalExpired(&tasks[i], now) && expireApproval(&tasks[i]) {
+			expired++
+		}
+	}
+	return expired
+}
+
+func startApprovalExpiry() {
+	ticker := time.NewTicker(APPROVAL_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		expireApprovals()
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func approveAs(user *User, taskID string) int {
+	r := gin.New()
+	r.GET("/approveTask/:id", func(c *gin.Context) { c.Set("user", user) }, requireRole(ROLE_APPROVER), approveTask)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/approveTask/"+taskID, nil))
+	return w.Code
+}
+
+func TestApproveTask(t *testing.T) {
+	setupTestDB(t)
+	creator := createTestUser(t, "creator", ROLE_ADMIN)
+	operator := createTestUser(t, "operator", ROLE_OPERATOR)
+	approver := createTestUser(t, "approver", ROLE_APPROVER)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	task, _, err := newTaskFromRequest(context.Background(), &req, creator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user *User
+		want int
+	}{
+		{creator, http.StatusForbidden},
+		{operator, http.StatusForbidden},
+		{approver, http.StatusFound},
+	} {
+		if got := approveAs(tc.user, task.TaskID); got != tc.want {
+			t.Errorf("%s approving: got %d, want %d", tc.user.Name, got, tc.want)
+		}
+	}
+	var approved Task
+	db.First(&approved, task.ID)
+	if !approved.Approved {
+		t.Error("task wasn't approved")
+	}
+}
+
+func TestApprovalRevokedByChange(t *testing.T) {
+	setupTestDB(t)
+	env, _ := config.environment(DEFAULT_ENVIRONMENT)
+	env.RequireApproval = true
+	creator := createTestUser(t, "creator", ROLE_ADMIN)
+	approver := createTestUser(t, "approver", ROLE_APPROVER)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	task, _, err := newTaskFromRequest(context.Background(), &req, creator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := approveAs(approver, task.TaskID); got != http.StatusFound {
+		t.Fatalf("approving: got %d", got)
+	}
+
+	// a playbook swapped in after the approval has to be approved again
+	r := gin.New()
+	r.PUT("/api/v1/playbooks/:id", func(c *gin.Context) { c.Set("user", creator) }, apiUpdatePlaybook)
+	w := httptest.NewRecorder()
+	body := `{"content": "- hosts: all\n  tasks:\n    - shell: rm -rf /tmp/x\n"}`
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/v1/playbooks/"+strconv.FormatUint(uint64(task.PlaybookID), 10), strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("replacing the playbook: got %d: %s", w.Code, w.Body)
+	}
+	if _, err := startTask(task.TaskID, creator, RunRequest{}); errorStatus(err) != http.StatusConflict {
+		t.Fatalf("starting after the playbook changed: got %v", err)
+	}
+
+	// an approval is good for one run
+	if got := approveAs(approver, task.TaskID); got != http.StatusFound {
+		t.Fatalf("approving again: got %d", got)
+	}
+	if _, err := startTask(task.TaskID, creator, RunRequest{}); err != nil {
+		t.Fatalf("starting the approved task: %v", err)
+	}
+	db.Model(&Task{}).Where("id = ?", task.ID).Updates(map[string]interface{}{"queued": false, "status": STATUS_SUCCEEDED})
+	if _, err := startTask(task.TaskID, creator, RunRequest{}); errorStatus(err) != http.StatusConflict {
+		t.Fatalf("starting it again: got %v", err)
+	}
+}
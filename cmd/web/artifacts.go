@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Artifact struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// cleanArtifactsDir normalizes a user supplied artifacts dir, which must
+// stay below the task directory.
+func cleanArtifactsDir(dir string) (string, error) {
+	dir = strings.TrimSpace(dir)
+	if dir == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(dir) {
+		return "", errors.New("artifacts dir must be relative to the task directory")
+	}
+	dir = filepath.Clean(dir)
+	if dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "", errors.New("artifacts dir must be inside the task directory")
+	}
+	return dir, nil
+}
+
+func artifactsRoot(task *Task) string {
+	return filepath.Join(rootDir, task.TaskID, task.ArtifactsDir)
+}
+
+// walkArtifacts visits the regular files below the artifacts root. Symlinks
+// are never followed so a playbook can't expose files outside the task.
+func walkArtifacts(task *Task, fn func(path string, info os.FileInfo) error) error {
+	base := artifactsRoot(task)
+	return filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == base {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		return fn(rel, info)
+	})
+}
+
+// pruneArtifacts deletes symlinks and files beyond the size limit once the
+// run is over.
+func pruneArtifacts(task *Task) {
+	base := artifactsRoot(task)
+	var total int64
+	filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(path)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		total += info.Size()
+		if total > artifactsLimit {
+			taskLogger("artifacts", task.TaskID).Warn("artifact dropped, size limit exceeded", "path", path, "limit", artifactsLimit)
+			os.Remove(path)
+			total -= info.Size()
+		}
+		return nil
+	})
+}
+
+// withinDir reports whether path still resolves below dir once symlinks
+// in any of its parents are followed.
+func withinDir(dir, path string) bool {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realDir, realPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func findArtifactsTask(c *gin.Context) (*Task, bool) {
+	var task Task
+	if err := db.First(&task, "task_id = ?", c.Param("id")).Error; err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if task.ArtifactsDir == "" {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task does not declare an artifacts dir"})
+		return nil, false
+	}
+	if task.Purged() {
+		c.IndentedJSON(errorStatus(errResultsPurged), gin.H{"error": errResultsPurged.Error()})
+		return nil, false
+	}
+	return &task, true
+}
+
+func listArtifacts(c *gin.Context) {
+	task, ok := findArtifactsTask(c)
+	if !ok {
+		return
+	}
+	artifacts := []Artifact{}
+	err := walkArtifacts(task, func(path string, info os.FileInfo) error {
+		artifacts = append(artifacts, Artifact{Path: filepath.ToSlash(path), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, artifacts)
+}
+
+func downloadArtifact(c *gin.Context) {
+	task, ok := findArtifactsTask(c)
+	if !ok {
+		return
+	}
+	file := strings.TrimPrefix(c.Param("file"), "/")
+	if file == "" {
+		listArtifacts(c)
+		return
+	}
+
+	base := artifactsRoot(task)
+	path := filepath.Join(base, filepath.Clean("/"+file))
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || !withinDir(base, path) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "artifact not found"})
+		return
+	}
+	c.FileAttachment(path, filepath.Base(path))
+}
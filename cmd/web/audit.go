@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	AUDIT_CREATE  = "create"
+	AUDIT_UPDATE  = "update"
+	AUDIT_DELETE  = "delete"
+	AUDIT_RUN     = "run"
+	AUDIT_CANCEL  = "cancel"
+	AUDIT_APPROVE = "approve"
+	AUDIT_RESTORE = "restore"
+	AUDIT_PURGE   = "purge"
+	AUDIT_LOCK    = "lock"
+	AUDIT_UNLOCK  = "unlock"
+
+	AUDIT_TASK              = "task"
+	AUDIT_PLAYBOOK          = "playbook"
+	AUDIT_INVENTORY         = "inventory"
+	AUDIT_LIBRARY_PLAYBOOK  = "library_playbook"
+	AUDIT_LIBRARY_INVENTORY = "library_inventory"
+	AUDIT_HOST              = "host"
+	AUDIT_WORKFLOW          = "workflow"
+
+	// auditObjectKey is set by handlers that create an object without a
+	// Location header
+	auditObjectKey = "audit_object"
+)
+
+var errAuditAppendOnly = errors.New("audit events can't be changed")
+
+// AuditEvent is an action a user took. The table is only ever appended to.
+type AuditEvent struct {
+	ID         uint      `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time `json:"created_at" gorm:"column:created_at;index"`
+	UserID     uint      `json:"user_id" gorm:"column:user_id;index"`
+	UserName   string    `json:"user_name" gorm:"column:user_name"`
+	Action     string    `json:"action" gorm:"column:action"`
+	ObjectType string    `json:"object_type" gorm:"column:object_type;size:32;index:idx_audit_object"`
+	ObjectID   string    `json:"object_id" gorm:"column:object_id;size:64;index:idx_audit_object"`
+	SourceIP   string    `json:"source_ip" gorm:"column:source_ip"`
+	RequestID  string    `json:"request_id" gorm:"column:request_id"`
+	// Status is the HTTP status the action was answered with
+	Status int `json:"status" gorm:"column:status"`
+}
+
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+// audit records the action of the route on objectType once the handler
+// succeeded. The object is the :id parameter, or for a create the one the
+// handler points to.
+func audit(action, objectType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		status := c.Writer.Status()
+		if status >= http.StatusBadRequest {
+			return
+		}
+		objectID := c.Param("id")
+		if objectID == "" {
+			objectID = c.GetString(auditObjectKey)
+		}
+		if objectID == "" {
+			if loc := c.Writer.Header().Get("Location"); loc != "" {
+				objectID = path.Base(loc)
+			}
+		}
+		recordAudit(c, action, objectType, objectID, status)
+	}
+}
+
+// recordAudit records an action of the user of the request, for handlers
+// that act on several objects at once.
+func recordAudit(c *gin.Context, action, objectType, objectID string, status int) {
+	event := AuditEvent{
+		Action:     action,
+		ObjectType: objectType,
+		ObjectID:   objectID,
+		SourceIP:   c.ClientIP(),
+		RequestID:  c.GetString("request_id"),
+		Status:     status,
+	}
+	if user, ok := c.Get("user"); ok {
+		event.UserID = user.(*User).ID
+		event.UserName = user.(*User).Name
+	}
+	if err := db.Create(&event).Error; err != nil {
+		requestLogger(c).Error("failed to record audit event", "action", action, "object_type", objectType, "object_id", objectID, "error", err)
+	}
+}
+
+// apiListAuditEvents lists the audit log, newest first, filtered by user,
+// action, object_type, object_id and a since/until time range.
+func apiListAuditEvents(c *gin.Context) {
+	query := db.Model(&AuditEvent{})
+	for _, key := range []string{"action", "object_type", "object_id"} {
+		if v := c.Query(key); v != "" {
+			query = query.Where(key+" = ?", v)
+		}
+	}
+	if v := c.Query("user"); v != "" {
+		query = query.Where("user_name = ?", v)
+	}
+	for key, op := range map[string]string{"since": ">=", "until": "<"} {
+		v := c.Query(key)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			apiError(c, withStatus(http.StatusBadRequest, errors.New("invalid "+key+", expected an RFC 3339 time")))
+			return
+		}
+		query = query.Where("created_at "+op+" ?", t)
+	}
+	var events []AuditEvent
+	page, err := listPage(c, query, &events)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	SESSION_COOKIE = "session"
+	ADMIN_USER     = "admin"
+)
+
+var (
+	sessionSecret string
+	sessionTTL    time.Duration
+	sessionKey    []byte
+)
+
+// setupSessions derives the key that signs session cookies. Without
+// -session-secret a random key is used and sessions end on restart.
+func setupSessions() error {
+	if sessionSecret != "" {
+		sessionKey = []byte(sessionSecret)
+		return nil
+	}
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return err
+	}
+	logger("auth").Warn("no -session-secret given, sessions won't survive a restart")
+	return nil
+}
+
+// ensureAdminUser creates the admin user on first start. The password is
+// taken from ADMIN_PASSWORD or generated and printed once.
+func ensureAdminUser() error {
+	var count int64
+	if err := db.Model(&User{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		buf := make([]byte, 12)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		password = hex.EncodeToString(buf)
+		logger("auth").Warn("created admin user", "user", ADMIN_USER, "password", password)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		user := User{Name: ADMIN_USER, Password: string(hash), Admin: true}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return setUserRole(tx, &user, ROLE_ADMIN)
+	})
+}
+
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// the cookie value is "<user id>.<unix expiry>.<signature>"
+func newSessionValue(userID uint, expires time.Time) string {
+	payload := fmt.Sprintf("%d.%d", userID, expires.Unix())
+	return payload + "." + signSession(payload)
+}
+
+func parseSessionValue(value string) (uint, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return 0, false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signSession(payload))) {
+		return 0, false
+	}
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// sessionUser returns the user of a valid API token or session cookie, or
+// nil. A request with a token is never looked up by its cookie.
+func sessionUser(c *gin.Context) *User {
+	if user, ok := bearerUser(c); ok {
+		return user
+	}
+	value, err := c.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+	userID, ok := parseSessionValue(value)
+	if !ok {
+		return nil
+	}
+	var user User
+	if err := db.Limit(1).Find(&user, userID).Error; err != nil || user.ID == 0 {
+		return nil
+	}
+	if err := loadRoles(&user); err != nil {
+		return nil
+	}
+	return &user
+}
+
+// currentUser is the user set by requireLogin.
+func currentUser(c *gin.Context) *User {
+	return c.MustGet("user").(*User)
+}
+
+// requireLogin redirects to the login page unless the request carries a
+// valid session.
+func requireLogin(c *gin.Context) {
+	user := sessionUser(c)
+	if user == nil {
+		next := c.Request.URL.RequestURI()
+		if c.Request.Method != http.MethodGet {
+			next = "/"
+		}
+		c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(next))
+		c.Abort()
+		return
+	}
+	c.Set("user", user)
+	c.Next()
+}
+
+// safeNext only allows redirects to a local path.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func showLogin(c *gin.Context) {
+	c.HTML(http.StatusOK, "login.html", gin.H{
+		"next": safeNext(c.Query("next")),
+	})
+}
+
+func login(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	password := c.PostForm("password")
+	next := safeNext(c.PostForm("next"))
+
+	var user User
+	if err := db.Limit(1).Find(&user, "name = ?", name).Error; err != nil {
+		logger("auth").Error("failed to look up user", "user", name, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if user.ID == 0 || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+			"next":  next,
+			"name":  name,
+			"error": "invalid user name or password",
+		})
+		return
+	}
+
+	expires := time.Now().Add(sessionTTL)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    newSessionValue(user.ID, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusFound, next)
+}
+
+func logout(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusFound, "/login")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// what a process does with -mode
+const (
+	MODE_ALL    = "all"
+	MODE_WEB    = "web"
+	MODE_WORKER = "worker"
+)
+
+const (
+	BROKER_QUEUE   = "ansible-runner:tasks"
+	BROKER_SUBJECT = "ansible-runner.tasks"
+	BROKER_GROUP   = "ansible-runner-workers"
+	// BROKER_POLL bounds how long a consumer blocks, so it notices a stop
+	BROKER_POLL  = 5 * time.Second
+	BROKER_RETRY = 5 * time.Second
+	// queued tasks no worker took for this long are published again, NATS
+	// drops them while no worker listens
+	BROKER_REPUBLISH = 30 * time.Second
+	// CANCEL_POLL is how often workers look for tasks cancelled on the web
+	// node
+	CANCEL_POLL = 2 * time.Second
+)
+
+var (
+	// brokerURL is a redis:// or nats:// URL, tasks are handed to the
+	// workers of this process without it
+	brokerURL string
+	mode      string
+	// nodeName tells the tasks of a worker process apart from the others
+	nodeName string
+	broker   taskBroker
+)
+
+// idleWorkers counts the workers waiting for a task, consumeTasks takes a
+// task off the broker only while one is, the others are left to other
+// worker processes. workerIdle wakes consumeTasks when a worker gets idle.
+var (
+	idleMu      sync.Mutex
+	idleWorkers int
+	workerIdle  = make(chan struct{}, 1)
+)
+
+// taskBroker carries the ids of queued tasks from the web node to worker
+// processes on other machines. The tasks stay queued in the database, a
+// worker claims them there, so an id handed out twice runs once.
+type taskBroker interface {
+	publish(taskID string, priority int) error
+	// consume waits up to BROKER_POLL for a task, "" if none came
+	consume() (string, error)
+}
+
+func setupBroker() error {
+	switch mode {
+	case MODE_ALL, MODE_WEB, MODE_WORKER:
+	default:
+		return fmt.Errorf("unknown -mode %q, use %s, %s or %s", mode, MODE_ALL, MODE_WEB, MODE_WORKER)
+	}
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	if brokerURL == "" {
+		if mode != MODE_ALL {
+			return fmt.Errorf("-mode %s needs a -broker", mode)
+		}
+		return nil
+	}
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return fmt.Errorf("invalid -broker: %v", err)
+	}
+	switch u.Scheme {
+	case "redis":
+		broker, err = newRedisBroker(u)
+	case "nats":
+		broker, err = newNATSBroker(u)
+	default:
+		return fmt.Errorf("invalid -broker %q, expected a redis:// or nats:// URL", brokerURL)
+	}
+	return err
+}
+
+// runsWorkers is false for a web node, it only queues tasks.
+func runsWorkers() bool {
+	return mode != MODE_WEB
+}
+
+func servesWeb() bool {
+	return mode != MODE_WORKER
+}
+
+// addIdleWorkers changes idleWorkers by n. A worker adds itself before it
+// waits for a task and takes itself off if it stops waiting without one,
+// whoever hands it a task takes it off.
+func addIdleWorkers(n int) {
+	idleMu.Lock()
+	idleWorkers += n
+	idleMu.Unlock()
+	if n > 0 {
+		select {
+		case workerIdle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func hasIdleWorker() bool {
+	idleMu.Lock()
+	defer idleMu.Unlock()
+	return idleWorkers > 0
+}
+
+// consumeTasks hands the tasks of the broker to the workers of this
+// process, one at a time while a worker is idle.
+func consumeTasks() {
+	for {
+		select {
+		case <-stopChan:
+			return
+		default:
+		}
+		if !hasIdleWorker() {
+			select {
+			case <-workerIdle:
+			case <-stopChan:
+				return
+			}
+			continue
+		}
+		taskID, err := broker.consume()
+		if err != nil {
+			logger("broker").Error("failed to consume", "error", err)
+			time.Sleep(BROKER_RETRY)
+			continue
+		}
+		if taskID == "" {
+			continue
+		}
+		select {
+		case taskChan <- taskID:
+			addIdleWorkers(-1)
+		case <-stopChan:
+			// give it to another worker
+			var task Task
+			db.Select("priority").Where("task_id = ?", taskID).Limit(1).Find(&task)
+			if err := broker.publish(taskID, task.Priority); err != nil {
+				taskLogger("broker", taskID).Error("failed to hand back task", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// republishQueued publishes the tasks that have waited in the queue for a
+// while again. A worker claims a task once, so copies of it do no harm.
+func republishQueued() {
+	ticker := time.NewTicker(BROKER_REPUBLISH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			var tasks []Task
+			err := db.Select("task_id", "priority").Where("queued = ? AND updated_at < ? AND retry_at <= ?", true, now.Add(-BROKER_REPUBLISH), now).
+				Find(&tasks).Error
+			if err != nil {
+				logger("broker").Error("failed to load queued tasks", "error", err)
+				continue
+			}
+			for _, task := range tasks {
+				if err := broker.publish(task.TaskID, task.Priority); err != nil {
+					taskLogger("broker", task.TaskID).Error("failed to publish task", "error", err)
+				}
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// watchCancelRequests cancels the tasks running on this node that were
+// cancelled through a web node, which can't reach them.
+func watchCancelRequests() {
+	ticker := time.NewTicker(CANCEL_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var ids []string
+			err := db.Model(&Task{}).Where("status = ? AND node = ? AND cancel_requested = ?", STATUS_RUNNING, nodeName, true).
+				Pluck("task_id", &ids).Error
+			if err != nil {
+				logger("broker").Error("failed to check for cancelled tasks", "error", err)
+				continue
+			}
+			for _, id := range ids {
+				runningMu.Lock()
+				cancel, ok := runningTasks[id]
+				runningMu.Unlock()
+				if ok {
+					cancel(errTaskCancelled)
+				}
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// redisBroker keeps the queue in a sorted set, scored so that BZPOPMIN
+// takes the highest priority first and the oldest within a priority.
+type redisBroker struct {
+	client *redis.Client
+}
+
+func newRedisBroker(u *url.URL) (*redisBroker, error) {
+	options, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid -broker: %v", err)
+	}
+	options.DialTimeout = BROKER_POLL
+	// BZPOPMIN may block for BROKER_POLL on top of this
+	options.ReadTimeout = BROKER_POLL
+	options.WriteTimeout = BROKER_POLL
+	return &redisBroker{client: redis.NewClient(options)}, nil
+}
+
+func (b *redisBroker) publish(taskID string, priority int) error {
+	// scores stay below 2^53, so they are exact in a double
+	score := float64(-priority)*1e13 + float64(time.Now().UnixMilli())
+	ctx, cancel := context.WithTimeout(context.Background(), 2*BROKER_POLL)
+	defer cancel()
+	return b.client.ZAddNX(ctx, BROKER_QUEUE, redis.Z{Score: score, Member: taskID}).Err()
+}
+
+func (b *redisBroker) consume() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*BROKER_POLL)
+	defer cancel()
+	z, err := b.client.BZPopMin(ctx, BROKER_POLL, BROKER_QUEUE).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	id, _ := z.Member.(string)
+	return id, nil
+}
+
+// natsBroker publishes task ids to a queue group, NATS gives each one to a
+// single subscriber. Core NATS has no priorities and keeps nothing while no
+// worker listens, such a task waits in the db until it is published again.
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+// newNATSBroker connects in the background and keeps reconnecting, so that
+// a server that is down doesn't stop the process from starting. The user
+// info of the URL is a user and password or a token.
+func newNATSBroker(u *url.URL) (*natsBroker, error) {
+	conn, err := nats.Connect(u.String(),
+		nats.Name("ansible-runner "+nodeName),
+		nats.Timeout(BROKER_POLL),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(BROKER_RETRY),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -broker: %v", err)
+	}
+	return &natsBroker{conn: conn}, nil
+}
+
+func (b *natsBroker) publish(taskID string, priority int) error {
+	return b.conn.Publish(BROKER_SUBJECT, []byte(taskID))
+}
+
+// consume subscribes for a single message, so that the server doesn't push
+// tasks this process has no worker for.
+func (b *natsBroker) consume() (string, error) {
+	sub, err := b.conn.QueueSubscribeSync(BROKER_SUBJECT, BROKER_GROUP)
+	if err != nil {
+		return "", err
+	}
+	// a task that comes between the timeout and the unsubscribe is dropped,
+	// it is still queued in the db and published again
+	defer sub.Unsubscribe()
+	if err := sub.AutoUnsubscribe(1); err != nil {
+		return "", err
+	}
+	msg, err := sub.NextMsg(BROKER_POLL)
+	if errors.Is(err, nats.ErrTimeout) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(msg.Data), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker hands out numbered tasks as fast as they are asked for.
+type fakeBroker struct {
+	mu       sync.Mutex
+	consumed int
+}
+
+func (b *fakeBroker) publish(taskID string, priority int) error { return nil }
+
+func (b *fakeBroker) consume() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consumed++
+	return strconv.Itoa(b.consumed), nil
+}
+
+func (b *fakeBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.consumed
+}
+
+func TestConsumeTasksOnlyForIdleWorkers(t *testing.T) {
+	setupTestDB(t)
+	fake := &fakeBroker{}
+	oldBroker, oldStop := broker, stopChan
+	broker, stopChan = fake, make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stopChan)
+		<-done
+		broker, stopChan = oldBroker, oldStop
+		idleMu.Lock()
+		idleWorkers = 0
+		idleMu.Unlock()
+	}()
+	go func() {
+		consumeTasks()
+		close(done)
+	}()
+
+	// three workers get idle at once, each gets a task
+	addIdleWorkers(1)
+	addIdleWorkers(1)
+	addIdleWorkers(1)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-taskChan:
+		case <-time.After(time.Second):
+			t.Fatalf("worker %d got no task", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := fake.count(); n != 3 {
+		t.Fatalf("took %d tasks off the broker for 3 idle workers", n)
+	}
+
+	// one that stops waiting leaves the tasks to others
+	addIdleWorkers(1)
+	addIdleWorkers(-1)
+	time.Sleep(50 * time.Millisecond)
+	if n := fake.count(); n > 4 {
+		t.Fatalf("took %d tasks off the broker, no worker is idle", n)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BULK_RUN    = "run"
+	BULK_CANCEL = "cancel"
+	BULK_DELETE = "delete"
+
+	// MAX_BULK_TASKS is how many tasks a bulk request acts on at most
+	MAX_BULK_TASKS = 100
+)
+
+var errBulkNoTasks = withStatus(http.StatusBadRequest, errors.New("give task_ids or filter the tasks with the query params of GET /api/v1/tasks"))
+
+// BulkTaskRequest runs, cancels or deletes the tasks of TaskIDs, or those
+// the query params select like they do for GET /api/v1/tasks. Both together
+// act on the tasks of TaskIDs that match the filter.
+type BulkTaskRequest struct {
+	Action  string   `json:"action"`
+	TaskIDs []string `json:"task_ids"`
+}
+
+// BulkTaskResult is the outcome for one task, Status is the HTTP status the
+// single task endpoint would have answered with.
+type BulkTaskResult struct {
+	TaskID string `json:"task_id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	RunID  uint   `json:"run_id,omitempty"`
+}
+
+type bulkTaskResponse struct {
+	Action    string           `json:"action"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []BulkTaskResult `json:"results"`
+}
+
+// bulkTaskIDs are the IDs of the tasks a bulk request acts on, in the order
+// of req.TaskIDs or else of creation. IDs the user can't see are left out.
+func bulkTaskIDs(c *gin.Context, req *BulkTaskRequest) ([]string, error) {
+	if len(req.TaskIDs) == 0 && !hasTaskFilter(c) {
+		return nil, errBulkNoTasks
+	}
+	if len(req.TaskIDs) > MAX_BULK_TASKS {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("at most %d tasks at once", MAX_BULK_TASKS))
+	}
+	query := filterTasks(c, db.Model(&Task{}))
+	if len(req.TaskIDs) > 0 {
+		query = query.Where("tasks.task_id IN ?", req.TaskIDs)
+	}
+	var found []string
+	if err := query.Order("tasks.id").Limit(MAX_BULK_TASKS+1).Pluck("tasks.task_id", &found).Error; err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	if len(found) > MAX_BULK_TASKS {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("the filter matches more than %d tasks", MAX_BULK_TASKS))
+	}
+	return found, nil
+}
+
+// apiBulkTasks runs, cancels or deletes many tasks and answers with the
+// result for each, a task that fails doesn't stop the others. Every run
+// takes a token of the rate limits, those over them fail with 429.
+func apiBulkTasks(c *gin.Context) {
+	var req BulkTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	var action string
+	switch req.Action {
+	case BULK_RUN:
+		action = AUDIT_RUN
+	case BULK_CANCEL:
+		action = AUDIT_CANCEL
+	case BULK_DELETE:
+		action = AUDIT_DELETE
+	default:
+		apiError(c, withStatus(http.StatusBadRequest, fmt.Errorf("unknown action %q, want run, cancel or delete", req.Action)))
+		return
+	}
+	found, err := bulkTaskIDs(c, &req)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	taskIDs := found
+	if len(req.TaskIDs) > 0 {
+		// the given IDs in their order, once each
+		taskIDs = nil
+		seen := map[string]bool{}
+		for _, id := range req.TaskIDs {
+			if !seen[id] {
+				seen[id] = true
+				taskIDs = append(taskIDs, id)
+			}
+		}
+	}
+	visible := map[string]bool{}
+	for _, id := range found {
+		visible[id] = true
+	}
+
+	user := currentUser(c)
+	resp := bulkTaskResponse{Action: req.Action, Results: make([]BulkTaskResult, 0, len(taskIDs))}
+	runs := 0
+	for _, id := range taskIDs {
+		result := BulkTaskResult{TaskID: id}
+		var err error
+		switch {
+		case !visible[id]:
+			err = errTaskNotFound
+		case req.Action == BULK_RUN:
+			// a run costs what the run endpoint charges, the first one was
+			// paid for by the request
+			runs++
+			if runs > 1 {
+				if limit, _ := takeRateLimit(c); limit != "" {
+					rateLimited.WithLabelValues(limit).Inc()
+					err = errRateLimited
+					break
+				}
+			}
+			var run *Run
+			if run, err = startTask(id, user, RunRequest{}); err == nil {
+				result.Status = http.StatusAccepted
+				result.RunID = run.ID
+			}
+		case req.Action == BULK_CANCEL:
+			if err = cancelRunningTask(id); err == nil {
+				result.Status = http.StatusOK
+			}
+		case req.Action == BULK_DELETE:
+			if err = trashTask(id, user); err == nil {
+				result.Status = http.StatusNoContent
+			}
+		}
+		if err != nil {
+			result.Status = errorStatus(err)
+			result.Error = err.Error()
+			resp.Failed++
+		} else {
+			recordAudit(c, action, AUDIT_TASK, id, result.Status)
+			resp.Succeeded++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	c.IndentedJSON(http.StatusOK, resp)
+}
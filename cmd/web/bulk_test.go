@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBulkRunRateLimited(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "admin", ROLE_ADMIN)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+		task, _, err := newTaskFromRequest(context.Background(), &req, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, task.TaskID)
+	}
+	oldLimiter := userLimiter
+	userLimiter = newRateLimiter(1, 2)
+	defer func() { userLimiter = oldLimiter }()
+
+	r := gin.New()
+	r.POST("/api/v1/tasks/bulk", func(c *gin.Context) { c.Set("user", user) }, rateLimit, apiBulkTasks)
+	body, _ := json.Marshal(BulkTaskRequest{Action: BULK_RUN, TaskIDs: ids})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/tasks/bulk", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var resp bulkTaskResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	// a burst of 2 runs two of the three
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		if got := resp.Results[i].Status; got != want {
+			t.Errorf("task %d: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestBulkWithoutFilter(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "admin", ROLE_ADMIN)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	if _, _, err := newTaskFromRequest(context.Background(), &req, user, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// paging isn't a filter, it must not select every task
+	r := gin.New()
+	r.POST("/api/v1/tasks/bulk", func(c *gin.Context) { c.Set("user", user) }, apiBulkTasks)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/tasks/bulk?page=1", strings.NewReader(`{"action": "delete"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var count int64
+	db.Model(&Task{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("%d tasks left, want 1", count)
+	}
+}
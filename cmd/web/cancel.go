@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errTaskCancelled   = errors.New("cancelled by user")
+	errTaskInterrupted = errors.New("interrupted by a shutdown of the server")
+	errTaskTimedOut    = errors.New("timed out")
+)
+
+// requeueInterrupted puts the tasks a shutdown interrupts back in the queue
+var requeueInterrupted bool
+
+var (
+	runningMu    sync.Mutex
+	runningTasks = map[string]context.CancelCauseFunc{}
+)
+
+// registerRunningTask makes a task cancellable, the cause passed to cancel
+// tells the worker why it stopped.
+func registerRunningTask(taskID string, cancel context.CancelCauseFunc) {
+	runningMu.Lock()
+	runningTasks[taskID] = cancel
+	runningMu.Unlock()
+}
+
+func unregisterRunningTask(taskID string) {
+	runningMu.Lock()
+	delete(runningTasks, taskID)
+	runningMu.Unlock()
+}
+
+var errTaskNotRunning = withStatus(http.StatusConflict, errors.New("task is not running"))
+
+func cancelTask(c *gin.Context) {
+	if err := cancelRunningTask(c.Param("id")); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(302, "/")
+}
+
+// cancelRunningTask cancels a running task or one waiting for a retry.
+// Errors carry an HTTP status.
+func cancelRunningTask(taskId string) error {
+	runningMu.Lock()
+	cancel, ok := runningTasks[taskId]
+	runningMu.Unlock()
+	if !ok && broker != nil {
+		// it may run in a worker process, which looks for the request
+		tx := db.Model(&Task{}).Where("task_id = ? AND status = ?", taskId, STATUS_RUNNING).Update("cancel_requested", true)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if tx.RowsAffected > 0 {
+			return nil
+		}
+	}
+	if !ok {
+		// a task waiting for a retry is cancelled before its next attempt
+		cancelled, err := cancelRetry(taskId)
+		if err != nil {
+			return err
+		}
+		if !cancelled {
+			return errTaskNotRunning
+		}
+		return nil
+	}
+	// the worker sees the cancelled context, stores the partial output and
+	// marks the task as cancelled
+	cancel(errTaskCancelled)
+	return nil
+}
+
+func runningTaskCount() int {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	return len(runningTasks)
+}
+
+// interruptRunningTasks cancels every running task for a shutdown, it
+// returns how many there were.
+func interruptRunningTasks() int {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for _, cancel := range runningTasks {
+		cancel(errTaskInterrupted)
+	}
+	return len(runningTasks)
+}
+
+// requeueTask queues a task a shutdown interrupted again, it runs from the
+// start once a worker takes it after the restart.
+func requeueTask(task *Task) {
+	err := db.Model(&Task{}).Where("id = ? AND status = ?", task.ID, STATUS_INTERRUPTED).
+		Updates(map[string]interface{}{"queued": true, "attempts": 0, "retry_at": time.Time{}}).Error
+	if err != nil {
+		taskLogger("worker", task.TaskID).Error("failed to requeue interrupted task", "error", err)
+		return
+	}
+	db.Model(&Run{}).Where("id = ?", task.RunID).Update("status", STATUS_WAITING)
+	taskLogger("worker", task.TaskID).Warn("interrupted task queued for the restart")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChatConfig is a chat robot that finished tasks are posted to. Playbooks
+// are glob patterns of playbook names and Users names of requesters, a task
+// has to match both lists that aren't empty.
+type ChatConfig struct {
+	// Type is slack, dingtalk or feishu, it also picks the template
+	Type string `json:"type"`
+	// URL is the incoming webhook of the robot
+	URL string `json:"url"`
+	// Secret signs the messages of dingtalk and feishu robots that have
+	// signing turned on
+	Secret    string   `json:"secret"`
+	On        string   `json:"on"`
+	Playbooks []string `json:"playbooks"`
+	Users     []string `json:"users"`
+}
+
+func checkChats(chats map[string]*ChatConfig) error {
+	for name, chat := range chats {
+		if chat == nil {
+			return fmt.Errorf("chat %q is empty", name)
+		}
+		switch chat.Type {
+		case NOTIFY_SLACK, NOTIFY_DINGTALK, NOTIFY_FEISHU:
+		default:
+			return fmt.Errorf("chat %q: unknown type %q, use %s, %s or %s", name, chat.Type, NOTIFY_SLACK, NOTIFY_DINGTALK, NOTIFY_FEISHU)
+		}
+		if err := checkWebhookURL(chat.URL); err != nil {
+			return fmt.Errorf("chat %q: %v", name, err)
+		}
+		switch chat.On {
+		case "":
+			chat.On = WEBHOOK_ON_FINISHED
+		case WEBHOOK_ON_FINISHED, WEBHOOK_ON_FAILED:
+		default:
+			return fmt.Errorf("chat %q: unknown event %q, use %s or %s", name, chat.On, WEBHOOK_ON_FINISHED, WEBHOOK_ON_FAILED)
+		}
+		for _, pattern := range chat.Playbooks {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("chat %q: bad playbook pattern %q", name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the outcome of task goes to the chat.
+func (chat *ChatConfig) matches(task *Task) bool {
+	if chat.On == WEBHOOK_ON_FAILED && !taskFailed(task) {
+		return false
+	}
+	if len(chat.Playbooks) > 0 {
+		found := false
+		for _, pattern := range chat.Playbooks {
+			if ok, _ := path.Match(pattern, task.Playbook.Name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(chat.Users) > 0 {
+		for _, name := range chat.Users {
+			if name == task.User.Name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// chatMessage builds the request of a chat robot for text, signed when the
+// chat has a secret.
+func (chat *ChatConfig) chatMessage(text string, now time.Time) (string, []byte, error) {
+	switch chat.Type {
+	case NOTIFY_DINGTALK:
+		u := chat.URL
+		if chat.Secret != "" {
+			ts := strconv.FormatInt(now.UnixMilli(), 10)
+			mac := hmac.New(sha256.New, []byte(chat.Secret))
+			mac.Write([]byte(ts + "\n" + chat.Secret))
+			sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+			sep := "?"
+			if strings.Contains(u, "?") {
+				sep = "&"
+			}
+			u += sep + "timestamp=" + ts + "&sign=" + url.QueryEscape(sign)
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": text},
+		})
+		return u, body, err
+	case NOTIFY_FEISHU:
+		msg := map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": text},
+		}
+		if chat.Secret != "" {
+			ts := strconv.FormatInt(now.Unix(), 10)
+			// feishu signs an empty message with the timestamp and secret
+			// as the key
+			mac := hmac.New(sha256.New, []byte(ts+"\n"+chat.Secret))
+			msg["timestamp"] = ts
+			msg["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		}
+		body, err := json.Marshal(msg)
+		return chat.URL, body, err
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	return chat.URL, body, err
+}
+
+// postChat posts a message, dingtalk and feishu answer errors with a 200
+// and a code in the body.
+func postChat(chat *ChatConfig, text string) error {
+	u, body, err := chat.chatMessage(text, time.Now())
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if chat.Type == NOTIFY_SLACK {
+		return nil
+	}
+	var res struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+		Code    int    `json:"code"`
+		Msg     string `json:"msg"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return nil
+	}
+	if res.ErrCode != 0 {
+		return fmt.Errorf("error %d: %s", res.ErrCode, res.ErrMsg)
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("error %d: %s", res.Code, res.Msg)
+	}
+	return nil
+}
+
+// notifyChats posts the outcome of task to the chats it matches in the
+// background, like notifyWebhook.
+func notifyChats(task *Task, data NotificationData) {
+	for name, chat := range config.Chats {
+		if !chat.matches(task) {
+			continue
+		}
+		text, err := renderNotification(chat.Type, data)
+		if err != nil {
+			taskLogger("notify", task.TaskID).Error("failed to render chat", "chat", name, "error", err)
+			continue
+		}
+		go func(name string, chat *ChatConfig) {
+			err := postChat(chat, text)
+			if err != nil {
+				time.Sleep(WEBHOOK_RETRY_DELAY)
+				err = postChat(chat, text)
+			}
+			if err != nil {
+				taskLogger("notify", task.TaskID).Error("chat failed", "chat", name, "error", err)
+			}
+		}(name, chat)
+	}
+}
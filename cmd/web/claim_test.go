@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestClaimTaskSingleWinner has many workers try to claim the same queued
+// task at once, the conditional update lets exactly one of them run it.
+func TestClaimTaskSingleWinner(t *testing.T) {
+	setupTestDB(t)
+	task := Task{TaskID: "contested", Status: STATUS_WAITING, Queued: true}
+	if err := db.Create(&task).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 16
+	var wins, failures int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			claimed, err := claimTask(task.TaskID)
+			if err != nil {
+				atomic.AddInt32(&failures, 1)
+				t.Error(err)
+				return
+			}
+			if claimed {
+				atomic.AddInt32(&wins, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if failures == 0 && wins != 1 {
+		t.Fatalf("%d workers claimed the task, want 1", wins)
+	}
+
+	db.First(&task, task.ID)
+	if task.Status != STATUS_RUNNING || task.Queued || task.Attempts != 1 {
+		t.Errorf("claimed task has status %d, queued %v, attempts %d", task.Status, task.Queued, task.Attempts)
+	}
+	if claimed, err := claimTask(task.TaskID); err != nil || claimed {
+		t.Errorf("a running task was claimed again: %v, %v", claimed, err)
+	}
+}
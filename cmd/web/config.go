@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const DEFAULT_ENVIRONMENT = "default"
+
+type Environment struct {
+	SSHUser           string `json:"ssh_user"`
+	SSHPort           int    `json:"ssh_port"`
+	SSHPrivateKeyFile string `json:"ssh_private_key_file"`
+	SSHCommonArgs     string `json:"ssh_common_args"`
+	// HostKeyChecking is the policy of the environment, the one of the
+	// config if empty
+	HostKeyChecking string `json:"host_key_checking"`
+	// SSHTimeout is the connection timeout in seconds, 0 leaves it to ansible
+	SSHTimeout int                    `json:"ssh_timeout"`
+	ExtraVars  map[string]interface{} `json:"extra_vars"`
+	// AllowedHosts are glob patterns, an empty list allows any host
+	AllowedHosts    []string `json:"allowed_hosts"`
+	RequireApproval bool     `json:"require_approval"`
+	// ApprovalSLA is how long a task waits for approval before it expires,
+	// e.g. "24h", empty waits forever
+	ApprovalSLA string `json:"approval_sla"`
+	// MaxHosts caps the hosts of a task for everybody but admins, 0 uses
+	// -max-hosts and a negative value means unlimited
+	MaxHosts int `json:"max_hosts"`
+	// Credential names the credential used below the SSH settings above
+	Credential string `json:"credential"`
+
+	approvalSLA time.Duration
+}
+
+type Config struct {
+	// BaseURL is used to build links in notifications
+	BaseURL       string                         `json:"base_url"`
+	Environments  map[string]*Environment        `json:"environments"`
+	Notifications map[string]*NotificationConfig `json:"notifications"`
+	// NDJSONEvents also writes the results as events.ndjson
+	NDJSONEvents bool `json:"ndjson_events"`
+	// TaskPaths records the file, line and role of every task, shown in
+	// the result view. It overrides callbacks_enabled of ansible.cfg.
+	TaskPaths bool `json:"task_paths"`
+	// HostKeyChecking is off, accept-new or strict, off if empty
+	HostKeyChecking string `json:"host_key_checking"`
+	// KnownHostsFile is where accept-new and strict keep the host keys,
+	// known_hosts in the data dir if empty
+	KnownHostsFile string `json:"known_hosts_file"`
+	// Executor defaults to running ansible-playbook directly
+	Executor ExecutorConfig `json:"executor"`
+	// VaultIDs are the vault identities tasks may use, label to password
+	// file or script
+	VaultIDs map[string]string `json:"vault_ids"`
+	// Webhooks are posted to when tasks finish, next to -webhook
+	Webhooks []*WebhookConfig `json:"webhooks"`
+	// Chats are the chat robots tasks are posted to, by name
+	Chats map[string]*ChatConfig `json:"chats"`
+	// SMTP sends the email notifications users ask for, none without it
+	SMTP *SMTPConfig `json:"smtp"`
+	// RedactPatterns are regexes scrubbed from the output of runs next to
+	// the built-in ones. They see the output as JSON text and shouldn't
+	// match a quote, the first group of a pattern is kept if it has one.
+	RedactPatterns []string `json:"redact_patterns"`
+
+	redactPatterns []*regexp.Regexp
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Environments: map[string]*Environment{
+			DEFAULT_ENVIRONMENT: {},
+		},
+	}
+}
+
+func loadConfig(filename string) (*Config, error) {
+	cfg := defaultConfig()
+	if filename == "" {
+		return cfg, cfg.finish()
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	builtin := cfg.Environments[DEFAULT_ENVIRONMENT]
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if _, ok := cfg.Environments[DEFAULT_ENVIRONMENT]; !ok {
+		cfg.Environments[DEFAULT_ENVIRONMENT] = builtin
+	}
+	for name, env := range cfg.Environments {
+		if env == nil {
+			return nil, fmt.Errorf("environment %q is empty", name)
+		}
+		for _, pattern := range env.AllowedHosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("environment %q: bad host pattern %q", name, pattern)
+			}
+		}
+		if err := checkHostKeyChecking(env.HostKeyChecking); err != nil {
+			return nil, fmt.Errorf("environment %q: %v", name, err)
+		}
+		if err := checkSSHTimeout(env.SSHTimeout); err != nil {
+			return nil, fmt.Errorf("environment %q: %v", name, err)
+		}
+		if env.ApprovalSLA != "" {
+			sla, err := time.ParseDuration(env.ApprovalSLA)
+			if err != nil || sla <= 0 {
+				return nil, fmt.Errorf("environment %q: bad approval_sla %q", name, env.ApprovalSLA)
+			}
+			env.approvalSLA = sla
+		}
+	}
+	return cfg, cfg.finish()
+}
+
+// finish fills in defaults and compiles the parts of c that need it.
+func (c *Config) finish() error {
+	if err := c.Executor.check(); err != nil {
+		return err
+	}
+	if err := checkHostKeyChecking(c.HostKeyChecking); err != nil {
+		return err
+	}
+	if err := checkVaultIDs(c.VaultIDs); err != nil {
+		return err
+	}
+	if err := checkWebhooks(c.Webhooks); err != nil {
+		return err
+	}
+	if err := checkChats(c.Chats); err != nil {
+		return err
+	}
+	if err := c.SMTP.check(); err != nil {
+		return err
+	}
+	if c.BaseURL == "" {
+		scheme := "http://"
+		if tlsEnabled() {
+			scheme = "https://"
+		}
+		c.BaseURL = scheme + address
+	}
+	var err error
+	if c.redactPatterns, err = compileRedactPatterns(c.RedactPatterns); err != nil {
+		return err
+	}
+	c.Notifications, err = compileNotifications(c.Notifications)
+	return err
+}
+
+func (c *Config) environment(name string) (*Environment, bool) {
+	if name == "" {
+		name = DEFAULT_ENVIRONMENT
+	}
+	env, ok := c.Environments[name]
+	return env, ok
+}
+
+func (c *Config) environmentNames() []string {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// maxHosts is the host cap of the environment, 0 if there is none.
+func (e *Environment) maxHosts() int {
+	switch {
+	case e.MaxHosts < 0:
+		return 0
+	case e.MaxHosts > 0:
+		return e.MaxHosts
+	}
+	return maxHosts
+}
+
+// allowsHost reports whether host matches one of the allowed patterns.
+func (e *Environment) allowsHost(host string) bool {
+	if len(e.AllowedHosts) == 0 {
+		return true
+	}
+	for _, pattern := range e.AllowedHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Credential is an SSH identity tasks and environments can refer to, it
+// logs in with a private key or with a password through sshpass. Both are
+// encrypted with the -credential-key-file key.
+type Credential struct {
+	ID      uint   `json:"id" gorm:"primarykey"`
+	Name    string `json:"name" gorm:"column:name;size:191;uniqueIndex"`
+	SSHUser string `json:"ssh_user" gorm:"column:ssh_user"`
+	SSHPort int    `json:"ssh_port" gorm:"column:ssh_port"`
+	// PrivateKey is base64 of the AES-GCM nonce and sealed key
+	PrivateKey string `json:"-" gorm:"column:private_key"`
+	HasKey     bool   `json:"has_private_key" gorm:"-"`
+	// Password is sealed like PrivateKey
+	Password    string    `json:"-" gorm:"column:password"`
+	HasPassword bool      `json:"has_password" gorm:"-"`
+	Creator     string    `json:"creator" gorm:"column:creator"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
+}
+
+// CredentialRequest creates a credential, PrivateKey is the PEM key itself.
+// A credential has a private key or a password, not both.
+type CredentialRequest struct {
+	Name       string `json:"name"`
+	SSHUser    string `json:"ssh_user"`
+	SSHPort    int    `json:"ssh_port"`
+	PrivateKey string `json:"private_key"`
+	Password   string `json:"password"`
+}
+
+var (
+	credentialKeyFile string
+	credentialAEAD    cipher.AEAD
+)
+
+var (
+	errNoCredentialKey    = withStatus(http.StatusServiceUnavailable, errors.New("no -credential-key-file, private keys and passwords can't be stored"))
+	errCredentialNotFound = withStatus(http.StatusNotFound, errors.New("credential not found"))
+)
+
+// setupCredentialKey loads the AES-256 key, stored as 64 hex digits.
+func setupCredentialKey() error {
+	if credentialKeyFile == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(credentialKeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("%s must hold a 32 byte key as 64 hex digits", credentialKeyFile)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	credentialAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+func encryptCredential(plain string) (string, error) {
+	if credentialAEAD == nil {
+		return "", errNoCredentialKey
+	}
+	nonce := make([]byte, credentialAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := credentialAEAD.Seal(nonce, nonce, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptCredential(sealed string) ([]byte, error) {
+	if credentialAEAD == nil {
+		return nil, errNoCredentialKey
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	n := credentialAEAD.NonceSize()
+	if len(raw) < n {
+		return nil, errors.New("credential is corrupt")
+	}
+	plain, err := credentialAEAD.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return nil, errors.New("credential can't be decrypted, was -credential-key-file changed?")
+	}
+	return plain, nil
+}
+
+// checkCredential checks that the credential id of a task request exists,
+// 0 is none.
+func checkCredential(id uint) error {
+	if id == 0 {
+		return nil
+	}
+	var count int64
+	if err := db.Model(&Credential{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("unknown credential %d", id))
+	}
+	return nil
+}
+
+// taskCredential is the credential of task, or else of its environment,
+// nil if neither has one.
+func taskCredential(task *Task, env *Environment) (*Credential, error) {
+	var cred Credential
+	switch {
+	case task.CredentialID != 0:
+		if err := db.Limit(1).Find(&cred, task.CredentialID).Error; err != nil {
+			return nil, err
+		}
+	case env.Credential != "":
+		if err := db.Limit(1).Find(&cred, "name = ?", env.Credential).Error; err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if cred.ID == 0 {
+		return nil, errCredentialNotFound
+	}
+	return &cred, nil
+}
+
+// materializeCredential writes the private key or the password of the
+// task's credential to a file only the runner can read, for
+// newPlaybookOptions to pass to ansible. The returned func removes it again.
+func materializeCredential(task *Task) (func(), error) {
+	env, ok := config.environment(task.Environment)
+	if !ok {
+		return nil, fmt.Errorf("unknown environment %q", task.Environment)
+	}
+	cred, err := taskCredential(task, env)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cred == nil:
+		return func() {}, nil
+	case cred.Password != "":
+		return materializeCredentialPassword(task, cred)
+	case cred.PrivateKey == "":
+		return func() {}, nil
+	}
+	key, err := decryptCredential(cred.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("credential %q: %v", cred.Name, err)
+	}
+	name, err := writeCredentialFile(task, key)
+	if err != nil {
+		return nil, err
+	}
+	task.credentialKeyFile = name
+	return func() {
+		os.Remove(name)
+		task.credentialKeyFile = ""
+	}, nil
+}
+
+// materializeCredentialPassword writes the password of cred as an extra vars
+// file. On the command line it would show in the process list and the log.
+func materializeCredentialPassword(task *Task, cred *Credential) (func(), error) {
+	// a container image has to bring its own
+	if config.Executor.Type != EXECUTOR_CONTAINER {
+		if _, err := exec.LookPath("sshpass"); err != nil {
+			return nil, fmt.Errorf("credential %q has a password, which needs sshpass on the runner", cred.Name)
+		}
+	}
+	password, err := decryptCredential(cred.Password)
+	if err != nil {
+		return nil, fmt.Errorf("credential %q: %v", cred.Name, err)
+	}
+	// every alias, like sshIdentityVars
+	vars, err := json.Marshal(map[string]string{
+		"ansible_password": string(password),
+		"ansible_ssh_pass": string(password),
+	})
+	if err != nil {
+		return nil, err
+	}
+	name, err := writeCredentialFile(task, vars)
+	if err != nil {
+		return nil, err
+	}
+	task.credentialVarsFile = name
+	task.credentialPassword = string(password)
+	return func() {
+		os.Remove(name)
+		task.credentialVarsFile = ""
+		task.credentialPassword = ""
+	}, nil
+}
+
+// writeCredentialFile writes content to a new file in the task dir, which a
+// container executor mounts as well.
+func writeCredentialFile(task *Task, content []byte) (string, error) {
+	// CreateTemp makes the file 0600
+	f, err := os.CreateTemp(filepath.Join(rootDir, task.TaskID), ".credential-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func apiListCredentials(c *gin.Context) {
+	var creds []Credential
+	page, err := listPage(c, db.Model(&Credential{}), &creds)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	for i := range creds {
+		creds[i].HasKey = creds[i].PrivateKey != ""
+		creds[i].HasPassword = creds[i].Password != ""
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiCreateCredential(c *gin.Context) {
+	var req CredentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("name is required")))
+		return
+	}
+	if req.SSHPort < 0 || req.SSHPort > 65535 {
+		apiError(c, withStatus(http.StatusBadRequest, fmt.Errorf("invalid ssh port %d", req.SSHPort)))
+		return
+	}
+	if req.PrivateKey != "" && req.Password != "" {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("a credential has a private key or a password, not both")))
+		return
+	}
+	var existing Credential
+	if err := db.Limit(1).Find(&existing, "name = ?", req.Name).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if existing.ID != 0 {
+		apiError(c, withStatus(http.StatusConflict, errors.New("credential already exists")))
+		return
+	}
+
+	cred := Credential{
+		Name:    req.Name,
+		SSHUser: strings.TrimSpace(req.SSHUser),
+		SSHPort: req.SSHPort,
+		Creator: currentUser(c).Name,
+	}
+	if req.PrivateKey != "" {
+		// ssh refuses keys without the final newline
+		key := strings.ReplaceAll(req.PrivateKey, "\r", "")
+		if !strings.HasSuffix(key, "\n") {
+			key += "\n"
+		}
+		sealed, err := encryptCredential(key)
+		if err != nil {
+			apiError(c, err)
+			return
+		}
+		cred.PrivateKey = sealed
+		cred.HasKey = true
+	}
+	if req.Password != "" {
+		sealed, err := encryptCredential(req.Password)
+		if err != nil {
+			apiError(c, err)
+			return
+		}
+		cred.Password = sealed
+		cred.HasPassword = true
+	}
+	if err := db.Create(&cred).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, cred)
+}
+
+func apiDeleteCredential(c *gin.Context) {
+	// trashed tasks count as well, they may be restored
+	var uses int64
+	if err := db.Unscoped().Model(&Task{}).Where("credential_id = ?", c.Param("id")).Count(&uses).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if uses > 0 {
+		apiError(c, withStatus(http.StatusConflict, fmt.Errorf("credential is used by %d tasks", uses)))
+		return
+	}
+	tx := db.Delete(&Credential{}, c.Param("id"))
+	if tx.Error != nil {
+		apiError(c, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		apiError(c, errCredentialNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
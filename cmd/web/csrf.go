@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CSRF_FIELD  = "csrf_token"
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+var errCSRF = withStatus(http.StatusForbidden, errors.New("missing or invalid CSRF token"))
+
+// the browser routes that change something on a GET, their links carry the
+// token in the query
+var csrfGETRoutes = map[string]bool{
+	"/cancelTask/:id":  true,
+	"/approveTask/:id": true,
+}
+
+// csrfToken is the token of the session of the request, "" without one.
+// It is derived from the session cookie, so it changes with every login.
+func csrfToken(c *gin.Context) string {
+	value, err := c.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return ""
+	}
+	if _, ok := parseSessionValue(value); !ok {
+		return ""
+	}
+	return signSession("csrf." + value)
+}
+
+// csrfProtect makes the requests of a session that change something carry
+// its token, in the csrf_token form field or query parameter or in the
+// X-CSRF-Token header. Requests with an API token are exempt, a browser
+// doesn't add those by itself.
+func csrfProtect(c *gin.Context) {
+	if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+		c.Next()
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if !csrfGETRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+	}
+	// the login form has no session yet
+	if c.FullPath() == "/login" {
+		c.Next()
+		return
+	}
+	want := csrfToken(c)
+	if want == "" {
+		// requireLogin turns the request away
+		c.Next()
+		return
+	}
+	got := c.GetHeader(CSRF_HEADER)
+	if got == "" {
+		got = c.Query(CSRF_FIELD)
+	}
+	if got == "" && c.ContentType() != "application/json" {
+		got = c.PostForm(CSRF_FIELD)
+	}
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		c.AbortWithStatusJSON(errorStatus(errCSRF), gin.H{"error": errCSRF.Error()})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const TRASH_CHECK_INTERVAL = time.Hour
+
+var errTaskRunning = withStatus(http.StatusConflict, errors.New("task is running"))
+
+var trashRetention time.Duration
+
+func deleteTask(c *gin.Context) {
+	if err := trashTask(c.Param("id"), currentUser(c)); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// trashTask moves a task to the trash. Its rows and files stay until it is
+// purged, by an admin or once it has been in the trash for -trash-retention.
+// Errors carry an HTTP status.
+func trashTask(taskId string, user *User) error {
+	var task Task
+	if err := db.Preload("Inventory").Limit(1).Find(&task, "task_id = ?", taskId).Error; err != nil {
+		return err
+	}
+	if task.ID == 0 {
+		return withStatus(http.StatusNotFound, errors.New("task not found"))
+	}
+
+	if task.Inventory.Locked && !user.Admin {
+		return withStatus(http.StatusForbidden, errInventoryLocked)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// re-checked on delete, the task may have started meanwhile. A
+		// queued task is dropped by the worker that receives it.
+		res := tx.Model(&Task{}).Where("id = ? AND status <> ?", task.ID, STATUS_RUNNING).
+			Updates(map[string]interface{}{"deleted_at": time.Now(), "queued": false})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errTaskRunning
+		}
+		// a retry with the same key creates a new task
+		return tx.Where("task_id = ?", task.ID).Delete(&IdempotencyKey{}).Error
+	})
+	if err != nil && err != errTaskRunning {
+		taskLogger("trash", taskId).Error("failed to delete task", "error", err)
+	}
+	return err
+}
+
+func showTrash(c *gin.Context) {
+	var tasks []Task
+	tx := db.Unscoped().Preload("Playbook").Preload("User").Scopes(inTeams(c, "tasks.team_id")).
+		Where("deleted_at IS NOT NULL").Order("deleted_at desc").Find(&tasks)
+	if tx.Error != nil {
+		c.JSON(400, gin.H{"error": tx.Error.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "trash.html", gin.H{
+		"csrf":      csrfToken(c),
+		"tasks":     tasks,
+		"operator":  hasRole(currentUser(c), ROLE_OPERATOR),
+		"admin":     currentUser(c).Admin,
+		"retention": trashRetention,
+	})
+}
+
+func restoreTask(c *gin.Context) {
+	tx := db.Unscoped().Model(&Task{}).
+		Where("task_id = ? AND deleted_at IS NOT NULL", c.Param("id")).
+		Update("deleted_at", nil)
+	if tx.Error != nil {
+		c.AbortWithError(http.StatusInternalServerError, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found in the trash"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/trash")
+}
+
+func purgeTrashedTask(c *gin.Context) {
+	if !currentUser(c).Admin {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "only admins can purge tasks"})
+		return
+	}
+	var task Task
+	err := db.Unscoped().Where("deleted_at IS NOT NULL").Limit(1).Find(&task, "task_id = ?", c.Param("id")).Error
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if task.ID == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found in the trash"})
+		return
+	}
+	if err := purgeTask(&task); err != nil {
+		requestLogger(c).Error("failed to purge task", "task_id", task.TaskID, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, "/trash")
+}
+
+// purgeTask removes a trashed task, its playbook and inventory rows and its
+// data directory. The rows are deleted in a transaction that is only
+// committed once the directory is gone, so a failed removal leaves the task
+// in the trash to be purged again.
+func purgeTask(task *Task) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// re-checked, the task may have been restored meanwhile
+		res := tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", task.ID).Delete(&Task{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		if err := tx.Delete(&Playbook{}, task.PlaybookID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&Inventory{}, task.InventoryID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ?", task.ID).Delete(&TaskAttempt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ?", task.ID).Delete(&Run{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("task_id = ?", task.ID).Delete(&TaskStep{}).Error; err != nil {
+			return err
+		}
+		if searchIndex {
+			if err := tx.Exec("DELETE FROM task_output_fts WHERE task_id = ?", task.TaskID).Error; err != nil {
+				return err
+			}
+		}
+		return os.RemoveAll(filepath.Join(rootDir, task.TaskID))
+	})
+}
+
+// purgeExpiredTrash purges the tasks trashed more than -trash-retention ago.
+func purgeExpiredTrash() {
+	var tasks []Task
+	err := db.Unscoped().Where("deleted_at < ?", time.Now().Add(-trashRetention)).Find(&tasks).Error
+	if err != nil {
+		logger("trash").Error("failed to list expired trash", "error", err)
+		return
+	}
+	for i := range tasks {
+		if err := purgeTask(&tasks[i]); err != nil {
+			taskLogger("trash", tasks[i].TaskID).Error("failed to purge task", "error", err)
+		}
+	}
+	if len(tasks) > 0 {
+		logger("trash").Warn("purged tasks from the trash", "count", len(tasks))
+	}
+}
+
+func startTrashJanitor() {
+	if trashRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(TRASH_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		purgeExpiredTrash()
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
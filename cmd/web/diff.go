@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MAX_DIFF_EDITS bounds the lines the line diff looks for changes in, files
+// that differ more are shown as removed and added as a whole
+const MAX_DIFF_EDITS = 4096
+
+// HostDiff is the change a task made, or would make in check mode, on a host.
+type HostDiff struct {
+	Play string `json:"play"`
+	Task string `json:"task"`
+	Host string `json:"host"`
+	Diff string `json:"diff"`
+}
+
+// ansibleDiff is an entry of the diff a module returns with --diff.
+type ansibleDiff struct {
+	Before       interface{} `json:"before"`
+	After        interface{} `json:"after"`
+	BeforeHeader string      `json:"before_header"`
+	AfterHeader  string      `json:"after_header"`
+	Prepared     string      `json:"prepared"`
+}
+
+// diffResults is the part of the json callback output go-ansible leaves out.
+type diffResults struct {
+	Plays []struct {
+		Play *struct {
+			Name string `json:"name"`
+		} `json:"play"`
+		Tasks []struct {
+			Task *struct {
+				Name string `json:"name"`
+			} `json:"task"`
+			Hosts map[string]struct {
+				Diff json.RawMessage `json:"diff"`
+			} `json:"hosts"`
+		} `json:"tasks"`
+	} `json:"plays"`
+}
+
+// readDiffs returns the diffs in result.json in play order, it is empty if
+// the task didn't run in diff mode.
+func readDiffs(resultPath string) []HostDiff {
+	f, err := os.Open(resultPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	// like the results, the last event of the stream sums up the run
+	var res diffResults
+	dec := json.NewDecoder(f)
+	for {
+		var v diffResults
+		if err := dec.Decode(&v); err != nil {
+			if err != io.EOF {
+				logger("result").Error("failed to read diffs", "path", resultPath, "error", err)
+			}
+			break
+		}
+		res = v
+	}
+
+	var diffs []HostDiff
+	for _, play := range res.Plays {
+		playName := ""
+		if play.Play != nil {
+			playName = play.Play.Name
+		}
+		for _, task := range play.Tasks {
+			taskName := ""
+			if task.Task != nil {
+				taskName = task.Task.Name
+			}
+			hosts := make([]string, 0, len(task.Hosts))
+			for host := range task.Hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			for _, host := range hosts {
+				if text := diffText(task.Hosts[host].Diff); text != "" {
+					diffs = append(diffs, HostDiff{Play: playName, Task: taskName, Host: host, Diff: text})
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// diffText renders the diff of a module result, which is one entry or a
+// list of them.
+func diffText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var list []ansibleDiff
+	if json.Unmarshal(raw, &list) != nil {
+		var one ansibleDiff
+		if json.Unmarshal(raw, &one) != nil {
+			return ""
+		}
+		list = []ansibleDiff{one}
+	}
+	var w strings.Builder
+	for _, d := range list {
+		if d.Prepared != "" {
+			w.WriteString(strings.TrimRight(d.Prepared, "\n") + "\n")
+			continue
+		}
+		before, after := outputText(d.Before), outputText(d.After)
+		if before == after {
+			continue
+		}
+		fmt.Fprintf(&w, "--- %s\n+++ %s\n", headerOr(d.BeforeHeader, "before"), headerOr(d.AfterHeader, "after"))
+		writeLineDiff(&w, splitLines(before), splitLines(after))
+	}
+	return w.String()
+}
+
+func headerOr(header, fallback string) string {
+	if header == "" {
+		return fallback
+	}
+	return header
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// writeLineDiff writes every line of a and b prefixed with ' ', '-' or '+',
+// from a shortest edit script.
+func writeLineDiff(w *strings.Builder, a, b []string) {
+	d := &lineDiff{a: a, b: b, removed: make([]bool, len(a)), added: make([]bool, len(b))}
+	d.compare(0, len(a), 0, len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && d.removed[i]:
+			w.WriteString("-" + a[i] + "\n")
+			i++
+		case j < len(b) && d.added[j]:
+			w.WriteString("+" + b[j] + "\n")
+			j++
+		default:
+			w.WriteString(" " + a[i] + "\n")
+			i++
+			j++
+		}
+	}
+}
+
+// lineDiff marks the lines of a that are removed and those of b that are
+// added with the linear space variant of Myers' diff, which splits the
+// files at the middle of a shortest edit script and diffs the halves.
+type lineDiff struct {
+	a, b           []string
+	removed, added []bool
+}
+
+// compare marks the changes between a[aLo:aHi] and b[bLo:bHi].
+func (d *lineDiff) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+	if aLo < aHi && bLo < bHi {
+		if x, y, ok := d.middle(aLo, aHi, bLo, bHi); ok {
+			d.compare(aLo, x, bLo, y)
+			d.compare(x, aHi, y, bHi)
+			return
+		}
+	}
+	for i := aLo; i < aHi; i++ {
+		d.removed[i] = true
+	}
+	for j := bLo; j < bHi; j++ {
+		d.added[j] = true
+	}
+}
+
+// middle returns a point of a shortest edit script of a[aLo:aHi] and
+// b[bLo:bHi], neither of which is empty and which start and end with
+// different lines. It searches from both ends at once until the paths
+// meet, it gives up once that takes more than MAX_DIFF_EDITS edits.
+func (d *lineDiff) middle(aLo, aHi, bLo, bHi int) (x, y int, ok bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := min((n+m+1)/2, MAX_DIFF_EDITS/2)
+	// forward[off+k] is the furthest x on diagonal k = x-y from the start,
+	// backward[off+k] the furthest x from the end with both reversed
+	off := maxD + 1
+	forward := make([]int, 2*off+1)
+	backward := make([]int, 2*off+1)
+	for k := range forward {
+		forward[k], backward[k] = -1, -1
+	}
+	forward[off+1], backward[off+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
+	// diagonals that ran off the edit graph aren't followed further
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+	for e := 0; e < maxD; e++ {
+		for k := -e + k1start; k <= e-k1end; k += 2 {
+			var x1 int
+			if k == -e || k != e && forward[off+k-1] < forward[off+k+1] {
+				x1 = forward[off+k+1]
+			} else {
+				x1 = forward[off+k-1] + 1
+			}
+			y1 := x1 - k
+			for x1 < n && y1 < m && d.a[aLo+x1] == d.b[bLo+y1] {
+				x1++
+				y1++
+			}
+			forward[off+k] = x1
+			switch {
+			case x1 > n:
+				k1end += 2
+			case y1 > m:
+				k1start += 2
+			case odd:
+				if k2 := off + delta - k; k2 >= 0 && k2 < len(backward) && backward[k2] != -1 && x1 >= n-backward[k2] {
+					return aLo + x1, bLo + y1, true
+				}
+			}
+		}
+		for k := -e + k2start; k <= e-k2end; k += 2 {
+			var x2 int
+			if k == -e || k != e && backward[off+k-1] < backward[off+k+1] {
+				x2 = backward[off+k+1]
+			} else {
+				x2 = backward[off+k-1] + 1
+			}
+			y2 := x2 - k
+			for x2 < n && y2 < m && d.a[aHi-x2-1] == d.b[bHi-y2-1] {
+				x2++
+				y2++
+			}
+			backward[off+k] = x2
+			switch {
+			case x2 > n:
+				k2end += 2
+			case y2 > m:
+				k2start += 2
+			case !odd:
+				if k1 := off + delta - k; k1 >= 0 && k1 < len(forward) && forward[k1] != -1 {
+					x1 := forward[k1]
+					if y1 := x1 - (k1 - off); x1 >= n-x2 {
+						return aLo + x1, bLo + y1, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lcsLength is the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := len(a) - 1; i >= 0; i-- {
+		cur := make([]int, len(b)+1)
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				cur[j] = prev[j+1] + 1
+			} else {
+				cur[j] = max(prev[j], cur[j+1])
+			}
+		}
+		prev = cur
+	}
+	return prev[0]
+}
+
+// checkLineDiff checks that the diff of a and b gives back both and makes
+// no more changes than needed.
+func checkLineDiff(t *testing.T, a, b []string) {
+	t.Helper()
+	var w strings.Builder
+	writeLineDiff(&w, a, b)
+	var gotA, gotB []string
+	changes := 0
+	for _, l := range splitLines(w.String()) {
+		switch l[0] {
+		case ' ':
+			gotA = append(gotA, l[1:])
+			gotB = append(gotB, l[1:])
+		case '-':
+			gotA = append(gotA, l[1:])
+			changes++
+		case '+':
+			gotB = append(gotB, l[1:])
+			changes++
+		}
+	}
+	if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+		t.Fatalf("diff of %q and %q doesn't give them back:\n%s", a, b, w.String())
+	}
+	if want := len(a) + len(b) - 2*lcsLength(a, b); changes != want {
+		t.Fatalf("diff of %q and %q has %d changes, want %d:\n%s", a, b, changes, want, w.String())
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	for _, tc := range []struct{ a, b string }{
+		{"", ""},
+		{"a", ""},
+		{"", "a"},
+		{"a", "a"},
+		{"a b c", "a x c"},
+		{"a b c d", "b c d e"},
+		{"a b c a b b a", "c b a b a c"},
+		{"x y", "y x"},
+	} {
+		checkLineDiff(t, strings.Fields(tc.a), strings.Fields(tc.b))
+	}
+	rnd := rand.New(rand.NewSource(1))
+	words := func() []string {
+		lines := make([]string, rnd.Intn(100))
+		for i := range lines {
+			lines[i] = fmt.Sprint(rnd.Intn(4))
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		checkLineDiff(t, words(), words())
+	}
+}
+
+func TestLineDiffTooManyEdits(t *testing.T) {
+	var a, b []string
+	for i := 0; i < MAX_DIFF_EDITS; i++ {
+		a = append(a, fmt.Sprint("a", i))
+		b = append(b, fmt.Sprint("b", i))
+	}
+	a = append(a, "same")
+	b = append(b, "same")
+	var w strings.Builder
+	writeLineDiff(&w, a, b)
+	lines := splitLines(w.String())
+	if len(lines) != 2*MAX_DIFF_EDITS+1 || lines[0] != "-a0" || lines[MAX_DIFF_EDITS] != "+b0" || lines[len(lines)-1] != " same" {
+		t.Errorf("got %d lines starting %q, want the files removed and added whole", len(lines), lines[:3])
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+	"github.com/apenella/go-ansible/v2/pkg/inventory"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// RESOLVE_INVENTORY_TIMEOUT bounds asking a cloud API for the hosts
+const RESOLVE_INVENTORY_TIMEOUT = 2 * time.Minute
+
+// inventoryPlugin is an inventory plugin a library inventory can use. The
+// plugin only takes a config file whose name ends with Suffix.
+type inventoryPlugin struct {
+	Name   string
+	Suffix string
+}
+
+var inventoryPlugins = map[string]inventoryPlugin{
+	"aws_ec2":     {Name: "amazon.aws.aws_ec2", Suffix: "aws_ec2.yml"},
+	"gcp_compute": {Name: "google.cloud.gcp_compute", Suffix: "gcp.yml"},
+	"vmware":      {Name: "community.vmware.vmware_vm_inventory", Suffix: "vmware.yml"},
+}
+
+var errNotDynamicInventory = withStatus(http.StatusBadRequest, errors.New("library inventory is not dynamic"))
+
+func inventoryPluginNames() []string {
+	names := make([]string, 0, len(inventoryPlugins))
+	for name := range inventoryPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkPluginConfig checks that the config of plugin is a YAML mapping of
+// the plugin options.
+func checkPluginConfig(plugin, config string) error {
+	if _, ok := inventoryPlugins[plugin]; !ok {
+		return fmt.Errorf("unknown inventory plugin %q, use one of %s", plugin, strings.Join(inventoryPluginNames(), ", "))
+	}
+	var options map[string]interface{}
+	if err := yaml.Unmarshal([]byte(config), &options); err != nil {
+		return fmt.Errorf("invalid plugin config: %v", err)
+	}
+	if _, ok := options["plugin"]; ok {
+		return errors.New("plugin config sets plugin, it comes from the plugin field")
+	}
+	return nil
+}
+
+// dynamicInventoryFile is the name of the config file of plugin in a task.
+func dynamicInventoryFile(plugin string) string {
+	return "inventory." + inventoryPlugins[plugin].Suffix
+}
+
+// isDynamicInventory tells the plugin config of a task from its other
+// inventories.
+func isDynamicInventory(path string) bool {
+	for _, plugin := range inventoryPlugins {
+		if strings.HasSuffix(path, plugin.Suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderPluginInventory(li *LibraryInventory) string {
+	content := "plugin: " + inventoryPlugins[li.Plugin].Name + "\n" + li.PluginConfig
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content
+}
+
+func cachedHosts(li *LibraryInventory) []string {
+	if li.CachedHosts == "" {
+		return nil
+	}
+	return strings.Split(li.CachedHosts, "\n")
+}
+
+// taskInventoryHosts are the hosts of the inventory of task. Those of a
+// dynamic inventory are known as of the last refresh of its library
+// inventory.
+func taskInventoryHosts(task *Task) ([]string, error) {
+	if isSpecInventory(task.Inventory.Path) {
+		spec, err := readInventorySpec(task)
+		if err != nil {
+			return nil, err
+		}
+		return spec.hosts()
+	}
+	if !isDynamicInventory(task.Inventory.Path) {
+		content, err := readFile(task.Inventory.Path)
+		if err != nil {
+			return nil, err
+		}
+		return inventoryHosts(content)
+	}
+	var li LibraryInventory
+	if err := db.Select("cached_hosts").Limit(1).Find(&li, task.LibraryInventoryID).Error; err != nil {
+		return nil, err
+	}
+	return cachedHosts(&li), nil
+}
+
+// checkDynamicInventory is checkInventory for a dynamic inventory. Its hosts
+// may change at any time, so an environment that only allows some hosts
+// can't use it.
+func checkDynamicInventory(li *LibraryInventory, envName string, user *User) error {
+	env, ok := config.environment(envName)
+	if !ok {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("unknown environment %q", envName))
+	}
+	if len(env.AllowedHosts) > 0 {
+		return withStatus(http.StatusBadRequest,
+			fmt.Errorf("environment %q only allows some hosts, it can't use the dynamic inventory %q", envName, li.Name))
+	}
+	hosts := cachedHosts(li)
+	if limit := env.maxHosts(); limit > 0 && len(hosts) > limit && !user.Admin {
+		return withStatus(http.StatusBadRequest,
+			fmt.Errorf("inventory had %d hosts when it was refreshed, environment %q allows at most %d", len(hosts), envName, limit))
+	}
+	return nil
+}
+
+// resolveDynamicInventory asks ansible-inventory on the server for the
+// hosts of li.
+func resolveDynamicInventory(li *LibraryInventory) ([]string, error) {
+	dir, err := os.MkdirTemp(rootDir, ".inventory-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, dynamicInventoryFile(li.Plugin))
+	if err := writeFile(path, renderPluginInventory(li)); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVE_INVENTORY_TIMEOUT)
+	defer cancel()
+	cmd := inventory.NewAnsibleInventoryCmd(
+		inventory.WithInventoryOptions(&inventory.AnsibleInventoryOptions{Inventory: path, List: true}),
+	)
+	var out, errOut bytes.Buffer
+	exec := execute.NewDefaultExecute(
+		execute.WithCmd(cmd),
+		execute.WithWrite(&out),
+		execute.WithWriteError(&errOut),
+		execute.WithEnvVars(map[string]string{
+			"ANSIBLE_INVENTORY_UNPARSED_FAILED":        "true",
+			"ANSIBLE_INVENTORY_ANY_UNPARSED_IS_FAILED": "true",
+		}),
+	)
+	if err := exec.Execute(ctx); err != nil {
+		return nil, validationError("failed to resolve inventory", errOut.String(), err)
+	}
+
+	// the hosts of the groups, _meta has the vars of the hosts
+	var groups map[string]struct {
+		Hosts []string `json:"hosts"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse the ansible-inventory output: %v", err)
+	}
+	seen := map[string]bool{}
+	hosts := []string{}
+	for name, group := range groups {
+		if name == "_meta" {
+			continue
+		}
+		for _, host := range group.Hosts {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if len(hosts) > MAX_INVENTORY_HOSTS {
+		return nil, withStatus(http.StatusBadRequest, errTooManyHosts)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// apiRefreshLibraryInventory resolves the hosts of a dynamic inventory and
+// keeps them to show, runs resolve them again.
+func apiRefreshLibraryInventory(c *gin.Context) {
+	li, err := libraryInventories.find(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if li.Plugin == "" {
+		apiError(c, errNotDynamicInventory)
+		return
+	}
+	hosts, err := resolveDynamicInventory(li)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	li.CachedHosts = strings.Join(hosts, "\n")
+	li.HostsRefreshedAt = time.Now()
+	if err := db.Select("cached_hosts", "hosts_refreshed_at").Updates(li).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := registerHosts(li.TeamID, hosts, nil); err != nil {
+		logger("hosts").Warn("failed to register hosts", "library_inventory", li.ID, "error", err)
+	}
+	c.IndentedJSON(http.StatusOK, li)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the email preference of a user, failed is the default once the user has
+// an email address
+const EMAIL_NEVER = "never"
+
+const SMTP_TIMEOUT = 30 * time.Second
+
+// SMTPConfig is the mail server notification emails are sent through.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	// TLS connects with TLS right away, as on port 465. Otherwise STARTTLS
+	// is used when the server offers it.
+	TLS bool `json:"tls"`
+}
+
+func (s *SMTPConfig) check() error {
+	if s == nil {
+		return nil
+	}
+	if s.Host == "" {
+		return errors.New("smtp: host is required")
+	}
+	if s.Port == 0 {
+		s.Port = 25
+		if s.TLS {
+			s.Port = 465
+		}
+	}
+	if _, err := mail.ParseAddress(s.From); err != nil {
+		return fmt.Errorf("smtp: bad from address %q: %v", s.From, err)
+	}
+	return nil
+}
+
+func checkEmailPreference(pref string) error {
+	switch pref {
+	case "", WEBHOOK_ON_FAILED, WEBHOOK_ON_FINISHED, EMAIL_NEVER:
+		return nil
+	}
+	return withStatus(http.StatusBadRequest, fmt.Errorf("unknown email preference %q, use %s, %s or %s",
+		pref, WEBHOOK_ON_FAILED, WEBHOOK_ON_FINISHED, EMAIL_NEVER))
+}
+
+// wantsEmail reports whether the requester of task is mailed about it.
+func wantsEmail(task *Task) bool {
+	user := &task.User
+	if config.SMTP == nil || user.Email == "" {
+		return false
+	}
+	switch user.NotifyEmail {
+	case EMAIL_NEVER:
+		return false
+	case WEBHOOK_ON_FINISHED:
+		return true
+	}
+	return taskFailed(task)
+}
+
+func emailMessage(from, to, subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+// sendEmail delivers msg with the smtp config, authenticating when it has
+// a username.
+func sendEmail(s *SMTPConfig, to string, msg []byte) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: SMTP_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if s.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: s.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if !s.TLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(s.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// notifyEmail mails the outcome of task to its requester in the background,
+// like notifyWebhook.
+func notifyEmail(task *Task, data NotificationData) {
+	if !wantsEmail(task) {
+		return
+	}
+	body, err := renderNotification(NOTIFY_EMAIL, data)
+	if err != nil {
+		taskLogger("notify", task.TaskID).Error("failed to render email", "error", err)
+		return
+	}
+	s, to := config.SMTP, task.User.Email
+	msg := emailMessage(s.From, to, fmt.Sprintf("[ansible-runner] %s %s", data.Name, data.Status), body)
+	go func() {
+		err := sendEmail(s, to, msg)
+		if err != nil {
+			time.Sleep(WEBHOOK_RETRY_DELAY)
+			err = sendEmail(s, to, msg)
+		}
+		if err != nil {
+			taskLogger("notify", task.TaskID).Error("email failed", "to", to, "error", err)
+		}
+	}()
+}
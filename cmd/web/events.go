@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_QUEUED       = "queued"
+	EVENT_STARTED      = "started"
+	EVENT_PLAY_STARTED = "play_started"
+	EVENT_TASK_STARTED = "task_started"
+	EVENT_HOST_RESULT  = "host_result"
+	EVENT_PROGRESS     = "progress"
+	EVENT_FINISHED     = "finished"
+	// MAX_STREAM_TASKS bounds the tasks of one /events/tasks stream, a
+	// page of the task list
+	MAX_STREAM_TASKS = 100
+)
+
+// TaskEvent is the data of an event of /events/task/:id, its type is also
+// the name of the event.
+type TaskEvent struct {
+	Type       string    `json:"type"`
+	TaskID     string    `json:"task_id"`
+	Play       string    `json:"play,omitempty"`
+	Task       string    `json:"task,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	StatusText string    `json:"status_text,omitempty"`
+	Progress   *Progress `json:"progress,omitempty"`
+}
+
+// hostEventStatus maps a runner event of the jsonl callback to the status
+// of a host result, "" for events that aren't host results.
+func hostEventStatus(event string, raw json.RawMessage) string {
+	switch event {
+	case "v2_runner_on_ok":
+		var item struct {
+			Changed bool `json:"changed"`
+		}
+		if json.Unmarshal(raw, &item) == nil && item.Changed {
+			return HOST_CHANGED
+		}
+		return HOST_OK
+	case "v2_runner_on_failed":
+		return HOST_FAILED
+	case "v2_runner_on_skipped":
+		return HOST_SKIPPED
+	case "v2_runner_on_unreachable":
+		return HOST_UNREACHABLE
+	}
+	return ""
+}
+
+// outputEvents turns a line of the run output into events, lines that
+// aren't jsonl events, like those of stderr, give none.
+func outputEvents(taskID, line string) []TaskEvent {
+	var ev jsonlEvent
+	if json.Unmarshal([]byte(line), &ev) != nil || ev.Event == "" {
+		return nil
+	}
+	switch ev.Event {
+	case "v2_playbook_on_play_start":
+		if ev.Play != nil {
+			return []TaskEvent{{Type: EVENT_PLAY_STARTED, TaskID: taskID, Play: ev.Play.Name}}
+		}
+	case "v2_playbook_on_task_start":
+		if ev.Task != nil {
+			return []TaskEvent{{Type: EVENT_TASK_STARTED, TaskID: taskID, Task: ev.Task.Name}}
+		}
+	}
+	hosts := make([]string, 0, len(ev.Hosts))
+	for host := range ev.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var events []TaskEvent
+	for _, host := range hosts {
+		status := hostEventStatus(ev.Event, ev.Hosts[host])
+		if status == "" {
+			continue
+		}
+		e := TaskEvent{Type: EVENT_HOST_RESULT, TaskID: taskID, Host: host, Status: status}
+		if ev.Task != nil {
+			e.Task = ev.Task.Name
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func sendTaskEvent(c *gin.Context, e TaskEvent) {
+	c.SSEvent(e.Type, e)
+}
+
+func finishedEvent(taskId string) TaskEvent {
+	var task Task
+	db.Select("status").Limit(1).Find(&task, "task_id = ?", taskId)
+	return TaskEvent{Type: EVENT_FINISHED, TaskID: taskId, StatusText: statusText(task.Status)}
+}
+
+// streamTaskEvents follows a task from the queue to its end as structured
+// events, for a progress bar. Once the task runs its events so far are
+// replayed, so a late client catches up.
+func streamTaskEvents(c *gin.Context) {
+	taskId := c.Param("id")
+	var task Task
+	if err := db.Limit(1).Find(&task, "task_id = ?", taskId).Error; err != nil || task.ID == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	followTaskEvents(c.Request.Context(), taskId, func(e TaskEvent) {
+		sendTaskEvent(c, e)
+		c.Writer.Flush()
+	})
+}
+
+// streamTaskListEvents is streamTaskEvents for the tasks of the tasks query
+// param, separated by commas, over one connection, so that a page follows
+// all of its rows without running out of the connections a browser opens
+// to a server. The task_id of an event tells the tasks apart, those of
+// other teams are left out.
+func streamTaskListEvents(c *gin.Context) {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(c.Query("tasks"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > MAX_STREAM_TASKS {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d tasks can be followed at once", MAX_STREAM_TASKS)})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// the request context ends with the connection, which stops the
+	// goroutines following the tasks
+	ctx := c.Request.Context()
+	user := currentUser(c)
+	events := make(chan TaskEvent, 64)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		if !canSeeTask(user, id) {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			followTaskEvents(ctx, id, func(e TaskEvent) {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+				}
+			})
+		}(id)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			sendTaskEvent(c, e)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// followTaskEvents hands the events of a task to send until it finishes or
+// ctx ends. A task that is gone is finished.
+func followTaskEvents(ctx context.Context, taskId string, send func(TaskEvent)) {
+	var history []string
+	var lines chan string
+	queued := false
+	for lines == nil {
+		if hub := findOutputHub(taskId); hub != nil {
+			history, lines = hub.subscribe()
+			if lines != nil {
+				defer hub.unsubscribe(lines)
+				break
+			}
+		}
+		var task Task
+		if err := db.Limit(1).Find(&task, "task_id = ?", taskId).Error; err != nil || task.ID == 0 || !task.Queued && task.Status != STATUS_WAITING && task.Status != STATUS_RUNNING {
+			send(finishedEvent(taskId))
+			return
+		}
+		if task.Queued && !queued {
+			queued = true
+			send(TaskEvent{Type: EVENT_QUEUED, TaskID: taskId, StatusText: statusText(task.Status)})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	send(TaskEvent{Type: EVENT_STARTED, TaskID: taskId})
+	for _, line := range history {
+		for _, e := range outputEvents(taskId, line) {
+			send(e)
+		}
+	}
+	var lastProgress Progress
+	sendProgress := func() {
+		if p, ok := taskProgress(taskId); ok && p != lastProgress {
+			lastProgress = p
+			send(TaskEvent{Type: EVENT_PROGRESS, TaskID: taskId, Progress: &p})
+		}
+	}
+	sendProgress()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				send(finishedEvent(taskId))
+				return
+			}
+			events := outputEvents(taskId, line)
+			for _, e := range events {
+				send(e)
+			}
+			if len(events) > 0 {
+				sendProgress()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
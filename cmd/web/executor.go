@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+)
+
+const (
+	EXECUTOR_LOCAL     = "local"
+	EXECUTOR_CONTAINER = "container"
+)
+
+// the env vars handed into the container, the values are set by go-ansible
+// and taskPathsEnv on the runtime's process
+var containerEnvVars = []string{
+	"ANSIBLE_STDOUT_CALLBACK",
+	"ANSIBLE_CALLBACK_PLUGINS",
+	"ANSIBLE_CALLBACKS_ENABLED",
+	"TASK_PATHS_FILE",
+	"ANSIBLE_LOAD_CALLBACK_PLUGINS",
+	"ANSIBLE_COLLECTIONS_PATH",
+	"ANSIBLE_ROLES_PATH",
+	"ANSIBLE_VAULT_IDENTITY_LIST",
+	"ANSIBLE_INVENTORY_UNPARSED_FAILED",
+	"ANSIBLE_INVENTORY_ANY_UNPARSED_IS_FAILED",
+	"ANSIBLE_VERBOSITY",
+	"ANSIBLE_HOST_KEY_CHECKING",
+}
+
+// ExecutorConfig selects how ansible-playbook is started. The local executor
+// runs it directly, the container executor inside a throwaway container
+// that only sees the task directory and the files the run needs.
+type ExecutorConfig struct {
+	Type string `json:"type"`
+	// Runtime is docker or podman
+	Runtime string `json:"runtime"`
+	Image   string `json:"image"`
+	// Images are glob patterns of the images tasks may pick instead of
+	// Image, e.g. "registry.example.com/ee/*"
+	Images []string `json:"images"`
+	CPUs   string   `json:"cpus"`
+	Memory string   `json:"memory"`
+	// PidsLimit of 0 leaves the runtime default
+	PidsLimit int    `json:"pids_limit"`
+	Network   string `json:"network"`
+	// ExtraArgs are added to the run command before the image
+	ExtraArgs []string `json:"extra_args"`
+}
+
+func (e *ExecutorConfig) check() error {
+	switch e.Type {
+	case "":
+		e.Type = EXECUTOR_LOCAL
+		return nil
+	case EXECUTOR_LOCAL:
+		return nil
+	case EXECUTOR_CONTAINER:
+	default:
+		return fmt.Errorf("unknown executor %q", e.Type)
+	}
+	if e.Runtime == "" {
+		e.Runtime = "docker"
+	}
+	if e.Image == "" {
+		return fmt.Errorf("the container executor needs an image")
+	}
+	for _, pattern := range e.Images {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("executor: bad image pattern %q", pattern)
+		}
+	}
+	if _, err := exec.LookPath(e.Runtime); err != nil {
+		return fmt.Errorf("container runtime: %v", err)
+	}
+	return nil
+}
+
+// checkImage checks that a task may run in image, empty for the image of the
+// executor.
+func (e *ExecutorConfig) checkImage(image string) error {
+	if image == "" || image == e.Image && e.Type == EXECUTOR_CONTAINER {
+		return nil
+	}
+	if e.Type != EXECUTOR_CONTAINER {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("image %q: tasks don't run in containers", image))
+	}
+	for _, pattern := range e.Images {
+		if ok, _ := path.Match(pattern, image); ok {
+			return nil
+		}
+	}
+	return withStatus(http.StatusBadRequest, fmt.Errorf("image %q isn't allowed", image))
+}
+
+// containerCmd runs an ansible command with the container runtime.
+// Paths are mounted at the same location so the command needs no rewriting.
+type containerCmd struct {
+	cmd    execute.Commander
+	name   string
+	image  string
+	mounts []string
+	config *ExecutorConfig
+}
+
+func (c *containerCmd) Command() ([]string, error) {
+	command, err := c.cmd.Command()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{c.config.Runtime, "run", "--rm", "--name", c.name,
+		"--security-opt", "no-new-privileges"}
+	if c.config.CPUs != "" {
+		args = append(args, "--cpus", c.config.CPUs)
+	}
+	if c.config.Memory != "" {
+		args = append(args, "--memory", c.config.Memory)
+	}
+	if c.config.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(c.config.PidsLimit))
+	}
+	if c.config.Network != "" {
+		args = append(args, "--network", c.config.Network)
+	}
+	for _, env := range containerEnvVars {
+		args = append(args, "--env", env)
+	}
+	// not -v, go-ansible drops it from quiet commands as a verbosity flag
+	for _, mount := range c.mounts {
+		args = append(args, "--volume", mount)
+	}
+	args = append(args, c.config.ExtraArgs...)
+	args = append(args, c.image)
+	return append(args, command...), nil
+}
+
+func (c *containerCmd) String() string {
+	command, err := c.Command()
+	if err != nil {
+		return c.cmd.String()
+	}
+	return strings.Join(command, " ")
+}
+
+// newTaskCommand wraps cmd, an ansible command run for task, for the
+// configured executor. The returned func
+// must be called once the run is over, it removes a container left behind
+// by a cancelled run.
+func newTaskCommand(task *Task, cmd execute.Commander, options *playbook.AnsiblePlaybookOptions) (execute.Commander, func()) {
+	e := &config.Executor
+	if e.Type != EXECUTOR_CONTAINER {
+		return cmd, func() {}
+	}
+
+	taskDir := filepath.Join(rootDir, task.TaskID)
+	mounts := []string{taskDir + ":" + taskDir}
+	readOnly := func(path string) {
+		if path != "" {
+			mounts = append(mounts, path+":"+path+":ro")
+		}
+	}
+	if keyFile, ok := options.ExtraVars["ansible_ssh_private_key_file"].(string); ok {
+		readOnly(keyFile)
+	}
+	readOnly(options.VaultPasswordFile)
+	if task.hostKeyChecking == HOST_KEY_ACCEPT_NEW || task.hostKeyChecking == HOST_KEY_STRICT {
+		// accept-new writes to it
+		if err := ensureKnownHostsFile(); err != nil {
+			taskLogger("worker", task.TaskID).Error("failed to create known hosts", "error", err)
+		}
+		mounts = append(mounts, knownHostsFile()+":"+knownHostsFile())
+	}
+	files, _ := vaultIDFiles(task)
+	for _, file := range files {
+		readOnly(file)
+	}
+	if config.TaskPaths {
+		readOnly(taskPathsPluginDir())
+	}
+	if task.RequirementsFile != "" && galaxyCache == GALAXY_CACHE_SHARED {
+		dir := galaxyDir(task)
+		os.MkdirAll(dir, 0755)
+		mounts = append(mounts, dir+":"+dir)
+	}
+
+	image := e.Image
+	if task.Image != "" {
+		image = task.Image
+	}
+	c := &containerCmd{cmd: cmd, name: "ansible-" + task.TaskID, image: image, mounts: mounts, config: e}
+	return c, func() {
+		// killing the runtime client on cancel doesn't stop the container
+		exec.Command(e.Runtime, "rm", "-f", c.name).Run()
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+)
+
+var exitCodeMessages = map[int]string{
+	0: "ok",
+	playbook.AnsiblePlaybookErrorCodeGeneralError:             playbook.AnsiblePlaybookErrorMessageGeneralError,
+	playbook.AnsiblePlaybookErrorCodeOneOrMoreHostFailed:      playbook.AnsiblePlaybookErrorMessageOneOrMoreHostFailed,
+	playbook.AnsiblePlaybookErrorCodeOneOrMoreHostUnreachable: playbook.AnsiblePlaybookErrorMessageOneOrMoreHostUnreachable,
+	playbook.AnsiblePlaybookErrorCodeParserError:              playbook.AnsiblePlaybookErrorMessageParserError,
+	playbook.AnsiblePlaybookErrorCodeBadOrIncompleteOptions:   playbook.AnsiblePlaybookErrorMessageBadOrIncompleteOptions,
+	playbook.AnsiblePlaybookErrorCodeUserInterruptedExecution: playbook.AnsiblePlaybookErrorMessageUserInterruptedExecution,
+	playbook.AnsiblePlaybookErrorCodeUnexpectedError:          playbook.AnsiblePlaybookErrorMessageUnexpectedError,
+}
+
+// exitCodeText is the human label of an ansible-playbook exit code, empty
+// when the task didn't exit on its own.
+func exitCodeText(code *int) string {
+	if code == nil {
+		return ""
+	}
+	if msg, ok := exitCodeMessages[*code]; ok {
+		return strings.TrimPrefix(msg, "ansible-playbook error: ")
+	}
+	return "unknown"
+}
+
+// exitCodeRecorder keeps the exit code of the command before the error is
+// enriched, which drops it.
+type exitCodeRecorder struct {
+	code *int
+}
+
+func (r *exitCodeRecorder) Enrich(err error) error {
+	if e, ok := err.(interface{ ExitCode() int }); ok {
+		code := e.ExitCode()
+		r.code = &code
+	}
+	return playbook.NewAnsiblePlaybookErrorEnrich().Enrich(err)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+func statusText(status uint) string {
+	switch status {
+	case STATUS_WAITING:
+		return "Waiting"
+	case STATUS_RUNNING:
+		return "Running"
+	case STATUS_SUCCEEDED:
+		return "Succeeded"
+	case STATUS_ERROR:
+		return "Error"
+	case STATUS_NO_HOSTS:
+		return "No hosts matched"
+	case STATUS_INTERRUPTED:
+		return "Interrupted"
+	case STATUS_CANCELLED:
+		return "Cancelled"
+	case STATUS_EXPIRED:
+		return "Expired"
+	case STATUS_TIMED_OUT:
+		return "Timed out"
+	default:
+		return "Unknown"
+	}
+}
+
+// statusTexts lists the status texts indexed by status.
+func statusTexts() []string {
+	var texts []string
+	for status := STATUS_WAITING; status <= STATUS_TIMED_OUT; status++ {
+		texts = append(texts, statusText(status))
+	}
+	return texts
+}
+
+// parseStatuses reads a comma separated list of statuses, by number or by
+// status text.
+func parseStatuses(list string) ([]uint, error) {
+	var statuses []uint
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		found := false
+		for status, text := range statusTexts() {
+			if item == strconv.Itoa(status) || strings.EqualFold(item, text) {
+				statuses = append(statuses, uint(status))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown status %q", item)
+		}
+	}
+	return statuses, nil
+}
+
+// parseQueryTime reads a date like 2006-01-02 or an RFC 3339 time. With
+// end set a date means the end of that day, so that ranges include it.
+func parseQueryTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use 2006-01-02 or RFC 3339", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// likePattern matches s anywhere, with the LIKE wildcards in s escaped by
+// '!' which, unlike a backslash, means the same to every database.
+func likePattern(s string) string {
+	s = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+	return "%" + s + "%"
+}
+
+// hasTaskFilter reports whether the query string of c sets one of the
+// taskFilters, paging and other params don't filter the tasks.
+func hasTaskFilter(c *gin.Context) bool {
+	for _, p := range taskFilters {
+		if strings.TrimSpace(c.Query(p.Name)) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTasks applies the task list filters taken from the query string,
+// shared by the index page and the exports so they always agree. Only the
+// tasks of the teams of the user are kept. A bad filter is added to the
+// errors of tx.
+func filterTasks(c *gin.Context, tx *gorm.DB) *gorm.DB {
+	tx = tx.Scopes(inTeams(c, "tasks.team_id"))
+	if status := c.Query("status"); status != "" {
+		statuses, err := parseStatuses(status)
+		if err != nil {
+			tx.AddError(withStatus(http.StatusBadRequest, err))
+			return tx
+		}
+		tx = tx.Where("tasks.status IN ?", statuses)
+	}
+	if name := c.Query("name"); name != "" {
+		tx = tx.Where("tasks.name LIKE ?", "%"+name+"%")
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likePattern(q)
+		tx = tx.Where("tasks.name LIKE ? ESCAPE '!' OR tasks.task_id LIKE ? ESCAPE '!' OR tasks.error LIKE ? ESCAPE '!' OR "+
+			"tasks.playbook_id IN (SELECT id FROM playbooks WHERE name LIKE ? ESCAPE '!')",
+			pattern, pattern, pattern, pattern)
+	}
+	if rerunOf := c.Query("rerun_of"); rerunOf != "" {
+		tx = tx.Where("tasks.rerun_of = ?", rerunOf)
+	}
+	if creator := c.Query("creator"); creator != "" {
+		tx = tx.Where("tasks.user_id IN (SELECT id FROM users WHERE name = ?)", creator)
+	}
+	// from and to bound the creation time, to is exclusive for times
+	if from := c.Query("from"); from != "" {
+		t, err := parseQueryTime(from, false)
+		if err != nil {
+			tx.AddError(withStatus(http.StatusBadRequest, err))
+			return tx
+		}
+		tx = tx.Where("tasks.created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseQueryTime(to, true)
+		if err != nil {
+			tx.AddError(withStatus(http.StatusBadRequest, err))
+			return tx
+		}
+		tx = tx.Where("tasks.created_at < ?", t)
+	}
+	return tx
+}
+
+func exportTasks(c *gin.Context) {
+	rows, err := filterTasks(c, db.Model(&Task{})).
+		Select("tasks.task_id, tasks.name, tasks.status, playbooks.creator, tasks.created_at, " +
+			"tasks.started_at, tasks.finished_at, tasks.host_count, tasks.failed_hosts, tasks.unreachable_hosts").
+		Joins("LEFT JOIN playbooks ON playbooks.id = tasks.playbook_id").
+		Order("tasks.id desc").
+		Rows()
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("tasks-%s.csv", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"task_id", "name", "status", "creator", "created_at", "duration",
+		"hosts", "failed_hosts", "unreachable_hosts"})
+
+	for rows.Next() {
+		var (
+			taskID, name                   string
+			status                         uint
+			creator                        sql.NullString
+			createdAt, startedAt, finishAt sql.NullTime
+			hosts, failed, unreachable     sql.NullInt64
+		)
+		if err := rows.Scan(&taskID, &name, &status, &creator, &createdAt,
+			&startedAt, &finishAt, &hosts, &failed, &unreachable); err != nil {
+			requestLogger(c).Error("failed to export tasks", "error", err)
+			break
+		}
+
+		var created, duration string
+		if createdAt.Valid && !createdAt.Time.IsZero() {
+			created = createdAt.Time.Format(time.RFC3339)
+		}
+		if startedAt.Valid && finishAt.Valid && !startedAt.Time.IsZero() && finishAt.Time.After(startedAt.Time) {
+			duration = finishAt.Time.Sub(startedAt.Time).Round(time.Second).String()
+		}
+
+		w.Write([]string{taskID, name, statusText(status), creator.String, created, duration,
+			strconv.FormatInt(hosts.Int64, 10), strconv.FormatInt(failed.Int64, 10),
+			strconv.FormatInt(unreachable.Int64, 10)})
+		w.Flush()
+	}
+	w.Flush()
+}
+
+// hostDurations is how long each host took, from the start of the first
+// task it has a result for to the end of the last. The json callback has
+// no times per host.
+func hostDurations(res *results.AnsiblePlaybookJSONResults) map[string]time.Duration {
+	first, last := map[string]time.Time{}, map[string]time.Time{}
+	for _, play := range res.Plays {
+		for _, task := range play.Tasks {
+			if task.Task == nil || task.Task.Duration == nil {
+				continue
+			}
+			start, err1 := time.Parse(time.RFC3339Nano, task.Task.Duration.Start)
+			end, err2 := time.Parse(time.RFC3339Nano, task.Task.Duration.End)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			for host := range task.Hosts {
+				if t, ok := first[host]; !ok || start.Before(t) {
+					first[host] = start
+				}
+				if end.After(last[host]) {
+					last[host] = end
+				}
+			}
+		}
+	}
+	durations := map[string]time.Duration{}
+	for host, start := range first {
+		if last[host].After(start) {
+			durations[host] = last[host].Sub(start)
+		}
+	}
+	return durations
+}
+
+// showResultCSV writes the recap of a run, a row per host.
+func showResultCSV(c *gin.Context, taskId string, res *results.AnsiblePlaybookJSONResults) {
+	summary := summarizeResults(res, nil)
+	durations := hostDurations(res)
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "result-"+taskId+".csv"))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"host", "ok", "changed", "failed", "skipped", "unreachable", "rescued", "ignored", "duration"})
+	for _, s := range summary.Stats {
+		var duration string
+		if d, ok := durations[s.Host]; ok {
+			duration = d.Round(time.Second).String()
+		}
+		w.Write([]string{s.Host, strconv.Itoa(s.Ok), strconv.Itoa(s.Changed), strconv.Itoa(s.Failed),
+			strconv.Itoa(s.Skipped), strconv.Itoa(s.Unreachable), strconv.Itoa(s.Rescued),
+			strconv.Itoa(s.Ignored), duration})
+	}
+	w.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+// FACTS_MODULE is the module of a gather facts task
+const FACTS_MODULE = "ansible.builtin.setup"
+
+// HostFacts are the facts the last gather facts task of a team found on a
+// host. The columns besides Facts are copied out of them to search by.
+type HostFacts struct {
+	ID           uint   `json:"id" gorm:"primarykey"`
+	TeamID       uint   `json:"team_id" gorm:"column:team_id;uniqueIndex:idx_host_facts_team_host"`
+	Host         string `json:"host" gorm:"column:host;uniqueIndex:idx_host_facts_team_host"`
+	TaskID       string `json:"task_id" gorm:"column:task_id"`
+	Hostname     string `json:"hostname" gorm:"column:hostname"`
+	OS           string `json:"os" gorm:"column:os;index"`
+	Kernel       string `json:"kernel" gorm:"column:kernel"`
+	Architecture string `json:"architecture" gorm:"column:architecture"`
+	// IPv4 are all IPv4 addresses of the host, comma separated
+	IPv4       string                 `json:"ipv4" gorm:"column:ipv4"`
+	Facts      map[string]interface{} `json:"facts,omitempty" gorm:"column:facts;serializer:json"`
+	GatheredAt time.Time              `json:"gathered_at" gorm:"column:gathered_at"`
+}
+
+var errFactsNotFound = withStatus(http.StatusNotFound, errors.New("facts not found"))
+
+// isFactsModule tells the setup module under its short or full name.
+func isFactsModule(module string) bool {
+	return module == FACTS_MODULE || module == "setup"
+}
+
+// checkGatherFacts makes req a gather facts task, an ad-hoc run of the setup
+// module. Module args like filter=ansible_distribution* stay.
+func checkGatherFacts(req *TaskRequest) error {
+	if req.Module != "" && !isFactsModule(req.Module) {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("a gather facts task runs %s, not %s", FACTS_MODULE, req.Module))
+	}
+	req.Module = FACTS_MODULE
+	return nil
+}
+
+func factString(facts map[string]interface{}, names ...string) string {
+	var parts []string
+	for _, name := range names {
+		if v, ok := facts[name].(string); ok && v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func newHostFacts(task *Task, host string, facts map[string]interface{}) HostFacts {
+	var ips []string
+	if addrs, ok := facts["ansible_all_ipv4_addresses"].([]interface{}); ok {
+		for _, addr := range addrs {
+			if s, ok := addr.(string); ok {
+				ips = append(ips, s)
+			}
+		}
+	}
+	hostname := factString(facts, "ansible_fqdn")
+	if hostname == "" {
+		hostname = factString(facts, "ansible_hostname")
+	}
+	return HostFacts{
+		TeamID:       task.TeamID,
+		Host:         host,
+		TaskID:       task.TaskID,
+		Hostname:     hostname,
+		OS:           factString(facts, "ansible_distribution", "ansible_distribution_version"),
+		Kernel:       factString(facts, "ansible_kernel"),
+		Architecture: factString(facts, "ansible_architecture"),
+		IPv4:         strings.Join(ips, ","),
+		Facts:        facts,
+		GatheredAt:   time.Now(),
+	}
+}
+
+// storeTaskFacts keeps the facts of the hosts a gather facts task reached,
+// in place of those of earlier ones.
+func storeTaskFacts(task *Task, res *results.AnsiblePlaybookJSONResults) error {
+	var rows []HostFacts
+	for _, play := range res.Plays {
+		for _, t := range play.Tasks {
+			for host, item := range t.Hosts {
+				if item.Failed || item.Unreachable || len(item.AnsibleFacts) == 0 {
+					continue
+				}
+				rows = append(rows, newHostFacts(task, host, item.AnsibleFacts))
+			}
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "team_id"}, {Name: "host"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"task_id", "hostname", "os", "kernel", "architecture", "ipv4", "facts", "gathered_at",
+		}),
+	}).CreateInBatches(rows, HOST_REGISTER_BATCH).Error
+}
+
+// factsQuery filters the facts a user sees by host, os, kernel, an IPv4
+// address or q, which also matches the architecture.
+func factsQuery(c *gin.Context) *gorm.DB {
+	query := db.Model(&HostFacts{}).Scopes(inTeams(c, "host_facts.team_id"))
+	if host := strings.TrimSpace(c.Query("host")); host != "" {
+		pattern := likePattern(host)
+		query = query.Where("host LIKE ? ESCAPE '!' OR hostname LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+	if os := strings.TrimSpace(c.Query("os")); os != "" {
+		query = query.Where("os LIKE ? ESCAPE '!'", likePattern(os))
+	}
+	if kernel := strings.TrimSpace(c.Query("kernel")); kernel != "" {
+		query = query.Where("kernel LIKE ? ESCAPE '!'", likePattern(kernel))
+	}
+	if ip := strings.TrimSpace(c.Query("ip")); ip != "" {
+		// a whole address of the list, 10.0.0.1 isn't 10.0.0.12
+		escaped := strings.Trim(likePattern(ip), "%")
+		query = query.Where("ipv4 = ? OR ipv4 LIKE ? ESCAPE '!' OR ipv4 LIKE ? ESCAPE '!' OR ipv4 LIKE ? ESCAPE '!'",
+			ip, escaped+",%", "%,"+escaped, "%,"+escaped+",%")
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likePattern(q)
+		query = query.Where("host LIKE ? ESCAPE '!' OR hostname LIKE ? ESCAPE '!' OR os LIKE ? ESCAPE '!' OR kernel LIKE ? ESCAPE '!' "+
+			"OR architecture LIKE ? ESCAPE '!' OR ipv4 LIKE ? ESCAPE '!'", pattern, pattern, pattern, pattern, pattern, pattern)
+	}
+	return query
+}
+
+// apiListFacts lists the facts of hosts without the facts themselves, show
+// a host for those.
+func apiListFacts(c *gin.Context) {
+	var facts []HostFacts
+	page, err := listPage(c, factsQuery(c).Omit("facts"), &facts)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// apiShowFacts shows all facts of a host, or only those named by the fact
+// query params, like fact=ansible_memtotal_mb.
+func apiShowFacts(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		apiError(c, errFactsNotFound)
+		return
+	}
+	var facts HostFacts
+	if err := db.Limit(1).Find(&facts, id).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if facts.ID == 0 {
+		apiError(c, errFactsNotFound)
+		return
+	}
+	if names := c.QueryArray("fact"); len(names) > 0 {
+		picked := map[string]interface{}{}
+		for _, name := range names {
+			if v, ok := facts.Facts[name]; ok {
+				picked[name] = v
+			}
+		}
+		facts.Facts = picked
+	}
+	c.IndentedJSON(http.StatusOK, facts)
+}
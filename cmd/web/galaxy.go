@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+	collection "github.com/apenella/go-ansible/v2/pkg/galaxy/collection/install"
+	role "github.com/apenella/go-ansible/v2/pkg/galaxy/role/install"
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	GALAXY_CACHE_TASK   = "task"
+	GALAXY_CACHE_SHARED = "shared"
+	REQUIREMENTS_FILE   = "requirements.yml"
+	GALAXY_TIMEOUT      = 10 * time.Minute
+	// galaxyInstalled marks a task cache whose requirements are installed
+	galaxyInstalled = ".installed"
+)
+
+// where a project keeps its requirements, the first one found is used
+var projectRequirementsFiles = []string{
+	REQUIREMENTS_FILE,
+	"collections/" + REQUIREMENTS_FILE,
+	"roles/" + REQUIREMENTS_FILE,
+}
+
+var (
+	// galaxyCache is task to install the requirements of a task into its
+	// own directory, or shared to install them once for all tasks
+	galaxyCache string
+	// galaxyLock serializes the installs into the shared cache, it is a
+	// channel so that waiting for it can be given up
+	galaxyLock = make(chan struct{}, 1)
+)
+
+func checkGalaxyCache() error {
+	switch galaxyCache {
+	case GALAXY_CACHE_TASK, GALAXY_CACHE_SHARED:
+		return nil
+	}
+	return fmt.Errorf("unknown galaxy cache %q, use %s or %s", galaxyCache, GALAXY_CACHE_TASK, GALAXY_CACHE_SHARED)
+}
+
+// galaxyDir is where the collections and roles of task are installed.
+func galaxyDir(task *Task) string {
+	if galaxyCache == GALAXY_CACHE_SHARED {
+		return filepath.Join(rootDir, ".galaxy")
+	}
+	return filepath.Join(rootDir, task.TaskID, ".galaxy")
+}
+
+// requirementsKinds tells what a requirements file installs: a list is the
+// old format with roles only, a mapping has collections and roles keys.
+func requirementsKinds(content string) (collections, roles bool, err error) {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(content), &v); err != nil {
+		return false, false, fmt.Errorf("invalid requirements: %v", err)
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		return false, len(v) > 0, nil
+	case map[string]interface{}:
+		_, collections = v["collections"]
+		_, roles = v["roles"]
+		if !collections && !roles {
+			return false, false, errors.New("invalid requirements: expected collections or roles")
+		}
+		return collections, roles, nil
+	}
+	return false, false, errors.New("invalid requirements: expected a list of roles or a mapping")
+}
+
+// findProjectRequirements returns the requirements file of the project
+// checked out in dir, or "" if it has none.
+func findProjectRequirements(dir string) string {
+	for _, name := range projectRequirementsFiles {
+		path := filepath.Join(dir, name)
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// galaxyEnv points ansible at the installed requirements, ahead of its
+// default paths where the stdout callback collection lives.
+func galaxyEnv(task *Task) map[string]string {
+	if task.RequirementsFile == "" {
+		return nil
+	}
+	dir := galaxyDir(task)
+	return map[string]string{
+		"ANSIBLE_COLLECTIONS_PATH": filepath.Join(dir, "collections") + ":~/.ansible/collections:/usr/share/ansible/collections",
+		"ANSIBLE_ROLES_PATH":       filepath.Join(dir, "roles") + ":~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles",
+	}
+}
+
+// installRequirements runs ansible-galaxy for the requirements of task. A
+// task cache is only filled once, the shared cache is brought up to date
+// for every run. The output is kept in galaxy.log of the task.
+func installRequirements(ctx context.Context, task *Task, options *playbook.AnsiblePlaybookOptions) error {
+	if task.RequirementsFile == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, GALAXY_TIMEOUT)
+	defer cancel()
+	dir := galaxyDir(task)
+	if galaxyCache == GALAXY_CACHE_SHARED {
+		select {
+		case galaxyLock <- struct{}{}:
+			defer func() { <-galaxyLock }()
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for another install into the shared cache: %v", ctx.Err())
+		}
+	} else if _, err := os.Stat(filepath.Join(dir, galaxyInstalled)); err == nil {
+		return nil
+	}
+
+	content, err := readFile(task.RequirementsFile)
+	if err != nil {
+		return err
+	}
+	collections, roles, err := requirementsKinds(content)
+	if err != nil {
+		return err
+	}
+	var cmds []execute.Commander
+	if collections {
+		cmds = append(cmds, collection.NewAnsibleGalaxyCollectionInstallCmd(
+			collection.WithGalaxyCollectionInstallOptions(&collection.AnsibleGalaxyCollectionInstallOptions{
+				RequirementsFile: task.RequirementsFile,
+				CollectionsPath:  filepath.Join(dir, "collections"),
+			}),
+		))
+	}
+	if roles {
+		cmds = append(cmds, role.NewAnsibleGalaxyRoleInstallCmd(
+			role.WithGalaxyRoleInstallOptions(&role.AnsibleGalaxyRoleInstallOptions{
+				RoleFile:  task.RequirementsFile,
+				RolesPath: filepath.Join(dir, "roles"),
+			}),
+		))
+	}
+
+	var out bytes.Buffer
+	defer func() {
+		if err := os.WriteFile(filepath.Join(rootDir, task.TaskID, "galaxy.log"), out.Bytes(), 0644); err != nil {
+			taskLogger("galaxy", task.TaskID).Error("failed to write galaxy log", "error", err)
+		}
+	}()
+	for _, cmd := range cmds {
+		taskCmd, cleanup := newTaskCommand(task, cmd, options)
+		taskLogger("galaxy", task.TaskID).Info("install requirements", "command", commandLine(taskCmd))
+		err := execute.NewDefaultExecute(
+			execute.WithCmd(taskCmd),
+			execute.WithWrite(&out),
+			execute.WithWriteError(&out),
+		).Execute(ctx)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to install requirements: %s", lastLines(out.String(), 5))
+		}
+	}
+	if galaxyCache == GALAXY_CACHE_TASK {
+		return writeFile(filepath.Join(dir, galaxyInstalled), "")
+	}
+	return nil
+}
+
+// lastLines returns the last n lines of out, where ansible-galaxy reports
+// what went wrong.
+func lastLines(out string, n int) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
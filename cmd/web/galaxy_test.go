@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstallRequirementsGivesUpWaiting(t *testing.T) {
+	old := galaxyCache
+	galaxyCache = GALAXY_CACHE_SHARED
+	t.Cleanup(func() { galaxyCache = old })
+	// another install holds the shared cache
+	galaxyLock <- struct{}{}
+	defer func() { <-galaxyLock }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	task := &Task{TaskID: "t1", RequirementsFile: "requirements.yml"}
+	start := time.Now()
+	err := installRequirements(ctx, task, nil)
+	if err == nil || !strings.Contains(err.Error(), "waiting for another install") {
+		t.Fatalf("got %v, want to stop waiting for the shared cache", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("waited %v", time.Since(start))
+	}
+}
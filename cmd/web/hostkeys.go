@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// host key checking policies
+const (
+	// HOST_KEY_OFF trusts any host key, the default
+	HOST_KEY_OFF = "off"
+	// HOST_KEY_ACCEPT_NEW adds the keys of new hosts to the known hosts
+	// file and refuses hosts whose key changed
+	HOST_KEY_ACCEPT_NEW = "accept-new"
+	// HOST_KEY_STRICT only connects to the hosts of the known hosts file
+	HOST_KEY_STRICT = "strict"
+)
+
+// MAX_KNOWN_HOSTS caps the known hosts file uploaded through the API
+const MAX_KNOWN_HOSTS = 4 << 20
+
+// knownHostsMu keeps a replaced known hosts file whole while it is written
+var knownHostsMu sync.Mutex
+
+func checkHostKeyChecking(policy string) error {
+	switch policy {
+	case "", HOST_KEY_OFF, HOST_KEY_ACCEPT_NEW, HOST_KEY_STRICT:
+		return nil
+	}
+	return fmt.Errorf("host key checking must be %s, %s or %s, not %q", HOST_KEY_OFF, HOST_KEY_ACCEPT_NEW, HOST_KEY_STRICT, policy)
+}
+
+// knownHostsFile is the managed known hosts file all runs share.
+func knownHostsFile() string {
+	if config.KnownHostsFile != "" {
+		return config.KnownHostsFile
+	}
+	return filepath.Join(rootDir, "known_hosts")
+}
+
+// hostKeyArgs are the ssh args of policy. They go after the ssh_common_args
+// of the environment, ssh keeps the first value of an option.
+func hostKeyArgs(policy string) string {
+	switch policy {
+	case HOST_KEY_ACCEPT_NEW:
+		return "-o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=" + knownHostsFile()
+	case HOST_KEY_STRICT:
+		return "-o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + knownHostsFile()
+	}
+	return "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+}
+
+// hostKeyEnv tells ansible the policy as well, it checks the key itself
+// before it hands a password to sshpass.
+func hostKeyEnv(task *Task) map[string]string {
+	if task.hostKeyChecking == "" || task.hostKeyChecking == HOST_KEY_OFF {
+		return map[string]string{"ANSIBLE_HOST_KEY_CHECKING": "False"}
+	}
+	return map[string]string{"ANSIBLE_HOST_KEY_CHECKING": "True"}
+}
+
+// ensureKnownHostsFile creates an empty known hosts file, a container
+// runtime would make a dir of a missing mount.
+func ensureKnownHostsFile() error {
+	f, err := os.OpenFile(knownHostsFile(), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func apiShowKnownHosts(c *gin.Context) {
+	content, err := os.ReadFile(knownHostsFile())
+	if err != nil && !os.IsNotExist(err) {
+		apiError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", content)
+}
+
+// apiUpdateKnownHosts replaces the known hosts file with the body, the
+// lines of ssh-keyscan or of another known_hosts.
+func apiUpdateKnownHosts(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, MAX_KNOWN_HOSTS+1))
+	if err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if len(body) > MAX_KNOWN_HOSTS {
+		apiError(c, withStatus(http.StatusRequestEntityTooLarge, fmt.Errorf("known hosts are larger than %d bytes", MAX_KNOWN_HOSTS)))
+		return
+	}
+	content := strings.ReplaceAll(string(body), "\r", "")
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// hosts, key type and key, @cert-authority and @revoked lines have
+		// their marker first
+		fields := strings.Fields(line)
+		if strings.HasPrefix(fields[0], "@") {
+			fields = fields[1:]
+		}
+		if len(fields) < 3 {
+			apiError(c, withStatus(http.StatusBadRequest, fmt.Errorf("line %d is not a known hosts line", i+1)))
+			return
+		}
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	path := knownHostsFile()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".known_hosts-*")
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	_, err = tmp.WriteString(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		apiError(c, fmt.Errorf("failed to write known hosts: %v", err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
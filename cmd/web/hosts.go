@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// the reachability of a host
+const (
+	REACHABILITY_UNKNOWN = "unknown"
+	REACHABILITY_OK      = "reachable"
+	REACHABILITY_FAILED  = "unreachable"
+)
+
+const (
+	DEFAULT_SSH_PORT = 22
+	// HOST_CHECK_TIMEOUT bounds connecting to a host and reading its banner
+	HOST_CHECK_TIMEOUT = 5 * time.Second
+	// HOST_CHECK_CONCURRENCY is how many hosts a round checks at once
+	HOST_CHECK_CONCURRENCY = 16
+	// HOST_REGISTER_BATCH is how many hosts of an inventory go in one insert
+	HOST_REGISTER_BATCH = 500
+)
+
+var hostCheckInterval time.Duration
+
+// Host is a host of the inventories of a team with how its SSH port last
+// answered the server.
+type Host struct {
+	ID     uint   `json:"id" gorm:"primarykey"`
+	TeamID uint   `json:"team_id" gorm:"column:team_id;uniqueIndex:idx_hosts_team_name"`
+	Name   string `json:"name" gorm:"column:name;uniqueIndex:idx_hosts_team_name"`
+	// Address and Port are where the host is checked, the ansible_host and
+	// ansible_port of the inventory or else the name and port 22
+	Address   string    `json:"address" gorm:"column:address"`
+	Port      int       `json:"port" gorm:"column:port"`
+	Status    string    `json:"status" gorm:"column:status;index"`
+	Error     string    `json:"error" gorm:"column:error"`
+	CheckedAt time.Time `json:"checked_at" gorm:"column:checked_at"`
+	// LastSeenAt is when a task last had the host in its inventory
+	LastSeenAt time.Time `json:"last_seen_at" gorm:"column:last_seen_at"`
+	CreatedAt  time.Time `json:"created_at" gorm:"column:created_at"`
+}
+
+// HostRequest changes where a host is checked.
+type HostRequest struct {
+	Address *string `json:"address"`
+	Port    *int    `json:"port"`
+}
+
+var errHostNotFound = withStatus(http.StatusNotFound, errors.New("host not found"))
+
+// hostAddress is the ansible_host and ansible_port an inventory sets.
+type hostAddress struct {
+	Address string
+	Port    int
+}
+
+// inventoryHostAddresses finds the host vars of the lines of an INI
+// inventory that tell where to connect.
+func inventoryHostAddresses(content string) map[string]hostAddress {
+	addrs := map[string]hostAddress{}
+	section := ""
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r", ""), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		// the vars, children and comments aren't hosts
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.Contains(section, ":") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var addr hostAddress
+		for _, field := range fields[1:] {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v = strings.Trim(v, `"'`)
+			switch k {
+			case "ansible_host":
+				addr.Address = v
+			case "ansible_port":
+				addr.Port, _ = strconv.Atoi(v)
+			}
+		}
+		if addr == (hostAddress{}) {
+			continue
+		}
+		names, err := expandHostRange(fields[0], MAX_INVENTORY_HOSTS)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			addrs[name] = addr
+		}
+	}
+	return addrs
+}
+
+// specHostAddresses is inventoryHostAddresses for a structured inventory.
+func specHostAddresses(spec *InventorySpec) map[string]hostAddress {
+	addrs := map[string]hostAddress{}
+	for pattern, vars := range spec.HostVars {
+		var addr hostAddress
+		if v, ok := vars["ansible_host"].(string); ok {
+			addr.Address = v
+		}
+		switch v := vars["ansible_port"].(type) {
+		case int:
+			addr.Port = v
+		case float64:
+			addr.Port = int(v)
+		case string:
+			addr.Port, _ = strconv.Atoi(v)
+		}
+		if addr == (hostAddress{}) {
+			continue
+		}
+		names, err := expandHostRange(pattern, MAX_INVENTORY_HOSTS)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			addrs[name] = addr
+		}
+	}
+	return addrs
+}
+
+// registerHosts adds the hosts of an inventory of team to the registry, or
+// marks them seen. An address the inventory sets replaces the known one.
+func registerHosts(teamID uint, names []string, addrs map[string]hostAddress) error {
+	now := time.Now()
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		host := Host{TeamID: teamID, Name: name, Status: REACHABILITY_UNKNOWN, LastSeenAt: now}
+		if addr, ok := addrs[name]; ok {
+			host.Address, host.Port = addr.Address, addr.Port
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var plain, addressed []Host
+		for _, host := range hosts {
+			if host.Address == "" && host.Port == 0 {
+				plain = append(plain, host)
+			} else {
+				addressed = append(addressed, host)
+			}
+		}
+		columns := []clause.Column{{Name: "team_id"}, {Name: "name"}}
+		if len(plain) > 0 {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   columns,
+				DoUpdates: clause.AssignmentColumns([]string{"last_seen_at"}),
+			}).CreateInBatches(plain, HOST_REGISTER_BATCH).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(addressed) > 0 {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   columns,
+				DoUpdates: clause.AssignmentColumns([]string{"address", "port", "last_seen_at"}),
+			}).CreateInBatches(addressed, HOST_REGISTER_BATCH).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// registerTaskHosts registers the hosts of the inventory of task. The
+// registry is only informative, a failure is logged.
+func registerTaskHosts(task *Task) {
+	names, err := taskInventoryHosts(task)
+	if err != nil {
+		taskLogger("hosts", task.TaskID).Warn("failed to read the inventory hosts", "error", err)
+		return
+	}
+	addrs := map[string]hostAddress{}
+	if spec, err := readInventorySpec(task); err == nil && spec != nil {
+		addrs = specHostAddresses(spec)
+	} else if !isDynamicInventory(task.Inventory.Path) {
+		if content, err := readFile(task.Inventory.Path); err == nil {
+			addrs = inventoryHostAddresses(content)
+		}
+	}
+	if err := registerHosts(task.TeamID, names, addrs); err != nil {
+		taskLogger("hosts", task.TaskID).Warn("failed to register hosts", "error", err)
+	}
+}
+
+// checkHost connects to the SSH port of host and expects the banner of an
+// SSH server.
+func checkHost(host *Host) error {
+	address := host.Address
+	if address == "" {
+		address = host.Name
+	}
+	port := host.Port
+	if port == 0 {
+		port = DEFAULT_SSH_PORT
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(port)), HOST_CHECK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(HOST_CHECK_TIMEOUT))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && banner == "" {
+		return fmt.Errorf("no SSH banner: %v", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return errors.New("no SSH server on the port")
+	}
+	return nil
+}
+
+// updateHostCheck checks host and stores the outcome.
+func updateHostCheck(host *Host) error {
+	host.Status, host.Error = REACHABILITY_OK, ""
+	if err := checkHost(host); err != nil {
+		host.Status, host.Error = REACHABILITY_FAILED, err.Error()
+	}
+	host.CheckedAt = time.Now()
+	return db.Model(host).Select("status", "error", "checked_at").Updates(host).Error
+}
+
+// checkHosts checks all registered hosts, a few at a time.
+func checkHosts() {
+	var hosts []Host
+	if err := db.Order("id").Find(&hosts).Error; err != nil {
+		logger("hosts").Error("failed to list hosts", "error", err)
+		return
+	}
+	sem := make(chan struct{}, HOST_CHECK_CONCURRENCY)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	unreachable := 0
+	for i := range hosts {
+		select {
+		case <-stopChan:
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(host *Host) {
+			defer func() { <-sem; wg.Done() }()
+			if err := updateHostCheck(host); err != nil {
+				logger("hosts").Error("failed to update host", "host", host.Name, "error", err)
+			}
+			if host.Status == REACHABILITY_FAILED {
+				mu.Lock()
+				unreachable++
+				mu.Unlock()
+			}
+		}(&hosts[i])
+	}
+	wg.Wait()
+	if unreachable > 0 {
+		logger("hosts").Warn("hosts are unreachable", "count", unreachable, "checked", len(hosts))
+	}
+}
+
+func startHostChecks() {
+	if hostCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hostCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkHosts()
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func findHost(c *gin.Context) (*Host, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, errHostNotFound
+	}
+	var host Host
+	if err := db.Limit(1).Find(&host, id).Error; err != nil {
+		return nil, err
+	}
+	if host.ID == 0 {
+		return nil, errHostNotFound
+	}
+	return &host, nil
+}
+
+// hostQuery is the hosts a user sees, filtered by status and a name or
+// address.
+func hostQuery(c *gin.Context) *gorm.DB {
+	query := db.Model(&Host{}).Scopes(inTeams(c, "hosts.team_id"))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likePattern(q)
+		query = query.Where("name LIKE ? ESCAPE '!' OR address LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+	return query
+}
+
+func showHosts(c *gin.Context) {
+	var hosts []Host
+	if err := hostQuery(c).Order("status = 'unreachable' desc, name").Limit(MAX_PAGE_SIZE * 10).Find(&hosts).Error; err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	if err := db.Model(&Host{}).Scopes(inTeams(c, "hosts.team_id")).
+		Select("status, count(*) as count").Group("status").Scan(&counts).Error; err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	totals := map[string]int{}
+	for _, count := range counts {
+		totals[count.Status] = count.Count
+	}
+	c.HTML(http.StatusOK, "hosts.html", gin.H{
+		"csrf":     csrfToken(c),
+		"hosts":    hosts,
+		"totals":   totals,
+		"status":   c.Query("status"),
+		"q":        c.Query("q"),
+		"interval": hostCheckInterval,
+		"operator": hasRole(currentUser(c), ROLE_OPERATOR),
+	})
+}
+
+func checkHostNow(c *gin.Context) {
+	host, err := findHost(c)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := updateHostCheck(host); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/hosts")
+}
+
+func apiListHosts(c *gin.Context) {
+	var hosts []Host
+	page, err := listPage(c, hostQuery(c), &hosts)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowHost(c *gin.Context) {
+	host, err := findHost(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, host)
+}
+
+func apiUpdateHost(c *gin.Context) {
+	var req HostRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	host, err := findHost(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if req.Address != nil {
+		host.Address = strings.TrimSpace(*req.Address)
+	}
+	if req.Port != nil {
+		if *req.Port < 0 || *req.Port > 65535 {
+			apiError(c, withStatus(http.StatusBadRequest, errors.New("port must be between 1 and 65535, 0 for 22")))
+			return
+		}
+		host.Port = *req.Port
+	}
+	if err := db.Model(host).Select("address", "port").Updates(host).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, host)
+}
+
+// apiCheckHost checks a host now instead of at the next round.
+func apiCheckHost(c *gin.Context) {
+	host, err := findHost(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := updateHostCheck(host); err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, host)
+}
+
+// apiDeleteHost forgets a host, a task that has it in its inventory adds it
+// again.
+func apiDeleteHost(c *gin.Context) {
+	host, err := findHost(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := db.Delete(host).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
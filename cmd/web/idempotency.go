@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errIdempotencyKeyInProgress = errors.New("a request with this Idempotency-Key is still in progress")
+
+// migrateIdempotencyKeys drops the index that made keys unique across all
+// users, the keys of before belong to no user and expire.
+func migrateIdempotencyKeys() error {
+	const old = "idx_idempotency_keys_idempotency_key"
+	if !db.Migrator().HasIndex(&IdempotencyKey{}, old) {
+		return nil
+	}
+	return db.Migrator().DropIndex(&IdempotencyKey{}, old)
+}
+
+// reserveIdempotencyKey claims key of the user userID for the current
+// request. It returns the task the user previously created with the same
+// key, or nil if the caller now owns the key and should go on creating the
+// task.
+func reserveIdempotencyKey(userID uint, key string) (*Task, error) {
+	now := time.Now()
+	if err := db.Where("expires_at < ?", now).Delete(&IdempotencyKey{}).Error; err != nil {
+		return nil, err
+	}
+
+	record := IdempotencyKey{UserID: userID, Key: key, ExpiresAt: now.Add(idempotencyTTL)}
+	createErr := db.Create(&record).Error
+	if createErr == nil {
+		return nil, nil
+	}
+
+	// the unique index rejected the insert: somebody else holds the key
+	if err := db.First(&record, "user_id = ? AND idempotency_key = ?", userID, key).Error; err != nil {
+		return nil, createErr
+	}
+	if record.TaskID == 0 {
+		return nil, errIdempotencyKeyInProgress
+	}
+
+	var task Task
+	if err := db.First(&task, record.TaskID).Error; err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func completeIdempotencyKey(userID uint, key string, taskID uint) error {
+	return db.Model(&IdempotencyKey{}).Where("user_id = ? AND idempotency_key = ?", userID, key).Update("task_id", taskID).Error
+}
+
+func releaseIdempotencyKey(userID uint, key string) {
+	db.Where("user_id = ? AND idempotency_key = ? AND task_id = 0", userID, key).Delete(&IdempotencyKey{})
+}
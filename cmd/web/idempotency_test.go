@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestIdempotencyKeyReturnsFirstTask(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "admin", ROLE_ADMIN)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+
+	first, created, err := newTaskFromRequest(context.Background(), &req, user, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("first request didn't create a task")
+	}
+	again := req
+	second, created, err := newTaskFromRequest(context.Background(), &again, user, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("duplicate key created a task")
+	}
+	if second.ID != first.ID || second.TaskID != first.TaskID {
+		t.Errorf("duplicate key returned task %s, want %s", second.TaskID, first.TaskID)
+	}
+	var count int64
+	db.Model(&Task{}).Count(&count)
+	if count != 1 {
+		t.Errorf("%d tasks, want 1", count)
+	}
+
+	other := req
+	third, created, err := newTaskFromRequest(context.Background(), &other, user, "key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || third.ID == first.ID {
+		t.Error("another key didn't create a new task")
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "admin", ROLE_ADMIN)
+	if existing, err := reserveIdempotencyKey(user.ID, "busy"); err != nil || existing != nil {
+		t.Fatalf("reserve: %v, %v", existing, err)
+	}
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	_, _, err := newTaskFromRequest(context.Background(), &req, user, "busy")
+	if errorStatus(err) != http.StatusConflict {
+		t.Fatalf("got %v, want a 409 while the key is in progress", err)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "admin", ROLE_ADMIN)
+	bad := TaskRequest{Name: "ping", Inventory: "h1"}
+	if _, _, err := newTaskFromRequest(context.Background(), &bad, user, "retry"); err == nil {
+		t.Fatal("a task without a playbook was created")
+	}
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	if _, created, err := newTaskFromRequest(context.Background(), &req, user, "retry"); err != nil || !created {
+		t.Fatalf("retry after a failure: created %v, %v", created, err)
+	}
+}
+
+func TestIdempotencyKeyPerUser(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice", ROLE_ADMIN)
+	bob := createTestUser(t, "bob", ROLE_ADMIN)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1"}
+	first, _, err := newTaskFromRequest(context.Background(), &req, alice, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same key of another user is another request
+	other := req
+	second, created, err := newTaskFromRequest(context.Background(), &other, bob, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || second.ID == first.ID {
+		t.Fatalf("bob got task %s of alice for the same key", second.TaskID)
+	}
+	again := req
+	if third, created, err := newTaskFromRequest(context.Background(), &again, alice, "deploy"); err != nil || created || third.ID != first.ID {
+		t.Fatalf("alice repeating her key: created %v, %v", created, err)
+	}
+}
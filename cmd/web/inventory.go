@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MAX_INVENTORY_HOSTS bounds the expansion of host ranges like
+// web[0:99999999].
+const MAX_INVENTORY_HOSTS = 100000
+
+// inventoryHosts returns the distinct host names listed in an INI inventory
+// body, with ranges expanded and group headers, comments and host variables
+// skipped.
+func inventoryHosts(content string) ([]string, error) {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r", ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		names, err := expandHostRange(strings.Fields(line)[0], MAX_INVENTORY_HOSTS-len(hosts))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				hosts = append(hosts, name)
+			}
+		}
+		if len(hosts) > MAX_INVENTORY_HOSTS {
+			return nil, errTooManyHosts
+		}
+	}
+	return hosts, nil
+}
+
+var errTooManyHosts = fmt.Errorf("inventory lists more than %d hosts", MAX_INVENTORY_HOSTS)
+
+// expandHostRange expands the numeric and alphabetic ranges of an ansible
+// host pattern, e.g. db-[a:c] or www[01:50:2].example.com, into at most
+// limit names. Brackets that aren't a range are kept as they are.
+func expandHostRange(pattern string, limit int) ([]string, error) {
+	i := strings.Index(pattern, "[")
+	j := strings.Index(pattern, "]")
+	if i < 0 || j < i {
+		return []string{pattern}, nil
+	}
+	head, spec, tail := pattern[:i], pattern[i+1:j], pattern[j+1:]
+
+	parts := strings.Split(spec, ":")
+	step := 1
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 1 {
+			return []string{pattern}, nil
+		}
+		step = n
+	} else if len(parts) != 2 {
+		return []string{pattern}, nil
+	}
+	start, end := parts[0], parts[1]
+
+	var values []string
+	if a, err := strconv.Atoi(start); err == nil {
+		b, err := strconv.Atoi(end)
+		if err != nil || b < a {
+			return []string{pattern}, nil
+		}
+		if (b-a)/step >= limit {
+			return nil, errTooManyHosts
+		}
+		format := "%d"
+		// zero padded ranges keep the width of the start
+		if len(start) > 1 && start[0] == '0' {
+			format = "%0" + strconv.Itoa(len(start)) + "d"
+		}
+		for n := a; n <= b; n += step {
+			values = append(values, fmt.Sprintf(format, n))
+		}
+	} else if len(start) == 1 && len(end) == 1 && start <= end {
+		for c := start[0]; c <= end[0]; c += byte(step) {
+			values = append(values, string(c))
+			if int(c)+step > 255 {
+				break
+			}
+		}
+	} else {
+		return []string{pattern}, nil
+	}
+
+	var names []string
+	for _, v := range values {
+		rest, err := expandHostRange(tail, limit-len(names))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rest {
+			if len(names) >= limit {
+				return nil, errTooManyHosts
+			}
+			names = append(names, head+v+r)
+		}
+	}
+	return names, nil
+}
+
+// INVENTORY_HEADER puts the submitted hosts in the group wrapped playbooks
+// target by default
+const INVENTORY_HEADER = "[servers]\n"
+
+func renderInventory(content string) string {
+	return INVENTORY_HEADER + content
+}
+
+// checkInventory checks the hosts of content against the allowed hosts and
+// the host cap of environment envName. Errors carry an HTTP status.
+func checkInventory(content string, envName string, user *User) error {
+	hosts, err := inventoryHosts(content)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	return checkInventoryHosts(hosts, envName, user)
+}
+
+// checkInventorySpec is checkInventory for a structured inventory.
+func checkInventorySpec(spec *InventorySpec, envName string, user *User) error {
+	hosts, err := spec.check()
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	return checkInventoryHosts(hosts, envName, user)
+}
+
+func checkInventoryHosts(hosts []string, envName string, user *User) error {
+	env, ok := config.environment(envName)
+	if !ok {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("unknown environment %q", envName))
+	}
+	for _, host := range hosts {
+		if !env.allowsHost(host) {
+			return withStatus(http.StatusBadRequest,
+				fmt.Errorf("host %q is not allowed in environment %q", host, envName))
+		}
+	}
+	// guards against targeting a whole fleet by accident, admins may exceed it
+	if limit := env.maxHosts(); limit > 0 && len(hosts) > limit && !user.Admin {
+		return withStatus(http.StatusBadRequest,
+			fmt.Errorf("inventory has %d hosts, environment %q allows at most %d", len(hosts), envName, limit))
+	}
+	return nil
+}
+
+var errInventoryLocked = errors.New("inventory is locked")
+
+// lockInventory and unlockInventory toggle Inventory.Locked. Only admins
+// may change a lock, and only admins may remove a locked inventory.
+func lockInventory(c *gin.Context) {
+	setInventoryLocked(c, true)
+}
+
+func unlockInventory(c *gin.Context) {
+	setInventoryLocked(c, false)
+}
+
+func setInventoryLocked(c *gin.Context, locked bool) {
+	if !currentUser(c).Admin {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "only an admin can lock or unlock an inventory"})
+		return
+	}
+	tx := db.Model(&Inventory{}).Where("id = ?", c.Param("id")).Update("locked", locked)
+	if tx.Error != nil {
+		c.AbortWithError(http.StatusBadRequest, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "inventory not found"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
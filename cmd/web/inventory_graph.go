@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/apenella/go-ansible/v2/pkg/inventory"
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+	"github.com/gin-gonic/gin"
+)
+
+// InventoryGraph is an inventory as ansible resolved it, its hosts and the
+// hosts and children of each group. The vars are left out, they may hold
+// secrets.
+type InventoryGraph struct {
+	Hosts  []string                      `json:"hosts"`
+	Groups map[string]InventoryGraphNode `json:"groups"`
+}
+
+type InventoryGraphNode struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+var errInventoryNoHosts = withStatus(http.StatusBadRequest, errors.New("inventory resolves to no hosts"))
+
+// resolveInventory lists the inventory of task with ansible-inventory, the
+// error carries what ansible said about a source it can't parse.
+func resolveInventory(ctx context.Context, task *Task, options *playbook.AnsiblePlaybookOptions) (*InventoryGraph, error) {
+	// ansible-inventory only warns about sources it can't parse
+	cmd := inventory.NewAnsibleInventoryCmd(
+		inventory.WithInventoryOptions(&inventory.AnsibleInventoryOptions{
+			Inventory:         task.Inventory.Path,
+			List:              true,
+			VaultPasswordFile: options.VaultPasswordFile,
+		}),
+	)
+	var list bytes.Buffer
+	out, err := runValidation(ctx, task, cmd, options, map[string]string{
+		"ANSIBLE_INVENTORY_UNPARSED_FAILED":        "true",
+		"ANSIBLE_INVENTORY_ANY_UNPARSED_IS_FAILED": "true",
+	}, &list)
+	if err != nil {
+		return nil, validationError("invalid inventory", out, err)
+	}
+	return parseInventoryList(list.Bytes())
+}
+
+// parseInventoryList reads the output of ansible-inventory --list, where
+// _meta has the vars of the hosts and every other key is a group.
+func parseInventoryList(list []byte) (*InventoryGraph, error) {
+	var groups map[string]json.RawMessage
+	if err := json.Unmarshal(list, &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse the ansible-inventory output: %v", err)
+	}
+	graph := &InventoryGraph{Hosts: []string{}, Groups: map[string]InventoryGraphNode{}}
+	seen := map[string]bool{}
+	for name, raw := range groups {
+		if name == "_meta" {
+			continue
+		}
+		var node InventoryGraphNode
+		if err := json.Unmarshal(raw, &node); err != nil {
+			return nil, fmt.Errorf("failed to parse group %q of the ansible-inventory output: %v", name, err)
+		}
+		sort.Strings(node.Hosts)
+		sort.Strings(node.Children)
+		graph.Groups[name] = node
+		for _, host := range node.Hosts {
+			if !seen[host] {
+				seen[host] = true
+				graph.Hosts = append(graph.Hosts, host)
+			}
+		}
+	}
+	sort.Strings(graph.Hosts)
+	return graph, nil
+}
+
+// checkTaskInventory resolves the inventory of a task about to run, so that
+// one ansible can't parse or that has no hosts stops it from being queued.
+func checkTaskInventory(task *Task) (*InventoryGraph, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), VALIDATE_TIMEOUT)
+	defer cancel()
+	options, err := newPlaybookOptions(task)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	graph, err := resolveInventory(ctx, task, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(graph.Hosts) == 0 {
+		return nil, errInventoryNoHosts
+	}
+	return graph, nil
+}
+
+// apiShowInventoryGraph resolves an inventory, what the hosts and groups of
+// a run are.
+func apiShowInventoryGraph(c *gin.Context) {
+	task, err := fileTask("inventory_id", c.Param("id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), VALIDATE_TIMEOUT)
+	defer cancel()
+	options, err := newPlaybookOptions(task)
+	if err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	graph, err := resolveInventory(ctx, task, options)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, graph)
+}
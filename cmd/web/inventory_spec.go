@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the files of a task with a structured inventory, the spec is kept for
+// editing and ansible reads the rendered YAML
+const (
+	INVENTORY_SPEC_FILE     = "inventory.json"
+	INVENTORY_RENDERED_FILE = "inventory.yaml"
+)
+
+// DEFAULT_PLAY_HOSTS is what a wrapped playbook targets, the group
+// renderInventory puts the hosts in
+const DEFAULT_PLAY_HOSTS = "servers"
+
+// InventorySpec is a structured inventory of groups with their hosts,
+// children and vars, and the vars of hosts. A host only named in HostVars
+// is in no group but all.
+type InventorySpec struct {
+	Groups   map[string]*InventoryGroup        `json:"groups,omitempty" yaml:"groups"`
+	HostVars map[string]map[string]interface{} `json:"host_vars,omitempty" yaml:"host_vars"`
+}
+
+type InventoryGroup struct {
+	Hosts    []string               `json:"hosts,omitempty" yaml:"hosts"`
+	Children []string               `json:"children,omitempty" yaml:"children"`
+	Vars     map[string]interface{} `json:"vars,omitempty" yaml:"vars"`
+}
+
+// ansible warns about and rewrites group names that aren't identifiers
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseInventorySpec reads a spec written as JSON or YAML.
+func parseInventorySpec(content string) (*InventorySpec, error) {
+	var spec InventorySpec
+	if err := yaml.Unmarshal([]byte(content), &spec); err != nil {
+		return nil, fmt.Errorf("invalid inventory spec: %v", err)
+	}
+	return &spec, nil
+}
+
+// check validates the names of s and that its children exist without
+// cycles. It returns the hosts of s.
+func (s *InventorySpec) check() ([]string, error) {
+	for name, group := range s.Groups {
+		if !groupNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid group name %q, use letters, digits and underscores", name)
+		}
+		if name == "all" || name == "ungrouped" {
+			return nil, fmt.Errorf("group %q is implicit", name)
+		}
+		if group == nil {
+			s.Groups[name] = &InventoryGroup{}
+			continue
+		}
+		for _, child := range group.Children {
+			if _, ok := s.Groups[child]; !ok {
+				return nil, fmt.Errorf("group %q has the unknown child %q", name, child)
+			}
+		}
+	}
+	if name, ok := s.groupCycle(); ok {
+		return nil, fmt.Errorf("group %q is its own descendant", name)
+	}
+	hosts, err := s.hosts()
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("inventory has no hosts")
+	}
+	return hosts, nil
+}
+
+// groupCycle finds a group that is a descendant of itself.
+func (s *InventorySpec) groupCycle() (string, bool) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return true
+		case done:
+			return false
+		}
+		state[name] = visiting
+		if group := s.Groups[name]; group != nil {
+			for _, child := range group.Children {
+				if visit(child) {
+					return true
+				}
+			}
+		}
+		state[name] = done
+		return false
+	}
+	for _, name := range s.groupNames() {
+		if visit(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (s *InventorySpec) groupNames() []string {
+	names := make([]string, 0, len(s.Groups))
+	for name := range s.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hosts are the distinct hosts of s with their ranges expanded, like
+// inventoryHosts.
+func (s *InventorySpec) hosts() ([]string, error) {
+	var patterns []string
+	for _, name := range s.groupNames() {
+		if group := s.Groups[name]; group != nil {
+			patterns = append(patterns, group.Hosts...)
+		}
+	}
+	for pattern := range s.HostVars {
+		patterns = append(patterns, pattern)
+	}
+	var hosts []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		if pattern == "" || strings.ContainsAny(pattern, " \t\n") {
+			return nil, fmt.Errorf("invalid host %q", pattern)
+		}
+		names, err := expandHostRange(pattern, MAX_INVENTORY_HOSTS-len(hosts))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				hosts = append(hosts, name)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// render writes s as a YAML inventory. The host vars go under all, ansible
+// merges them with the groups the host is in.
+func (s *InventorySpec) render() (string, error) {
+	all := map[string]interface{}{}
+	if len(s.HostVars) > 0 {
+		hosts := map[string]interface{}{}
+		for host, vars := range s.HostVars {
+			hosts[host] = vars
+		}
+		all["hosts"] = hosts
+	}
+	if len(s.Groups) > 0 {
+		children := map[string]interface{}{}
+		for name, group := range s.Groups {
+			g := map[string]interface{}{}
+			if len(group.Hosts) > 0 {
+				hosts := map[string]interface{}{}
+				for _, host := range group.Hosts {
+					hosts[host] = nil
+				}
+				g["hosts"] = hosts
+			}
+			if len(group.Children) > 0 {
+				sub := map[string]interface{}{}
+				for _, child := range group.Children {
+					sub[child] = map[string]interface{}{}
+				}
+				g["children"] = sub
+			}
+			if len(group.Vars) > 0 {
+				g["vars"] = group.Vars
+			}
+			children[name] = g
+		}
+		all["children"] = children
+	}
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]interface{}{"all": all}); err != nil {
+		return "", fmt.Errorf("failed to render inventory: %v", err)
+	}
+	return out.String(), nil
+}
+
+// isSpecInventory tells a task inventory rendered from a spec.
+func isSpecInventory(path string) bool {
+	return filepath.Base(path) == INVENTORY_RENDERED_FILE
+}
+
+// writeInventorySpec writes the spec of a task and its rendering to dir and
+// returns the path of the rendering.
+func writeInventorySpec(dir string, spec *InventorySpec) (string, error) {
+	rendered, err := spec.render()
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(filepath.Join(dir, INVENTORY_SPEC_FILE), string(raw)); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, INVENTORY_RENDERED_FILE)
+	return path, writeFile(path, rendered)
+}
+
+// replaceInventorySpec gives task the structured inventory spec, also in
+// place of an inventory.ini.
+func replaceInventorySpec(ctx context.Context, task *Task, spec *InventorySpec) error {
+	rendered, err := spec.render()
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	old := task.Inventory.Path
+	dir := filepath.Dir(old)
+	task.Inventory.Path = filepath.Join(dir, INVENTORY_RENDERED_FILE)
+	if err := replaceTaskFile(ctx, task, &task.Inventory.Path, rendered); err != nil {
+		task.Inventory.Path = old
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, INVENTORY_SPEC_FILE), string(raw)); err != nil {
+		return err
+	}
+	if old != task.Inventory.Path {
+		if err := db.Model(&task.Inventory).Update("path", task.Inventory.Path).Error; err != nil {
+			return err
+		}
+		os.Remove(old)
+	}
+	return nil
+}
+
+// readInventorySpec reads the spec of a task inventory, nil for one that
+// has none.
+func readInventorySpec(task *Task) (*InventorySpec, error) {
+	if !isSpecInventory(task.Inventory.Path) {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(filepath.Join(filepath.Dir(task.Inventory.Path), INVENTORY_SPEC_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var spec InventorySpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// cleanPlayHosts checks the target of a wrapped playbook, by default the
+// servers group of a plain inventory and all hosts of any other.
+func cleanPlayHosts(hosts string, plain bool) (string, error) {
+	hosts = strings.TrimSpace(hosts)
+	if strings.ContainsAny(hosts, "\n\r") {
+		return "", errors.New("invalid play hosts, a host pattern is a single line")
+	}
+	if hosts == "" {
+		if plain {
+			return DEFAULT_PLAY_HOSTS, nil
+		}
+		return "all", nil
+	}
+	return hosts, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+// the JUnit format, as Jenkins and GitLab read it: a suite per play and a
+// testcase per host and task
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// durationSeconds is the time between the start and end of the json
+// callback, which are RFC 3339 timestamps.
+func durationSeconds(start, end string) string {
+	s, err1 := time.Parse(time.RFC3339Nano, start)
+	e, err2 := time.Parse(time.RFC3339Nano, end)
+	if err1 != nil || err2 != nil || e.Before(s) {
+		return "0"
+	}
+	return fmt.Sprintf("%.3f", e.Sub(s).Seconds())
+}
+
+// junitResults converts the results of task. A failed host is a failure, an
+// unreachable one an error, so CI can tell broken playbooks from broken
+// connections.
+func junitResults(task *Task, res *results.AnsiblePlaybookJSONResults) *junitTestSuites {
+	suites := &junitTestSuites{Name: task.Name}
+	for _, play := range res.Plays {
+		suite := junitTestSuite{Time: "0"}
+		if play.Play != nil {
+			suite.Name = play.Play.Name
+			if d := play.Play.Duration; d != nil {
+				suite.Time = durationSeconds(d.Start, d.End)
+				suite.Timestamp = d.Start
+			}
+		}
+		for _, t := range play.Tasks {
+			taskName, taskTime := "", "0"
+			if t.Task != nil {
+				taskName = t.Task.Name
+				if d := t.Task.Duration; d != nil {
+					taskTime = durationSeconds(d.Start, d.End)
+				}
+			}
+			hosts := make([]string, 0, len(t.Hosts))
+			for host := range t.Hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			for _, host := range hosts {
+				item := t.Hosts[host]
+				tc := junitTestCase{
+					ClassName: host,
+					Name:      taskName,
+					Time:      taskTime,
+					SystemOut: outputText(item.Stdout),
+					SystemErr: outputText(item.Stderr),
+				}
+				msg := outputText(item.Msg)
+				switch hostResultStatus(item) {
+				case HOST_UNREACHABLE:
+					tc.Error = &junitMessage{Message: msg, Text: msg}
+					suite.Errors++
+				case HOST_FAILED:
+					tc.Failure = &junitMessage{Message: msg, Text: strings.TrimSpace(msg + "\n" + outputText(item.Stderr))}
+					suite.Failures++
+				case HOST_SKIPPED:
+					tc.Skipped = &junitMessage{Message: item.SkipReason}
+					suite.Skipped++
+				}
+				suite.Tests++
+				suite.Cases = append(suite.Cases, tc)
+			}
+		}
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Errors += suite.Errors
+		suites.Skipped += suite.Skipped
+		suites.Suites = append(suites.Suites, suite)
+	}
+	return suites
+}
+
+func showResultJUnit(c *gin.Context, task *Task, res *results.AnsiblePlaybookJSONResults) {
+	raw, err := xml.MarshalIndent(junitResults(task, res), "", "  ")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), raw...))
+}
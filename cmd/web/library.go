@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LibraryItem is what the items of the library, playbooks and
+// inventories, have in common.
+type LibraryItem struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	Name        string    `json:"name" gorm:"column:name;size:191;uniqueIndex"`
+	Description string    `json:"description" gorm:"column:description"`
+	Creator     string    `json:"creator" gorm:"column:creator"`
+	TeamID      uint      `json:"team_id" gorm:"column:team_id;index"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"column:updated_at"`
+}
+
+// LibraryItemRequest is the part of a request to create or update a library
+// item every kind has, a missing field is left as is.
+type LibraryItemRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	// TeamID is the team a new item goes to, the first of the user if 0
+	TeamID uint `json:"team_id"`
+}
+
+// LibraryPlaybook is a named playbook saved for reuse. Tasks created from it
+// get a copy, editing it doesn't change the tasks that already exist.
+type LibraryPlaybook struct {
+	LibraryItem
+	// Content is a task list like the form takes, or a whole playbook if Raw
+	Content string `json:"content" gorm:"column:content"`
+	Raw     bool   `json:"raw" gorm:"column:raw"`
+}
+
+// LibraryPlaybookRequest creates or updates a library playbook.
+type LibraryPlaybookRequest struct {
+	LibraryItemRequest
+	Content *string `json:"content"`
+	Raw     *bool   `json:"raw"`
+}
+
+var (
+	errLibraryPlaybookNotFound = withStatus(http.StatusNotFound, errors.New("library playbook not found"))
+	errLibraryPlaybookExists   = withStatus(http.StatusConflict, errors.New("library playbook already exists"))
+)
+
+// libraryKind is what the handlers of a kind of library item need to know
+// about it, T is its model and R the request that creates or updates one.
+type libraryKind[T, R any] struct {
+	path     string
+	table    string
+	notFound error
+	exists   error
+	// columns are what an update writes besides those of LibraryItem
+	columns []string
+	// item and request return the parts every kind has
+	item    func(*T) *LibraryItem
+	request func(*R) *LibraryItemRequest
+	// required checks that a create request has what a new item needs
+	required func(*R) error
+	// apply copies the other fields set in a request to an item and checks
+	// what results
+	apply func(*T, *R) error
+}
+
+var libraryPlaybooks = &libraryKind[LibraryPlaybook, LibraryPlaybookRequest]{
+	path:     "/api/v1/library/playbooks/",
+	table:    "library_playbooks",
+	notFound: errLibraryPlaybookNotFound,
+	exists:   errLibraryPlaybookExists,
+	columns:  []string{"content", "raw"},
+	item:     func(lp *LibraryPlaybook) *LibraryItem { return &lp.LibraryItem },
+	request:  func(req *LibraryPlaybookRequest) *LibraryItemRequest { return &req.LibraryItemRequest },
+	required: func(req *LibraryPlaybookRequest) error {
+		if req.Name == nil || req.Content == nil {
+			return withStatus(http.StatusBadRequest, errors.New("name and content are required"))
+		}
+		return nil
+	},
+	apply: applyLibraryPlaybookRequest,
+}
+
+// find loads the item of the :id parameter.
+func (k *libraryKind[T, R]) find(c *gin.Context) (*T, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, k.notFound
+	}
+	item := new(T)
+	if err := db.Limit(1).Find(item, id).Error; err != nil {
+		return nil, err
+	}
+	if k.item(item).ID == 0 {
+		return nil, k.notFound
+	}
+	return item, nil
+}
+
+// findOwn is find for a change, which only its creator and admins may
+// make.
+func (k *libraryKind[T, R]) findOwn(c *gin.Context) (*T, error) {
+	item, err := k.find(c)
+	if err != nil {
+		return nil, err
+	}
+	if user := currentUser(c); !user.Admin && k.item(item).Creator != user.Name {
+		return nil, withStatus(http.StatusForbidden, errors.New("only the creator or an admin may change a library item"))
+	}
+	return item, nil
+}
+
+// applyRequest copies the fields set in req to item, checking that the name
+// is free, and hands the rest to the kind.
+func (k *libraryKind[T, R]) applyRequest(item *T, req *R) error {
+	li, r := k.item(item), k.request(req)
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if name == "" {
+			return withStatus(http.StatusBadRequest, errors.New("name is required"))
+		}
+		if name != li.Name {
+			var count int64
+			if err := db.Table(k.table).Where("name = ?", name).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return k.exists
+			}
+		}
+		li.Name = name
+	}
+	if r.Description != nil {
+		li.Description = strings.TrimSpace(*r.Description)
+	}
+	return k.apply(item, req)
+}
+
+func (k *libraryKind[T, R]) list(c *gin.Context) {
+	var items []T
+	query := db.Model(new(T)).Scopes(inTeams(c, k.table+".team_id"))
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likePattern(q)
+		query = query.Where("name LIKE ? ESCAPE '!' OR description LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+	page, err := listPage(c, query, &items)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func (k *libraryKind[T, R]) show(c *gin.Context) {
+	item, err := k.find(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, item)
+}
+
+func (k *libraryKind[T, R]) create(c *gin.Context) {
+	req := new(R)
+	if err := c.ShouldBindJSON(req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if err := k.required(req); err != nil {
+		apiError(c, err)
+		return
+	}
+	teamID, err := requestTeam(currentUser(c), k.request(req).TeamID)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	item := new(T)
+	li := k.item(item)
+	li.Creator = currentUser(c).Name
+	li.TeamID = teamID
+	if err := k.applyRequest(item, req); err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := db.Create(item).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Header("Location", k.path+strconv.FormatUint(uint64(li.ID), 10))
+	c.IndentedJSON(http.StatusCreated, item)
+}
+
+func (k *libraryKind[T, R]) update(c *gin.Context) {
+	req := new(R)
+	if err := c.ShouldBindJSON(req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	item, err := k.findOwn(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := k.applyRequest(item, req); err != nil {
+		apiError(c, err)
+		return
+	}
+	columns := append([]string{"name", "description", "updated_at"}, k.columns...)
+	if err := db.Select(columns).Updates(item).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, item)
+}
+
+func (k *libraryKind[T, R]) delete(c *gin.Context) {
+	item, err := k.findOwn(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	// tasks keep their copy, only the reference goes
+	if err := db.Delete(item).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// applyLibraryPlaybookRequest copies the playbook fields set in req to lp,
+// checking that the playbook renders.
+func applyLibraryPlaybookRequest(lp *LibraryPlaybook, req *LibraryPlaybookRequest) error {
+	if req.Content != nil {
+		lp.Content = strings.ReplaceAll(*req.Content, "\r", "")
+	}
+	if req.Raw != nil {
+		lp.Raw = *req.Raw
+	}
+	if strings.TrimSpace(lp.Content) == "" {
+		return withStatus(http.StatusBadRequest, errors.New("content is required"))
+	}
+	if _, err := renderPlaybook(lp.Content, lp.Raw, DEFAULT_PLAY_HOSTS); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	return nil
+}
+
+// useLibraryPlaybook fills in the playbook of req from the library playbook
+// it names and returns that playbook.
+func useLibraryPlaybook(req *TaskRequest) (*LibraryPlaybook, error) {
+	if strings.TrimSpace(req.Playbook) != "" {
+		return nil, withStatus(http.StatusBadRequest, errors.New("give either a playbook or a library playbook, not both"))
+	}
+	var lp LibraryPlaybook
+	if err := db.Limit(1).Find(&lp, req.LibraryPlaybookID).Error; err != nil {
+		return nil, err
+	}
+	if lp.ID == 0 || lp.TeamID != req.TeamID {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("unknown library playbook %d", req.LibraryPlaybookID))
+	}
+	req.Playbook = lp.Content
+	req.RawPlaybook = lp.Raw
+	return &lp, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LibraryInventory is a named inventory saved for reuse, the inventory
+// counterpart of LibraryPlaybook.
+type LibraryInventory struct {
+	LibraryItem
+	// Content is what the form takes, host names or inventory.ini lines
+	Content string `json:"content" gorm:"column:content"`
+	// Plugin makes the inventory dynamic instead, one of inventoryPlugins.
+	// PluginConfig is the YAML of its options.
+	Plugin       string `json:"plugin" gorm:"column:plugin"`
+	PluginConfig string `json:"plugin_config" gorm:"column:plugin_config"`
+	// CachedHosts are the hosts of a dynamic inventory as of its last
+	// refresh, one per line
+	CachedHosts string `json:"cached_hosts" gorm:"column:cached_hosts"`
+	// Spec makes the inventory structured instead
+	Spec             *InventorySpec `json:"spec" gorm:"column:spec;serializer:json"`
+	HostsRefreshedAt time.Time      `json:"hosts_refreshed_at" gorm:"column:hosts_refreshed_at"`
+	// SSH settings for the tasks made from the inventory, used between the
+	// ones of the environment and of the task
+	SSHUser           string `json:"ssh_user" gorm:"column:ssh_user"`
+	SSHPort           int    `json:"ssh_port" gorm:"column:ssh_port"`
+	SSHPrivateKeyFile string `json:"ssh_private_key_file" gorm:"column:ssh_private_key_file"`
+	SSHTimeout        int    `json:"ssh_timeout" gorm:"column:ssh_timeout"`
+	// HostKeyChecking is the policy of the environment if empty
+	HostKeyChecking string `json:"host_key_checking" gorm:"column:host_key_checking"`
+}
+
+// LibraryInventoryRequest creates or updates a library inventory.
+type LibraryInventoryRequest struct {
+	LibraryItemRequest
+	Content           *string        `json:"content"`
+	Plugin            *string        `json:"plugin"`
+	PluginConfig      *string        `json:"plugin_config"`
+	Spec              *InventorySpec `json:"spec"`
+	SSHUser           *string        `json:"ssh_user"`
+	SSHPort           *int           `json:"ssh_port"`
+	SSHPrivateKeyFile *string        `json:"ssh_private_key_file"`
+	SSHTimeout        *int           `json:"ssh_timeout"`
+	HostKeyChecking   *string        `json:"host_key_checking"`
+}
+
+var (
+	errLibraryInventoryNotFound = withStatus(http.StatusNotFound, errors.New("library inventory not found"))
+	errLibraryInventoryExists   = withStatus(http.StatusConflict, errors.New("library inventory already exists"))
+)
+
+var libraryInventories = &libraryKind[LibraryInventory, LibraryInventoryRequest]{
+	path:     "/api/v1/library/inventories/",
+	table:    "library_inventories",
+	notFound: errLibraryInventoryNotFound,
+	exists:   errLibraryInventoryExists,
+	columns:  []string{"content", "plugin", "plugin_config", "cached_hosts", "hosts_refreshed_at", "spec", "ssh_user", "ssh_port", "ssh_private_key_file", "ssh_timeout", "host_key_checking"},
+	item:     func(li *LibraryInventory) *LibraryItem { return &li.LibraryItem },
+	request:  func(req *LibraryInventoryRequest) *LibraryItemRequest { return &req.LibraryItemRequest },
+	required: func(req *LibraryInventoryRequest) error {
+		if req.Name == nil || req.Content == nil && req.Plugin == nil && req.Spec == nil {
+			return withStatus(http.StatusBadRequest, errors.New("name and content, a plugin or a spec are required"))
+		}
+		return nil
+	},
+	apply: applyLibraryInventoryRequest,
+}
+
+// applyLibraryInventoryRequest copies the inventory fields set in req to
+// li, checking that the hosts parse. Which hosts an environment allows is
+// checked when a task uses it.
+func applyLibraryInventoryRequest(li *LibraryInventory, req *LibraryInventoryRequest) error {
+	if req.SSHUser != nil {
+		li.SSHUser = strings.TrimSpace(*req.SSHUser)
+	}
+	if req.SSHPort != nil {
+		if *req.SSHPort < 0 || *req.SSHPort > 65535 {
+			return withStatus(http.StatusBadRequest, fmt.Errorf("invalid ssh port %d", *req.SSHPort))
+		}
+		li.SSHPort = *req.SSHPort
+	}
+	if req.SSHPrivateKeyFile != nil {
+		li.SSHPrivateKeyFile = strings.TrimSpace(*req.SSHPrivateKeyFile)
+	}
+	if req.SSHTimeout != nil {
+		if err := checkSSHTimeout(*req.SSHTimeout); err != nil {
+			return withStatus(http.StatusBadRequest, err)
+		}
+		li.SSHTimeout = *req.SSHTimeout
+	}
+	if req.HostKeyChecking != nil {
+		policy := strings.TrimSpace(*req.HostKeyChecking)
+		if err := checkHostKeyChecking(policy); err != nil {
+			return withStatus(http.StatusBadRequest, err)
+		}
+		li.HostKeyChecking = policy
+	}
+	// an inventory is one of hosts, a plugin or a spec, setting one
+	// replaces the others
+	content := req.Content != nil && strings.TrimSpace(*req.Content) != ""
+	plugin := req.Plugin != nil && strings.TrimSpace(*req.Plugin) != ""
+	if content && plugin || content && req.Spec != nil || plugin && req.Spec != nil {
+		return withStatus(http.StatusBadRequest, errors.New("give one of content, a plugin or a spec"))
+	}
+	switch {
+	case content:
+		li.Content = strings.ReplaceAll(*req.Content, "\r", "")
+		li.Plugin, li.PluginConfig, li.Spec = "", "", nil
+	case plugin:
+		li.Content, li.Spec = "", nil
+	case req.Spec != nil:
+		li.Spec = req.Spec
+		li.Content, li.Plugin, li.PluginConfig = "", "", ""
+	}
+	if req.Plugin != nil || req.PluginConfig != nil {
+		if req.Plugin != nil {
+			li.Plugin = strings.TrimSpace(*req.Plugin)
+		}
+		if req.PluginConfig != nil {
+			li.PluginConfig = strings.ReplaceAll(*req.PluginConfig, "\r", "")
+		}
+		// the hosts of another config are of no use
+		li.CachedHosts = ""
+		li.HostsRefreshedAt = time.Time{}
+	}
+	if li.Plugin != "" {
+		if err := checkPluginConfig(li.Plugin, li.PluginConfig); err != nil {
+			return withStatus(http.StatusBadRequest, err)
+		}
+		return nil
+	}
+	li.PluginConfig = ""
+	if li.Spec != nil {
+		if _, err := li.Spec.check(); err != nil {
+			return withStatus(http.StatusBadRequest, err)
+		}
+		return nil
+	}
+	hosts, err := inventoryHosts(li.Content)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	if len(hosts) == 0 {
+		return withStatus(http.StatusBadRequest, errors.New("inventory has no hosts"))
+	}
+	return nil
+}
+
+// useLibraryInventory fills in the inventory of req from the library
+// inventory it names and returns that inventory. A dynamic one leaves it
+// empty, the task gets the plugin config instead, a structured one sets
+// the inventory spec.
+func useLibraryInventory(req *TaskRequest) (*LibraryInventory, error) {
+	if strings.TrimSpace(req.Inventory) != "" {
+		return nil, withStatus(http.StatusBadRequest, errors.New("give either an inventory or a library inventory, not both"))
+	}
+	var li LibraryInventory
+	if err := db.Limit(1).Find(&li, req.LibraryInventoryID).Error; err != nil {
+		return nil, err
+	}
+	if li.ID == 0 || li.TeamID != req.TeamID {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("unknown library inventory %d", req.LibraryInventoryID))
+	}
+	req.Inventory = li.Content
+	if li.Spec != nil {
+		if req.InventorySpec != nil {
+			return nil, withStatus(http.StatusBadRequest, errors.New("give either an inventory spec or a library inventory, not both"))
+		}
+		req.InventorySpec = li.Spec
+	}
+	return &li, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func libraryRequest(user *User, handler gin.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(method, path, func(c *gin.Context) { c.Set("user", user) }, handler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, strings.Replace(path, ":id", "1", 1), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLibraryPlaybooks(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin", ROLE_ADMIN)
+	operator := createTestUser(t, "operator", ROLE_OPERATOR)
+	const path = "/api/v1/library/playbooks/:id"
+
+	w := libraryRequest(admin, libraryPlaybooks.create, http.MethodPost, "/api/v1/library/playbooks", `{"name": " ping ", "content": "- ping:"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var lp LibraryPlaybook
+	if err := json.Unmarshal(w.Body.Bytes(), &lp); err != nil {
+		t.Fatal(err)
+	}
+	if lp.ID != 1 || lp.Name != "ping" || lp.Creator != "admin" || w.Header().Get("Location") != "/api/v1/library/playbooks/1" {
+		t.Errorf("created %+v at %q", lp, w.Header().Get("Location"))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		user    *User
+		handler gin.HandlerFunc
+		method  string
+		path    string
+		body    string
+		want    int
+	}{
+		{"missing content", admin, libraryPlaybooks.create, http.MethodPost, "/api/v1/library/playbooks", `{"name": "other"}`, http.StatusBadRequest},
+		{"name taken", admin, libraryPlaybooks.create, http.MethodPost, "/api/v1/library/playbooks", `{"name": "ping", "content": "- ping:"}`, http.StatusConflict},
+		{"not the creator", operator, libraryPlaybooks.update, http.MethodPut, path, `{"description": "mine"}`, http.StatusForbidden},
+		{"update", admin, libraryPlaybooks.update, http.MethodPut, path, `{"description": "pings"}`, http.StatusOK},
+		{"show", operator, libraryPlaybooks.show, http.MethodGet, path, "", http.StatusOK},
+		{"delete", admin, libraryPlaybooks.delete, http.MethodDelete, path, "", http.StatusNoContent},
+		{"deleted", admin, libraryPlaybooks.show, http.MethodGet, path, "", http.StatusNotFound},
+	} {
+		if w := libraryRequest(tc.user, tc.handler, tc.method, tc.path, tc.body); w.Code != tc.want {
+			t.Errorf("%s: got %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestLibraryInventoryUpdate(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin", ROLE_ADMIN)
+	w := libraryRequest(admin, libraryInventories.create, http.MethodPost, "/api/v1/library/inventories", `{"name": "web", "content": "h1", "ssh_port": 2222}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	w = libraryRequest(admin, libraryInventories.update, http.MethodPut, "/api/v1/library/inventories/:id", `{"name": "db", "content": "h2"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	var li LibraryInventory
+	db.First(&li, 1)
+	if li.Name != "db" || li.Content != "h2" || li.SSHPort != 2222 {
+		t.Errorf("stored %+v", li)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const LINT_TIMEOUT = 2 * time.Minute
+
+// Task.LintStatus values, empty when the playbook wasn't linted. LINT_ERROR
+// means ansible-lint itself failed and never blocks a task.
+const (
+	LINT_PASSED   = "passed"
+	LINT_WARNINGS = "warnings"
+	LINT_FAILED   = "failed"
+	LINT_ERROR    = "error"
+)
+
+var (
+	lintPlaybooks bool
+	lintBlock     bool
+)
+
+var errLintFailed = withStatus(http.StatusConflict, errors.New("the playbook failed ansible-lint, see lint_output"))
+
+// lintTask runs ansible-lint on the playbook of task and records what it
+// found on the task. It runs in the playbook's directory so that the
+// .ansible-lint of a project applies.
+func lintTask(task *Task) {
+	ctx, cancel := context.WithTimeout(context.Background(), LINT_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ansible-lint", "--nocolor", filepath.Base(task.Playbook.Path))
+	cmd.Dir = filepath.Dir(task.Playbook.Path)
+	// the violations go to stdout, the summary and errors to stderr
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	task.LintOutput = strings.TrimSpace(stdout.String())
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil && task.LintOutput == "":
+		task.LintStatus = LINT_PASSED
+	case err == nil:
+		task.LintStatus = LINT_WARNINGS
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 2:
+		task.LintStatus = LINT_FAILED
+	default:
+		task.LintStatus = LINT_ERROR
+		task.LintOutput = strings.TrimSpace(fmt.Sprintf("%v\n%s", err, stderr.String()))
+		taskLogger("lint", task.TaskID).Error("ansible-lint failed", "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+const MAX_LOCK_KEY = 191
+
+// TaskLock is held by a running task, tasks with the same lock key run one
+// at a time. The row is the lock, so it holds across worker processes.
+type TaskLock struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Key       string    `json:"key" gorm:"column:lock_key;size:191;uniqueIndex"`
+	TaskID    string    `json:"task_id" gorm:"column:task_id"`
+	Node      string    `json:"node" gorm:"column:node"`
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at"`
+}
+
+var (
+	// lockMu keeps taking a lock and waiting for it apart from releasing it,
+	// so no waiter misses the release
+	lockMu sync.Mutex
+	// lockWaiters are the tasks handed to a worker while their lock was
+	// held by a task of this process, by lock key
+	lockWaiters = map[string][]queuedTask{}
+)
+
+func cleanLockKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if len(key) > MAX_LOCK_KEY {
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("lock key is longer than %d bytes", MAX_LOCK_KEY))
+	}
+	return key, nil
+}
+
+// taskLockKey is the lock key of task, by default the library inventory it
+// was made from or else its own inventory.
+func taskLockKey(task *Task) string {
+	switch {
+	case task.LockKey != "":
+		return task.LockKey
+	case task.LibraryInventoryID != 0:
+		return fmt.Sprintf("library-inventory:%d", task.LibraryInventoryID)
+	}
+	return fmt.Sprintf("inventory:%d", task.InventoryID)
+}
+
+// acquireTaskLock takes the lock of taskId before a worker claims it. When
+// another task of this process holds the lock, taskId waits for
+// releaseTaskLock. A lock held in another worker process is waited for by
+// the broker handing the task out again.
+func acquireTaskLock(taskId string) (string, bool) {
+	var task Task
+	err := db.Select("id", "task_id", "priority", "lock_key", "inventory_id", "library_inventory_id").
+		Limit(1).Find(&task, "task_id = ?", taskId).Error
+	if err != nil {
+		taskLogger("worker", taskId).Error("failed to load lock key", "error", err)
+		enqueueTaskAfter(taskId, task.Priority, BROKER_RETRY)
+		return "", false
+	}
+	if task.ID == 0 {
+		// gone, the claim fails
+		return "", true
+	}
+	key := taskLockKey(&task)
+
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	tx := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&TaskLock{Key: key, TaskID: taskId, Node: nodeName})
+	if tx.Error != nil {
+		taskLogger("worker", taskId).Error("failed to take lock", "lock_key", key, "error", tx.Error)
+		enqueueTaskAfter(taskId, task.Priority, BROKER_RETRY)
+		return key, false
+	}
+	if tx.RowsAffected > 0 {
+		return key, true
+	}
+	var holder TaskLock
+	db.Where("lock_key = ?", key).Limit(1).Find(&holder)
+	if holder.TaskID == taskId {
+		// handed out twice, the task already runs
+		return key, false
+	}
+	taskLogger("worker", taskId).Info("waiting for lock", "lock_key", key, "holder", holder.TaskID)
+	if holder.ID == 0 || holder.Node == nodeName {
+		lockWaiters[key] = append(lockWaiters[key], queuedTask{TaskID: taskId, Priority: task.Priority, LockKey: key})
+	}
+	// released in between, the waiter is woken right away
+	if holder.ID == 0 {
+		go releaseTaskLock(key, "")
+	}
+	return key, false
+}
+
+// releaseTaskLock gives up the lock of taskId and queues the tasks that
+// waited for it again, the first of them to get a worker takes it.
+func releaseTaskLock(key, taskId string) {
+	if key == "" {
+		return
+	}
+	lockMu.Lock()
+	if taskId != "" {
+		if err := db.Where("lock_key = ? AND task_id = ?", key, taskId).Delete(&TaskLock{}).Error; err != nil {
+			taskLogger("worker", taskId).Error("failed to release lock", "lock_key", key, "error", err)
+		}
+	}
+	waiters := lockWaiters[key]
+	delete(lockWaiters, key)
+	lockMu.Unlock()
+
+	for _, t := range waiters {
+		enqueueTask(t.TaskID, t.Priority)
+	}
+}
+
+// releaseStaleLocks drops the locks the tasks of a process that didn't
+// stop cleanly still hold, every lock without a broker.
+func releaseStaleLocks() error {
+	query := db.Where("1 = 1")
+	if broker != nil {
+		query = db.Where("node = ?", nodeName)
+	}
+	return query.Delete(&TaskLock{}).Error
+}
+
+// snapshotLockWaiters lists the tasks waiting for a lock, by priority.
+func snapshotLockWaiters() []queuedTask {
+	lockMu.Lock()
+	list := []queuedTask{}
+	for _, waiters := range lockWaiters {
+		list = append(list, waiters...)
+	}
+	lockMu.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Priority > list[j].Priority })
+	return list
+}
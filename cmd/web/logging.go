@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+	LOG_FORMAT_TEXT   = "text"
+	LOG_FORMAT_JSON   = "json"
+)
+
+var (
+	logFormat string
+	logLevel  string
+)
+
+// a request id passed in by a proxy is kept if it looks like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// setupLogging installs the slog handler of -log-format and -log-level, the
+// log package writes through it too.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q", logLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(logFormat) {
+	case LOG_FORMAT_TEXT:
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case LOG_FORMAT_JSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("invalid -log-format %q, use %s or %s", logFormat, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	return nil
+}
+
+// logger returns the logger of a part of the server.
+func logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// taskLogger tags the lines about a task with its id.
+func taskLogger(component, taskID string) *slog.Logger {
+	return logger(component).With("task_id", taskID)
+}
+
+// fatal logs an error the server can't start with and exits.
+func fatal(msg string, args ...any) {
+	logger("server").Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestID gives every request an id, taken from X-Request-ID if the
+// client sent one, sends it back and logs the request once it is served.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(REQUEST_ID_HEADER)
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.New().String()
+	}
+	c.Set("request_id", id)
+	c.Header(REQUEST_ID_HEADER, id)
+
+	start := time.Now()
+	c.Next()
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	requestLogger(c).Log(c.Request.Context(), level, "request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"client_ip", c.ClientIP(),
+	)
+}
+
+// requestLogger tags the lines about a request with its id.
+func requestLogger(c *gin.Context) *slog.Logger {
+	return logger("http").With("request_id", c.GetString("request_id"))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -21,19 +23,27 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"gorm.io/driver/sqlite"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
 	"gorm.io/gorm"
 
 	"github.com/apenella/go-ansible/v2/pkg/execute"
 	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
-	"github.com/apenella/go-ansible/v2/pkg/execute/stdoutcallback"
 	"github.com/apenella/go-ansible/v2/pkg/playbook"
 )
 
 type User struct {
-	ID       uint   `json:"id" gorm:"primarykey"`
-	Name     string `json:"name" gorm:"column:name"`
-	Password string `json:"password" gorm:"column:password"`
+	ID   uint   `json:"id" gorm:"primarykey"`
+	Name string `json:"name" gorm:"column:name"`
+	// Password is a bcrypt hash
+	Password string `json:"-" gorm:"column:password"`
+	Admin    bool   `json:"admin" gorm:"column:is_admin"`
+	// NotifyEmail is when tasks of the user are mailed to Email: failed,
+	// finished or never, empty for failed
+	Email       string `json:"email" gorm:"column:email"`
+	NotifyEmail string `json:"notify_email" gorm:"column:notify_email"`
+	// Role is loaded from UserRole
+	Role string `json:"role" gorm:"-"`
 }
 
 type Inventory struct {
@@ -41,6 +51,9 @@ type Inventory struct {
 	Name    string `json:"name" gorm:"column:name"`
 	Path    string `json:"path" gorm:"column:path"`
 	Creator string `json:"creator" gorm:"column:creator"`
+	// Locked inventories can only be removed by an admin
+	Locked bool `json:"locked" gorm:"column:locked"`
+	TeamID uint `json:"team_id" gorm:"column:team_id;index"`
 }
 
 type Playbook struct {
@@ -48,6 +61,10 @@ type Playbook struct {
 	Name    string `json:"name" gorm:"column:name"`
 	Path    string `json:"path" gorm:"column:path"`
 	Creator string `json:"creator" gorm:"column:creator"`
+	// VaultIDs are the labels of the vault ids the playbook needs, comma
+	// separated
+	VaultIDs string `json:"vault_ids" gorm:"column:vault_ids"`
+	TeamID   uint   `json:"team_id" gorm:"column:team_id;index"`
 }
 
 type Task struct {
@@ -55,31 +72,159 @@ type Task struct {
 	TaskID      string    `json:"task_id" gorm:"column:task_id"`
 	Name        string    `json:"name" gorm:"column:name"`
 	Status      uint      `json:"status" gorm:"column:status"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
 	UpdatedAt   time.Time `json:"updated_at" gorm:"column:updated_at"`
+	StartedAt   time.Time `json:"started_at" gorm:"column:started_at"`
+	FinishedAt  time.Time `json:"finished_at" gorm:"column:finished_at"`
 	PlaybookID  uint      `gorm:"column:playbook_id"`
 	Playbook    Playbook  `gorm:"foreignKey:PlaybookID;references:ID"`
 	InventoryID uint      `gorm:"column:inventory_id"`
 	Inventory   Inventory `gorm:"foreignKey:InventoryID;references:ID"`
 	UserID      uint      `gorm:"column:user_id"`
 	User        User      `gorm:"foreignKey:UserID;references:ID"`
+	TeamID      uint      `json:"team_id" gorm:"column:team_id;index"`
 	Error       string    `json:"error" gorm:"column:error"`
+	HostCount   uint      `json:"host_count" gorm:"column:host_count"`
+	FailedHosts uint      `json:"failed_hosts" gorm:"column:failed_hosts"`
+	Unreachable uint      `json:"unreachable_hosts" gorm:"column:unreachable_hosts"`
+	// ArtifactsDir is relative to the task directory
+	ArtifactsDir string `json:"artifacts_dir" gorm:"column:artifacts_dir"`
+	Environment  string `json:"environment" gorm:"column:environment"`
+	Approved     bool   `json:"approved" gorm:"column:approved"`
+	// ApprovalRequestedAt is zero for tasks that don't need approval
+	ApprovalRequestedAt time.Time `json:"approval_requested_at" gorm:"column:approval_requested_at"`
+	// Queued is set while the task waits in the queue for a worker
+	Queued bool `json:"queued" gorm:"column:queued"`
+	// Priority orders the queue, higher first
+	Priority int `json:"priority" gorm:"column:priority"`
+	// SSH settings, empty values fall back to the environment's
+	SSHUser           string `json:"ssh_user" gorm:"column:ssh_user"`
+	SSHPort           int    `json:"ssh_port" gorm:"column:ssh_port"`
+	SSHPrivateKeyFile string `json:"ssh_private_key_file" gorm:"column:ssh_private_key_file"`
+	// SSHTimeout is the connection timeout in seconds
+	SSHTimeout int `json:"ssh_timeout" gorm:"column:ssh_timeout"`
+	// CredentialID is used below the SSH settings above, 0 for the one of
+	// the environment
+	CredentialID uint `json:"credential_id" gorm:"column:credential_id"`
+	// credentialKeyFile holds the credential's private key during a run,
+	// credentialVarsFile its password as extra vars
+	credentialKeyFile  string
+	credentialVarsFile string
+	credentialPassword string
+	// hostKeyChecking is the policy newPlaybookOptions found for the run
+	hostKeyChecking string
+	// ExtraVars is a JSON object
+	ExtraVars string `json:"extra_vars" gorm:"column:extra_vars"`
+	Become    bool   `json:"become" gorm:"column:become"`
+	Check     bool   `json:"check" gorm:"column:check_mode"`
+	Diff      bool   `json:"diff" gorm:"column:diff_mode"`
+	// Tags and SkipTags are comma separated, Limit is a host pattern
+	Tags     string `json:"tags" gorm:"column:tags"`
+	SkipTags string `json:"skip_tags" gorm:"column:skip_tags"`
+	Limit    string `json:"limit" gorm:"column:host_limit"`
+	// Module and ModuleArgs make an ad-hoc task, it has no playbook file
+	Module     string `json:"module" gorm:"column:module"`
+	ModuleArgs string `json:"module_args" gorm:"column:module_args"`
+	// RequirementsFile is installed with ansible-galaxy before a run
+	RequirementsFile string `json:"requirements_file" gorm:"column:requirements_file"`
+	// LibraryPlaybookID is the library playbook site.yaml was copied from
+	LibraryPlaybookID uint `json:"library_playbook_id" gorm:"column:library_playbook_id"`
+	// LibraryInventoryID is the library inventory inventory.ini was copied from
+	LibraryInventoryID uint `json:"library_inventory_id" gorm:"column:library_inventory_id"`
+	// ProjectID and ProjectCommit are the project and commit the playbook
+	// was taken from
+	ProjectID     uint   `json:"project_id" gorm:"column:project_id"`
+	ProjectCommit string `json:"project_commit" gorm:"column:project_commit"`
+	// LintStatus and LintOutput are what ansible-lint found with -lint
+	LintStatus string `json:"lint_status" gorm:"column:lint_status"`
+	LintOutput string `json:"lint_output" gorm:"column:lint_output"`
+	// RawPlaybook is set when site.yaml was written as submitted
+	RawPlaybook bool `json:"raw_playbook" gorm:"column:raw_playbook"`
+	// a task whose hosts were unreachable runs up to MaxAttempts times,
+	// RetryBackoff is the delay before the first retry and doubles after
+	MaxAttempts  uint   `json:"max_attempts" gorm:"column:max_attempts"`
+	RetryBackoff string `json:"retry_backoff" gorm:"column:retry_backoff"`
+	// Attempts counts the runs since the task was last started
+	Attempts uint `json:"attempts" gorm:"column:attempts"`
+	// RetryAt is when a task waiting for a retry goes to a worker
+	RetryAt time.Time `json:"retry_at" gorm:"column:retry_at"`
+	// ExitCode is the exit code of ansible-playbook, nil until it exits
+	ExitCode *int `json:"exit_code" gorm:"column:exit_code"`
+	// Image is the container image the task runs in, empty for the one of
+	// the executor
+	Image string `json:"image" gorm:"column:image"`
+	// Verbosity is the number of -v of ansible-playbook, a run may ask for
+	// another one
+	Verbosity int `json:"verbosity" gorm:"column:verbosity"`
+	// Timeout is the maximum run time of the task, empty for -timeout
+	Timeout string `json:"timeout" gorm:"column:timeout"`
+	// LockKey keeps tasks with the same key from running at once, empty
+	// for the key of the inventory, see taskLockKey
+	LockKey string `json:"lock_key" gorm:"column:lock_key"`
+	// RerunOf is the task ID of the task this one was cloned from by a
+	// re-run
+	RerunOf string `json:"rerun_of,omitempty" gorm:"column:rerun_of;index"`
+	// RunID is the last run of the task
+	RunID uint `json:"run_id" gorm:"column:run_id"`
+	// Node is the -node-name of the process that ran the task last
+	Node string `json:"node" gorm:"column:node"`
+	// CancelRequested asks the worker process running the task to cancel it
+	CancelRequested bool `json:"-" gorm:"column:cancel_requested"`
+	// PurgedAt is set once the retention janitor removed the task's files
+	PurgedAt time.Time `json:"purged_at" gorm:"column:purged_at"`
+	// DeletedAt is set while the task is in the trash
+	DeletedAt gorm.DeletedAt `json:"deleted_at" gorm:"column:deleted_at;index"`
+}
+
+type IdempotencyKey struct {
+	ID uint `json:"id" gorm:"primarykey"`
+	// a key is only unique among the keys of its user
+	UserID    uint      `json:"user_id" gorm:"column:user_id;uniqueIndex:idx_idempotency_keys_user_key"`
+	Key       string    `json:"key" gorm:"column:idempotency_key;size:191;uniqueIndex:idx_idempotency_keys_user_key"`
+	TaskID    uint      `json:"task_id" gorm:"column:task_id"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"column:expires_at"`
 }
 
 const (
-	SSH_USER_PRI_KEY_FILE = "/home/user/.ssh/id_rsa"
-	SSH_USER              = "auser"
-	SSH_PORT              = 8513
+	STATUS_WAITING     uint = 0
+	STATUS_RUNNING     uint = 1
+	STATUS_SUCCEEDED   uint = 2
+	STATUS_ERROR       uint = 3
+	STATUS_NO_HOSTS    uint = 4
+	STATUS_INTERRUPTED uint = 5
+	STATUS_CANCELLED   uint = 6
+	STATUS_EXPIRED     uint = 7
+	STATUS_TIMED_OUT   uint = 8
+)
+
+var errNoHostsMatched = errors.New("no hosts matched")
+
+const (
+	DEFAULT_WORKERS      = 2
+	DEFAULT_TASK_TIMEOUT = 30 * time.Minute
+	DEFAULT_MAX_TIMEOUT  = 24 * time.Hour
 )
 
 var (
 	//go:embed templates/*.html
 	fs embed.FS
 
-	address  string
-	db       *gorm.DB
-	rootDir  string
-	taskChan = make(chan string)
-	stopChan = make(chan struct{})
+	address         string
+	configPath      string
+	db              *gorm.DB
+	rootDir         string
+	idempotencyTTL  time.Duration
+	vaultPassScript string
+	artifactsLimit  int64
+	workerCount     int
+	shutdownGrace   time.Duration
+	pollInterval    time.Duration
+	validateTasks   bool
+	maxHosts        int
+	taskTimeout     time.Duration
+	maxTaskTimeout  time.Duration
+	taskChan        = make(chan string)
+	stopChan        = make(chan struct{})
 )
 
 func init() {
@@ -89,44 +234,335 @@ func init() {
 		os.Mkdir(rootDir, 0755)
 	}
 	flag.StringVar(&address, "s", "0.0.0.0:17000", "address to listen on")
+	flag.StringVar(&configPath, "c", "", "path to the JSON config file")
+	defaultDB := os.Getenv("DATABASE_URL")
+	if defaultDB == "" {
+		defaultDB = DEFAULT_DB
+	}
+	flag.StringVar(&dbDSN, "db", defaultDB, "database DSN, sqlite://, postgres:// or mysql:// (env DATABASE_URL)")
+	flag.IntVar(&workerCount, "workers", DEFAULT_WORKERS, "number of tasks run concurrently")
+	flag.DurationVar(&taskTimeout, "timeout", DEFAULT_TASK_TIMEOUT, "maximum run time of a task that doesn't set its own timeout")
+	flag.DurationVar(&maxTaskTimeout, "max-timeout", DEFAULT_MAX_TIMEOUT, "longest timeout a task may set")
+	flag.IntVar(&maxHosts, "max-hosts", 0, "default maximum hosts of a task for non-admins, 0 for unlimited")
+	flag.BoolVar(&validateTasks, "validate", true, "check the inventory and playbook syntax of new tasks with ansible, and the inventory again when they run")
+	flag.BoolVar(&lintPlaybooks, "lint", false, "run ansible-lint on the playbooks of new tasks and keep what it finds")
+	flag.StringVar(&galaxyCache, "galaxy-cache", GALAXY_CACHE_TASK, "where requirements are installed, task for a directory per task or shared for one for all tasks")
+	flag.BoolVar(&lintBlock, "lint-block", false, "refuse to start tasks whose playbook failed ansible-lint")
+	flag.DurationVar(&pollInterval, "poll-interval", 5*time.Second, "how often the task list refreshes running tasks, 0 to disable")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 10*time.Minute, "how long running tasks may finish on shutdown before they are interrupted")
+	flag.BoolVar(&requeueInterrupted, "requeue-interrupted", false, "queue the tasks interrupted by a shutdown again, they run from the start after the restart")
+	flag.StringVar(&webhookURL, "webhook", "", "URL to POST a JSON summary to when a task finishes")
+	flag.StringVar(&credentialKeyFile, "credential-key-file", "", "file with the 64 hex digit key that encrypts credential private keys")
+	flag.StringVar(&vaultPassScript, "vault-password-script", "", "executable that prints the vault password")
+	flag.Int64Var(&artifactsLimit, "artifacts-max-size", 100<<20, "maximum total size in bytes of the artifacts kept per task")
+	flag.BoolVar(&searchIndex, "search-index", false, "index task output for full-text search (needs -tags sqlite_fts5)")
+	flag.IntVar(&playbookDailyLimit, "playbook-daily-limit", 0, "default maximum runs per playbook per rolling 24h, 0 for unlimited")
+	flag.StringVar(&sessionSecret, "session-secret", "", "key that signs session cookies, random if empty")
+	flag.DurationVar(&sessionTTL, "session-ttl", 12*time.Hour, "how long a login session lasts")
+	flag.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "how long deleted tasks stay in the trash, 0 to keep them until purged")
+	flag.DurationVar(&resultRetention, "result-retention", 0, "how long the files of finished tasks are kept, 0 to keep them")
+	flag.DurationVar(&hostCheckInterval, "host-check-interval", 10*time.Minute, "how often the SSH ports of the registered hosts are checked, 0 to disable")
+	flag.IntVar(&resultKeepRuns, "result-keep-runs", 0, "how many finished tasks per playbook keep their files, 0 for all")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file to serve HTTPS with, along with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of -tls-cert")
+	flag.StringVar(&tlsAutocert, "tls-autocert", "", "comma separated domains to get Let's Encrypt certificates for")
+	flag.StringVar(&tlsAutocertCache, "tls-autocert-cache", "", "directory the Let's Encrypt certificates are kept in, .autocert of the data dir if empty")
+	flag.StringVar(&tlsHTTPAddress, "tls-http", "", "address for plain HTTP that redirects to HTTPS and answers ACME challenges, e.g. :80")
+	flag.StringVar(&logFormat, "log-format", LOG_FORMAT_TEXT, "format of the log lines, text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "lowest level logged: debug, info, warn or error")
+	flag.StringVar(&brokerURL, "broker", "", "redis:// or nats:// URL that hands tasks to worker processes, which share the database and data dir")
+	flag.StringVar(&mode, "mode", MODE_ALL, "all to serve and run tasks, web to only serve or worker to only run tasks from the -broker. "+
+		"Only the process running a task streams its output and progress, /stream/:id of another sends its saved steps")
+	flag.StringVar(&nodeName, "node-name", "", "name of this process among the workers, the host name if empty")
+	flag.IntVar(&rateLimitIP, "rate-limit-ip", 0, "tasks a client IP may create or run per minute, 0 for unlimited")
+	flag.IntVar(&rateLimitUser, "rate-limit-user", 0, "tasks a user may create or run per minute, 0 for unlimited")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 0, "how many of the rate limited requests may come at once, the per minute limit if 0")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long an Idempotency-Key is remembered")
 	os.Setenv("ANSIBLE_STDOUT_CALLBACK", "json")
 }
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	serverLog := logger("server")
+	serverLog.Info("ansible runner web", "version", version, "commit", commit, "built", buildDate)
+
+	if workerCount < 1 {
+		serverLog.Warn("invalid -workers", "workers", workerCount, "using", DEFAULT_WORKERS)
+		workerCount = DEFAULT_WORKERS
+	}
+	if taskTimeout <= 0 {
+		serverLog.Warn("invalid -timeout", "timeout", taskTimeout, "using", DEFAULT_TASK_TIMEOUT)
+		taskTimeout = DEFAULT_TASK_TIMEOUT
+	}
+	if maxTaskTimeout < taskTimeout {
+		serverLog.Warn("-max-timeout is below -timeout", "max_timeout", maxTaskTimeout, "using", taskTimeout)
+		maxTaskTimeout = taskTimeout
+	}
+
+	if err := checkTLSFlags(); err != nil {
+		fatal("invalid TLS flags", "error", err)
+	}
+
+	var err error
+	if config, err = loadConfig(configPath); err != nil {
+		fatal("failed to load config", "error", err)
+	}
+
+	if webhookURL != "" {
+		if err := checkWebhookURL(webhookURL); err != nil {
+			fatal("invalid webhook", "error", err)
+		}
+	}
+
+	if resultKeepRuns < 0 {
+		fatal("invalid -result-keep-runs", "result_keep_runs", resultKeepRuns)
+	}
+	if err := setupRateLimits(); err != nil {
+		fatal("invalid rate limit", "error", err)
+	}
+	if err := setupBroker(); err != nil {
+		fatal("invalid broker", "error", err)
+	}
+
+	if err := checkGalaxyCache(); err != nil {
+		fatal("invalid -galaxy-cache", "error", err)
+	}
+
+	if vaultPassScript != "" {
+		if err := checkVaultPasswordScript(vaultPassScript); err != nil {
+			fatal("invalid vault password script", "error", err)
+		}
+	}
+
+	if err := setupCredentialKey(); err != nil {
+		fatal("invalid credential key", "error", err)
+	}
+
+	if err := setupSessions(); err != nil {
+		fatal("failed to set up sessions", "error", err)
+	}
+
+	if config.TaskPaths {
+		if err := setupTaskPaths(); err != nil {
+			fatal("failed to install the task_paths callback", "error", err)
+		}
+	}
 
 	setupDB()
+	if err := ensureAdminUser(); err != nil {
+		fatal("failed to create the admin user", "error", err)
+	}
+	recoverTasks()
+	recoverProjects()
 
 	gin.SetMode(gin.ReleaseMode)
 	gin.DefaultWriter = io.Discard
 
 	r := gin.Default()
-	templ := template.Must(template.New("").ParseFS(fs, "templates/*.html"))
+	r.Use(requestID, strictTransport, csrfProtect)
+	templ := template.Must(template.New("").Funcs(template.FuncMap{
+		"needsApproval": needsApproval,
+		"statusText":    statusText,
+	}).ParseFS(fs, "templates/*.html"))
 	r.SetHTMLTemplate(templ)
-	r.GET("/", showIndex)
-	r.GET("/task", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "createTask.html", gin.H{})
+	// any logged in user may read, see roles.go for the rest
+	operator := requireRole(ROLE_OPERATOR)
+	approver := requireRole(ROLE_APPROVER)
+	admin := requireRole(ROLE_ADMIN)
+	// what belongs to other teams looks like it doesn't exist
+	taskTeam := teamAccess("tasks", "task_id", errTaskNotFound)
+	playbookTeam := teamAccess("playbooks", "id", errAPINotFound)
+	inventoryTeam := teamAccess("inventories", "id", errAPINotFound)
+	hostTeam := teamAccess("hosts", "id", errHostNotFound)
+	factsTeam := teamAccess("host_facts", "id", errFactsNotFound)
+	workflowTeam := teamAccess("workflows", "id", errWorkflowNotFound)
+	libraryPlaybookTeam := teamAccess(libraryPlaybooks.table, "id", libraryPlaybooks.notFound)
+	libraryInventoryTeam := teamAccess(libraryInventories.table, "id", libraryInventories.notFound)
+	projectTeam := teamAccess("projects", "id", errProjectNotFound)
+	r.GET("/", requireLogin, showIndex)
+	r.GET("/version", showVersion)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/login", showLogin)
+	r.POST("/login", login)
+	r.GET("/logout", logout)
+	r.GET("/task", requireLogin, operator, func(c *gin.Context) {
+		var credentials []Credential
+		db.Order("name").Find(&credentials)
+		var playbooks []LibraryPlaybook
+		db.Scopes(inTeams(c, "library_playbooks.team_id")).Select("id", "name").Order("name").Find(&playbooks)
+		var inventories []LibraryInventory
+		db.Scopes(inTeams(c, "library_inventories.team_id")).Select("id", "name").Order("name").Find(&inventories)
+		var projects []Project
+		db.Scopes(inTeams(c, "projects.team_id")).Select("id", "name").Where("commit_sha <> ?", "").Order("name").Find(&projects)
+		var teams []Team
+		db.Scopes(inTeams(c, "teams.id")).Order("name").Find(&teams)
+		c.HTML(http.StatusOK, "createTask.html", gin.H{
+			"csrf":          csrfToken(c),
+			"environments":  config.environmentNames(),
+			"default":       DEFAULT_ENVIRONMENT,
+			"credentials":   credentials,
+			"teams":         teams,
+			"playbooks":     playbooks,
+			"inventories":   inventories,
+			"projects":      projects,
+			"vaultIDs":      config.vaultIDLabels(),
+			"executor":      config.Executor,
+			"timeout":       taskTimeout,
+			"maxTimeout":    maxTaskTimeout,
+			"maxSSHTimeout": MAX_SSH_TIMEOUT,
+		})
 	})
-	r.GET("/task/:id", showTask)
-	r.POST("/task", createTask)
-	r.GET("/result/:id", showResult)
-	r.GET("/runTask/:id", func(c *gin.Context) {
-		taskId := c.Param("id")
-		taskChan <- taskId
-		c.Redirect(302, "/")
+	r.GET("/task/:id", requireLogin, taskTeam, showTask)
+	r.POST("/task", requireLogin, operator, rateLimit, audit(AUDIT_CREATE, AUDIT_TASK), createTask)
+	r.GET("/task/:id/status", requireLogin, taskTeam, showTaskStatus)
+	r.GET("/task/:id/options", requireLogin, taskTeam, showTaskOptions)
+	r.GET("/task/:id/artifacts", requireLogin, taskTeam, listArtifacts)
+	r.GET("/task/:id/artifacts/*file", requireLogin, taskTeam, downloadArtifact)
+	r.GET("/result/:id", requireLogin, taskTeam, showResult)
+	r.GET("/result/:id/events.ndjson", requireLogin, taskTeam, showResultEvents)
+	r.GET("/stream", requireLogin, streamRunningTasks)
+	r.GET("/stream/:id", requireLogin, taskTeam, streamTask)
+	r.GET("/events/task/:id", requireLogin, taskTeam, streamTaskEvents)
+	r.GET("/events/tasks", requireLogin, streamTaskListEvents)
+	r.GET("/api/v1/tasks", requireAPILogin, apiListTasks)
+	r.POST("/api/v1/tasks", requireAPILogin, operator, rateLimit, audit(AUDIT_CREATE, AUDIT_TASK), apiCreateTask)
+	r.GET("/api/v1/tasks/:id", requireAPILogin, taskTeam, apiShowTask)
+	r.DELETE("/api/v1/tasks/:id", requireAPILogin, taskTeam, operator, audit(AUDIT_DELETE, AUDIT_TASK), apiDeleteTask)
+	r.POST("/api/v1/tasks/:id/run", requireAPILogin, taskTeam, operator, rateLimit, audit(AUDIT_RUN, AUDIT_TASK), apiCreateRun)
+	r.POST("/api/v1/tasks/:id/runs", requireAPILogin, taskTeam, operator, rateLimit, audit(AUDIT_RUN, AUDIT_TASK), apiCreateRun)
+	r.GET("/api/v1/tasks/:id/runs", requireAPILogin, taskTeam, apiListRuns)
+	r.GET("/api/v1/tasks/:id/runs/:run_id", requireAPILogin, taskTeam, apiShowRun)
+	r.GET("/api/v1/tasks/:id/attempts", requireAPILogin, taskTeam, apiListTaskAttempts)
+	r.GET("/api/v1/tasks/:id/progress", requireAPILogin, taskTeam, apiShowTaskProgress)
+	r.POST("/api/v1/tasks/:id/rerun", requireAPILogin, taskTeam, operator, rateLimit, audit(AUDIT_RUN, AUDIT_TASK), apiRerunTask)
+	r.GET("/api/v1/tasks/export.csv", requireAPILogin, exportTasks)
+	r.GET("/api/v1/tasks/search", requireAPILogin, apiSearchTasks)
+	r.POST("/api/v1/tasks/bulk", requireAPILogin, operator, rateLimit, apiBulkTasks)
+	// playbooks and inventories are created and removed along with their task
+	r.GET("/api/v1/playbooks", requireAPILogin, apiListPlaybooks)
+	r.GET("/api/v1/playbooks/:id", requireAPILogin, playbookTeam, apiShowPlaybook)
+	r.PUT("/api/v1/playbooks/:id", requireAPILogin, playbookTeam, operator, audit(AUDIT_UPDATE, AUDIT_PLAYBOOK), apiUpdatePlaybook)
+	r.GET("/api/v1/library/playbooks", requireAPILogin, libraryPlaybooks.list)
+	r.POST("/api/v1/library/playbooks", requireAPILogin, operator, audit(AUDIT_CREATE, AUDIT_LIBRARY_PLAYBOOK), libraryPlaybooks.create)
+	r.GET("/api/v1/library/playbooks/:id", requireAPILogin, libraryPlaybookTeam, libraryPlaybooks.show)
+	r.PUT("/api/v1/library/playbooks/:id", requireAPILogin, libraryPlaybookTeam, operator, audit(AUDIT_UPDATE, AUDIT_LIBRARY_PLAYBOOK), libraryPlaybooks.update)
+	r.DELETE("/api/v1/library/playbooks/:id", requireAPILogin, libraryPlaybookTeam, operator, audit(AUDIT_DELETE, AUDIT_LIBRARY_PLAYBOOK), libraryPlaybooks.delete)
+	r.GET("/api/v1/library/inventories", requireAPILogin, libraryInventories.list)
+	r.POST("/api/v1/library/inventories", requireAPILogin, operator, audit(AUDIT_CREATE, AUDIT_LIBRARY_INVENTORY), libraryInventories.create)
+	r.GET("/api/v1/library/inventories/:id", requireAPILogin, libraryInventoryTeam, libraryInventories.show)
+	r.PUT("/api/v1/library/inventories/:id", requireAPILogin, libraryInventoryTeam, operator, audit(AUDIT_UPDATE, AUDIT_LIBRARY_INVENTORY), libraryInventories.update)
+	r.POST("/api/v1/library/inventories/:id/refresh", requireAPILogin, libraryInventoryTeam, operator, apiRefreshLibraryInventory)
+	r.DELETE("/api/v1/library/inventories/:id", requireAPILogin, libraryInventoryTeam, operator, audit(AUDIT_DELETE, AUDIT_LIBRARY_INVENTORY), libraryInventories.delete)
+	r.GET("/api/v1/projects", requireAPILogin, apiListProjects)
+	r.POST("/api/v1/projects", requireAPILogin, admin, apiCreateProject)
+	r.GET("/api/v1/projects/:id", requireAPILogin, projectTeam, apiShowProject)
+	r.DELETE("/api/v1/projects/:id", requireAPILogin, projectTeam, admin, apiDeleteProject)
+	r.POST("/api/v1/projects/:id/sync", requireAPILogin, projectTeam, operator, apiSyncProject)
+	r.GET("/api/v1/projects/:id/playbooks", requireAPILogin, projectTeam, apiListProjectPlaybooks)
+	r.GET("/api/v1/hosts", requireAPILogin, apiListHosts)
+	r.GET("/api/v1/hosts/:id", requireAPILogin, hostTeam, apiShowHost)
+	r.PUT("/api/v1/hosts/:id", requireAPILogin, hostTeam, operator, audit(AUDIT_UPDATE, AUDIT_HOST), apiUpdateHost)
+	r.POST("/api/v1/hosts/:id/check", requireAPILogin, hostTeam, operator, apiCheckHost)
+	r.DELETE("/api/v1/hosts/:id", requireAPILogin, hostTeam, operator, audit(AUDIT_DELETE, AUDIT_HOST), apiDeleteHost)
+	r.GET("/api/v1/workflows", requireAPILogin, apiListWorkflows)
+	r.POST("/api/v1/workflows", requireAPILogin, operator, audit(AUDIT_CREATE, AUDIT_WORKFLOW), apiCreateWorkflow)
+	r.GET("/api/v1/workflows/:id", requireAPILogin, workflowTeam, apiShowWorkflow)
+	r.PUT("/api/v1/workflows/:id", requireAPILogin, workflowTeam, operator, audit(AUDIT_UPDATE, AUDIT_WORKFLOW), apiUpdateWorkflow)
+	r.DELETE("/api/v1/workflows/:id", requireAPILogin, workflowTeam, operator, audit(AUDIT_DELETE, AUDIT_WORKFLOW), apiDeleteWorkflow)
+	r.POST("/api/v1/workflows/:id/runs", requireAPILogin, workflowTeam, operator, rateLimit, audit(AUDIT_RUN, AUDIT_WORKFLOW), apiCreateWorkflowRun)
+	r.GET("/api/v1/workflows/:id/runs", requireAPILogin, workflowTeam, apiListWorkflowRuns)
+	r.GET("/api/v1/workflows/:id/runs/:run_id", requireAPILogin, workflowTeam, apiShowWorkflowRun)
+	r.POST("/api/v1/workflows/:id/runs/:run_id/cancel", requireAPILogin, workflowTeam, operator, audit(AUDIT_CANCEL, AUDIT_WORKFLOW), apiCancelWorkflowRun)
+	r.GET("/api/v1/facts", requireAPILogin, apiListFacts)
+	r.GET("/api/v1/facts/:id", requireAPILogin, factsTeam, apiShowFacts)
+	r.GET("/api/v1/inventories", requireAPILogin, apiListInventories)
+	r.GET("/api/v1/inventories/:id", requireAPILogin, inventoryTeam, apiShowInventory)
+	r.GET("/api/v1/inventories/:id/graph", requireAPILogin, inventoryTeam, apiShowInventoryGraph)
+	r.PUT("/api/v1/inventories/:id", requireAPILogin, inventoryTeam, admin, audit(AUDIT_UPDATE, AUDIT_INVENTORY), apiUpdateInventory)
+	r.GET("/api/v1/users", requireAPILogin, admin, apiListUsers)
+	r.POST("/api/v1/users", requireAPILogin, admin, apiCreateUser)
+	r.GET("/api/v1/users/:id", requireAPILogin, apiShowUser)
+	r.PUT("/api/v1/users/:id", requireAPILogin, apiUpdateUser)
+	r.DELETE("/api/v1/users/:id", requireAPILogin, admin, apiDeleteUser)
+	r.GET("/api/v1/credentials", requireAPILogin, apiListCredentials)
+	r.GET("/api/v1/known-hosts", requireAPILogin, apiShowKnownHosts)
+	r.PUT("/api/v1/known-hosts", requireAPILogin, admin, apiUpdateKnownHosts)
+	r.POST("/api/v1/credentials", requireAPILogin, admin, apiCreateCredential)
+	r.DELETE("/api/v1/credentials/:id", requireAPILogin, admin, apiDeleteCredential)
+	r.GET("/api/v1/tokens", requireAPILogin, apiListTokens)
+	r.POST("/api/v1/tokens", requireAPILogin, apiCreateToken)
+	r.DELETE("/api/v1/tokens/:id", requireAPILogin, apiRevokeToken)
+	r.GET("/api/v1/search", requireAPILogin, searchTasks)
+	r.GET("/api/v1/teams", requireAPILogin, apiListTeams)
+	r.POST("/api/v1/teams", requireAPILogin, admin, apiCreateTeam)
+	r.GET("/api/v1/teams/:id", requireAPILogin, apiShowTeam)
+	r.PUT("/api/v1/teams/:id", requireAPILogin, admin, apiUpdateTeam)
+	r.DELETE("/api/v1/teams/:id", requireAPILogin, admin, apiDeleteTeam)
+	r.PUT("/api/v1/teams/:id/members/:user_id", requireAPILogin, admin, apiAddTeamMember)
+	r.DELETE("/api/v1/teams/:id/members/:user_id", requireAPILogin, admin, apiRemoveTeamMember)
+	r.GET("/api/v1/audit", requireAPILogin, admin, apiListAuditEvents)
+	r.GET("/api/openapi.json", requireLogin, showOpenAPIDoc)
+	r.GET("/api/docs", requireLogin, showAPIDocs)
+	r.POST("/task/:id/run", requireLogin, taskTeam, operator, rateLimit, audit(AUDIT_RUN, AUDIT_TASK), runTask)
+	r.GET("/cancelTask/:id", requireLogin, taskTeam, operator, audit(AUDIT_CANCEL, AUDIT_TASK), cancelTask)
+	r.GET("/approveTask/:id", requireLogin, taskTeam, approver, audit(AUDIT_APPROVE, AUDIT_TASK), approveTask)
+	r.POST("/deleteTask/:id", requireLogin, taskTeam, operator, audit(AUDIT_DELETE, AUDIT_TASK), deleteTask)
+	r.GET("/trash", requireLogin, showTrash)
+	r.GET("/hosts", requireLogin, showHosts)
+	r.POST("/hosts/:id/check", requireLogin, hostTeam, operator, checkHostNow)
+	r.POST("/trash/:id/restore", requireLogin, taskTeam, operator, audit(AUDIT_RESTORE, AUDIT_TASK), restoreTask)
+	r.POST("/trash/:id/purge", requireLogin, taskTeam, admin, audit(AUDIT_PURGE, AUDIT_TASK), purgeTrashedTask)
+	r.POST("/inventories/:id/lock", requireLogin, inventoryTeam, admin, audit(AUDIT_LOCK, AUDIT_INVENTORY), lockInventory)
+	r.POST("/inventories/:id/unlock", requireLogin, inventoryTeam, admin, audit(AUDIT_UNLOCK, AUDIT_INVENTORY), unlockInventory)
+	r.GET("/queue", requireLogin, showQueue)
+	r.GET("/workers", requireLogin, listWorkers)
+	r.POST("/workers/:id/drain", requireAPILogin, admin, drainWorker)
+	r.POST("/workers/:id/resume", requireAPILogin, admin, resumeWorker)
+	r.GET("/playbookLimits", requireLogin, listPlaybookLimits)
+	r.POST("/playbookLimits", requireAPILogin, admin, setPlaybookLimit)
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			apiNotFound(c)
+		}
 	})
+	if openAPIDoc, err = buildOpenAPIDoc(r.Routes()); err != nil {
+		fatal("failed to build the OpenAPI doc", "error", err)
+	}
 
-	srv := &http.Server{Addr: address, Handler: r}
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
+	var srv *http.Server
+	if servesWeb() {
+		srv = &http.Server{Addr: address, Handler: r}
+		go func() {
+			if err := serve(srv); err != nil && err != http.ErrServerClosed {
+				fatal("listen", "error", err)
+			}
+		}()
+		go startApprovalExpiry()
+		go startTrashJanitor()
+		go startResultJanitor()
+		go startHostChecks()
+		go startWorkflowScheduler()
+	}
 
 	wait := sync.WaitGroup{}
-	for i := 0; i < 2; i++ {
-		wait.Add(1)
-		go startRunAnsiblePlaybookService(i, &wait)
+	if runsWorkers() {
+		for i := 0; i < workerCount; i++ {
+			wait.Add(1)
+			go startRunAnsiblePlaybookService(i, &wait)
+		}
+	}
+	if broker == nil {
+		go dispatchTasks()
+	} else if servesWeb() {
+		go republishQueued()
+	}
+	if broker != nil && runsWorkers() {
+		serverLog.Info("taking tasks from the broker", "broker", brokerURL, "node", nodeName, "mode", mode)
+		go consumeTasks()
+		go watchCancelRequests()
 	}
 
 	//
@@ -134,45 +570,231 @@ func main() {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		name := <-quit
-		fmt.Printf("Warn: received signal: %v\n", name)
-		close(taskChan)
+		serverLog.Warn("received signal", "signal", name)
+		// tasks left in the queue are still queued in the db for the next
+		// start
+		close(stopChan)
+
+		// the workers stop once their running task is done, a second
+		// signal or the end of the grace period interrupts those tasks
+		serverLog.Warn("waiting for running tasks, signal again to interrupt them",
+			"grace", shutdownGrace, "running", runningTaskCount())
+		select {
+		case <-time.After(shutdownGrace):
+		case <-quit:
+		}
+		serverLog.Warn("interrupted running tasks", "count", interruptRunningTasks())
 	}()
 
+	if !runsWorkers() {
+		<-stopChan
+	}
 	wait.Wait()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// open streams don't end by themselves
+		if err := srv.Shutdown(ctx); err != nil {
+			serverLog.Warn("closing remaining connections", "error", err)
+			srv.Close()
+		}
 	}
-	log.Println("Server exiting")
+	serverLog.Info("server exiting")
 }
 
 func setupDB() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("data.db"), &gorm.Config{})
+	dialector, err := openDialector(dbDSN)
 	if err != nil {
-		log.Fatalf("failed to connect database: %v", err)
+		fatal("invalid -db", "error", err)
+	}
+	db, err = gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		fatal("failed to connect database", "error", err)
 	}
 
 	if err := db.AutoMigrate(
-		&User{}, &Inventory{}, &Playbook{}, &Task{},
+		&User{}, &Inventory{}, &Playbook{}, &Task{}, &IdempotencyKey{},
+		&PlaybookRun{}, &PlaybookLimit{}, &UserRole{}, &Token{}, &Credential{},
+		&TaskAttempt{}, &Run{}, &TaskLock{}, &LibraryPlaybook{}, &LibraryInventory{}, &Project{},
+		&AuditEvent{}, &Team{}, &TeamMember{}, &Host{}, &HostFacts{},
+		&Workflow{}, &WorkflowRun{}, &WorkflowNodeRun{}, &TaskStep{},
 	); err != nil {
-		log.Fatalf("failed to migrate: %v", err)
+		fatal("failed to migrate", "error", err)
+	}
+	if err := migrateRoles(); err != nil {
+		fatal("failed to migrate roles", "error", err)
+	}
+	if err := migrateTeams(); err != nil {
+		fatal("failed to migrate teams", "error", err)
+	}
+	if err := migrateIdempotencyKeys(); err != nil {
+		fatal("failed to migrate idempotency keys", "error", err)
+	}
+
+	if searchIndex {
+		if db.Dialector.Name() != "sqlite" {
+			fatal("-search-index needs a sqlite database")
+		}
+		if err := setupSearchIndex(); err != nil {
+			fatal("failed to create search index, is the binary built with -tags sqlite_fts5?", "error", err)
+		}
+	}
+}
+
+// recoverTasks re-enqueues the tasks that were waiting in the queue when the
+// process stopped and marks those that were running as interrupted.
+// With a broker the workers only look after the tasks of their node, and
+// the web node only re-enqueues.
+func recoverTasks() {
+	if runsWorkers() {
+		running := db.Model(&Task{}).Where("status = ?", STATUS_RUNNING)
+		if broker != nil {
+			running = running.Where("node = ?", nodeName)
+		}
+		tx := running.Updates(map[string]interface{}{
+			"status":      STATUS_INTERRUPTED,
+			"error":       "interrupted by a restart of the server",
+			"finished_at": time.Now(),
+		})
+		if tx.Error != nil {
+			fatal("failed to recover running tasks", "error", tx.Error)
+		}
+		if tx.RowsAffected > 0 {
+			logger("queue").Warn("running tasks marked as interrupted", "count", tx.RowsAffected)
+		}
+		runs := db.Model(&Run{}).Where("status = ?", STATUS_RUNNING)
+		if broker != nil {
+			runs = runs.Where("node = ?", nodeName)
+		}
+		err := runs.Updates(map[string]interface{}{
+			"status":      STATUS_INTERRUPTED,
+			"error":       "interrupted by a restart of the server",
+			"finished_at": time.Now(),
+		}).Error
+		if err != nil {
+			fatal("failed to recover running runs", "error", err)
+		}
+		if err := releaseStaleLocks(); err != nil {
+			fatal("failed to release task locks", "error", err)
+		}
+	}
+	if !servesWeb() {
+		return
+	}
+
+	var queued []Task
+	if err := db.Select("task_id", "priority", "retry_at").Where("queued = ?", true).Order("id").Find(&queued).Error; err != nil {
+		fatal("failed to recover queued tasks", "error", err)
+	}
+	if len(queued) == 0 {
+		return
 	}
+	logger("queue").Warn("re-enqueue queued tasks", "count", len(queued))
+	go func() {
+		for _, task := range queued {
+			// a retry waits for the rest of its backoff
+			if delay := time.Until(task.RetryAt); delay > 0 {
+				enqueueTaskAfter(task.TaskID, task.Priority, delay)
+				continue
+			}
+			if !enqueueTask(task.TaskID, task.Priority) {
+				return
+			}
+		}
+	}()
+}
+
+const (
+	DEFAULT_PAGE_SIZE = 10
+	MAX_PAGE_SIZE     = 100
+)
+
+// pagination reads page and page_size, or its alias per_page, from the
+// query string. Bad values are clamped into range instead of rejected.
+func pagination(c *gin.Context, total int64) (page, pageSize, pages int) {
+	pageSize = queryInt(c, "per_page", queryInt(c, "page_size", DEFAULT_PAGE_SIZE))
+	if pageSize < 1 {
+		pageSize = DEFAULT_PAGE_SIZE
+	} else if pageSize > MAX_PAGE_SIZE {
+		pageSize = MAX_PAGE_SIZE
+	}
+	pages = int((total + int64(pageSize) - 1) / int64(pageSize))
+	if pages < 1 {
+		pages = 1
+	}
+	page = queryInt(c, "page", 1)
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	return page, pageSize, pages
 }
 
 func showIndex(c *gin.Context) {
-	var tasks []Task
-	tx := db.Preload("Playbook").Preload("Inventory").Preload("User").Order("id desc").Limit(10).Find(&tasks)
+	var total int64
+	if err := filterTasks(c, db.Model(&Task{})).Count(&total).Error; err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	page, pageSize, pages := pagination(c, total)
 
+	var tasks []Task
+	tx := filterTasks(c, db.Preload("Playbook").Preload("Inventory").Preload("User")).
+		Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&tasks)
 	if tx.Error != nil {
 		c.JSON(400, gin.H{"error": tx.Error.Error()})
+		return
+	}
+
+	pageURL := func(n int) string {
+		q := c.Request.URL.Query()
+		q.Set("page", strconv.Itoa(n))
+		q.Del("per_page")
+		q.Set("page_size", strconv.Itoa(pageSize))
+		return "/?" + q.Encode()
+	}
+	var prev, next string
+	if page > 1 {
+		prev = pageURL(page - 1)
+	}
+	if page < pages {
+		next = pageURL(page + 1)
 	}
 	c.HTML(http.StatusOK, "index.html", gin.H{
-		"tasks": tasks,
+		"csrf":     csrfToken(c),
+		"tasks":    tasks,
+		"total":    total,
+		"page":     page,
+		"pages":    pages,
+		"prev":     prev,
+		"next":     next,
+		"status":   c.Query("status"),
+		"q":        c.Query("q"),
+		"name":     c.Query("name"),
+		"creator":  c.Query("creator"),
+		"from":     c.Query("from"),
+		"to":       c.Query("to"),
+		"statuses": statusTexts(),
+		// milliseconds for setInterval
+		"pollInterval": pollInterval.Milliseconds(),
+		"operator":     hasRole(currentUser(c), ROLE_OPERATOR),
+		"approver":     hasRole(currentUser(c), ROLE_APPROVER),
+		"userID":       currentUser(c).ID,
 	})
 }
 
+// queryInt returns the integer query param key, or def if it is missing or
+// not a number.
+func queryInt(c *gin.Context, key string, def int) int {
+	n, err := strconv.Atoi(c.Query(key))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
 func showTask(c *gin.Context) {
 	taskId := c.Param("id")
 	var task Task
@@ -180,9 +802,11 @@ func showTask(c *gin.Context) {
 
 	var playbookContent, inventoryContent string
 	var err error
-	playbookContent, err = readFile(task.Playbook.Path)
-	if err != nil {
-		playbookContent = err.Error()
+	if !task.AdHoc() {
+		playbookContent, err = readFile(task.Playbook.Path)
+		if err != nil {
+			playbookContent = err.Error()
+		}
 	}
 	inventoryContent, err = readFile(task.Inventory.Path)
 	if err != nil {
@@ -190,92 +814,746 @@ func showTask(c *gin.Context) {
 	}
 
 	c.IndentedJSON(http.StatusOK, gin.H{
-		"task":      task,
-		"playbook":  playbookContent,
-		"inventory": inventoryContent,
+		"task":           task,
+		"exit_code_text": exitCodeText(task.ExitCode),
+		"playbook":       playbookContent,
+		"inventory":      inventoryContent,
 	})
 }
 
+// TaskRequest is what a task is created from, filled in from the form by
+// createTask and from the JSON body by apiCreateTask.
+type TaskRequest struct {
+	Name      string `json:"name"`
+	Playbook  string `json:"playbook"`
+	Inventory string `json:"inventory"`
+	// InventorySpec is a structured inventory instead of Inventory
+	InventorySpec *InventorySpec `json:"inventory_spec"`
+	// Hosts is the target of a playbook that isn't raw, the servers group
+	// of Inventory or all hosts of another inventory by default
+	Hosts             string                 `json:"hosts"`
+	Environment       string                 `json:"environment"`
+	ExtraVars         map[string]interface{} `json:"extra_vars"`
+	RawPlaybook       bool                   `json:"raw_playbook"`
+	Become            bool                   `json:"become"`
+	Check             bool                   `json:"check"`
+	Diff              bool                   `json:"diff"`
+	Tags              string                 `json:"tags"`
+	SkipTags          string                 `json:"skip_tags"`
+	Limit             string                 `json:"limit"`
+	ArtifactsDir      string                 `json:"artifacts_dir"`
+	SSHUser           string                 `json:"ssh_user"`
+	SSHPort           int                    `json:"ssh_port"`
+	SSHPrivateKeyFile string                 `json:"ssh_private_key_file"`
+	SSHTimeout        int                    `json:"ssh_timeout"`
+	CredentialID      uint                   `json:"credential_id"`
+	MaxAttempts       uint                   `json:"max_attempts"`
+	RetryBackoff      string                 `json:"retry_backoff"`
+	Priority          int                    `json:"priority"`
+	Image             string                 `json:"image"`
+	LockKey           string                 `json:"lock_key"`
+	Timeout           string                 `json:"timeout"`
+	Verbosity         int                    `json:"verbosity"`
+	// LibraryPlaybookID and LibraryInventoryID take the playbook and the
+	// inventory from the library instead
+	LibraryPlaybookID  uint `json:"library_playbook_id"`
+	LibraryInventoryID uint `json:"library_inventory_id"`
+	// ProjectPlaybook is the path of the playbook inside project ProjectID
+	ProjectID       uint   `json:"project_id"`
+	ProjectPlaybook string `json:"project_playbook"`
+	// Module runs a single module with ModuleArgs instead of a playbook
+	Module     string `json:"module"`
+	ModuleArgs string `json:"module_args"`
+	// GatherFacts runs the setup module and keeps the facts of the hosts
+	GatherFacts bool `json:"gather_facts"`
+	// TeamID is the team the task goes to, the first of the user if 0
+	TeamID uint `json:"team_id"`
+	// Requirements is a requirements.yml, a project task uses the one of
+	// the project without it
+	Requirements string `json:"requirements"`
+	// VaultIDs are labels of the vault_ids config
+	VaultIDs []string `json:"vault_ids"`
+}
+
 func createTask(c *gin.Context) {
-	taskName := c.PostForm("name")
-	playbookContent := c.PostForm("playbook")
-	inventoryContent := c.PostForm("inventory")
+	req := TaskRequest{
+		Name:              c.PostForm("name"),
+		Playbook:          c.PostForm("playbook"),
+		Inventory:         c.PostForm("inventory"),
+		Environment:       c.PostForm("environment"),
+		RawPlaybook:       formBool(c, "raw"),
+		Become:            formBool(c, "become"),
+		Check:             formBool(c, "check"),
+		Diff:              formBool(c, "diff"),
+		Tags:              c.PostForm("tags"),
+		SkipTags:          c.PostForm("skip_tags"),
+		Limit:             c.PostForm("limit"),
+		Hosts:             c.PostForm("hosts"),
+		Module:            strings.TrimSpace(c.PostForm("module")),
+		ModuleArgs:        c.PostForm("module_args"),
+		GatherFacts:       formBool(c, "gather_facts"),
+		Requirements:      c.PostForm("requirements"),
+		VaultIDs:          c.PostFormArray("vault_ids"),
+		ArtifactsDir:      c.PostForm("artifacts_dir"),
+		SSHUser:           c.PostForm("ssh_user"),
+		SSHPrivateKeyFile: c.PostForm("ssh_private_key_file"),
+		RetryBackoff:      strings.TrimSpace(c.PostForm("retry_backoff")),
+		Image:             strings.TrimSpace(c.PostForm("image")),
+		LockKey:           c.PostForm("lock_key"),
+		Timeout:           strings.TrimSpace(c.PostForm("timeout")),
+	}
+	var err error
+	if n := strings.TrimSpace(c.PostForm("max_attempts")); n != "" {
+		attempts, err := strconv.ParseUint(n, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid max attempts %q", n)})
+			return
+		}
+		req.MaxAttempts = uint(attempts)
+	}
+	if p := strings.TrimSpace(c.PostForm("priority")); p != "" {
+		if req.Priority, err = strconv.Atoi(p); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid priority %q", p)})
+			return
+		}
+	}
+	if v := strings.TrimSpace(c.PostForm("verbosity")); v != "" {
+		if req.Verbosity, err = strconv.Atoi(v); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid verbosity %q", v)})
+			return
+		}
+	}
+	if id := strings.TrimSpace(c.PostForm("library_playbook_id")); id != "" {
+		n, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid library playbook %q", id)})
+			return
+		}
+		req.LibraryPlaybookID = uint(n)
+	}
+	if id := strings.TrimSpace(c.PostForm("library_inventory_id")); id != "" {
+		n, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid library inventory %q", id)})
+			return
+		}
+		req.LibraryInventoryID = uint(n)
+	}
+	if id := strings.TrimSpace(c.PostForm("project_id")); id != "" {
+		n, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid project %q", id)})
+			return
+		}
+		req.ProjectID = uint(n)
+		req.ProjectPlaybook = c.PostForm("project_playbook")
+	}
+	if id := strings.TrimSpace(c.PostForm("team_id")); id != "" {
+		n, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid team %q", id)})
+			return
+		}
+		req.TeamID = uint(n)
+	}
+	if id := strings.TrimSpace(c.PostForm("credential_id")); id != "" {
+		n, err := strconv.ParseUint(id, 10, 0)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid credential %q", id)})
+			return
+		}
+		req.CredentialID = uint(n)
+	}
+	if port := strings.TrimSpace(c.PostForm("ssh_port")); port != "" {
+		if req.SSHPort, err = strconv.Atoi(port); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ssh port %q", port)})
+			return
+		}
+	}
+	if t := strings.TrimSpace(c.PostForm("ssh_timeout")); t != "" {
+		if req.SSHTimeout, err = strconv.Atoi(t); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ssh timeout %q", t)})
+			return
+		}
+	}
+	if spec := strings.TrimSpace(c.PostForm("inventory_spec")); spec != "" {
+		if req.InventorySpec, err = parseInventorySpec(spec); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.ExtraVars, err = parseExtraVars(c.PostForm("extra_vars")); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, _, err := newTaskFromRequest(c.Request.Context(), &req, currentUser(c), c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(auditObjectKey, task.TaskID)
+	c.IndentedJSON(http.StatusOK, task)
+}
+
+// newTaskFromRequest validates req and writes the playbook, inventory and
+// task. With an idempotency key the task created earlier with the same key
+// is returned instead, created tells them apart. ctx is that of the request
+// and bounds the validation. Errors carry an HTTP status for errorStatus.
+func newTaskFromRequest(ctx context.Context, req *TaskRequest, user *User, idempotencyKey string) (task *Task, created bool, err error) {
 	taskID := uuid.New().String()
 
-	var w bytes.Buffer
-	w.WriteString("- hosts: servers\n")
-	w.WriteString("  tasks:\n")
-	playbookContent = strings.ReplaceAll(playbookContent, "\r", "")
-	for _, v := range strings.Split(playbookContent, "\n") {
-		w.WriteString("  " + v + "\n")
+	artifactsDir, err := cleanArtifactsDir(req.ArtifactsDir)
+	if err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	if req.SSHPort < 0 || req.SSHPort > 65535 {
+		return nil, false, withStatus(http.StatusBadRequest, fmt.Errorf("invalid ssh port %d", req.SSHPort))
+	}
+	if err := checkSSHTimeout(req.SSHTimeout); err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	if err := checkRetryPolicy(req.MaxAttempts, req.RetryBackoff); err != nil {
+		return nil, false, err
+	}
+	if err := checkPriority(req.Priority); err != nil {
+		return nil, false, err
+	}
+	if err := config.Executor.checkImage(req.Image); err != nil {
+		return nil, false, err
+	}
+	lockKey, err := cleanLockKey(req.LockKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkTaskTimeout(req.Timeout); err != nil {
+		return nil, false, err
+	}
+	if err := checkVerbosity(req.Verbosity); err != nil {
+		return nil, false, err
+	}
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	skipTags, err := cleanTags(req.SkipTags)
+	if err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	limit, err := cleanLimit(req.Limit)
+	if err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	vaultIDs, err := cleanVaultIDs(req.VaultIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	requirements := strings.ReplaceAll(req.Requirements, "\r", "")
+	if strings.TrimSpace(requirements) != "" {
+		if _, _, err := requirementsKinds(requirements); err != nil {
+			return nil, false, withStatus(http.StatusBadRequest, err)
+		}
 	}
 
-	playbookPath := filepath.Join(rootDir, taskID, "site.yaml")
-	if err := writeFile(playbookPath, w.String()); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
+	var extraVars string
+	if len(req.ExtraVars) > 0 {
+		raw, err := json.Marshal(req.ExtraVars)
+		if err != nil {
+			return nil, false, withStatus(http.StatusBadRequest, fmt.Errorf("invalid extra vars: %v", err))
+		}
+		extraVars = string(raw)
 	}
 
-	playbook := Playbook{
-		Name:    taskName,
-		Path:    playbookPath,
-		Creator: "admin",
+	// a task from a project or the library goes to its team
+	if req.TeamID == 0 {
+		req.TeamID = referencedTeam(req)
 	}
-	if err := db.Create(&playbook).Error; err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
+	if req.TeamID, err = requestTeam(user, req.TeamID); err != nil {
+		return nil, false, err
+	}
+
+	envName := req.Environment
+	if envName == "" {
+		envName = DEFAULT_ENVIRONMENT
+	}
+	env, ok := config.environment(envName)
+	if !ok {
+		return nil, false, withStatus(http.StatusBadRequest, fmt.Errorf("unknown environment %q", envName))
+	}
+	inventoryName := req.Name
+	var li *LibraryInventory
+	if req.LibraryInventoryID != 0 {
+		if li, err = useLibraryInventory(req); err != nil {
+			return nil, false, err
+		}
+		inventoryName = li.Name
+	}
+	switch {
+	case li != nil && li.Plugin != "":
+		if err := checkDynamicInventory(li, envName, user); err != nil {
+			return nil, false, err
+		}
+	case req.InventorySpec != nil:
+		if strings.TrimSpace(req.Inventory) != "" {
+			return nil, false, withStatus(http.StatusBadRequest, errors.New("give either an inventory or an inventory spec, not both"))
+		}
+		if err := checkInventorySpec(req.InventorySpec, envName, user); err != nil {
+			return nil, false, err
+		}
+	default:
+		if err := checkInventory(req.Inventory, envName, user); err != nil {
+			return nil, false, err
+		}
+	}
+	playHosts, err := cleanPlayHosts(req.Hosts, (li == nil || li.Plugin == "") && req.InventorySpec == nil)
+	if err != nil {
+		return nil, false, withStatus(http.StatusBadRequest, err)
+	}
+	if err := checkCredential(req.CredentialID); err != nil {
+		return nil, false, err
+	}
+
+	if idempotencyKey != "" {
+		existing, err := reserveIdempotencyKey(user.ID, idempotencyKey)
+		if err == errIdempotencyKeyInProgress {
+			return nil, false, withStatus(http.StatusConflict, err)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil {
+			return existing, false, nil
+		}
+		// release the reservation unless the task was actually created,
+		// so that a retry after a failure is not answered with a 409.
+		defer func() {
+			if !created {
+				releaseIdempotencyKey(user.ID, idempotencyKey)
+				return
+			}
+			if err := completeIdempotencyKey(user.ID, idempotencyKey, task.ID); err != nil {
+				logger("api").Error("failed to store idempotency key", "key", idempotencyKey, "error", err)
+			}
+		}()
+	}
+
+	playbookName := req.Name
+	var project *Project
+	var site string
+	if req.GatherFacts {
+		if err := checkGatherFacts(req); err != nil {
+			return nil, false, err
+		}
+	}
+	if req.Module != "" {
+		if err := checkAdHoc(req); err != nil {
+			return nil, false, err
+		}
+		playbookName = req.Module
+	} else if req.ProjectID != 0 {
+		if project, err = useProject(req); err != nil {
+			return nil, false, err
+		}
+		playbookName = project.Name + ":" + req.ProjectPlaybook
+	} else {
+		if req.LibraryPlaybookID != 0 {
+			lp, err := useLibraryPlaybook(req)
+			if err != nil {
+				return nil, false, err
+			}
+			playbookName = lp.Name
+		}
+		if strings.TrimSpace(req.Playbook) == "" {
+			return nil, false, withStatus(http.StatusBadRequest, errors.New("playbook is required"))
+		}
+		if site, err = renderPlaybook(req.Playbook, req.RawPlaybook, playHosts); err != nil {
+			return nil, false, withStatus(http.StatusBadRequest, err)
+		}
+	}
+
+	// nothing of a task that isn't created is kept
+	defer func() {
+		if !created {
+			os.RemoveAll(filepath.Join(rootDir, taskID))
+		}
+	}()
+
+	playbookPath := filepath.Join(rootDir, taskID, "site.yaml")
+	switch {
+	case req.Module != "":
+		playbookPath = ""
+	case project != nil:
+		if playbookPath, err = snapshotProject(project, req.ProjectPlaybook, filepath.Join(rootDir, taskID)); err != nil {
+			return nil, false, err
+		}
+	default:
+		if err := writeFile(playbookPath, site); err != nil {
+			return nil, false, err
+		}
 	}
 
-	w.Reset()
-	w.WriteString("[servers]\n")
-	w.WriteString(inventoryContent)
+	var requirementsPath string
+	if strings.TrimSpace(requirements) != "" {
+		requirementsPath = filepath.Join(rootDir, taskID, REQUIREMENTS_FILE)
+		if err := writeFile(requirementsPath, requirements); err != nil {
+			return nil, false, err
+		}
+	} else if project != nil {
+		requirementsPath = findProjectRequirements(filepath.Join(rootDir, taskID, PROJECT_DIR))
+	}
 
 	inventoryPath := filepath.Join(rootDir, taskID, "inventory.ini")
-	if err := writeFile(inventoryPath, w.String()); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	inventoryContent := renderInventory(req.Inventory)
+	if li != nil && li.Plugin != "" {
+		inventoryPath = filepath.Join(rootDir, taskID, dynamicInventoryFile(li.Plugin))
+		inventoryContent = renderPluginInventory(li)
 	}
-	inventory := Inventory{
-		Name:    taskName,
-		Path:    inventoryPath,
-		Creator: "admin",
+	if req.InventorySpec != nil {
+		if inventoryPath, err = writeInventorySpec(filepath.Join(rootDir, taskID), req.InventorySpec); err != nil {
+			return nil, false, err
+		}
+	} else if err := writeFile(inventoryPath, inventoryContent); err != nil {
+		return nil, false, err
 	}
-	if err := db.Create(&inventory).Error; err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
+
+	task = &Task{
+		TaskID: taskID,
+		Name:   req.Name,
+		Status: STATUS_WAITING,
+		Playbook: Playbook{
+			Name:     playbookName,
+			Path:     playbookPath,
+			Creator:  user.Name,
+			VaultIDs: vaultIDs,
+			TeamID:   req.TeamID,
+		},
+		Inventory: Inventory{
+			Name:    inventoryName,
+			Path:    inventoryPath,
+			Creator: user.Name,
+			TeamID:  req.TeamID,
+		},
+		UserID:             user.ID,
+		TeamID:             req.TeamID,
+		ArtifactsDir:       artifactsDir,
+		Environment:        envName,
+		SSHUser:            strings.TrimSpace(req.SSHUser),
+		SSHPort:            req.SSHPort,
+		SSHPrivateKeyFile:  strings.TrimSpace(req.SSHPrivateKeyFile),
+		SSHTimeout:         req.SSHTimeout,
+		CredentialID:       req.CredentialID,
+		MaxAttempts:        req.MaxAttempts,
+		RetryBackoff:       req.RetryBackoff,
+		Priority:           req.Priority,
+		Image:              req.Image,
+		LockKey:            lockKey,
+		Timeout:            req.Timeout,
+		Verbosity:          req.Verbosity,
+		ExtraVars:          extraVars,
+		Become:             req.Become,
+		Check:              req.Check,
+		Diff:               req.Diff,
+		Tags:               tags,
+		SkipTags:           skipTags,
+		Limit:              limit,
+		Module:             req.Module,
+		ModuleArgs:         req.ModuleArgs,
+		RequirementsFile:   requirementsPath,
+		RawPlaybook:        req.RawPlaybook,
+		LibraryPlaybookID:  req.LibraryPlaybookID,
+		LibraryInventoryID: req.LibraryInventoryID,
+	}
+	if project != nil {
+		task.ProjectID = project.ID
+		task.ProjectCommit = project.Commit
+		task.RawPlaybook = true
+	}
+	if env.RequireApproval {
+		task.ApprovalRequestedAt = time.Now()
+	}
+	if validateTasks {
+		if err := validateTask(ctx, task); err != nil {
+			return nil, false, err
+		}
+	}
+	if lintPlaybooks && !task.AdHoc() {
+		lintTask(task)
+	}
+	// the playbook and inventory rows are created along with the task in
+	// one transaction
+	if err := db.Create(task).Error; err != nil {
+		return nil, false, err
 	}
+	registerTaskHosts(task)
+	return task, true, nil
+}
+
+// claimTask marks a queued task running in one conditional update, so of
+// two workers handed the same task only one gets true and runs it.
+func claimTask(taskId string) (bool, error) {
+	now := time.Now()
+	tx := db.Model(&Task{}).
+		Where("task_id = ? AND queued = ? AND status <> ?", taskId, true, STATUS_RUNNING).
+		Updates(map[string]interface{}{
+			"queued":           false,
+			"status":           STATUS_RUNNING,
+			"node":             nodeName,
+			"cancel_requested": false,
+			"updated_at":       now,
+			"started_at":       now,
+			"attempts":         gorm.Expr("attempts + 1"),
+			// what an earlier attempt found isn't carried over
+			"error":             "",
+			"host_count":        0,
+			"failed_hosts":      0,
+			"unreachable_hosts": 0,
+			"exit_code":         nil,
+		})
+	return tx.RowsAffected > 0, tx.Error
+}
 
-	task := Task{
-		TaskID:      taskID,
-		Name:        taskName,
-		Status:      0,
-		PlaybookID:  playbook.ID,
-		InventoryID: inventory.ID,
-		UserID:      1,
+var errTaskAlreadyQueued = withStatus(http.StatusConflict, errors.New("task is already queued or running"))
+
+// startTask queues a task for the workers after checking its environment,
+// approval and the playbook run limit.
+func startTask(taskId string, user *User, req RunRequest) (*Run, error) {
+	var task Task
+	if err := db.Preload("Playbook").Preload("Inventory").Limit(1).Find(&task, "task_id = ?", taskId).Error; err != nil {
+		return nil, err
+	}
+	if task.ID == 0 {
+		return nil, errTaskNotFound
 	}
-	if err := db.Create(&task).Error; err != nil {
+	env, ok := config.environment(task.Environment)
+	if !ok {
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("unknown environment %q", task.Environment))
+	}
+	if task.Status == STATUS_EXPIRED {
+		return nil, errApprovalExpired
+	}
+	if task.Purged() {
+		return nil, errResultsPurged
+	}
+	if lintBlock && task.LintStatus == LINT_FAILED {
+		return nil, errLintFailed
+	}
+	if env.RequireApproval && !task.Approved {
+		return nil, errNotApproved
+	}
+	// the inventory may have changed or, if dynamic, resolve to other hosts
+	// since the task was made
+	if validateTasks {
+		if _, err := checkTaskInventory(&task); err != nil {
+			return nil, err
+		}
+	}
+	updates := map[string]interface{}{"queued": true, "attempts": 0, "retry_at": time.Time{}}
+	query := db.Model(&Task{}).Where("task_id = ? AND queued = ? AND status <> ?", taskId, false, STATUS_RUNNING)
+	if env.RequireApproval {
+		// an approval is good for one run, and not for content swapped in
+		// since it was loaded
+		updates["approved"] = false
+		updates["approval_requested_at"] = time.Now()
+		query = query.Where("approved = ?", true)
+	}
+	tx := query.Updates(updates)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, errTaskAlreadyQueued
+	}
+	if err := recordPlaybookRun(&task); err != nil {
+		db.Model(&Task{}).Where("task_id = ?", taskId).Updates(map[string]interface{}{"queued": false, "approved": task.Approved})
+		return nil, withStatus(http.StatusTooManyRequests, err)
+	}
+	run, err := createRun(&task, user, req)
+	if err != nil {
+		db.Model(&Task{}).Where("task_id = ?", taskId).Updates(map[string]interface{}{"queued": false, "approved": task.Approved})
+		return nil, err
+	}
+	if !enqueueTask(taskId, task.Priority) {
+		return nil, withStatus(http.StatusServiceUnavailable, errors.New("server is shutting down, the task runs after the restart"))
+	}
+	return run, nil
+}
+
+func needsApproval(task Task) bool {
+	env, ok := config.environment(task.Environment)
+	return ok && env.RequireApproval && !task.Approved && task.Status != STATUS_EXPIRED
+}
+
+func approveTask(c *gin.Context) {
+	var task Task
+	if err := db.Limit(1).Find(&task, "task_id = ?", c.Param("id")).Error; err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
-	c.IndentedJSON(http.StatusOK, task)
+	if task.ID == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+	// somebody else has to agree with running it
+	if task.UserID == currentUser(c).ID {
+		c.IndentedJSON(errorStatus(errSelfApproval), gin.H{"error": errSelfApproval.Error()})
+		return
+	}
+	// the sweep may not have caught up with a task past its window yet
+	if task.Status != STATUS_EXPIRED && approvalExpired(&task, time.Now()) {
+		expireApproval(&task)
+	}
+	tx := db.Model(&Task{}).
+		Where("task_id = ? AND status <> ?", task.TaskID, STATUS_EXPIRED).
+		Update("approved", true)
+	if tx.Error != nil {
+		c.AbortWithError(http.StatusBadRequest, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		c.IndentedJSON(errorStatus(errApprovalExpired), gin.H{"error": errApprovalExpired.Error()})
+		return
+	}
+	c.Redirect(302, "/")
+}
+
+// storedResult marks dry runs so they can't be mistaken for real ones
+type storedResult struct {
+	CheckMode bool `json:"check_mode"`
+	*results.AnsiblePlaybookJSONResults
 }
 
 func showResult(c *gin.Context) {
 	taskId := c.Param("id")
+	// /result/:id.xml is the JUnit export, /result/:id.csv the host recap
+	format := filepath.Ext(taskId)
+	if format == ".xml" || format == ".csv" {
+		taskId = strings.TrimSuffix(taskId, format)
+	}
+
+	var task Task
+	db.Select("check_mode", "name", "purged_at").Where("task_id = ?", taskId).Limit(1).Find(&task)
+	if task.Purged() {
+		c.IndentedJSON(errorStatus(errResultsPurged), gin.H{"error": errResultsPurged.Error()})
+		return
+	}
 
 	resultPath := filepath.Join(rootDir, taskId, "result.json")
 	// 读取文件
-	fd, err := os.OpenFile(resultPath, os.O_RDONLY, 755)
+	raw, err := os.ReadFile(resultPath)
 	if err != nil {
 		c.IndentedJSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
-	content, err := io.ReadAll(fd)
-	res := results.AnsiblePlaybookJSONResults{}
-	if err := json.Unmarshal(content, &res); err != nil {
+	// results written before redaction, or before a pattern was added
+	raw = redactOutput(raw, nil)
+	// result.json holds one jsonl event per line, the last one sums up the run
+	res, err := results.ParseJSONResultsStream(bytes.NewReader(raw))
+	if err != nil {
 		c.IndentedJSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
-	c.IndentedJSON(http.StatusOK, res)
+	switch format {
+	case ".xml":
+		showResultJUnit(c, &task, res)
+		return
+	case ".csv":
+		showResultCSV(c, taskId, res)
+		return
+	}
+	if c.Query("raw") == "1" {
+		c.IndentedJSON(http.StatusOK, storedResult{CheckMode: task.Check, AnsiblePlaybookJSONResults: res})
+		return
+	}
+	summary := summarizeResults(res, readTaskPaths(taskId))
+	summary.CheckMode = task.Check
+	summary.Diffs = readDiffs(resultPath)
+	c.IndentedJSON(http.StatusOK, summary)
+}
+
+// renderPlaybook returns the content of site.yaml. By default the submitted
+// tasks are wrapped into a play against hosts, in raw mode the content is a
+// whole playbook and only has to be valid YAML.
+func renderPlaybook(content string, raw bool, hosts string) (string, error) {
+	content = strings.ReplaceAll(content, "\r", "")
+	if raw {
+		var plays []interface{}
+		if err := yaml.Unmarshal([]byte(content), &plays); err != nil {
+			return "", fmt.Errorf("invalid playbook: %v", err)
+		}
+		if len(plays) == 0 {
+			return "", errors.New("invalid playbook: no plays")
+		}
+		return content, nil
+	}
+
+	var w bytes.Buffer
+	// a JSON string is a YAML one, patterns like !web need the quotes
+	quoted, _ := json.Marshal(hosts)
+	w.WriteString("- hosts: " + string(quoted) + "\n")
+	w.WriteString("  tasks:\n")
+	for _, v := range strings.Split(content, "\n") {
+		w.WriteString("  " + v + "\n")
+	}
+	return w.String(), nil
+}
+
+// parseExtraVars accepts a JSON object, a YAML mapping or key=value lines.
+func parseExtraVars(content string) (map[string]interface{}, error) {
+	content = strings.TrimSpace(strings.ReplaceAll(content, "\r", ""))
+	vars := map[string]interface{}{}
+	if content == "" {
+		return vars, nil
+	}
+	if strings.HasPrefix(content, "{") {
+		if err := json.Unmarshal([]byte(content), &vars); err != nil {
+			return nil, fmt.Errorf("invalid extra vars: %v", err)
+		}
+		return vars, nil
+	}
+	if isYAMLVars(content) {
+		if err := yaml.Unmarshal([]byte(content), &vars); err != nil {
+			return nil, fmt.Errorf("invalid extra vars: %v", err)
+		}
+		return vars, nil
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid extra var %q, expected key=value", line)
+		}
+		vars[k] = strings.TrimSpace(v)
+	}
+	return vars, nil
+}
+
+// isYAMLVars tells a YAML mapping from key=value lines by the first line
+// that isn't a comment: "key: value" or a document start.
+func isYAMLVars(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "---" {
+			return true
+		}
+		colon, eq := strings.Index(line, ":"), strings.Index(line, "=")
+		return colon > 0 && (eq < 0 || colon < eq)
+	}
+	return false
+}
+
+func formBool(c *gin.Context, key string) bool {
+	switch strings.ToLower(c.PostForm(key)) {
+	case "1", "on", "true", "yes":
+		return true
+	}
+	return false
 }
 
 func readFile(path string) (string, error) {
@@ -306,9 +1584,14 @@ func writeFile(path, content string) error {
 func updateTask(task Task) error {
 	tx := db.Where("id = ?", task.ID).Updates(
 		Task{
-			Status:    task.Status,
-			UpdatedAt: time.Now(),
-			Error:     task.Error,
+			Status:      task.Status,
+			UpdatedAt:   time.Now(),
+			FinishedAt:  task.FinishedAt,
+			Error:       task.Error,
+			HostCount:   task.HostCount,
+			FailedHosts: task.FailedHosts,
+			Unreachable: task.Unreachable,
+			ExitCode:    task.ExitCode,
 		})
 	if tx.Error != nil {
 		return tx.Error
@@ -318,93 +1601,390 @@ func updateTask(task Task) error {
 
 func startRunAnsiblePlaybookService(index int, wait *sync.WaitGroup) {
 	defer func() {
-		fmt.Printf("# %d service stopped\n", index)
+		logger("worker").Info("worker stopped", "worker", index)
 		wait.Done()
 	}()
+	w := registerWorker(index)
 	for {
+		if w.isDraining() {
+			w.setState(WORKER_DRAINED, "")
+			select {
+			case <-stopChan:
+				return
+			case <-w.wake:
+				continue
+			}
+		}
+		w.setState(WORKER_IDLE, "")
+		addIdleWorkers(1)
+
 		select {
-		case taskId, ok := <-taskChan:
+		case <-stopChan:
+			return
+		case <-w.wake:
+			addIdleWorkers(-1)
+			continue
+		case taskId := <-taskChan:
+			lockKey, ok := acquireTaskLock(taskId)
 			if !ok {
-				return
+				continue
+			}
+
+			claimed, err := claimTask(taskId)
+			if err != nil {
+				taskLogger("worker", taskId).Error("failed to claim task", "error", err)
+				releaseTaskLock(lockKey, taskId)
+				continue
+			}
+			if !claimed {
+				releaseTaskLock(lockKey, taskId)
+				continue
 			}
 
 			var task Task
 			tx := db.Preload("Playbook").Preload("Inventory").Preload("User").First(&task, "task_id = ?", taskId)
 			if tx.Error != nil {
-				fmt.Printf("Error: task(%v) %v\n", taskId, tx.Error)
+				taskLogger("worker", taskId).Error("failed to load task", "error", tx.Error)
+				// don't leave the claimed task running forever
+				db.Where("task_id = ?", taskId).Updates(Task{Status: STATUS_ERROR, Error: tx.Error.Error(), FinishedAt: time.Now()})
+				releaseTaskLock(lockKey, taskId)
 				continue
 			}
 
-			tx = db.Where("task_id = ?", taskId).Updates(Task{
-				Status:    1,
-				UpdatedAt: time.Now(),
-			})
-			if tx.Error != nil {
-				fmt.Printf("Error: task(%v) %v\n", taskId, tx.Error)
+			updateRun(&task)
+			task.Verbosity = runVerbosity(&task)
+			w.setState(WORKER_RUNNING, taskId)
+			newOutputHub(task.TaskID)
+			err = runAnsiblePlaybook(&task, taskRunTimeout(&task))
+			setRunStatus(&task, err)
+			task.FinishedAt = time.Now()
+			if err := recordAttempt(&task); err != nil {
+				taskLogger("worker", task.TaskID).Error("failed to record attempt", "error", err)
+			}
+			if retryable(&task) {
+				err := scheduleRetry(&task)
+				// other tasks may run before the next attempt
+				releaseTaskLock(lockKey, task.TaskID)
+				closeOutputHub(task.TaskID)
+				if err != nil {
+					taskLogger("worker", task.TaskID).Error("failed to schedule retry", "error", err)
+				}
 				continue
 			}
-
-			err := runAnsiblePlaybook(&task)
+			err = updateTask(task)
+			releaseTaskLock(lockKey, task.TaskID)
+			// only now that the final status is stored may streams end
+			closeOutputHub(task.TaskID)
 			if err != nil {
-				task.Status = 3
-				task.Error = fmt.Sprintf("%v", err)
-			} else {
-				task.Status = 2
-				task.Error = ""
-			}
-			if err := updateTask(task); err != nil {
-				fmt.Printf("Error: task(%v) %v\n", task, err)
+				taskLogger("worker", task.TaskID).Error("failed to update task", "error", err)
 				continue
 			}
+			updateRun(&task)
+			if task.Status == STATUS_INTERRUPTED && requeueInterrupted {
+				requeueTask(&task)
+			}
+			tasksFinished.WithLabelValues(statusText(task.Status)).Inc()
+			notifyFinished(&task)
 
 		}
 	}
 }
 
-func runAnsiblePlaybook(task *Task) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(30)*time.Minute)
-	defer cancel()
+// newPlaybookOptions resolves the options a task runs with. It is shared by
+// the worker and showTaskOptions so what is shown is what runs.
+func newPlaybookOptions(task *Task) (*playbook.AnsiblePlaybookOptions, error) {
+	env, ok := config.environment(task.Environment)
+	if !ok {
+		return nil, fmt.Errorf("unknown environment %q", task.Environment)
+	}
+
+	extraVars := map[string]interface{}{}
+	for k, v := range env.ExtraVars {
+		extraVars[k] = v
+	}
+	if task.ExtraVars != "" {
+		var taskVars map[string]interface{}
+		if err := json.Unmarshal([]byte(task.ExtraVars), &taskVars); err != nil {
+			return nil, fmt.Errorf("invalid extra vars: %v", err)
+		}
+		for k, v := range taskVars {
+			extraVars[k] = v
+		}
+	}
+
+	// from the least to the most specific: the environment's credential,
+	// its SSH settings, the ones of the library inventory the task was made
+	// from, the task's credential and its SSH settings
+	var user, keyFile string
+	var port, timeout int
+	layer := func(u string, p int, k string, t int) {
+		if u != "" {
+			user = u
+		}
+		if p != 0 {
+			port = p
+		}
+		if k != "" {
+			keyFile = k
+		}
+		if t != 0 {
+			timeout = t
+		}
+	}
+	cred, err := taskCredential(task, env)
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil && task.CredentialID == 0 {
+		layer(cred.SSHUser, cred.SSHPort, task.credentialKeyFile, 0)
+	}
+	layer(env.SSHUser, env.SSHPort, env.SSHPrivateKeyFile, env.SSHTimeout)
+	task.hostKeyChecking = config.HostKeyChecking
+	if env.HostKeyChecking != "" {
+		task.hostKeyChecking = env.HostKeyChecking
+	}
+	if task.LibraryInventoryID != 0 {
+		// a deleted library inventory has no settings left
+		var li LibraryInventory
+		if err := db.Limit(1).Find(&li, task.LibraryInventoryID).Error; err != nil {
+			return nil, err
+		}
+		layer(li.SSHUser, li.SSHPort, li.SSHPrivateKeyFile, li.SSHTimeout)
+		if li.HostKeyChecking != "" {
+			task.hostKeyChecking = li.HostKeyChecking
+		}
+	}
+	if cred != nil && task.CredentialID != 0 {
+		layer(cred.SSHUser, cred.SSHPort, task.credentialKeyFile, 0)
+	}
+	layer(task.SSHUser, task.SSHPort, task.SSHPrivateKeyFile, task.SSHTimeout)
+	for k, v := range sshIdentityVars(user, port, keyFile, timeout) {
+		extraVars[k] = v
+	}
+	if task.ArtifactsDir != "" {
+		extraVars["artifacts_dir"] = filepath.Join(rootDir, task.TaskID, task.ArtifactsDir)
+	}
+
+	options := &playbook.AnsiblePlaybookOptions{
+		Become:        task.Become,
+		Check:         task.Check,
+		Diff:          task.Diff,
+		Tags:          task.Tags,
+		SkipTags:      task.SkipTags,
+		Limit:         task.Limit,
+		ExtraVars:     extraVars,
+		Inventory:     task.Inventory.Path,
+		SSHCommonArgs: strings.TrimSpace(env.SSHCommonArgs + " " + hostKeyArgs(task.hostKeyChecking)),
+		User:          user,
+		Timeout:       timeout,
+	}
+	if task.credentialVarsFile != "" {
+		options.AddExtraVarsFile(task.credentialVarsFile)
+	}
+
+	if vaultPassScript != "" {
+		// the script may have been removed or changed since startup
+		if err := checkVaultPasswordScript(vaultPassScript); err != nil {
+			return nil, fmt.Errorf("invalid vault password script: %v", err)
+		}
+		// ansible runs an executable vault password file and reads the
+		// password from its stdout, so it never passes through this process.
+		options.VaultPasswordFile = vaultPassScript
+	}
+	// the vault ids of the config may have changed since the task was made
+	if _, err := vaultIDFiles(task); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// MAX_SSH_TIMEOUT caps the connection timeout, in seconds
+const MAX_SSH_TIMEOUT = 600
+
+func checkSSHTimeout(timeout int) error {
+	if timeout < 0 || timeout > MAX_SSH_TIMEOUT {
+		return fmt.Errorf("ssh timeout must be between 0 and %d seconds", MAX_SSH_TIMEOUT)
+	}
+	return nil
+}
+
+// sshIdentityVars pins the connection identity. Command line extra vars
+// beat inventory host and group vars, but ansible looks the aliases up in a
+// fixed order (ansible_private_key_file before ansible_ssh_private_key_file),
+// so every alias has to be set or an inventory could still swap one in.
+// Settings left empty are up to ansible.
+func sshIdentityVars(user string, port int, keyFile string, timeout int) map[string]interface{} {
+	vars := map[string]interface{}{}
+	if user != "" {
+		vars["ansible_user"] = user
+		vars["ansible_ssh_user"] = user
+	}
+	if port != 0 {
+		vars["ansible_port"] = port
+		vars["ansible_ssh_port"] = port
+	}
+	if keyFile != "" {
+		vars["ansible_private_key_file"] = keyFile
+		vars["ansible_ssh_private_key_file"] = keyFile
+	}
+	// --timeout goes below the inventory vars
+	if timeout != 0 {
+		vars["ansible_ssh_timeout"] = timeout
+	}
+	return vars
+}
+
+func runAnsiblePlaybook(task *Task, timeout time.Duration) error {
+	parent, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	ctx, cancelTimeout := context.WithTimeout(parent, timeout)
+	defer cancelTimeout()
+	registerRunningTask(task.TaskID, cancel)
+	defer unregisterRunningTask(task.TaskID)
 
 	buff := new(bytes.Buffer)
+	errBuff := new(bytes.Buffer)
+
+	removeKey, err := materializeCredential(task)
+	if err != nil {
+		return err
+	}
+	defer removeKey()
+	options, err := newPlaybookOptions(task)
+	if err != nil {
+		return err
+	}
+	if task.ArtifactsDir != "" {
+		if err := os.MkdirAll(options.ExtraVars["artifacts_dir"].(string), 0755); err != nil {
+			return fmt.Errorf("failed to create artifacts dir: %v", err)
+		}
+		defer pruneArtifacts(task)
+	}
+	if err := installRequirements(ctx, task, options); err != nil {
+		return err
+	}
+	taskCmd, cleanup := newTaskCommand(task, newAnsibleCmd(task, options), options)
+	defer cleanup()
+	taskLogger("worker", task.TaskID).Info("run", "command", commandLine(taskCmd))
+
+	hostsTotal := 0
+	if hosts, err := taskInventoryHosts(task); err == nil {
+		hostsTotal = len(hosts)
+	}
+	progress := newProgressWriter(task, hostsTotal)
+	defer removeProgress(task.TaskID)
 
-	cmd := playbook.NewAnsiblePlaybookCmd(
-		playbook.WithPlaybooks(task.Playbook.Path),
-		playbook.WithPlaybookOptions(&playbook.AnsiblePlaybookOptions{
-			Become:  false,
-			Verbose: true,
-			ExtraVars: map[string]interface{}{
-				"ansible_ssh_private_key_file": "/root/.ssh/id_rsa",
-				"ansible_user":                 "auser",
-				"ansible_port":                 8513,
-			},
-			Inventory:     task.Inventory.Path,
-			SSHCommonArgs: "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null",
-			User:          "auser",
-		}),
-	)
-	fmt.Printf("[%s] %s\n", task.TaskID, cmd.String())
-
-	exec := stdoutcallback.NewJSONStdoutCallbackExecute(
-		execute.NewDefaultExecute(
-			execute.WithEnvVars(map[string]string{"ANSIBLE_STDOUT_CALLBACK": "json"}),
-			execute.WithCmd(cmd),
-			execute.WithErrorEnrich(playbook.NewAnsiblePlaybookErrorEnrich()),
-			execute.WithWrite(io.Writer(buff)),
-			execute.WithWriteError(io.Writer(buff)),
-		),
-	)
+	secrets := secretValues(options.ExtraVars)
+	if len(task.credentialPassword) >= MIN_REDACTED_VALUE {
+		quoted, _ := json.Marshal(task.credentialPassword)
+		secrets = append(secrets, quoted[1:len(quoted)-1])
+	}
+	// what is shown or saved while the run goes on is redacted right away,
+	// buff is redacted as a whole once it is done
+	live := newRedactingWriter(progress, secrets)
+	var liveErr *redactingWriter
+	var stdout, stderr io.Writer = io.MultiWriter(buff, live), errBuff
+	if hub := findOutputHub(task.TaskID); hub != nil {
+		live.out = io.MultiWriter(progress, hub)
+		liveErr = newRedactingWriter(hub, secrets)
+		stderr = io.MultiWriter(errBuff, liveErr)
+	}
+	var verbose *verboseOutputWriter
+	if task.Verbosity > 0 {
+		verbose = &verboseOutputWriter{out: stdout, verbose: stderr}
+		stdout = verbose
+	}
+
+	exitCode := &exitCodeRecorder{}
+	executeOptions := []execute.ExecuteOptions{
+		execute.WithCmd(taskCmd),
+		execute.WithErrorEnrich(exitCode),
+		execute.WithWrite(stdout),
+		execute.WithWriteError(stderr),
+		execute.WithEnvVars(ansibleCmdEnv(task)),
+		execute.WithEnvVars(galaxyEnv(task)),
+		execute.WithEnvVars(vaultIDEnv(task)),
+		execute.WithEnvVars(verbosityEnv(task)),
+		execute.WithEnvVars(hostKeyEnv(task)),
+	}
+	if config.TaskPaths {
+		executeOptions = append(executeOptions, execute.WithEnvVars(taskPathsEnv(task)))
+	}
+	exec := newJSONLStdoutCallbackExecute(execute.NewDefaultExecute(executeOptions...))
 
 	if err := exec.Execute(ctx); err != nil {
-		fmt.Printf("[%s] failed to exec: %v", task.TaskID, err)
+		taskLogger("worker", task.TaskID).Error("failed to exec", "error", err)
+		task.ExitCode = exitCode.code
+	} else {
+		task.ExitCode = new(int)
 	}
+	if verbose != nil {
+		verbose.flush()
+	}
+	live.flush()
+	if liveErr != nil {
+		liveErr.flush()
+	}
+	progress.close()
+	// only cancelTask cancels before the deadline
+	cancelled := ctx.Err() == context.Canceled
+	timedOut := ctx.Err() == context.DeadlineExceeded
 
 	raw, err := io.ReadAll(io.Reader(buff))
 	if err != nil {
 		return fmt.Errorf("failed to read result: %v", err)
 	}
+	raw = redactOutput(raw, secrets)
 	resultPath := filepath.Join(rootDir, task.TaskID, "result.json")
 	if err := os.WriteFile(resultPath, raw, 0644); err != nil {
-		fmt.Println("failed to write result: %v", err)
+		taskLogger("worker", task.TaskID).Error("failed to write result", "error", err)
+	}
+	// stderr is kept apart so that warnings don't corrupt result.json
+	stderrPath := filepath.Join(rootDir, task.TaskID, "stderr.log")
+	if err := os.WriteFile(stderrPath, redactOutput(errBuff.Bytes(), secrets), 0644); err != nil {
+		taskLogger("worker", task.TaskID).Error("failed to write stderr", "error", err)
+	}
+
+	res, err := results.ParseJSONResultsStream(bytes.NewReader(raw))
+	if err == nil {
+		task.HostCount = uint(len(res.Stats))
+		for _, stats := range res.Stats {
+			if stats.Failures > 0 {
+				task.FailedHosts++
+			}
+			if stats.Unreachable > 0 {
+				task.Unreachable++
+			}
+		}
+		observeTaskResult(task, len(raw))
+		if config.NDJSONEvents {
+			eventsPath := filepath.Join(rootDir, task.TaskID, "events.ndjson")
+			if err := writeResultEvents(eventsPath, task, res); err != nil {
+				taskLogger("worker", task.TaskID).Error("failed to write events", "error", err)
+			}
+		}
+		if searchIndex {
+			if err := indexTaskOutput(task, res); err != nil {
+				taskLogger("worker", task.TaskID).Error("failed to index output", "error", err)
+			}
+		}
+		if isFactsModule(task.Module) {
+			if err := storeTaskFacts(task, res); err != nil {
+				taskLogger("worker", task.TaskID).Error("failed to store facts", "error", err)
+			}
+		}
+		if !cancelled && !timedOut && len(res.Plays) > 0 && len(res.Stats) == 0 {
+			return errNoHostsMatched
+		}
+	}
+	if cancelled {
+		if context.Cause(ctx) == errTaskInterrupted {
+			return errTaskInterrupted
+		}
+		return errTaskCancelled
+	}
+	if timedOut {
+		return fmt.Errorf("%w after %v", errTaskTimedOut, timeout)
 	}
 
 	return nil
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// setupTestDB points the globals at a fresh sqlite database and data
+// directory, tasks aren't validated with ansible.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	rootDir = dir
+	dbDSN = "sqlite://" + filepath.Join(dir, "test.db")
+	config = defaultConfig()
+	validateTasks = false
+	lintPlaybooks = false
+	setupDB()
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// createTestUser adds a user with role, an admin for ROLE_ADMIN.
+func createTestUser(t *testing.T, name, role string) *User {
+	t.Helper()
+	user := &User{Name: name, Admin: role == ROLE_ADMIN}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := setUserRole(db, user, role); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
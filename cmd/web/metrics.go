@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tasksFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_runner_tasks_finished_total",
+		Help: "Tasks that finished, by final status.",
+	}, []string{"status"})
+
+	taskResultBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ansible_runner_task_result_bytes",
+		Help:    "Size of the result.json written per task.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 10),
+	})
+
+	taskHosts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ansible_runner_task_hosts",
+		Help:    "Hosts in the recap of a task.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+
+	// failed and unreachable hosts of every run, by environment
+	hostProblems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_runner_hosts_total",
+		Help: "Hosts that failed or were unreachable, summed over all runs.",
+	}, []string{"environment", "state"})
+)
+
+// observeTaskResult records the metrics of a parsed run.
+func observeTaskResult(task *Task, size int) {
+	env := task.Environment
+	if env == "" {
+		env = DEFAULT_ENVIRONMENT
+	}
+	taskResultBytes.Observe(float64(size))
+	taskHosts.Observe(float64(task.HostCount))
+	hostProblems.WithLabelValues(env, HOST_FAILED).Add(float64(task.FailedHosts))
+	hostProblems.WithLabelValues(env, HOST_UNREACHABLE).Add(float64(task.Unreachable))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	NOTIFY_WEBHOOK = "webhook"
+	NOTIFY_SLACK   = "slack"
+	NOTIFY_EMAIL   = "email"
+	// chat notifications, see chat.go
+	NOTIFY_DINGTALK = "dingtalk"
+	NOTIFY_FEISHU   = "feishu"
+)
+
+var defaultNotificationTemplates = map[string]string{
+	NOTIFY_WEBHOOK: `Task {{ .Name }} finished: {{ .Status }}`,
+	NOTIFY_SLACK: `*{{ .Name }}* {{ .Status }} in {{ .Duration }} ({{ .HostSummary }}) <{{ .Link }}|result>{{ if .Recap }}
+` + "```" + `
+{{ .Recap }}
+` + "```" + `{{ end }}`,
+	NOTIFY_DINGTALK: `{{ .Name }} {{ .Status }} in {{ .Duration }} ({{ .HostSummary }})
+{{ if .Recap }}{{ .Recap }}
+{{ end }}{{ .Link }}`,
+	NOTIFY_FEISHU: `{{ .Name }} {{ .Status }} in {{ .Duration }} ({{ .HostSummary }})
+{{ if .Recap }}{{ .Recap }}
+{{ end }}{{ .Link }}`,
+	NOTIFY_EMAIL: `Task {{ .Name }} ({{ .TaskID }}) finished with status {{ .Status }}.
+Hosts: {{ .HostSummary }}
+Duration: {{ .Duration }}
+{{ if .Error }}Error: {{ .Error }}
+{{ end }}Result: {{ .Link }}
+{{ if .Recap }}
+{{ .Recap }}
+{{ end }}`,
+}
+
+type NotificationConfig struct {
+	Template string `json:"template"`
+
+	tmpl *template.Template
+}
+
+// NotificationData is what notification templates are rendered with.
+type NotificationData struct {
+	TaskID      string `json:"task_id"`
+	Name        string `json:"name"`
+	Requester   string `json:"requester"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	HostSummary string `json:"host_summary"`
+	Duration    string `json:"duration"`
+	Link        string `json:"link"`
+	// Recap is a line per host with its stats, empty if the task didn't run
+	Recap string `json:"-"`
+}
+
+// compileNotifications parses the configured templates, falling back to the
+// built-in ones for channels left unset.
+func compileNotifications(channels map[string]*NotificationConfig) (map[string]*NotificationConfig, error) {
+	if channels == nil {
+		channels = map[string]*NotificationConfig{}
+	}
+	for name, text := range defaultNotificationTemplates {
+		if ch, ok := channels[name]; !ok || ch == nil || ch.Template == "" {
+			channels[name] = &NotificationConfig{Template: text}
+		}
+	}
+	for name, ch := range channels {
+		if _, ok := defaultNotificationTemplates[name]; !ok {
+			return nil, fmt.Errorf("unknown notification channel %q", name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(ch.Template)
+		if err != nil {
+			return nil, fmt.Errorf("notification template %q: %v", name, err)
+		}
+		// catch references to fields that don't exist now rather than
+		// when the first task finishes
+		if err := tmpl.Execute(new(bytes.Buffer), NotificationData{}); err != nil {
+			return nil, fmt.Errorf("notification template %q: %v", name, err)
+		}
+		ch.tmpl = tmpl
+	}
+	return channels, nil
+}
+
+func newNotificationData(task *Task, recap []HostStats) NotificationData {
+	var duration string
+	if !task.StartedAt.IsZero() && task.FinishedAt.After(task.StartedAt) {
+		duration = task.FinishedAt.Sub(task.StartedAt).Round(time.Second).String()
+	}
+	return NotificationData{
+		TaskID:    task.TaskID,
+		Name:      task.Name,
+		Requester: task.User.Name,
+		Status:    statusText(task.Status),
+		Error:     task.Error,
+		HostSummary: fmt.Sprintf("%d hosts, %d failed, %d unreachable",
+			task.HostCount, task.FailedHosts, task.Unreachable),
+		Duration: duration,
+		Link:     strings.TrimRight(config.BaseURL, "/") + "/result/" + task.TaskID,
+		Recap:    recapText(recap),
+	}
+}
+
+func recapText(stats []HostStats) string {
+	lines := make([]string, 0, len(stats))
+	for _, s := range stats {
+		lines = append(lines, fmt.Sprintf("%s: ok=%d changed=%d failed=%d unreachable=%d skipped=%d",
+			s.Host, s.Ok, s.Changed, s.Failed, s.Unreachable, s.Skipped))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notifyFinished lets the webhooks, chats and requester know that task is
+// over.
+func notifyFinished(task *Task) {
+	if webhookURL == "" && len(config.Webhooks) == 0 && len(config.Chats) == 0 && !wantsEmail(task) {
+		return
+	}
+	recap := readRecap(task)
+	data := newNotificationData(task, recap)
+	notifyWebhook(task, data, recap)
+	notifyChats(task, data)
+	notifyEmail(task, data)
+}
+
+func renderNotification(channel string, data NotificationData) (string, error) {
+	ch, ok := config.Notifications[channel]
+	if !ok || ch.tmpl == nil {
+		return "", fmt.Errorf("unknown notification channel %q", channel)
+	}
+	var buf bytes.Buffer
+	if err := ch.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
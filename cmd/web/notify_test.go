@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+// outcomeTasks are tasks as they finish, named by whether they failed.
+func outcomeTasks() map[string]*Task {
+	code := func(c int) *int { return &c }
+	return map[string]*Task{
+		"succeeded":        {Status: STATUS_SUCCEEDED, ExitCode: code(0)},
+		"error":            {Status: STATUS_ERROR, Error: "boom"},
+		"timed out":        {Status: STATUS_TIMED_OUT},
+		"failed hosts":     {Status: STATUS_SUCCEEDED, FailedHosts: 1, ExitCode: code(2)},
+		"unreachable":      {Status: STATUS_SUCCEEDED, Unreachable: 1, ExitCode: code(4)},
+		"nonzero exit":     {Status: STATUS_SUCCEEDED, ExitCode: code(1)},
+		"no exit code yet": {Status: STATUS_SUCCEEDED},
+	}
+}
+
+func TestTaskFailed(t *testing.T) {
+	for name, task := range outcomeTasks() {
+		want := name != "succeeded" && name != "no exit code yet"
+		if got := taskFailed(task); got != want {
+			t.Errorf("%s: taskFailed = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSetRunStatusAgreesWithTaskFailed(t *testing.T) {
+	// a run that ansible got through without an error of its own
+	for name, task := range outcomeTasks() {
+		if task.Status != STATUS_SUCCEEDED {
+			continue
+		}
+		setRunStatus(task, nil)
+		if failed := task.Status != STATUS_SUCCEEDED; failed != taskFailed(task) {
+			t.Errorf("%s: status %s but taskFailed = %v", name, statusText(task.Status), taskFailed(task))
+		}
+		if name == "failed hosts" && task.Status != STATUS_ERROR {
+			t.Errorf("failed hosts: status %s, want Error", statusText(task.Status))
+		}
+	}
+	task := &Task{Status: STATUS_SUCCEEDED, Unreachable: 2, MaxAttempts: 3, Attempts: 1}
+	setRunStatus(task, nil)
+	if !retryable(task) {
+		t.Error("a run with unreachable hosts isn't retried")
+	}
+}
+
+func TestWebhookURLsOnFailed(t *testing.T) {
+	old, oldURL := config, webhookURL
+	t.Cleanup(func() { config, webhookURL = old, oldURL })
+	config = defaultConfig()
+	webhookURL = ""
+	config.Webhooks = []*WebhookConfig{{URL: "http://failed", On: WEBHOOK_ON_FAILED}, {URL: "http://all", On: WEBHOOK_ON_FINISHED}}
+	for name, task := range outcomeTasks() {
+		want := 1
+		if taskFailed(task) {
+			want = 2
+		}
+		if urls := webhookURLs(task); len(urls) != want {
+			t.Errorf("%s: posted to %v", name, urls)
+		}
+	}
+}
+
+func TestChatMatchesOnFailed(t *testing.T) {
+	chat := &ChatConfig{On: WEBHOOK_ON_FAILED}
+	for name, task := range outcomeTasks() {
+		if got := chat.matches(task); got != taskFailed(task) {
+			t.Errorf("%s: chat on failed matches = %v", name, got)
+		}
+	}
+}
+
+func TestWantsEmailOnFailed(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config = defaultConfig()
+	config.SMTP = &SMTPConfig{}
+	for name, task := range outcomeTasks() {
+		task.User = User{Email: "ops@example.com", NotifyEmail: WEBHOOK_ON_FAILED}
+		if got := wantsEmail(task); got != taskFailed(task) {
+			t.Errorf("%s: wantsEmail = %v", name, got)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// the page loads Swagger UI from a CDN, only the page itself is embedded
+const SWAGGER_UI_VERSION = "5.17.14"
+
+// apiOperation documents a route beyond what the router knows about it.
+// Body and Response are Go values whose types are turned into schemas,
+// List wraps Response into a page.
+type apiOperation struct {
+	Summary     string
+	Query       []apiParam
+	Body        interface{}
+	Response    interface{}
+	List        bool
+	Status      int
+	ContentType string
+}
+
+type apiParam struct {
+	Name, Type, Description string
+}
+
+var pageParams = []apiParam{
+	{"page", "integer", "page number, from 1"},
+	{"per_page", "integer", "items per page"},
+}
+
+var taskFilters = []apiParam{
+	{"status", "string", "comma separated statuses, by name or number"},
+	{"name", "string", "part of the task name"},
+	{"q", "string", "part of the name, task ID, playbook name or error"},
+	{"creator", "string", "name of the user who created the task"},
+	{"rerun_of", "string", "task ID of the task the tasks are re-runs of"},
+	{"from", "string", "created at or after, a date or RFC 3339 time"},
+	{"to", "string", "created before, a date or RFC 3339 time"},
+}
+
+var taskFilterParams = append(taskFilters, pageParams...)
+
+var apiOperations = map[string]apiOperation{
+	"GET /api/v1/tasks":     {Summary: "List tasks", Query: taskFilterParams, Response: APITask{}, List: true},
+	"POST /api/v1/tasks":    {Summary: "Create a task, an Idempotency-Key header makes retries safe", Body: TaskRequest{}, Response: APITask{}, Status: http.StatusCreated},
+	"GET /api/v1/tasks/:id": {Summary: "Show a task", Response: APITask{}},
+	"DELETE /api/v1/tasks/:id": {Summary: "Move a task to the trash, purge removes its rows and files at once", Query: []apiParam{{"purge", "boolean", "true to purge the task, admins only"}},
+		Status: http.StatusNoContent},
+	"POST /api/v1/tasks/:id/run": {Summary: "Queue a task, the same as POST /api/v1/tasks/:id/runs", Response: runCreated{}, Status: http.StatusAccepted},
+	"POST /api/v1/tasks/:id/runs": {Summary: "Run a task, it is queued and runs in the background", Body: RunRequest{}, Response: runCreated{},
+		Status: http.StatusAccepted},
+	"GET /api/v1/tasks/:id/runs":         {Summary: "List the runs of a task", Query: pageParams, Response: Run{}, List: true},
+	"GET /api/v1/tasks/:id/runs/:run_id": {Summary: "Show a run with its attempts", Response: Run{}},
+	"GET /api/v1/tasks/:id/attempts": {Summary: "List the attempts of a task", Response: struct {
+		Items []TaskAttempt `json:"items"`
+	}{}},
+	"GET /api/v1/tasks/:id/progress": {Summary: "Show the plays and tasks of a run so far, also while it runs", Query: []apiParam{
+		{"run_id", "integer", "the run, the last one by default"}, {"attempt", "integer", "the attempt of the run, the last one by default"}},
+		Response: struct {
+			TaskID  string         `json:"task_id"`
+			RunID   uint           `json:"run_id"`
+			Attempt uint           `json:"attempt"`
+			Plays   []PlayProgress `json:"plays"`
+		}{}},
+	"POST /api/v1/tasks/:id/rerun": {Summary: "Re-run a finished task as a new task with the same playbook, inventory and options", Response: rerunCreated{},
+		Status: http.StatusAccepted},
+	"POST /api/v1/tasks/bulk": {Summary: "Run, cancel or delete up to 100 tasks, by task_ids or the filter, with the result for each", Query: taskFilters,
+		Body: BulkTaskRequest{}, Response: bulkTaskResponse{}},
+	"GET /api/v1/tasks/export.csv":                   {Summary: "Export tasks as CSV", Query: taskFilterParams, ContentType: "text/csv"},
+	"GET /api/v1/tasks/search":                       {Summary: "Search tasks", Query: taskFilterParams, Response: APITask{}, List: true},
+	"GET /api/v1/playbooks":                          {Summary: "List the playbooks of tasks", Query: pageParams, Response: Playbook{}, List: true},
+	"GET /api/v1/playbooks/:id":                      {Summary: "Show a playbook with its content", Response: APIFile{}},
+	"PUT /api/v1/playbooks/:id":                      {Summary: "Replace the content of a playbook", Body: FileRequest{}, Response: APIFile{}},
+	"GET /api/v1/hosts":                              {Summary: "List the registered hosts", Query: append([]apiParam{{"status", "string", "unknown, reachable or unreachable"}, {"q", "string", "name or address"}}, pageParams...), Response: Host{}, List: true},
+	"GET /api/v1/hosts/:id":                          {Summary: "Show a host with its last check", Response: Host{}},
+	"PUT /api/v1/hosts/:id":                          {Summary: "Change the address or port a host is checked at", Body: HostRequest{}, Response: Host{}},
+	"POST /api/v1/hosts/:id/check":                   {Summary: "Check that the SSH port of a host answers", Response: Host{}},
+	"DELETE /api/v1/hosts/:id":                       {Summary: "Forget a host", Status: http.StatusNoContent},
+	"GET /api/v1/workflows":                          {Summary: "List workflows", Query: pageParams, Response: Workflow{}, List: true},
+	"POST /api/v1/workflows":                         {Summary: "Add a workflow, a DAG of tasks", Body: WorkflowRequest{}, Response: Workflow{}, Status: http.StatusCreated},
+	"GET /api/v1/workflows/:id":                      {Summary: "Show a workflow", Response: Workflow{}},
+	"PUT /api/v1/workflows/:id":                      {Summary: "Update a workflow, nodes replace all nodes", Body: WorkflowRequest{}, Response: Workflow{}},
+	"DELETE /api/v1/workflows/:id":                   {Summary: "Delete a workflow and its runs", Status: http.StatusNoContent},
+	"POST /api/v1/workflows/:id/runs":                {Summary: "Run a workflow, the nodes go on in the background", Response: WorkflowRun{}, Status: http.StatusAccepted},
+	"GET /api/v1/workflows/:id/runs":                 {Summary: "List the runs of a workflow", Query: append([]apiParam{{"status", "string", "running, successful, failed or cancelled"}}, pageParams...), Response: WorkflowRun{}, List: true},
+	"GET /api/v1/workflows/:id/runs/:run_id":         {Summary: "Show a workflow run with its nodes and their status counts", Response: WorkflowRun{}},
+	"POST /api/v1/workflows/:id/runs/:run_id/cancel": {Summary: "Start no more nodes of a workflow run, running tasks go on", Response: WorkflowRun{}},
+	"GET /api/v1/facts":                              {Summary: "Search the facts of hosts gathered by gather facts tasks", Query: append([]apiParam{{"q", "string", "host, OS, kernel, architecture or address"}, {"host", "string", ""}, {"os", "string", ""}, {"kernel", "string", ""}, {"ip", "string", "an IPv4 address of the host"}}, pageParams...), Response: HostFacts{}, List: true},
+	"GET /api/v1/facts/:id":                          {Summary: "Show the facts of a host", Query: []apiParam{{"fact", "string", "only this fact, may repeat"}}, Response: HostFacts{}},
+	"GET /api/v1/inventories":                        {Summary: "List the inventories of tasks", Query: pageParams, Response: Inventory{}, List: true},
+	"GET /api/v1/inventories/:id":                    {Summary: "Show an inventory with its content", Response: APIFile{}},
+	"GET /api/v1/inventories/:id/graph":              {Summary: "Resolve an inventory with ansible-inventory into its hosts and groups", Response: InventoryGraph{}},
+	"PUT /api/v1/inventories/:id":                    {Summary: "Replace the content of an inventory", Body: FileRequest{}, Response: APIFile{}},
+	"GET /api/v1/library/playbooks":                  {Summary: "List library playbooks", Query: pageParams, Response: LibraryPlaybook{}, List: true},
+	"POST /api/v1/library/playbooks":                 {Summary: "Add a library playbook", Body: LibraryPlaybookRequest{}, Response: LibraryPlaybook{}, Status: http.StatusCreated},
+	"GET /api/v1/library/inventories":                {Summary: "List library inventories", Query: pageParams, Response: LibraryInventory{}, List: true},
+	"POST /api/v1/library/inventories": {Summary: "Add a library inventory", Body: LibraryInventoryRequest{}, Response: LibraryInventory{},
+		Status: http.StatusCreated},
+	"POST /api/v1/library/inventories/:id/refresh": {Summary: "Resolve and keep the hosts of a dynamic library inventory", Response: LibraryInventory{}},
+	"GET /api/v1/projects":                         {Summary: "List projects", Query: pageParams, Response: Project{}, List: true},
+	"POST /api/v1/projects":                        {Summary: "Add a project", Body: ProjectRequest{}, Response: Project{}, Status: http.StatusCreated},
+	"GET /api/v1/users":                            {Summary: "List users", Query: pageParams, Response: User{}, List: true},
+	"POST /api/v1/users":                           {Summary: "Add a user", Body: UserRequest{}, Response: User{}, Status: http.StatusCreated},
+	"PUT /api/v1/users/:id":                        {Summary: "Update a user", Body: UserRequest{}, Response: User{}},
+	"GET /api/v1/teams":                            {Summary: "List your teams, every team for admins", Query: pageParams, Response: Team{}, List: true},
+	"POST /api/v1/teams":                           {Summary: "Add a team", Body: TeamRequest{}, Response: Team{}, Status: http.StatusCreated},
+	"GET /api/v1/teams/:id":                        {Summary: "Show a team with its members", Response: Team{}},
+	"PUT /api/v1/teams/:id":                        {Summary: "Update a team", Body: TeamRequest{}, Response: Team{}},
+	"GET /api/v1/credentials":                      {Summary: "List credentials", Query: pageParams, Response: Credential{}, List: true},
+	"POST /api/v1/credentials":                     {Summary: "Add a credential", Body: CredentialRequest{}, Response: Credential{}, Status: http.StatusCreated},
+	"GET /api/v1/known-hosts":                      {Summary: "Show the known hosts file of host key checking", ContentType: "text/plain"},
+	"PUT /api/v1/known-hosts":                      {Summary: "Replace the known hosts file with the known_hosts lines of the body", Status: http.StatusNoContent},
+	"GET /api/v1/tokens":                           {Summary: "List your API tokens", Query: pageParams, Response: Token{}, List: true},
+	"POST /api/v1/tokens": {Summary: "Create an API token, the secret is only shown once", Body: TokenRequest{}, Response: struct {
+		Token string `json:"token"`
+		Info  Token  `json:"info"`
+	}{}, Status: http.StatusCreated},
+	"GET /api/v1/search":            {Summary: "Full-text search of task output", Query: []apiParam{{"q", "string", "FTS5 query"}}, Response: []SearchHit{}},
+	"GET /api/v1/audit":             {Summary: "List audit events", Query: append([]apiParam{{"action", "string", ""}, {"object_type", "string", ""}, {"object_id", "string", ""}, {"user", "string", "user name"}, {"since", "string", "RFC 3339 time"}, {"until", "string", "RFC 3339 time"}}, pageParams...), Response: AuditEvent{}, List: true},
+	"GET /result/:id":               {Summary: "Show the results of a task, .xml for JUnit and .csv for the host recap", Query: []apiParam{{"raw", "string", "1 for the stored results"}}, Response: ResultSummary{}},
+	"GET /result/:id/events.ndjson": {Summary: "Stream the results of a task as events", ContentType: "application/x-ndjson"},
+	"GET /task/:id/status":          {Summary: "Show the status of a task", Response: APITask{}},
+	"GET /task/:id/artifacts":       {Summary: "List the artifacts of a task", Response: []Artifact{}},
+	"GET /task/:id/artifacts/*file": {Summary: "Download an artifact", ContentType: "application/octet-stream"},
+	"GET /events/task/:id":          {Summary: "Follow a task as server-sent events", Response: TaskEvent{}, ContentType: "text/event-stream"},
+	"GET /events/tasks":             {Summary: "Follow several tasks over one stream of server-sent events", Query: []apiParam{{"tasks", "string", "comma separated task IDs, at most 100"}}, Response: TaskEvent{}, ContentType: "text/event-stream"},
+}
+
+var openAPIDoc []byte
+
+// openAPISchemas turns Go types into the component schemas of the doc.
+type openAPISchemas map[string]interface{}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage{})
+)
+
+func (s openAPISchemas) ref(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case deletedAtType:
+		return map[string]interface{}{"type": "string", "format": "date-time", "nullable": true}
+	case rawJSONType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.ref(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.ref(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			// a placeholder stops recursive types
+			s[t.Name()] = nil
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object is the schema of a struct as encoding/json writes it, embedded
+// structs without a name are flattened into it.
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			name := strings.Split(tag, ",")[0]
+			if name == "-" {
+				continue
+			}
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				addFields(ft)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = s.ref(f.Type)
+		}
+	}
+	addFields(t)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func pageSchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"items":     map[string]interface{}{"type": "array", "items": items},
+			"total":     map[string]interface{}{"type": "integer"},
+			"page":      map[string]interface{}{"type": "integer"},
+			"page_size": map[string]interface{}{"type": "integer"},
+			"pages":     map[string]interface{}{"type": "integer"},
+		},
+	}
+}
+
+// openAPIPath converts a gin path to an OpenAPI one and returns its
+// parameters.
+func openAPIPath(route string) (string, []string) {
+	var params []string
+	parts := strings.Split(route, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// operationID is the name of the handler, closures get one made of the
+// route.
+func operationID(route gin.RouteInfo) string {
+	name := path.Ext(route.Handler)
+	name = strings.TrimPrefix(name, ".")
+	if name == "" || strings.HasPrefix(name, "func") {
+		name = strings.ToLower(route.Method) + strings.NewReplacer("/", "_", ":", "", "*", "", ".", "_").Replace(route.Path)
+	}
+	return name
+}
+
+// buildOpenAPIDoc documents every route of the router, with the details of
+// apiOperations where there are some.
+func buildOpenAPIDoc(routes gin.RoutesInfo) ([]byte, error) {
+	schemas := openAPISchemas{}
+	errorSchema := schemas.ref(reflect.TypeOf(struct {
+		Error string `json:"error"`
+	}{}))
+	paths := map[string]map[string]interface{}{}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, route := range routes {
+		p, params := openAPIPath(route.Path)
+		doc := apiOperations[route.Method+" "+route.Path]
+		op := map[string]interface{}{"operationId": operationID(route)}
+		if doc.Summary != "" {
+			op["summary"] = doc.Summary
+		}
+		tag := strings.Split(strings.TrimPrefix(strings.TrimPrefix(route.Path, "/api/v1"), "/"), "/")[0]
+		if tag != "" {
+			op["tags"] = []string{tag}
+		}
+
+		var parameters []interface{}
+		for _, name := range params {
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range doc.Query {
+			param := map[string]interface{}{"name": q.Name, "in": "query", "schema": map[string]interface{}{"type": q.Type}}
+			if q.Description != "" {
+				param["description"] = q.Description
+			}
+			parameters = append(parameters, param)
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		if doc.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.ref(reflect.TypeOf(doc.Body))},
+				},
+			}
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]interface{}{"description": http.StatusText(status)}
+		if status != http.StatusNoContent {
+			contentType := doc.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			schema := map[string]interface{}{}
+			if doc.Response != nil {
+				schema = schemas.ref(reflect.TypeOf(doc.Response))
+				if doc.List {
+					schema = pageSchema(schema)
+				}
+			} else if contentType != "application/json" {
+				schema = map[string]interface{}{"type": "string"}
+			}
+			resp["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": schema}}
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(status): resp,
+			"default": map[string]interface{}{
+				"description": "error",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+			},
+		}
+		if paths[p] == nil {
+			paths[p] = map[string]interface{}{}
+		}
+		paths[p][strings.ToLower(route.Method)] = op
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "ansible runner web",
+			"version": version,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": strings.TrimRight(config.BaseURL, "/")}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"token":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": SESSION_COOKIE},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"token": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}, "", "  ")
+}
+
+func showOpenAPIDoc(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDoc)
+}
+
+func showAPIDocs(c *gin.Context) {
+	c.HTML(http.StatusOK, "apidocs.html", gin.H{"version": SWAGGER_UI_VERSION, "csrf": csrfToken(c)})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+	"github.com/gin-gonic/gin"
+)
+
+const REDACTED = "********"
+
+// secret extra vars are recognised by name, e.g. ansible_become_password,
+// ansible_ssh_pass or api_token
+var secretVarNames = []string{"pass", "secret", "token", "credential"}
+
+func isSecretVar(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretVarNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactOptions returns a copy of options with the values of secret extra
+// vars replaced.
+func redactOptions(options *playbook.AnsiblePlaybookOptions) *playbook.AnsiblePlaybookOptions {
+	redacted := *options
+	redacted.ExtraVars = make(map[string]interface{}, len(options.ExtraVars))
+	for k, v := range options.ExtraVars {
+		if isSecretVar(k) {
+			v = REDACTED
+		}
+		redacted.ExtraVars[k] = v
+	}
+	return &redacted
+}
+
+// cleanTags normalizes a comma separated tag list like "web, db".
+func cleanTags(tags string) (string, error) {
+	var list []string
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(tag, "-") || strings.ContainsAny(tag, " \t\r\n") {
+			return "", fmt.Errorf("invalid tag %q", tag)
+		}
+		list = append(list, tag)
+	}
+	return strings.Join(list, ","), nil
+}
+
+// cleanLimit checks a host pattern for --limit, e.g. "web:!web3". Patterns
+// starting with @ are refused, ansible reads the hosts of those from a file
+// on the server.
+func cleanLimit(limit string) (string, error) {
+	limit = strings.TrimSpace(limit)
+	if strings.HasPrefix(limit, "-") || strings.ContainsAny(limit, "\r\n") {
+		return "", errors.New("invalid limit, give an ansible host pattern")
+	}
+	for _, pattern := range strings.FieldsFunc(limit, func(r rune) bool { return r == ',' || r == ':' }) {
+		if strings.HasPrefix(strings.TrimSpace(pattern), "@") {
+			return "", errors.New("invalid limit, host lists from files aren't allowed")
+		}
+	}
+	return limit, nil
+}
+
+func showTaskOptions(c *gin.Context) {
+	taskId := c.Param("id")
+
+	var task Task
+	tx := db.Preload("Playbook").Preload("Inventory").Limit(1).Find(&task, "task_id = ?", taskId)
+	if tx.Error != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		return
+	}
+	if task.ID == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "task not found"})
+		return
+	}
+
+	options, err := newPlaybookOptions(&task)
+	if err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	options = redactOptions(options)
+	taskCmd, _ := newTaskCommand(&task, newAnsibleCmd(&task, options), options)
+	env := gin.H{
+		"ANSIBLE_STDOUT_CALLBACK": JSONL_STDOUT_CALLBACK,
+	}
+	for k, v := range vaultIDEnv(&task) {
+		env[k] = v
+	}
+	for k, v := range verbosityEnv(&task) {
+		env[k] = v
+	}
+	for k, v := range hostKeyEnv(&task) {
+		env[k] = v
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"task_id":     task.TaskID,
+		"environment": task.Environment,
+		"playbook":    task.Playbook.Path,
+		"options":     options,
+		"env":         env,
+		"executor":    config.Executor.Type,
+		"command":     commandLine(taskCmd),
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCleanLimit(t *testing.T) {
+	for _, tc := range []struct {
+		limit string
+		ok    bool
+	}{
+		{"", true},
+		{" web:!web3 ", true},
+		{"web,db&prod", true},
+		{"-e", false},
+		{"web\nx", false},
+		{"@/etc/hosts", false},
+		{" @retry", false},
+		{"web,@/tmp/hosts", false},
+		{"web: @hosts", false},
+	} {
+		_, err := cleanLimit(tc.limit)
+		if (err == nil) != tc.ok {
+			t.Errorf("cleanLimit(%q): %v, want ok %v", tc.limit, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+# Records the file, line and role of every task the playbook starts, one JSON
+# object per line in $TASK_PATHS_FILE. The web server joins it with the jsonl
+# results by task id, as the json callbacks don't carry the role.
+from __future__ import absolute_import, division, print_function
+__metaclass__ = type
+
+DOCUMENTATION = '''
+    name: task_paths
+    type: aggregate
+    short_description: write the path and role of every task to a file
+    description:
+      - Writes one JSON line per started task to the file named by TASK_PATHS_FILE.
+'''
+
+import json
+import os
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'aggregate'
+    CALLBACK_NAME = 'task_paths'
+    CALLBACK_NEEDS_ENABLED = True
+
+    def __init__(self, *args, **kwargs):
+        super(CallbackModule, self).__init__(*args, **kwargs)
+        self._file = os.environ.get('TASK_PATHS_FILE')
+
+    def _record(self, task):
+        if not self._file:
+            return
+        role = task._role.get_name() if task._role else ''
+        with open(self._file, 'a') as f:
+            f.write(json.dumps({
+                'id': str(task._uuid),
+                'path': task.get_path() or '',
+                'role': role,
+            }) + '\n')
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._record(task)
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._record(task)
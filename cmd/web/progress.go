@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute/configuration"
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+	"github.com/apenella/go-ansible/v2/pkg/execute/stdoutcallback"
+)
+
+// the jsonl callback prints one event per line while the playbook runs, its
+// last line has the same layout as the json callback's single document
+const JSONL_STDOUT_CALLBACK = "ansible.posix.jsonl"
+
+// jsonlStdoutCallbackExecute is stdoutcallback.JSONStdoutCallbackExecute
+// with the jsonl callback.
+type jsonlStdoutCallbackExecute struct {
+	executor stdoutcallback.ExecutorQuietStdoutCallbackSetter
+}
+
+func newJSONLStdoutCallbackExecute(executor stdoutcallback.ExecutorQuietStdoutCallbackSetter) *jsonlStdoutCallbackExecute {
+	return &jsonlStdoutCallbackExecute{executor: executor}
+}
+
+func (e *jsonlStdoutCallbackExecute) Execute(ctx context.Context) error {
+	e.executor.Quiet()
+	e.executor.WithOutput(results.NewJSONStdoutCallbackResults())
+	return configuration.NewAnsibleWithConfigurationSettingsExecute(e.executor,
+		configuration.WithAnsibleStdoutCallback(JSONL_STDOUT_CALLBACK),
+	).Execute(ctx)
+}
+
+type Progress struct {
+	Play       string `json:"play"`
+	Task       string `json:"task"`
+	TasksDone  int    `json:"tasks_done"`
+	HostsTotal int    `json:"hosts_total"`
+	// HostsDone counts the hosts that finished the current task
+	HostsDone   int `json:"hosts_done"`
+	Failed      int `json:"failed"`
+	Unreachable int `json:"unreachable"`
+}
+
+type progressState struct {
+	Progress
+	taskID      string
+	hostsDone   map[string]bool
+	failed      map[string]bool
+	unreachable map[string]bool
+}
+
+// progressWriter follows the jsonl events of one run and keeps its Progress
+// up to date.
+type progressWriter struct {
+	taskID  string
+	partial []byte
+	steps   *stepRecorder
+}
+
+type jsonlEvent struct {
+	Event string `json:"_event"`
+	Play  *struct {
+		Name string `json:"name"`
+	} `json:"play"`
+	Task *struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"task"`
+	Hosts map[string]json.RawMessage `json:"hosts"`
+}
+
+var (
+	progressMu sync.Mutex
+	progresses = map[string]*progressState{}
+)
+
+func newProgressWriter(task *Task, hostsTotal int) *progressWriter {
+	progressMu.Lock()
+	progresses[task.TaskID] = &progressState{
+		Progress:    Progress{HostsTotal: hostsTotal},
+		hostsDone:   map[string]bool{},
+		failed:      map[string]bool{},
+		unreachable: map[string]bool{},
+	}
+	progressMu.Unlock()
+	return &progressWriter{taskID: task.TaskID, steps: newStepRecorder(task)}
+}
+
+// close saves the ansible task the run stopped in, once ansible exited.
+func (w *progressWriter) close() {
+	w.steps.finish()
+}
+
+func removeProgress(taskID string) {
+	progressMu.Lock()
+	delete(progresses, taskID)
+	progressMu.Unlock()
+}
+
+// taskProgress returns a copy of the progress of a running task.
+func taskProgress(taskID string) (Progress, bool) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p, ok := progresses[taskID]
+	if !ok {
+		return Progress{}, false
+	}
+	return p.Progress, true
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.handle(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) handle(line []byte) {
+	var ev jsonlEvent
+	if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &ev) != nil || ev.Event == "" {
+		return
+	}
+	w.updateProgress(&ev)
+	w.steps.record(&ev)
+}
+
+func (w *progressWriter) updateProgress(ev *jsonlEvent) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p, ok := progresses[w.taskID]
+	if !ok {
+		return
+	}
+
+	if ev.Play != nil && ev.Event == "v2_playbook_on_play_start" {
+		p.Play = ev.Play.Name
+	}
+	if ev.Task != nil && ev.Task.ID != p.taskID {
+		if p.taskID != "" {
+			p.TasksDone++
+		}
+		p.taskID = ev.Task.ID
+		p.Task = ev.Task.Name
+		p.hostsDone = map[string]bool{}
+	}
+	for host := range ev.Hosts {
+		switch ev.Event {
+		case "v2_runner_on_ok", "v2_runner_on_skipped":
+		case "v2_runner_on_failed":
+			p.failed[host] = true
+		case "v2_runner_on_unreachable":
+			p.unreachable[host] = true
+		default:
+			continue
+		}
+		p.hostsDone[host] = true
+	}
+	if ev.Event == "v2_playbook_on_stats" && p.taskID != "" {
+		p.TasksDone++
+		p.taskID = ""
+	}
+	p.HostsDone = len(p.hostsDone)
+	p.Failed = len(p.failed)
+	p.Unreachable = len(p.unreachable)
+}
+
+func showTaskStatus(c *gin.Context) {
+	var task Task
+	if err := db.First(&task, "task_id = ?", c.Param("id")).Error; err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{
+		"task_id":     task.TaskID,
+		"status":      task.Status,
+		"status_text": statusText(task.Status),
+		"queued":      task.Queued,
+	}
+	if p, ok := taskProgress(task.TaskID); ok {
+		resp["progress"] = p
+	}
+	c.IndentedJSON(http.StatusOK, resp)
+}
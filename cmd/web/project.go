@@ -0,0 +1,546 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PROJECT_NEVER_SYNCED = "never"
+	PROJECT_SYNCING      = "syncing"
+	PROJECT_SYNCED       = "synced"
+	PROJECT_SYNC_FAILED  = "failed"
+
+	PROJECT_SYNC_TIMEOUT = 10 * time.Minute
+	// PROJECT_DIR is where a task's snapshot of its project goes
+	PROJECT_DIR = "project"
+)
+
+// Project is a Git repository tasks take their playbook from. The server
+// keeps a clone of Branch below data/projects, each task runs on a snapshot
+// of the commit that was synced when it was created.
+type Project struct {
+	ID   uint   `json:"id" gorm:"primarykey"`
+	Name string `json:"name" gorm:"column:name;size:191;uniqueIndex"`
+	// URL may hold a token, only its redacted form is shown
+	URL         string `json:"-" gorm:"column:url"`
+	RedactedURL string `json:"url" gorm:"-"`
+	// Branch is the remote's default branch if empty
+	Branch     string    `json:"branch" gorm:"column:branch"`
+	SyncStatus string    `json:"sync_status" gorm:"column:sync_status"`
+	SyncError  string    `json:"sync_error" gorm:"column:sync_error"`
+	SyncedAt   time.Time `json:"synced_at" gorm:"column:synced_at"`
+	Commit     string    `json:"commit" gorm:"column:commit_sha"`
+	Creator    string    `json:"creator" gorm:"column:creator"`
+	CreatedAt  time.Time `json:"created_at" gorm:"column:created_at"`
+	TeamID     uint      `json:"team_id" gorm:"column:team_id;index"`
+}
+
+// ProjectRequest creates a project.
+type ProjectRequest struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	// TeamID is the team the project goes to, the first of the user if 0
+	TeamID uint `json:"team_id"`
+}
+
+var (
+	errProjectNotFound = withStatus(http.StatusNotFound, errors.New("project not found"))
+	errProjectSyncing  = withStatus(http.StatusConflict, errors.New("project is already syncing"))
+)
+
+// projectLocks keeps a clone from being synced and snapshotted at once.
+var projectLocks sync.Map
+
+func projectLock(id uint) *sync.RWMutex {
+	mu, _ := projectLocks.LoadOrStore(id, &sync.RWMutex{})
+	return mu.(*sync.RWMutex)
+}
+
+func projectDir(id uint) string {
+	return filepath.Join(rootDir, "projects", strconv.FormatUint(uint64(id), 10))
+}
+
+func (p *Project) redact() {
+	p.RedactedURL = p.URL
+	if u, err := url.Parse(p.URL); err == nil && u.User != nil {
+		p.RedactedURL = u.Redacted()
+	}
+}
+
+// git runs git with args in dir and returns its output, which the error
+// includes as well.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// a repository that wants a password fails instead of hanging
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return out.String(), fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+// syncProject clones the project, or updates its clone to the head of its
+// branch, and records the outcome.
+func syncProject(project *Project) {
+	mu := projectLock(project.ID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PROJECT_SYNC_TIMEOUT)
+	defer cancel()
+	commit, err := updateClone(ctx, project)
+
+	updates := map[string]interface{}{"sync_status": PROJECT_SYNCED, "sync_error": ""}
+	if err != nil {
+		logger("project").Error("sync failed", "project", project.Name, "error", err)
+		updates = map[string]interface{}{"sync_status": PROJECT_SYNC_FAILED, "sync_error": err.Error()}
+	} else {
+		updates["commit_sha"] = commit
+		updates["synced_at"] = time.Now()
+	}
+	if err := db.Model(&Project{}).Where("id = ?", project.ID).Updates(updates).Error; err != nil {
+		logger("project").Error("failed to update project", "project", project.Name, "error", err)
+	}
+}
+
+func updateClone(ctx context.Context, project *Project) (string, error) {
+	dir := projectDir(project.ID)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", err
+		}
+		os.RemoveAll(dir)
+		args := []string{"clone", "--depth", "1"}
+		if project.Branch != "" {
+			args = append(args, "--branch", project.Branch)
+		}
+		if _, err := git(ctx, "", append(args, "--", project.URL, dir)...); err != nil {
+			return "", err
+		}
+	} else {
+		ref := "HEAD"
+		if project.Branch != "" {
+			ref = project.Branch
+		}
+		// the URL may have been changed since the clone
+		if _, err := git(ctx, dir, "remote", "set-url", "origin", project.URL); err != nil {
+			return "", err
+		}
+		if _, err := git(ctx, dir, "fetch", "--depth", "1", "origin", ref); err != nil {
+			return "", err
+		}
+		if _, err := git(ctx, dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+	out, err := git(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// startProjectSync marks the project as syncing and syncs it in the
+// background, unless it is syncing already.
+func startProjectSync(project *Project) error {
+	tx := db.Model(&Project{}).Where("id = ? AND sync_status <> ?", project.ID, PROJECT_SYNCING).
+		Update("sync_status", PROJECT_SYNCING)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return errProjectSyncing
+	}
+	project.SyncStatus = PROJECT_SYNCING
+	go syncProject(project)
+	return nil
+}
+
+// recoverProjects fails the syncs a restart cut short.
+func recoverProjects() {
+	err := db.Model(&Project{}).Where("sync_status = ?", PROJECT_SYNCING).Updates(map[string]interface{}{
+		"sync_status": PROJECT_SYNC_FAILED,
+		"sync_error":  "interrupted by a restart of the server",
+	}).Error
+	if err != nil {
+		logger("project").Error("failed to recover project syncs", "error", err)
+	}
+}
+
+// cleanProjectPath checks that path names a file inside a project.
+func cleanProjectPath(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return "", errors.New("playbook path is required")
+	}
+	if filepath.IsAbs(path) {
+		return "", errors.New("playbook path must be relative to the project")
+	}
+	path = filepath.Clean(path)
+	if path == "." || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", errors.New("playbook path must be inside the project")
+	}
+	return path, nil
+}
+
+// snapshotProject extracts the synced commit of project into the dir of a
+// task and returns the path of its playbook there.
+func snapshotProject(project *Project, playbookPath, taskDir string) (string, error) {
+	mu := projectLock(project.ID)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PROJECT_SYNC_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar", project.Commit)
+	cmd.Dir = projectDir(project.ID)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(taskDir, PROJECT_DIR)
+	extractErr := extractTar(stdout, dest)
+	// drain what is left so that git can exit
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("git archive: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if extractErr != nil {
+		return "", extractErr
+	}
+
+	path := filepath.Join(dest, playbookPath)
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || !withinDir(dest, path) {
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("project %q has no playbook %q", project.Name, playbookPath))
+	}
+	return path, nil
+}
+
+// extractTar writes the directories, files, symlinks and hard links of a
+// tar stream below dest. Entries that would end up outside of it or below a
+// symlink and links that point outside of it are refused, so that nothing
+// is written through a link and the playbook can't read through one.
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return checkTarSymlinks(dest)
+		}
+		if err != nil {
+			return err
+		}
+		name, err := cleanProjectPath(hdr.Name)
+		if err != nil {
+			if hdr.Typeflag == tar.TypeXGlobalHeader || filepath.Clean(hdr.Name) == "." {
+				continue
+			}
+			return fmt.Errorf("project file %q: %v", hdr.Name, err)
+		}
+		if err := checkNoSymlinks(dest, name); err != nil {
+			return fmt.Errorf("project file %q: %v", hdr.Name, err)
+		}
+		path := filepath.Join(dest, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = writeTarFile(path, tr, hdr.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			// the target is relative to the dir of the link
+			target := filepath.Join(filepath.Dir(name), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || target == ".." || strings.HasPrefix(target, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("project file %q: symlink to %q leaves the project", hdr.Name, hdr.Linkname)
+			}
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, path)
+			}
+		case tar.TypeLink:
+			err = linkTarFile(dest, name, hdr.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkNoSymlinks refuses name if it or one of its parents below dest is a
+// symlink already.
+func checkNoSymlinks(dest, name string) error {
+	path := dest
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", strings.TrimPrefix(path, dest+string(filepath.Separator)))
+		}
+	}
+	return nil
+}
+
+// linkTarFile makes name a hard link to the file target, both relative to
+// the root of the archive, that was extracted before it.
+func linkTarFile(dest, name, linkname string) error {
+	target, err := cleanProjectPath(linkname)
+	if err != nil {
+		return fmt.Errorf("project file %q: hard link to %q leaves the project", name, linkname)
+	}
+	if err := checkNoSymlinks(dest, target); err != nil {
+		return fmt.Errorf("project file %q: hard link to %q: %v", name, target, err)
+	}
+	info, err := os.Lstat(filepath.Join(dest, target))
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("project file %q: hard link to %q, which is not a file of the project", name, target)
+	}
+	path := filepath.Join(dest, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Link(filepath.Join(dest, target), path)
+}
+
+// checkTarSymlinks refuses symlinks that resolve outside of dest through
+// other symlinks, like a link to x/../.. where x links to a dir further up.
+// Dangling links are left alone.
+func checkTarSymlinks(dest string) error {
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+		if !withinDir(dest, path) {
+			return fmt.Errorf("project file %q: symlink leaves the project", strings.TrimPrefix(path, dest+string(filepath.Separator)))
+		}
+		return nil
+	})
+}
+
+func writeTarFile(path string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// useProject checks that the project of req is synced and that its playbook
+// path is sane, it returns the project.
+func useProject(req *TaskRequest) (*Project, error) {
+	if strings.TrimSpace(req.Playbook) != "" || req.LibraryPlaybookID != 0 {
+		return nil, withStatus(http.StatusBadRequest, errors.New("give either a playbook, a library playbook or a project, not several"))
+	}
+	path, err := cleanProjectPath(req.ProjectPlaybook)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	req.ProjectPlaybook = path
+	var project Project
+	if err := db.Limit(1).Find(&project, req.ProjectID).Error; err != nil {
+		return nil, err
+	}
+	if project.ID == 0 || project.TeamID != req.TeamID {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("unknown project %d", req.ProjectID))
+	}
+	if project.Commit == "" {
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("project %q hasn't been synced yet", project.Name))
+	}
+	return &project, nil
+}
+
+func findProject(c *gin.Context) (*Project, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, errProjectNotFound
+	}
+	var project Project
+	if err := db.Limit(1).Find(&project, id).Error; err != nil {
+		return nil, err
+	}
+	if project.ID == 0 {
+		return nil, errProjectNotFound
+	}
+	project.redact()
+	return &project, nil
+}
+
+func apiListProjects(c *gin.Context) {
+	var projects []Project
+	page, err := listPage(c, db.Model(&Project{}).Scopes(inTeams(c, "projects.team_id")), &projects)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	for i := range projects {
+		projects[i].redact()
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowProject(c *gin.Context) {
+	project, err := findProject(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, project)
+}
+
+func apiCreateProject(c *gin.Context) {
+	var req ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	project := Project{
+		Name:       strings.TrimSpace(req.Name),
+		URL:        strings.TrimSpace(req.URL),
+		Branch:     strings.TrimSpace(req.Branch),
+		SyncStatus: PROJECT_NEVER_SYNCED,
+		Creator:    currentUser(c).Name,
+	}
+	if project.Name == "" || project.URL == "" {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("name and url are required")))
+		return
+	}
+	// git would take them for options
+	if strings.HasPrefix(project.URL, "-") || strings.HasPrefix(project.Branch, "-") {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("url and branch can't start with -")))
+		return
+	}
+	var count int64
+	if err := db.Model(&Project{}).Where("name = ?", project.Name).Count(&count).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if count > 0 {
+		apiError(c, withStatus(http.StatusConflict, errors.New("project already exists")))
+		return
+	}
+	teamID, err := requestTeam(currentUser(c), req.TeamID)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	project.TeamID = teamID
+	if err := db.Create(&project).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := startProjectSync(&project); err != nil {
+		apiError(c, err)
+		return
+	}
+	project.redact()
+	c.Header("Location", "/api/v1/projects/"+strconv.FormatUint(uint64(project.ID), 10))
+	c.IndentedJSON(http.StatusCreated, project)
+}
+
+func apiSyncProject(c *gin.Context) {
+	project, err := findProject(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := startProjectSync(project); err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusAccepted, project)
+}
+
+// apiListProjectPlaybooks lists the YAML files of the synced commit, the
+// candidates for a task's playbook.
+func apiListProjectPlaybooks(c *gin.Context) {
+	project, err := findProject(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	files := []string{}
+	if project.Commit != "" {
+		mu := projectLock(project.ID)
+		mu.RLock()
+		out, err := git(c.Request.Context(), projectDir(project.ID), "ls-tree", "-r", "--name-only", project.Commit)
+		mu.RUnlock()
+		if err != nil {
+			apiError(c, err)
+			return
+		}
+		for _, name := range strings.Split(out, "\n") {
+			if strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml") {
+				files = append(files, name)
+			}
+		}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"commit": project.Commit, "playbooks": files})
+}
+
+func apiDeleteProject(c *gin.Context) {
+	project, err := findProject(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if project.SyncStatus == PROJECT_SYNCING {
+		apiError(c, errProjectSyncing)
+		return
+	}
+	// tasks keep their snapshots
+	if err := db.Delete(project).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	mu := projectLock(project.ID)
+	mu.Lock()
+	os.RemoveAll(projectDir(project.ID))
+	mu.Unlock()
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name, link, body string
+	typ              byte
+}
+
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0644, Size: int64(len(e.body))}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []tarEntry
+		// err is part of the error expected, empty if it extracts
+		err string
+	}{
+		{"files", []tarEntry{
+			{name: "roles/", typ: tar.TypeDir},
+			{name: "roles/main.yml", body: "- ping:", typ: tar.TypeReg},
+			{name: "site.yml", body: "- hosts: all", typ: tar.TypeReg},
+		}, ""},
+		{"symlink inside", []tarEntry{
+			{name: "site.yml", body: "x", typ: tar.TypeReg},
+			{name: "roles/link.yml", link: "../site.yml", typ: tar.TypeSymlink},
+			{name: "here", link: ".", typ: tar.TypeSymlink},
+		}, ""},
+		{"dangling symlink", []tarEntry{{name: "missing", link: "nope", typ: tar.TypeSymlink}}, ""},
+		{"hard link inside", []tarEntry{
+			{name: "site.yml", body: "x", typ: tar.TypeReg},
+			{name: "dir/copy.yml", link: "site.yml", typ: tar.TypeLink},
+		}, ""},
+		{"path outside", []tarEntry{{name: "../evil", body: "x", typ: tar.TypeReg}}, "inside the project"},
+		{"absolute symlink", []tarEntry{{name: "passwd", link: "/etc/passwd", typ: tar.TypeSymlink}}, "leaves the project"},
+		{"relative symlink outside", []tarEntry{{name: "dir/up", link: "../../outside", typ: tar.TypeSymlink}}, "leaves the project"},
+		{"symlink through symlink", []tarEntry{
+			{name: "a/b/", typ: tar.TypeDir},
+			{name: "a/b/s", link: "../t", typ: tar.TypeSymlink},
+			{name: "a/t/", typ: tar.TypeDir},
+			{name: "top", link: "a/b/s/../../..", typ: tar.TypeSymlink},
+		}, "leaves the project"},
+		{"hard link outside", []tarEntry{{name: "shadow", link: "../../etc/shadow", typ: tar.TypeLink}}, "leaves the project"},
+		{"hard link to a symlink", []tarEntry{
+			{name: "dir", link: ".", typ: tar.TypeSymlink},
+			{name: "copy", link: "dir/site.yml", typ: tar.TypeLink},
+		}, "is a symlink"},
+		{"write through symlink", []tarEntry{
+			{name: "dir", link: ".", typ: tar.TypeSymlink},
+			{name: "dir/site.yml", body: "x", typ: tar.TypeReg},
+		}, "is a symlink"},
+		{"overwrite symlink", []tarEntry{
+			{name: "site.yml", link: "other.yml", typ: tar.TypeSymlink},
+			{name: "site.yml", body: "x", typ: tar.TypeReg},
+		}, "is a symlink"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "project")
+			err := extractTar(makeTar(t, tc.entries), dest)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v, want an error with %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestExtractTarHardLinkUsesExtractedFile(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "project")
+	err := extractTar(makeTar(t, []tarEntry{
+		{name: "site.yml", body: "- hosts: all", typ: tar.TypeReg},
+		{name: "copy.yml", link: "site.yml", typ: tar.TypeLink},
+	}), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "copy.yml"))
+	if err != nil || string(data) != "- hosts: all" {
+		t.Errorf("copy.yml has %q, %v", data, err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	MIN_PRIORITY = -100
+	MAX_PRIORITY = 100
+)
+
+// queuedTask waits in taskQueue until dispatchTasks hands it to a worker.
+type queuedTask struct {
+	TaskID   string `json:"task_id"`
+	Priority int    `json:"priority"`
+	// LockKey is set while the task waits for its lock
+	LockKey string `json:"lock_key,omitempty"`
+	seq     uint64
+	index   int
+}
+
+// taskQueue is a heap of the queued tasks, highest priority first and in
+// the order they were queued within a priority.
+type taskQueue []*queuedTask
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	t := x.(*queuedTask)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+var (
+	queueMu  sync.Mutex
+	queue    taskQueue
+	queueSeq uint64
+	// queueWake tells dispatchTasks the head of the queue may have changed
+	queueWake = make(chan struct{}, 1)
+)
+
+func checkPriority(priority int) error {
+	if priority < MIN_PRIORITY || priority > MAX_PRIORITY {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("priority must be between %d and %d", MIN_PRIORITY, MAX_PRIORITY))
+	}
+	return nil
+}
+
+// enqueueTask queues taskId for the workers, it returns false if the server
+// is shutting down. The task must already be marked as queued. With a
+// broker the task goes to it instead, a failure leaves the task queued in
+// the db for the next start of the web node.
+func enqueueTask(taskId string, priority int) bool {
+	select {
+	case <-stopChan:
+		return false
+	default:
+	}
+	if broker != nil {
+		if err := broker.publish(taskId, priority); err != nil {
+			taskLogger("broker", taskId).Error("failed to publish task", "error", err)
+		}
+		return true
+	}
+	queueMu.Lock()
+	queueSeq++
+	heap.Push(&queue, &queuedTask{TaskID: taskId, Priority: priority, seq: queueSeq})
+	queueMu.Unlock()
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// dispatchTasks offers the head of the queue to the workers until one takes
+// it. A task queued meanwhile with a higher priority is offered instead.
+func dispatchTasks() {
+	for {
+		queueMu.Lock()
+		var next *queuedTask
+		if len(queue) > 0 {
+			next = queue[0]
+		}
+		queueMu.Unlock()
+		if next == nil {
+			select {
+			case <-queueWake:
+				continue
+			case <-stopChan:
+				return
+			}
+		}
+
+		select {
+		case taskChan <- next.TaskID:
+			addIdleWorkers(-1)
+			queueMu.Lock()
+			heap.Remove(&queue, next.index)
+			queueMu.Unlock()
+		case <-queueWake:
+		case <-stopChan:
+			// what is left is still queued in the db for the next start
+			return
+		}
+	}
+}
+
+// snapshotQueue lists the queued tasks in the order they will run.
+func snapshotQueue() []queuedTask {
+	queueMu.Lock()
+	q := make(taskQueue, len(queue))
+	for i, t := range queue {
+		c := *t
+		q[i] = &c
+	}
+	queueMu.Unlock()
+	list := make([]queuedTask, 0, len(q))
+	for q.Len() > 0 {
+		list = append(list, *heap.Pop(&q).(*queuedTask))
+	}
+	return list
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func queuedTaskIDs() []string {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	ids := make([]string, 0, len(queue))
+	for _, t := range queue {
+		ids = append(ids, t.TaskID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TestRecoverTasksRequeuesOnce leaves the rows a stopped process would,
+// recovers them and checks that every queued task is queued exactly once.
+func TestRecoverTasksRequeuesOnce(t *testing.T) {
+	setupTestDB(t)
+	queueMu.Lock()
+	queue = nil
+	queueMu.Unlock()
+	t.Cleanup(func() {
+		queueMu.Lock()
+		queue = nil
+		queueMu.Unlock()
+	})
+
+	rows := []Task{
+		{TaskID: "queued-1", Status: STATUS_WAITING, Queued: true},
+		{TaskID: "queued-2", Status: STATUS_WAITING, Queued: true, Priority: 5},
+		// a retry whose backoff ran out while the process was down
+		{TaskID: "retry", Status: STATUS_WAITING, Queued: true, Attempts: 1, RetryAt: time.Now().Add(-time.Minute)},
+		{TaskID: "running", Status: STATUS_RUNNING},
+		{TaskID: "done", Status: STATUS_SUCCEEDED},
+		{TaskID: "waiting", Status: STATUS_WAITING},
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	recoverTasks()
+	want := []string{"queued-1", "queued-2", "retry"}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(queuedTaskIDs()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// anything enqueued twice would show up meanwhile
+	time.Sleep(100 * time.Millisecond)
+	got := queuedTaskIDs()
+	if len(got) != len(want) {
+		t.Fatalf("queued %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("queued %v, want %v", got, want)
+		}
+	}
+
+	var running Task
+	db.First(&running, "task_id = ?", "running")
+	if running.Status != STATUS_INTERRUPTED || running.Queued {
+		t.Errorf("running task has status %d, queued %v after recovery, want interrupted", running.Status, running.Queued)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// rateLimitIP and rateLimitUser are how many tasks a client IP and a user
+	// may create or run per minute, 0 disables the limit
+	rateLimitIP   int
+	rateLimitUser int
+	// rateLimitBurst is how many of them may come at once, the per minute
+	// limit if 0
+	rateLimitBurst int
+)
+
+var errRateLimited = withStatus(http.StatusTooManyRequests, errors.New("too many requests, try again later"))
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ansible_runner_rate_limited_total",
+	Help: "Requests turned away by the rate limits, by the limit that hit.",
+}, []string{"limit"})
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per key, refilled at perMinute tokens a
+// minute up to burst.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	buckets   map[string]*tokenBucket
+	swept     time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &rateLimiter{perMinute: perMinute, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token of key. When there is none it returns how long until
+// the next one.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(l.perMinute) / float64(time.Minute)
+	// buckets that filled up again are the same as new ones
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+float64(now.Sub(b.last))*rate >= float64(l.burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+var ipLimiter, userLimiter *rateLimiter
+
+func setupRateLimits() error {
+	if rateLimitIP < 0 || rateLimitUser < 0 || rateLimitBurst < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	if rateLimitIP > 0 {
+		ipLimiter = newRateLimiter(rateLimitIP, rateLimitBurst)
+	}
+	if rateLimitUser > 0 {
+		userLimiter = newRateLimiter(rateLimitUser, rateLimitBurst)
+	}
+	return nil
+}
+
+// rateLimit throttles the routes that create or run tasks, by client IP and
+// by the logged in user. It goes after the login check.
+func rateLimit(c *gin.Context) {
+	if limit, wait := takeRateLimit(c); limit != "" {
+		tooManyRequests(c, limit, wait)
+		return
+	}
+	c.Next()
+}
+
+// takeRateLimit takes a token of the client IP and of the user of c. When
+// one has none it returns the limit that hit and how long until the next.
+func takeRateLimit(c *gin.Context) (string, time.Duration) {
+	now := time.Now()
+	if ipLimiter != nil {
+		if ok, wait := ipLimiter.allow(c.ClientIP(), now); !ok {
+			return "ip", wait
+		}
+	}
+	if user, exists := c.Get("user"); exists && userLimiter != nil {
+		if ok, wait := userLimiter.allow(strconv.FormatUint(uint64(user.(*User).ID), 10), now); !ok {
+			return "user", wait
+		}
+	}
+	return "", 0
+}
+
+func tooManyRequests(c *gin.Context, limit string, wait time.Duration) {
+	rateLimited.WithLabelValues(limit).Inc()
+	requestLogger(c).Warn("rate limited", "limit", limit, "retry_after", wait)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(errorStatus(errRateLimited), gin.H{"error": errRateLimited.Error()})
+}
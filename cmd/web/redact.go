@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// the output is redacted as JSON text, so no pattern may match past the
+// quote that ends a string
+var defaultRedactPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[^"]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	// a vault header with the hex lines that follow it
+	regexp.MustCompile(`\$ANSIBLE_VAULT;[^"\\\s]*(?:(?:\\n|\s)+[0-9a-fA-F]+)*`),
+	// the value of password=..., password: ..., "api_token": "..." and the
+	// like, a value that isn't a string is left alone to keep the JSON valid
+	regexp.MustCompile(`(?i)([a-z0-9_]*(?:password|passwd|_pass|secret|token|api_key)(?:\\?"\s*:\s*\\?"|=|:[ \t]+))[^"\\\s,}]+`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}`),
+	regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+}
+
+// values shorter than this aren't replaced where they appear, they would
+// match all over the output
+const MIN_REDACTED_VALUE = 4
+
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact_patterns: %v", err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// secretValues are the secret extra vars of a run, as they appear inside
+// the JSON strings of the output.
+func secretValues(extraVars map[string]interface{}) [][]byte {
+	var values [][]byte
+	for k, v := range extraVars {
+		s, ok := v.(string)
+		if !isSecretVar(k) || !ok || len(s) < MIN_REDACTED_VALUE {
+			continue
+		}
+		quoted, _ := json.Marshal(s)
+		values = append(values, quoted[1:len(quoted)-1])
+	}
+	return values
+}
+
+// redactOutput scrubs private keys, vault content, secret looking
+// assignments, the redact_patterns of the config and the given values from
+// the JSON output of a run.
+func redactOutput(raw []byte, values [][]byte) []byte {
+	for _, v := range values {
+		raw = bytes.ReplaceAll(raw, v, []byte(REDACTED))
+	}
+	for _, re := range defaultRedactPatterns {
+		raw = redactMatches(re, raw)
+	}
+	for _, re := range config.redactPatterns {
+		raw = redactMatches(re, raw)
+	}
+	return raw
+}
+
+// redactMatches replaces the matches of re, keeping its first group if it
+// has one, e.g. the name in password=secret.
+func redactMatches(re *regexp.Regexp, raw []byte) []byte {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteral(raw, []byte(REDACTED))
+	}
+	return re.ReplaceAll(raw, []byte("${1}"+REDACTED))
+}
+
+// redactingWriter redacts the output of a run line by line before it is
+// shown live, the values are those of redactOutput.
+type redactingWriter struct {
+	out     io.Writer
+	values  [][]byte
+	partial []byte
+}
+
+func newRedactingWriter(out io.Writer, values [][]byte) *redactingWriter {
+	return &redactingWriter{out: out, values: values}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := w.partial[:i+1]
+	w.partial = append([]byte(nil), w.partial[i+1:]...)
+	if _, err := w.out.Write(redactOutput(lines, w.values)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes an unterminated last line.
+func (w *redactingWriter) flush() {
+	if len(w.partial) > 0 {
+		w.out.Write(redactOutput(w.partial, w.values))
+		w.partial = nil
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHubOutputRedacted(t *testing.T) {
+	config = defaultConfig()
+	hub := newOutputHub("redacted")
+	_, lines := hub.subscribe()
+	secrets := secretValues(map[string]interface{}{"db_password": "hunter22"})
+	w := newRedactingWriter(hub, secrets)
+
+	// the secret is split over writes, the way ansible's output may come
+	w.Write([]byte(`{"msg": "connecting with hun`))
+	w.Write([]byte("ter22\"}\n{\"msg\": \"token=abc123def\"}\n{\"msg\": \"hunter22"))
+	w.flush()
+	closeOutputHub("redacted")
+
+	n := 0
+	for line := range lines {
+		n++
+		if strings.Contains(line, "hunter22") || strings.Contains(line, "abc123def") {
+			t.Errorf("secret streamed: %s", line)
+		}
+	}
+	if n != 3 {
+		t.Errorf("got %d lines, want 3", n)
+	}
+}
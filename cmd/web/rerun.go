@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errTaskNotFinished = withStatus(http.StatusConflict, errors.New("task has not finished, only finished tasks can be re-run"))
+
+// rerunCreated is the answer to a re-run, Run is nil while the new task
+// waits for approval.
+type rerunCreated struct {
+	Task APITask `json:"task"`
+	Run  *Run    `json:"run,omitempty"`
+}
+
+// rebaseTaskPath is path of the task dir oldDir moved to newDir, a path
+// outside of oldDir stays as it is.
+func rebaseTaskPath(path, oldDir, newDir string) string {
+	if path == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(oldDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.Join(newDir, rel)
+}
+
+// copyTaskFile copies a file of the task dir oldDir to newDir.
+func copyTaskFile(path, oldDir, newDir string) error {
+	dest := rebaseTaskPath(path, oldDir, newDir)
+	if dest == path {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyTaskTree copies a directory of a task, like its project snapshot,
+// with the symlinks in it.
+func copyTaskTree(dir, oldDir, newDir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dest := rebaseTaskPath(path, oldDir, newDir)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dest, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dest)
+		case info.Mode().IsRegular():
+			return copyTaskFile(path, oldDir, newDir)
+		}
+		return nil
+	})
+}
+
+// checkRerun runs the checks of a new task that depend on the settings and
+// on user against the options and the hosts of src, they may have changed
+// since it was created by someone else.
+func checkRerun(src *Task, user *User) error {
+	if err := config.Executor.checkImage(src.Image); err != nil {
+		return err
+	}
+	if err := checkTaskTimeout(src.Timeout); err != nil {
+		return err
+	}
+	if err := checkCredential(src.CredentialID); err != nil {
+		return err
+	}
+	if isDynamicInventory(src.Inventory.Path) {
+		var li LibraryInventory
+		if err := db.Limit(1).Find(&li, src.LibraryInventoryID).Error; err != nil {
+			return err
+		}
+		if li.ID == 0 {
+			return withStatus(http.StatusConflict, fmt.Errorf("dynamic inventory %d is gone", src.LibraryInventoryID))
+		}
+		return checkDynamicInventory(&li, src.Environment, user)
+	}
+	hosts, err := taskInventoryHosts(src)
+	if err != nil {
+		return err
+	}
+	return checkInventoryHosts(hosts, src.Environment, user)
+}
+
+// cloneTask copies a finished task, the files it was made from and its
+// options, into a new task of user that is a re-run of it. Its results and
+// what it ran into are left behind.
+func cloneTask(src *Task, user *User) (task *Task, err error) {
+	if src.Queued || src.Status == STATUS_WAITING || src.Status == STATUS_RUNNING {
+		return nil, errTaskNotFinished
+	}
+	if src.Purged() {
+		return nil, errResultsPurged
+	}
+	env, ok := config.environment(src.Environment)
+	if !ok {
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("unknown environment %q", src.Environment))
+	}
+	if err := checkRerun(src, user); err != nil {
+		return nil, err
+	}
+
+	taskID := uuid.New().String()
+	oldDir := filepath.Join(rootDir, src.TaskID)
+	newDir := filepath.Join(rootDir, taskID)
+	created := false
+	defer func() {
+		if !created {
+			os.RemoveAll(newDir)
+		}
+	}()
+	if src.ProjectID != 0 {
+		if err := copyTaskTree(filepath.Join(oldDir, PROJECT_DIR), oldDir, newDir); err != nil {
+			return nil, err
+		}
+	} else if !src.AdHoc() {
+		if err := copyTaskFile(src.Playbook.Path, oldDir, newDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyTaskFile(src.Inventory.Path, oldDir, newDir); err != nil {
+		return nil, err
+	}
+	if isSpecInventory(src.Inventory.Path) {
+		if err := copyTaskFile(filepath.Join(oldDir, INVENTORY_SPEC_FILE), oldDir, newDir); err != nil {
+			return nil, err
+		}
+	}
+	if src.RequirementsFile != "" && src.ProjectID == 0 {
+		if err := copyTaskFile(src.RequirementsFile, oldDir, newDir); err != nil {
+			return nil, err
+		}
+	}
+
+	// the options are kept, everything a run set goes back to that of a
+	// new task
+	clone := *src
+	clone.ID = 0
+	clone.TaskID = taskID
+	clone.Status = STATUS_WAITING
+	clone.CreatedAt = time.Time{}
+	clone.UpdatedAt = time.Time{}
+	clone.StartedAt = time.Time{}
+	clone.FinishedAt = time.Time{}
+	clone.UserID = user.ID
+	clone.User = User{}
+	clone.Error = ""
+	clone.HostCount = 0
+	clone.FailedHosts = 0
+	clone.Unreachable = 0
+	clone.Approved = false
+	clone.ApprovalRequestedAt = time.Time{}
+	clone.Queued = false
+	clone.Attempts = 0
+	clone.RetryAt = time.Time{}
+	clone.ExitCode = nil
+	clone.RunID = 0
+	clone.Node = ""
+	clone.CancelRequested = false
+	clone.PurgedAt = time.Time{}
+	clone.DeletedAt = gorm.DeletedAt{}
+	clone.credentialKeyFile = ""
+	clone.credentialVarsFile = ""
+	clone.credentialPassword = ""
+	clone.hostKeyChecking = ""
+	clone.RerunOf = src.TaskID
+	clone.PlaybookID = 0
+	clone.Playbook = Playbook{
+		Name:     src.Playbook.Name,
+		Path:     rebaseTaskPath(src.Playbook.Path, oldDir, newDir),
+		Creator:  user.Name,
+		VaultIDs: src.Playbook.VaultIDs,
+		TeamID:   src.TeamID,
+	}
+	clone.InventoryID = 0
+	clone.Inventory = Inventory{
+		Name:    src.Inventory.Name,
+		Path:    rebaseTaskPath(src.Inventory.Path, oldDir, newDir),
+		Creator: user.Name,
+		TeamID:  src.TeamID,
+	}
+	clone.RequirementsFile = rebaseTaskPath(src.RequirementsFile, oldDir, newDir)
+	if env.RequireApproval {
+		clone.ApprovalRequestedAt = time.Now()
+	}
+	if err := db.Create(&clone).Error; err != nil {
+		return nil, err
+	}
+	created = true
+	clone.User = *user
+	registerTaskHosts(&clone)
+	return &clone, nil
+}
+
+// discardTask removes a task that was never queued along with its files.
+func discardTask(task *Task) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Where("id = ? AND queued = ?", task.ID, false).Delete(&Task{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		if err := tx.Delete(&Playbook{}, task.PlaybookID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&Inventory{}, task.InventoryID).Error; err != nil {
+			return err
+		}
+		return os.RemoveAll(filepath.Join(rootDir, task.TaskID))
+	})
+}
+
+// apiRerunTask clones a finished task into a new one and runs that, the
+// new task keeps the ID of the original in rerun_of. List the re-runs of a
+// task with GET /api/v1/tasks?rerun_of=<task id>.
+func apiRerunTask(c *gin.Context) {
+	var src Task
+	if err := db.Preload("Playbook").Preload("Inventory").Limit(1).Find(&src, "task_id = ?", c.Param("id")).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if src.ID == 0 {
+		apiError(c, errTaskNotFound)
+		return
+	}
+	user := currentUser(c)
+	task, err := cloneTask(&src, user)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Set(auditObjectKey, task.TaskID)
+	c.Header("Location", "/api/v1/tasks/"+task.TaskID)
+	if needsApproval(*task) {
+		c.IndentedJSON(http.StatusCreated, rerunCreated{Task: APITask{Task: task, StatusText: statusText(task.Status)}})
+		return
+	}
+	run, err := startTask(task.TaskID, user, RunRequest{})
+	if err != nil {
+		// a re-run that can't run isn't kept, one queued while shutting
+		// down runs after the restart
+		if err := discardTask(task); err != nil {
+			taskLogger("api", task.TaskID).Error("failed to discard re-run", "error", err)
+		}
+		apiError(c, err)
+		return
+	}
+	run.StatusText = "Queued"
+	task.Queued = true
+	task.RunID = run.ID
+	c.Header("Location", "/api/v1/tasks/"+task.TaskID+"/runs/"+strconv.FormatUint(uint64(run.ID), 10))
+	c.IndentedJSON(http.StatusAccepted, rerunCreated{Task: APITask{Task: task, StatusText: statusText(task.Status)}, Run: run})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestCloneTaskChecksUser(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin", ROLE_ADMIN)
+	operator := createTestUser(t, "operator", ROLE_OPERATOR)
+	req := TaskRequest{Name: "ping", Playbook: "- ping:", Inventory: "h1\nh2\nh3"}
+	task, _, err := newTaskFromRequest(context.Background(), &req, admin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(task).Update("status", STATUS_SUCCEEDED)
+	var src Task
+	db.Preload("Playbook").Preload("Inventory").First(&src, task.ID)
+
+	// the host cap set after the admin created it holds for the operator
+	env, _ := config.environment(DEFAULT_ENVIRONMENT)
+	env.MaxHosts = 2
+	if _, err := cloneTask(&src, operator); errorStatus(err) != http.StatusBadRequest {
+		t.Fatalf("operator re-running over the host cap: got %v", err)
+	}
+	if _, err := cloneTask(&src, admin); err != nil {
+		t.Fatalf("admin re-running over the host cap: %v", err)
+	}
+
+	// hosts the environment no longer allows are refused to everyone
+	env.AllowedHosts = []string{"web*"}
+	if _, err := cloneTask(&src, admin); errorStatus(err) != http.StatusBadRequest {
+		t.Fatalf("re-running with hosts that aren't allowed: got %v", err)
+	}
+	env.AllowedHosts = nil
+
+	// as is a credential that was removed
+	db.Model(&src).Update("credential_id", 42)
+	src.CredentialID = 42
+	if _, err := cloneTask(&src, admin); errorStatus(err) != http.StatusBadRequest {
+		t.Fatalf("re-running with a removed credential: got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+const (
+	HOST_OK          = "ok"
+	HOST_CHANGED     = "changed"
+	HOST_FAILED      = "failed"
+	HOST_SKIPPED     = "skipped"
+	HOST_UNREACHABLE = "unreachable"
+)
+
+type HostTaskResult struct {
+	Play string `json:"play"`
+	Task string `json:"task"`
+	// Path (file:line) and Role are only known with config task_paths
+	Path   string `json:"path,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Cmd    string `json:"cmd,omitempty"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	Msg    string `json:"msg,omitempty"`
+}
+
+type HostStats struct {
+	Host        string `json:"host"`
+	Ok          int    `json:"ok"`
+	Changed     int    `json:"changed"`
+	Failed      int    `json:"failed"`
+	Skipped     int    `json:"skipped"`
+	Unreachable int    `json:"unreachable"`
+	Rescued     int    `json:"rescued"`
+	Ignored     int    `json:"ignored"`
+}
+
+type ResultSummary struct {
+	CheckMode bool             `json:"check_mode"`
+	Results   []HostTaskResult `json:"results"`
+	Stats     []HostStats      `json:"stats"`
+	// Diffs are the changes of a diff mode run
+	Diffs []HostDiff `json:"diffs,omitempty"`
+}
+
+// outputText renders a module output field, which may be any JSON value.
+func outputText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+}
+
+func hostResultStatus(item *results.AnsiblePlaybookJSONResultsPlayTaskHostsItem) string {
+	switch {
+	case item.Unreachable:
+		return HOST_UNREACHABLE
+	case item.Failed:
+		return HOST_FAILED
+	case item.Skipped:
+		return HOST_SKIPPED
+	case item.Changed:
+		return HOST_CHANGED
+	default:
+		return HOST_OK
+	}
+}
+
+// summarizeResults flattens the plays into one row per host and task, in
+// play order, followed by the recap of every host. paths adds where each
+// task came from, it may be empty.
+func summarizeResults(res *results.AnsiblePlaybookJSONResults, paths map[string]TaskPath) ResultSummary {
+	summary := ResultSummary{Results: []HostTaskResult{}, Stats: []HostStats{}}
+	for _, play := range res.Plays {
+		playName := ""
+		if play.Play != nil {
+			playName = play.Play.Name
+		}
+		for _, task := range play.Tasks {
+			taskName, taskPath := "", TaskPath{}
+			if task.Task != nil {
+				taskName = task.Task.Name
+				taskPath = paths[task.Task.Id]
+				if taskPath.Path == "" {
+					taskPath.Path = task.Task.Path
+				}
+			}
+			hosts := make([]string, 0, len(task.Hosts))
+			for host := range task.Hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			for _, host := range hosts {
+				item := task.Hosts[host]
+				summary.Results = append(summary.Results, HostTaskResult{
+					Play:   playName,
+					Task:   taskName,
+					Path:   taskPath.Path,
+					Role:   taskPath.Role,
+					Host:   host,
+					Status: hostResultStatus(item),
+					Cmd:    outputText(item.Cmd),
+					Stdout: outputText(item.Stdout),
+					Stderr: outputText(item.Stderr),
+					Msg:    outputText(item.Msg),
+				})
+			}
+		}
+	}
+
+	for host, stats := range res.Stats {
+		summary.Stats = append(summary.Stats, HostStats{
+			Host:        host,
+			Ok:          stats.Ok,
+			Changed:     stats.Changed,
+			Failed:      stats.Failures,
+			Skipped:     stats.Skipped,
+			Unreachable: stats.Unreachable,
+			Rescued:     stats.Rescued,
+			Ignored:     stats.Ignored,
+		})
+	}
+	sort.Slice(summary.Stats, func(i, j int) bool { return summary.Stats[i].Host < summary.Stats[j].Host })
+	return summary
+}
+
+// ResultEvent is one line of events.ndjson.
+type ResultEvent struct {
+	Type     string `json:"type"`
+	TaskID   string `json:"task_id"`
+	TaskName string `json:"task_name"`
+	// Host shadows the Host of both embedded structs
+	Host string `json:"host"`
+	*HostTaskResult
+	*HostStats
+}
+
+// writeResultEvents writes every host result and host recap of the run as
+// newline delimited JSON for log shippers.
+func writeResultEvents(path string, task *Task, res *results.AnsiblePlaybookJSONResults) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	summary := summarizeResults(res, readTaskPaths(task.TaskID))
+	enc := json.NewEncoder(f)
+	for i := range summary.Results {
+		if err := enc.Encode(ResultEvent{Type: "host_result", TaskID: task.TaskID, TaskName: task.Name,
+			Host: summary.Results[i].Host, HostTaskResult: &summary.Results[i]}); err != nil {
+			return err
+		}
+	}
+	for i := range summary.Stats {
+		if err := enc.Encode(ResultEvent{Type: "host_stats", TaskID: task.TaskID, TaskName: task.Name,
+			Host: summary.Stats[i].Host, HostStats: &summary.Stats[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func showResultEvents(c *gin.Context) {
+	path := filepath.Join(rootDir, filepath.Base(c.Param("id")), "events.ndjson")
+	if _, err := os.Stat(path); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "no events for this task"})
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.File(path)
+}
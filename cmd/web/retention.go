@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const RETENTION_CHECK_INTERVAL = time.Hour
+
+var errResultsPurged = withStatus(http.StatusGone, errors.New("the results and files of the task were purged"))
+
+var (
+	// resultRetention is how long the files of a finished task are kept
+	resultRetention time.Duration
+	// resultKeepRuns is how many finished tasks per playbook keep their
+	// files
+	resultKeepRuns int
+)
+
+// Purged reports whether the retention janitor removed the files of the
+// task. The row stays for the task list and the history.
+func (t *Task) Purged() bool {
+	return !t.PurgedAt.IsZero()
+}
+
+// finishedTasks selects the tasks that ran and are done, whose files are
+// still there.
+func finishedTasks() *gorm.DB {
+	return db.Model(&Task{}).
+		Where("tasks.queued = ? AND tasks.status NOT IN ?", false, []uint{STATUS_WAITING, STATUS_RUNNING}).
+		Where("tasks.finished_at > ?", time.Time{}).
+		// the column is NULL for tasks from before it was added
+		Where("tasks.purged_at IS NULL OR tasks.purged_at = ?", time.Time{})
+}
+
+// purgeResults removes the data directory of a finished task and marks it
+// purged. Like purgeTask the mark is only committed once the directory is
+// gone.
+func purgeResults(task *Task) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// re-checked, the task may have been started again meanwhile
+		res := tx.Model(&Task{}).
+			Where("id = ? AND queued = ? AND status <> ?", task.ID, false, STATUS_RUNNING).
+			Where("purged_at IS NULL OR purged_at = ?", time.Time{}).
+			Update("purged_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		if searchIndex {
+			if err := tx.Exec("DELETE FROM task_output_fts WHERE task_id = ?", task.TaskID).Error; err != nil {
+				return err
+			}
+		}
+		return os.RemoveAll(filepath.Join(rootDir, task.TaskID))
+	})
+}
+
+// expiredResults lists the tasks past -result-retention and those beyond
+// the last -result-keep-runs of their playbook.
+func expiredResults() ([]Task, error) {
+	var tasks []Task
+	if resultRetention > 0 {
+		err := finishedTasks().Where("tasks.finished_at < ?", time.Now().Add(-resultRetention)).Find(&tasks).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resultKeepRuns <= 0 {
+		return tasks, nil
+	}
+
+	var names []string
+	err := finishedTasks().Joins("LEFT JOIN playbooks ON playbooks.id = tasks.playbook_id").
+		Group("playbooks.name").Having("COUNT(*) > ?", resultKeepRuns).
+		Pluck("playbooks.name", &names).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var runs []Task
+		err := finishedTasks().Joins("LEFT JOIN playbooks ON playbooks.id = tasks.playbook_id").
+			Where("playbooks.name = ?", name).Order("tasks.finished_at desc").Find(&runs).Error
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, runs[resultKeepRuns:]...)
+	}
+	return tasks, nil
+}
+
+func purgeExpiredResults() {
+	tasks, err := expiredResults()
+	if err != nil {
+		logger("retention").Error("failed to list expired results", "error", err)
+		return
+	}
+	purged := map[uint]bool{}
+	for i := range tasks {
+		if purged[tasks[i].ID] {
+			continue
+		}
+		purged[tasks[i].ID] = true
+		if err := purgeResults(&tasks[i]); err != nil {
+			taskLogger("retention", tasks[i].TaskID).Error("failed to purge results", "error", err)
+		}
+	}
+	if len(purged) > 0 {
+		logger("retention").Warn("purged task results", "count", len(purged))
+	}
+}
+
+func startResultJanitor() {
+	if resultRetention <= 0 && resultKeepRuns <= 0 {
+		return
+	}
+	ticker := time.NewTicker(RETENTION_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		purgeExpiredResults()
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
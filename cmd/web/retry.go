@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+)
+
+const (
+	MAX_TASK_ATTEMPTS     = 10
+	DEFAULT_RETRY_BACKOFF = 30 * time.Second
+	MAX_RETRY_BACKOFF     = time.Hour
+)
+
+// TaskAttempt is one run of a task, the errors of the attempts before a
+// retry would be lost otherwise.
+type TaskAttempt struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	TaskID      uint      `json:"task_id" gorm:"column:task_id;index"`
+	RunID       uint      `json:"run_id" gorm:"column:run_id;index"`
+	Attempt     uint      `json:"attempt" gorm:"column:attempt"`
+	Status      uint      `json:"status" gorm:"column:status"`
+	StatusText  string    `json:"status_text" gorm:"-"`
+	Error       string    `json:"error" gorm:"column:error"`
+	ExitCode    *int      `json:"exit_code" gorm:"column:exit_code"`
+	FailedHosts uint      `json:"failed_hosts" gorm:"column:failed_hosts"`
+	Unreachable uint      `json:"unreachable_hosts" gorm:"column:unreachable_hosts"`
+	StartedAt   time.Time `json:"started_at" gorm:"column:started_at"`
+	FinishedAt  time.Time `json:"finished_at" gorm:"column:finished_at"`
+}
+
+// checkRetryPolicy validates the retry fields of a task request.
+func checkRetryPolicy(maxAttempts uint, backoff string) error {
+	if maxAttempts > MAX_TASK_ATTEMPTS {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("max attempts must be at most %d", MAX_TASK_ATTEMPTS))
+	}
+	if backoff == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(backoff)
+	if err != nil || d <= 0 || d > MAX_RETRY_BACKOFF {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("retry backoff must be a duration up to %v like 30s", MAX_RETRY_BACKOFF))
+	}
+	return nil
+}
+
+// retryDelay is the backoff of the task doubled for each attempt it has
+// made after the first.
+func retryDelay(task *Task) time.Duration {
+	delay := DEFAULT_RETRY_BACKOFF
+	if d, err := time.ParseDuration(task.RetryBackoff); err == nil && d > 0 {
+		delay = d
+	}
+	for i := uint(1); i < task.Attempts && delay < MAX_RETRY_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_BACKOFF {
+		delay = MAX_RETRY_BACKOFF
+	}
+	return delay
+}
+
+// retryable reports whether the task may do better when run again: hosts
+// were unreachable, but none failed, and attempts are left.
+func retryable(task *Task) bool {
+	if task.Status != STATUS_ERROR || task.Attempts >= task.MaxAttempts {
+		return false
+	}
+	if task.ExitCode != nil && *task.ExitCode == playbook.AnsiblePlaybookErrorCodeOneOrMoreHostUnreachable {
+		return true
+	}
+	return task.Unreachable > 0 && task.FailedHosts == 0
+}
+
+// attemptError describes what went wrong in the attempt, unreachable hosts
+// don't leave an error on the task.
+func attemptError(task *Task) string {
+	if task.Error != "" {
+		return task.Error
+	}
+	if task.ExitCode != nil && *task.ExitCode != 0 {
+		return fmt.Sprintf("%s, %d hosts unreachable", exitCodeText(task.ExitCode), task.Unreachable)
+	}
+	if task.Unreachable > 0 {
+		return fmt.Sprintf("%d hosts unreachable", task.Unreachable)
+	}
+	return ""
+}
+
+func recordAttempt(task *Task) error {
+	return db.Create(&TaskAttempt{
+		TaskID:      task.ID,
+		RunID:       task.RunID,
+		Attempt:     task.Attempts,
+		Status:      task.Status,
+		Error:       attemptError(task),
+		ExitCode:    task.ExitCode,
+		FailedHosts: task.FailedHosts,
+		Unreachable: task.Unreachable,
+		StartedAt:   task.StartedAt,
+		FinishedAt:  task.FinishedAt,
+	}).Error
+}
+
+// scheduleRetry puts the failed task back in the queue, a worker gets it
+// once the backoff is over.
+func scheduleRetry(task *Task) error {
+	delay := retryDelay(task)
+	task.RetryAt = time.Now().Add(delay)
+	task.Error = fmt.Sprintf("attempt %d of %d failed, retrying at %s: %s",
+		task.Attempts, task.MaxAttempts, task.RetryAt.Format(time.RFC3339), attemptError(task))
+	task.Status = STATUS_WAITING
+	err := db.Model(&Task{}).Where("id = ?", task.ID).Updates(map[string]interface{}{
+		"status":            task.Status,
+		"queued":            true,
+		"retry_at":          task.RetryAt,
+		"error":             task.Error,
+		"updated_at":        time.Now(),
+		"finished_at":       task.FinishedAt,
+		"host_count":        task.HostCount,
+		"failed_hosts":      task.FailedHosts,
+		"unreachable_hosts": task.Unreachable,
+		"exit_code":         task.ExitCode,
+	}).Error
+	if err != nil {
+		return err
+	}
+	updateRun(task)
+	enqueueTaskAfter(task.TaskID, task.Priority, delay)
+	return nil
+}
+
+// enqueueTaskAfter is enqueueTask after delay, unless the server stops
+// first. The task stays queued in the db for the next start then.
+func enqueueTaskAfter(taskId string, priority int, delay time.Duration) {
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			enqueueTask(taskId, priority)
+		case <-stopChan:
+		}
+	}()
+}
+
+// cancelRetry cancels a task waiting for its next attempt, it returns
+// false if the task isn't waiting for one.
+func cancelRetry(taskId string) (bool, error) {
+	tx := db.Model(&Task{}).
+		Where("task_id = ? AND queued = ? AND status = ? AND attempts > 0", taskId, true, STATUS_WAITING).
+		Updates(map[string]interface{}{
+			"queued":      false,
+			"status":      STATUS_CANCELLED,
+			"error":       errTaskCancelled.Error(),
+			"retry_at":    time.Time{},
+			"updated_at":  time.Now(),
+			"finished_at": time.Now(),
+		})
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return false, tx.Error
+	}
+	err := db.Model(&Run{}).Where("id = (?)", db.Model(&Task{}).Select("run_id").Where("task_id = ?", taskId)).
+		Updates(map[string]interface{}{"status": STATUS_CANCELLED, "error": errTaskCancelled.Error(), "finished_at": time.Now()}).Error
+	return true, err
+}
+
+func apiListTaskAttempts(c *gin.Context) {
+	var task Task
+	if err := db.Limit(1).Find(&task, "task_id = ?", c.Param("id")).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if task.ID == 0 {
+		apiError(c, withStatus(http.StatusNotFound, errors.New("task not found")))
+		return
+	}
+	var attempts []TaskAttempt
+	if err := db.Where("task_id = ?", task.ID).Order("id").Find(&attempts).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	for i := range attempts {
+		attempts[i].StatusText = statusText(attempts[i].Status)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"items": attempts})
+}
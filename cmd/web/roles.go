@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// viewers read tasks and results, operators also create and run them,
+// approvers also approve the tasks of others and admins also manage users
+// and inventories.
+const (
+	ROLE_VIEWER   = "viewer"
+	ROLE_OPERATOR = "operator"
+	ROLE_APPROVER = "approver"
+	ROLE_ADMIN    = "admin"
+)
+
+var roleRanks = map[string]int{
+	ROLE_VIEWER:   1,
+	ROLE_OPERATOR: 2,
+	ROLE_APPROVER: 3,
+	ROLE_ADMIN:    4,
+}
+
+// UserRole assigns a role to a user. User.Admin mirrors the admin role.
+type UserRole struct {
+	ID     uint   `json:"id" gorm:"primarykey"`
+	UserID uint   `json:"user_id" gorm:"column:user_id;uniqueIndex"`
+	Role   string `json:"role" gorm:"column:role"`
+}
+
+func checkRole(role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("unknown role %q", role))
+	}
+	return nil
+}
+
+// hasRole reports whether user's role is role or a higher one.
+func hasRole(user *User, role string) bool {
+	return user != nil && roleRanks[user.Role] >= roleRanks[role]
+}
+
+// migrateRoles gives the users from before roles existed the role their
+// admin flag implies, everybody could create and run tasks back then.
+func migrateRoles() error {
+	return db.Exec("INSERT INTO user_roles (user_id, role) "+
+		"SELECT id, CASE WHEN is_admin THEN ? ELSE ? END FROM users "+
+		"WHERE id NOT IN (SELECT user_id FROM user_roles)", ROLE_ADMIN, ROLE_OPERATOR).Error
+}
+
+// loadRoles fills in the Role of users.
+func loadRoles(users ...*User) error {
+	ids := make([]uint, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	var roles []UserRole
+	if err := db.Where("user_id IN ?", ids).Find(&roles).Error; err != nil {
+		return err
+	}
+	byUser := map[uint]string{}
+	for _, r := range roles {
+		byUser[r.UserID] = r.Role
+	}
+	for _, user := range users {
+		user.Role = byUser[user.ID]
+		user.Admin = user.Role == ROLE_ADMIN
+	}
+	return nil
+}
+
+// setUserRole stores the role of user, keeping its admin flag in step.
+func setUserRole(tx *gorm.DB, user *User, role string) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role"}),
+	}).Create(&UserRole{UserID: user.ID, Role: role}).Error
+	if err != nil {
+		return err
+	}
+	user.Role = role
+	user.Admin = role == ROLE_ADMIN
+	return tx.Model(user).Update("is_admin", user.Admin).Error
+}
+
+// requireRole only lets users with role or a higher one through. It goes
+// after requireLogin or requireAPILogin.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasRole(currentUser(c), role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": role + " role required"})
+			return
+		}
+		c.Next()
+	}
+}
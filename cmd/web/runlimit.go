@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// playbookDailyLimit is the default cap on runs of one playbook per rolling
+// 24h, 0 disables it.
+var playbookDailyLimit int
+
+// playbookRunMu keeps the count and the insert of recordPlaybookRun together
+var playbookRunMu sync.Mutex
+
+type PlaybookRun struct {
+	ID           uint      `json:"id" gorm:"primarykey"`
+	PlaybookID   uint      `json:"playbook_id" gorm:"column:playbook_id"`
+	PlaybookName string    `json:"playbook_name" gorm:"column:playbook_name;index"`
+	TaskID       string    `json:"task_id" gorm:"column:task_id"`
+	CreatedAt    time.Time `json:"created_at" gorm:"column:created_at;index"`
+}
+
+// PlaybookLimit overrides playbookDailyLimit for playbooks of that name,
+// a limit of 0 or less means unlimited.
+type PlaybookLimit struct {
+	ID         uint   `json:"id" gorm:"primarykey"`
+	Name       string `json:"name" gorm:"column:name;size:191;uniqueIndex"`
+	DailyLimit int    `json:"daily_limit" gorm:"column:daily_limit"`
+}
+
+func dailyLimitFor(name string) int {
+	var limit PlaybookLimit
+	if tx := db.Where("name = ?", name).Limit(1).Find(&limit); tx.Error == nil && tx.RowsAffected > 0 {
+		return limit.DailyLimit
+	}
+	return playbookDailyLimit
+}
+
+// recordPlaybookRun counts a run of the task's playbook, failing if that
+// would exceed its daily limit.
+func recordPlaybookRun(task *Task) error {
+	playbookRunMu.Lock()
+	defer playbookRunMu.Unlock()
+
+	limit := dailyLimitFor(task.Playbook.Name)
+	if limit > 0 {
+		var count int64
+		since := time.Now().Add(-24 * time.Hour)
+		if err := db.Model(&PlaybookRun{}).
+			Where("(playbook_id = ? OR playbook_name = ?) AND created_at > ?", task.PlaybookID, task.Playbook.Name, since).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= int64(limit) {
+			return fmt.Errorf("playbook %q already ran %d times in the last 24h (limit %d)", task.Playbook.Name, count, limit)
+		}
+	}
+	return db.Create(&PlaybookRun{
+		PlaybookID:   task.PlaybookID,
+		PlaybookName: task.Playbook.Name,
+		TaskID:       task.TaskID,
+	}).Error
+}
+
+func listPlaybookLimits(c *gin.Context) {
+	var limits []PlaybookLimit
+	if err := db.Order("name").Find(&limits).Error; err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"default": playbookDailyLimit,
+		"limits":  limits,
+	})
+}
+
+func setPlaybookLimit(c *gin.Context) {
+	name := c.PostForm("name")
+	limit, err := strconv.Atoi(c.PostForm("daily_limit"))
+	if name == "" || err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "name and a numeric daily_limit are required"})
+		return
+	}
+	record := PlaybookLimit{Name: name}
+	if err := db.Where(PlaybookLimit{Name: name}).
+		Assign(PlaybookLimit{DailyLimit: limit}).
+		FirstOrCreate(&record).Error; err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, record)
+}
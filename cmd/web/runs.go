@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Run is one execution of a task, from the request to run it to its final
+// status. A task can be run many times, the retries of a run are its
+// TaskAttempts.
+type Run struct {
+	ID     uint `json:"id" gorm:"primarykey"`
+	TaskID uint `json:"task_id" gorm:"column:task_id;index"`
+	// Number counts the runs of the task from 1
+	Number uint `json:"number" gorm:"column:number"`
+	// Verbosity is the one of the task unless the run asked for another
+	Verbosity int `json:"verbosity" gorm:"column:verbosity"`
+	// UserID is who asked for the run
+	UserID      uint      `json:"user_id" gorm:"column:user_id"`
+	Status      uint      `json:"status" gorm:"column:status"`
+	StatusText  string    `json:"status_text" gorm:"-"`
+	Error       string    `json:"error" gorm:"column:error"`
+	ExitCode    *int      `json:"exit_code" gorm:"column:exit_code"`
+	HostCount   uint      `json:"host_count" gorm:"column:host_count"`
+	FailedHosts uint      `json:"failed_hosts" gorm:"column:failed_hosts"`
+	Unreachable uint      `json:"unreachable_hosts" gorm:"column:unreachable_hosts"`
+	Attempts    uint      `json:"attempts" gorm:"column:attempts"`
+	Node        string    `json:"node" gorm:"column:node"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
+	StartedAt   time.Time `json:"started_at" gorm:"column:started_at"`
+	FinishedAt  time.Time `json:"finished_at" gorm:"column:finished_at"`
+	// AttemptList is only loaded when a single run is shown
+	AttemptList []TaskAttempt `json:"attempt_list,omitempty" gorm:"-"`
+}
+
+var errRunNotFound = withStatus(http.StatusNotFound, errors.New("run not found"))
+
+// RunRequest is what a run may change about the task for itself.
+type RunRequest struct {
+	// Verbosity is the one of the task if unset
+	Verbosity *int `json:"verbosity"`
+}
+
+func (r RunRequest) check() error {
+	if r.Verbosity != nil {
+		return checkVerbosity(*r.Verbosity)
+	}
+	return nil
+}
+
+// createRun records a new run of task, which startTask just queued.
+func createRun(task *Task, user *User, req RunRequest) (*Run, error) {
+	var count int64
+	if err := db.Model(&Run{}).Where("task_id = ?", task.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	run := &Run{TaskID: task.ID, Number: uint(count) + 1, Status: STATUS_WAITING, Verbosity: task.Verbosity}
+	if req.Verbosity != nil {
+		run.Verbosity = *req.Verbosity
+	}
+	if user != nil {
+		run.UserID = user.ID
+	}
+	if err := db.Create(run).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&Task{}).Where("id = ?", task.ID).Update("run_id", run.ID).Error; err != nil {
+		return nil, err
+	}
+	task.RunID = run.ID
+	return run, nil
+}
+
+// updateRun copies the status of task to its current run.
+func updateRun(task *Task) {
+	if task.RunID == 0 {
+		return
+	}
+	fields := map[string]interface{}{
+		"status":            task.Status,
+		"error":             task.Error,
+		"exit_code":         task.ExitCode,
+		"host_count":        task.HostCount,
+		"failed_hosts":      task.FailedHosts,
+		"unreachable_hosts": task.Unreachable,
+		"attempts":          task.Attempts,
+		"node":              task.Node,
+		"finished_at":       task.FinishedAt,
+	}
+	// a retry doesn't start the run again
+	if task.Attempts <= 1 {
+		fields["started_at"] = task.StartedAt
+	}
+	if err := db.Model(&Run{}).Where("id = ?", task.RunID).Updates(fields).Error; err != nil {
+		taskLogger("worker", task.TaskID).Error("failed to update run", "run_id", task.RunID, "error", err)
+	}
+}
+
+// runFailure tells why a finished run failed, nil if it didn't. Failed or
+// unreachable hosts and a nonzero exit of ansible fail a run as well, the
+// worker stores those as STATUS_ERROR but runs of before stayed succeeded.
+func runFailure(status uint, errText string, failedHosts, unreachable uint, exitCode *int) error {
+	if status != STATUS_SUCCEEDED {
+		return errors.New(statusText(status) + ": " + errText)
+	}
+	if failedHosts > 0 || unreachable > 0 {
+		return fmt.Errorf("failed hosts: %d, unreachable hosts: %d", failedHosts, unreachable)
+	}
+	if exitCode != nil && *exitCode != 0 {
+		return fmt.Errorf("ansible exited with %d", *exitCode)
+	}
+	return nil
+}
+
+// taskFailed reports whether the last run of a finished task failed, which
+// is what notifications on failed go by.
+func taskFailed(task *Task) bool {
+	return runFailure(task.Status, task.Error, task.FailedHosts, task.Unreachable, task.ExitCode) != nil
+}
+
+// setRunStatus gives task the status and error of a run that ended with
+// err from runAnsiblePlaybook.
+func setRunStatus(task *Task, err error) {
+	if err == errTaskCancelled {
+		task.Status = STATUS_CANCELLED
+		task.Error = err.Error()
+	} else if err == errTaskInterrupted {
+		task.Status = STATUS_INTERRUPTED
+		task.Error = err.Error()
+		if requeueInterrupted {
+			task.Error += ", it runs again after the restart"
+		}
+	} else if errors.Is(err, errTaskTimedOut) {
+		task.Status = STATUS_TIMED_OUT
+		task.Error = err.Error()
+	} else if err == errNoHostsMatched {
+		task.Status = STATUS_NO_HOSTS
+		task.Error = "no hosts matched the play, check that the inventory lists hosts in the groups it targets"
+	} else if err != nil {
+		task.Status = STATUS_ERROR
+		task.Error = fmt.Sprintf("%v", err)
+	} else if failure := runFailure(STATUS_SUCCEEDED, "", task.FailedHosts, task.Unreachable, task.ExitCode); failure != nil {
+		// ansible got through its hosts, but not all of them
+		task.Status = STATUS_ERROR
+		task.Error = failure.Error()
+	} else {
+		task.Status = STATUS_SUCCEEDED
+		task.Error = ""
+	}
+}
+
+// runVerbosity is the verbosity the current run of task asked for.
+func runVerbosity(task *Task) int {
+	var run Run
+	if task.RunID == 0 || db.Select("verbosity").Limit(1).Find(&run, "id = ?", task.RunID).Error != nil {
+		return task.Verbosity
+	}
+	return run.Verbosity
+}
+
+func runTask(c *gin.Context) {
+	var req RunRequest
+	if v := strings.TrimSpace(c.PostForm("verbosity")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid verbosity %q", v)})
+			return
+		}
+		req.Verbosity = &n
+	}
+	if err := req.check(); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	_, err := startTask(c.Param("id"), currentUser(c), req)
+	if err != nil && err != errTaskAlreadyQueued {
+		c.IndentedJSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	// a task already queued or running is not run twice
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// runCreated is the answer to a request to run a task.
+type runCreated struct {
+	TaskID     string `json:"task_id"`
+	RunID      uint   `json:"run_id"`
+	StatusText string `json:"status_text"`
+	Run        *Run   `json:"run"`
+}
+
+// apiCreateRun queues a task and answers with the run it made, the run
+// goes on in the background.
+func apiCreateRun(c *gin.Context) {
+	taskId := c.Param("id")
+	// the body is optional
+	var req RunRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apiError(c, withStatus(http.StatusBadRequest, err))
+			return
+		}
+	}
+	if err := req.check(); err != nil {
+		apiError(c, err)
+		return
+	}
+	run, err := startTask(taskId, currentUser(c), req)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	run.StatusText = "Queued"
+	c.Header("Location", "/api/v1/tasks/"+taskId+"/runs/"+strconv.FormatUint(uint64(run.ID), 10))
+	c.IndentedJSON(http.StatusAccepted, runCreated{TaskID: taskId, RunID: run.ID, StatusText: run.StatusText, Run: run})
+}
+
+func apiListRuns(c *gin.Context) {
+	task, ok := loadAPITask(c)
+	if !ok {
+		return
+	}
+	var runs []Run
+	page, err := listPage(c, db.Model(&Run{}).Where("task_id = ?", task.ID), &runs)
+	if err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	for i := range runs {
+		runs[i].StatusText = statusText(runs[i].Status)
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowRun(c *gin.Context) {
+	task, ok := loadAPITask(c)
+	if !ok {
+		return
+	}
+	var run Run
+	if err := db.Limit(1).Find(&run, "id = ? AND task_id = ?", c.Param("run_id"), task.ID).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if run.ID == 0 {
+		apiError(c, errRunNotFound)
+		return
+	}
+	run.StatusText = statusText(run.Status)
+	if err := db.Where("run_id = ?", run.ID).Order("id").Find(&run.AttemptList).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	for i := range run.AttemptList {
+		run.AttemptList[i].StatusText = statusText(run.AttemptList[i].Status)
+	}
+	c.IndentedJSON(http.StatusOK, run)
+}
+
+func loadAPITask(c *gin.Context) (*Task, bool) {
+	var task Task
+	if err := db.Limit(1).Find(&task, "task_id = ?", c.Param("id")).Error; err != nil {
+		apiError(c, err)
+		return nil, false
+	}
+	if task.ID == 0 {
+		apiError(c, errTaskNotFound)
+		return nil, false
+	}
+	return &task, true
+}
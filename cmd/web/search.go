@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+// searchIndex enables the full-text index over task output. It needs the
+// sqlite driver built with FTS5: go build -tags sqlite_fts5
+var searchIndex bool
+
+type SearchHit struct {
+	TaskID  string `json:"task_id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Host    string `json:"host"`
+	Task    string `json:"task"`
+	Snippet string `json:"snippet"`
+}
+
+func setupSearchIndex() error {
+	return db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS task_output_fts USING fts5(" +
+		"task_id UNINDEXED, host UNINDEXED, task UNINDEXED, content)").Error
+}
+
+// indexTaskOutput replaces the indexed output of task with res.
+func indexTaskOutput(task *Task, res *results.AnsiblePlaybookJSONResults) error {
+	if err := db.Exec("DELETE FROM task_output_fts WHERE task_id = ?", task.TaskID).Error; err != nil {
+		return err
+	}
+	for _, play := range res.Plays {
+		for _, t := range play.Tasks {
+			taskName := ""
+			if t.Task != nil {
+				taskName = t.Task.Name
+			}
+			for host, item := range t.Hosts {
+				content := strings.Join([]string{
+					outputText(item.Msg), outputText(item.Stdout), outputText(item.Stderr), outputText(item.Cmd),
+				}, "\n")
+				if strings.TrimSpace(content) == "" {
+					continue
+				}
+				if err := db.Exec("INSERT INTO task_output_fts (task_id, host, task, content) VALUES (?, ?, ?, ?)",
+					task.TaskID, host, taskName, content).Error; err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func searchTasks(c *gin.Context) {
+	if !searchIndex {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "search index is disabled"})
+		return
+	}
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "missing q"})
+		return
+	}
+
+	user := currentUser(c)
+	rows, err := db.Raw("SELECT f.task_id, t.name, t.status, f.host, f.task, "+
+		"snippet(task_output_fts, 3, '[', ']', '...', 16) "+
+		"FROM task_output_fts f JOIN tasks t ON t.task_id = f.task_id "+
+		"WHERE task_output_fts MATCH ? AND t.deleted_at IS NULL "+
+		"AND (? OR t.team_id IN (SELECT team_id FROM team_members WHERE user_id = ?)) "+
+		"ORDER BY rank LIMIT 50", q, user.Admin, user.ID).Rows()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("bad query: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var hit SearchHit
+		var status uint
+		if err := rows.Scan(&hit.TaskID, &hit.Name, &status, &hit.Host, &hit.Task, &hit.Snippet); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		hit.Status = statusText(status)
+		hits = append(hits, hit)
+	}
+	c.IndentedJSON(http.StatusOK, hits)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+)
+
+// go-ansible hands the command to exec as an argv, so paths with spaces or
+// other special characters reach ansible-playbook untouched, but its String()
+// joins the arguments with plain spaces. commandLine renders the same argv
+// quoted so the logged command is unambiguous and can be pasted into a shell.
+func commandLine(cmd execute.Commander) string {
+	args, err := cmd.Command()
+	if err != nil {
+		return cmd.String()
+	}
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell when it contains anything other
+// than characters that are always safe unquoted.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
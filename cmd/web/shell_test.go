@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+type fakeCommand struct {
+	args []string
+	err  error
+}
+
+func (f fakeCommand) Command() ([]string, error) { return append([]string(nil), f.args...), f.err }
+func (f fakeCommand) String() string             { return "unquoted" }
+
+var shellQuoteTests = []struct {
+	in, want string
+}{
+	{"", "''"},
+	{"site.yaml", "site.yaml"},
+	{"/data/run/site.yaml", "/data/run/site.yaml"},
+	{"--extra-vars=@/tmp/vars.json", "--extra-vars=@/tmp/vars.json"},
+	{"my playbook.yaml", "'my playbook.yaml'"},
+	{"  leading and trailing  ", "'  leading and trailing  '"},
+	{"tab\there", "'tab\there'"},
+	{"new\nline", "'new\nline'"},
+	{"it's", `'it'\''s'`},
+	{"''", `''\'''\'''`},
+	{`say "hi"`, `'say "hi"'`},
+	{`back\slash`, `'back\slash'`},
+	{"$HOME", "'$HOME'"},
+	{"`id`", "'`id`'"},
+	{"a;rm -rf /", "'a;rm -rf /'"},
+	{"*.yml", "'*.yml'"},
+	{"playbooks/déploiement.yaml", "'playbooks/déploiement.yaml'"},
+	{"部署/站点.yaml", "'部署/站点.yaml'"},
+	{"emoji 🚀.yaml", "'emoji 🚀.yaml'"},
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tt := range shellQuoteTests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestShellQuoteRoundTrip has a shell print every quoted argument back.
+func TestShellQuoteRoundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	for _, tt := range shellQuoteTests {
+		out, err := exec.Command(sh, "-c", "printf %s "+shellQuote(tt.in)).Output()
+		if err != nil {
+			t.Fatalf("sh for %q: %v", tt.in, err)
+		}
+		if string(out) != tt.in {
+			t.Errorf("sh printed %q for %q", out, tt.in)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  fakeCommand
+		want string
+	}{
+		{"plain", fakeCommand{args: []string{"ansible-playbook", "-i", "inventory.ini", "site.yaml"}},
+			"ansible-playbook -i inventory.ini site.yaml"},
+		{"spaces", fakeCommand{args: []string{"ansible-playbook", "-i", "/data/my inventory.ini", "/data/my site.yaml"}},
+			"ansible-playbook -i '/data/my inventory.ini' '/data/my site.yaml'"},
+		{"quotes", fakeCommand{args: []string{"ansible-playbook", "--limit", "web's", `--extra-vars={"a": "b"}`}},
+			`ansible-playbook --limit 'web'\''s' '--extra-vars={"a": "b"}'`},
+		{"unicode", fakeCommand{args: []string{"ansible-playbook", "部署.yaml"}},
+			"ansible-playbook '部署.yaml'"},
+		{"error", fakeCommand{err: errors.New("no binary")}, "unquoted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commandLine(tt.cmd); got != tt.want {
+				t.Errorf("commandLine() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
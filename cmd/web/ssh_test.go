@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestSSHIdentityAliasesPinned sets each alias of the SSH identity the way
+// an inventory or the task's own extra vars would, and checks that the
+// command line extra vars, which beat both, pin it to the task's setting.
+func TestSSHIdentityAliasesPinned(t *testing.T) {
+	setupTestDB(t)
+	task := &Task{
+		TaskID:            "ssh-aliases",
+		Environment:       DEFAULT_ENVIRONMENT,
+		SSHUser:           "deploy",
+		SSHPort:           2222,
+		SSHPrivateKeyFile: "/keys/deploy",
+	}
+	tests := []struct {
+		alias string
+		want  interface{}
+	}{
+		{"ansible_user", "deploy"},
+		{"ansible_ssh_user", "deploy"},
+		{"ansible_port", 2222},
+		{"ansible_ssh_port", 2222},
+		{"ansible_private_key_file", "/keys/deploy"},
+		{"ansible_ssh_private_key_file", "/keys/deploy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			vars := sshIdentityVars(task.SSHUser, task.SSHPort, task.SSHPrivateKeyFile, 0)
+			if got := vars[tt.alias]; got != tt.want {
+				t.Errorf("sshIdentityVars()[%s] = %v, want %v", tt.alias, got, tt.want)
+			}
+
+			// the task's own extra vars try to swap the alias the way
+			// "h1 <alias>=root" in an inventory would
+			raw, _ := json.Marshal(map[string]interface{}{tt.alias: "root"})
+			withVars := *task
+			withVars.ExtraVars = string(raw)
+			options, err := newPlaybookOptions(&withVars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := options.ExtraVars[tt.alias]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("extra vars %s = %v, want %v", tt.alias, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHIdentityVarsUnset(t *testing.T) {
+	if vars := sshIdentityVars("", 0, "", 0); len(vars) != 0 {
+		t.Errorf("empty settings pinned %v, they are up to ansible", vars)
+	}
+}
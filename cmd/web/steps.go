@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// STEP_SAVE_INTERVAL is how often the host counts of the ansible task that
+// is running are saved, finished ones are saved right away
+const STEP_SAVE_INTERVAL = time.Second
+
+// TaskStep is one ansible task of an attempt of a run, saved while the
+// playbook runs from the jsonl events, so that the progress of each play
+// and task can be followed from every process sharing the database.
+type TaskStep struct {
+	ID      uint `json:"id" gorm:"primarykey"`
+	TaskID  uint `json:"-" gorm:"column:task_id;index"`
+	RunID   uint `json:"run_id" gorm:"column:run_id;index"`
+	Attempt uint `json:"attempt" gorm:"column:attempt"`
+	// PlayNumber and Number count the plays of the playbook and the tasks
+	// of the attempt from 1
+	PlayNumber    int       `json:"play_number" gorm:"column:play_number"`
+	Play          string    `json:"play" gorm:"column:play"`
+	Number        int       `json:"number" gorm:"column:number"`
+	AnsibleTaskID string    `json:"ansible_task_id" gorm:"column:ansible_task_id"`
+	Name          string    `json:"name" gorm:"column:name"`
+	Ok            int       `json:"ok" gorm:"column:ok"`
+	Changed       int       `json:"changed" gorm:"column:changed"`
+	Failed        int       `json:"failed" gorm:"column:failed"`
+	Skipped       int       `json:"skipped" gorm:"column:skipped"`
+	Unreachable   int       `json:"unreachable" gorm:"column:unreachable"`
+	StartedAt     time.Time `json:"started_at" gorm:"column:started_at"`
+	// FinishedAt is zero while the task runs, a task the run stopped in is
+	// finished when the run is
+	FinishedAt time.Time `json:"finished_at" gorm:"column:finished_at"`
+}
+
+// PlayProgress is a play of an attempt with the tasks it ran so far.
+type PlayProgress struct {
+	Number    int        `json:"number"`
+	Name      string     `json:"name"`
+	TasksDone int        `json:"tasks_done"`
+	Tasks     []TaskStep `json:"tasks"`
+}
+
+// stepRecorder saves the TaskSteps of one attempt, it is only used by the
+// progressWriter of the attempt.
+type stepRecorder struct {
+	task       *Task
+	playNumber int
+	play       string
+	number     int
+	step       *TaskStep
+	savedAt    time.Time
+}
+
+func newStepRecorder(task *Task) *stepRecorder {
+	return &stepRecorder{task: task}
+}
+
+func (r *stepRecorder) save(step *TaskStep) {
+	if err := db.Save(step).Error; err != nil {
+		taskLogger("worker", r.task.TaskID).Error("failed to save task step", "task", step.Name, "error", err)
+	}
+	r.savedAt = time.Now()
+}
+
+// finish saves the running ansible task as finished.
+func (r *stepRecorder) finish() {
+	if r.step == nil {
+		return
+	}
+	r.step.FinishedAt = time.Now()
+	r.save(r.step)
+	r.step = nil
+}
+
+func (r *stepRecorder) record(ev *jsonlEvent) {
+	if ev.Event == "v2_playbook_on_play_start" && ev.Play != nil {
+		r.finish()
+		r.playNumber++
+		r.play = ev.Play.Name
+	}
+	if ev.Task != nil && (r.step == nil || ev.Task.ID != r.step.AnsibleTaskID) {
+		r.finish()
+		r.number++
+		r.step = &TaskStep{
+			TaskID:        r.task.ID,
+			RunID:         r.task.RunID,
+			Attempt:       r.task.Attempts,
+			PlayNumber:    r.playNumber,
+			Play:          r.play,
+			Number:        r.number,
+			AnsibleTaskID: ev.Task.ID,
+			Name:          ev.Task.Name,
+			StartedAt:     time.Now(),
+		}
+		r.save(r.step)
+	}
+	if r.step != nil && len(ev.Hosts) > 0 {
+		counted := true
+		for _, raw := range ev.Hosts {
+			switch ev.Event {
+			case "v2_runner_on_ok":
+				var result struct {
+					Changed bool `json:"changed"`
+				}
+				json.Unmarshal(raw, &result)
+				if result.Changed {
+					r.step.Changed++
+				} else {
+					r.step.Ok++
+				}
+			case "v2_runner_on_failed":
+				r.step.Failed++
+			case "v2_runner_on_skipped":
+				r.step.Skipped++
+			case "v2_runner_on_unreachable":
+				r.step.Unreachable++
+			default:
+				counted = false
+			}
+		}
+		if counted && time.Since(r.savedAt) >= STEP_SAVE_INTERVAL {
+			r.save(r.step)
+		}
+	}
+	if ev.Event == "v2_playbook_on_stats" {
+		r.finish()
+	}
+}
+
+// taskPlays groups steps by play.
+func taskPlays(steps []TaskStep) []PlayProgress {
+	plays := []PlayProgress{}
+	for _, step := range steps {
+		if len(plays) == 0 || plays[len(plays)-1].Number != step.PlayNumber {
+			plays = append(plays, PlayProgress{Number: step.PlayNumber, Name: step.Play, Tasks: []TaskStep{}})
+		}
+		play := &plays[len(plays)-1]
+		play.Tasks = append(play.Tasks, step)
+		if !step.FinishedAt.IsZero() {
+			play.TasksDone++
+		}
+	}
+	return plays
+}
+
+// apiShowTaskProgress shows the plays and tasks of the last attempt of the
+// last run of a task, or of the run and attempt asked for, also while it
+// runs. The host counts of the running task lag by up to
+// STEP_SAVE_INTERVAL.
+func apiShowTaskProgress(c *gin.Context) {
+	task, ok := loadAPITask(c)
+	if !ok {
+		return
+	}
+	runID := task.RunID
+	if id := c.Query("run_id"); id != "" {
+		var run Run
+		if err := db.Limit(1).Find(&run, "id = ? AND task_id = ?", id, task.ID).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+		if run.ID == 0 {
+			apiError(c, errRunNotFound)
+			return
+		}
+		runID = run.ID
+	}
+	var attempt uint
+	if a := c.Query("attempt"); a != "" {
+		n, err := strconv.ParseUint(a, 10, 0)
+		if err != nil {
+			apiError(c, withStatus(http.StatusBadRequest, fmt.Errorf("invalid attempt %q", a)))
+			return
+		}
+		attempt = uint(n)
+	} else if err := db.Model(&TaskStep{}).Where("run_id = ?", runID).Select("COALESCE(MAX(attempt), 0)").Scan(&attempt).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	var steps []TaskStep
+	if err := db.Where("run_id = ? AND attempt = ?", runID, attempt).Order("number").Find(&steps).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	resp := gin.H{
+		"task_id":     task.TaskID,
+		"run_id":      runID,
+		"attempt":     attempt,
+		"status":      task.Status,
+		"status_text": statusText(task.Status),
+		"plays":       taskPlays(steps),
+	}
+	if p, ok := taskProgress(task.TaskID); ok && runID == task.RunID {
+		resp["progress"] = p
+	}
+	c.IndentedJSON(http.StatusOK, resp)
+}
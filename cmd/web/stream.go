@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// outputHub fans the output of one running task out to the clients
+// streaming it. Writes never block: a client that can't keep up loses lines
+// rather than stalling ansible.
+type outputHub struct {
+	mu      sync.Mutex
+	partial []byte
+	history []string
+	subs    map[chan string]struct{}
+	closed  bool
+}
+
+// hubHistoryLines is how much output is replayed to late subscribers
+const hubHistoryLines = 1000
+
+var (
+	hubsMu sync.Mutex
+	hubs   = map[string]*outputHub{}
+)
+
+func newOutputHub(taskID string) *outputHub {
+	hub := &outputHub{subs: map[chan string]struct{}{}}
+	hubsMu.Lock()
+	hubs[taskID] = hub
+	hubsMu.Unlock()
+	return hub
+}
+
+func findOutputHub(taskID string) *outputHub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	return hubs[taskID]
+}
+
+// outputHubIDs lists the tasks that currently have a hub.
+func outputHubIDs() []string {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	ids := make([]string, 0, len(hubs))
+	for id := range hubs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// closeOutputHub flushes any unterminated line and ends every subscription.
+func closeOutputHub(taskID string) {
+	hubsMu.Lock()
+	hub := hubs[taskID]
+	delete(hubs, taskID)
+	hubsMu.Unlock()
+	if hub == nil {
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.partial) > 0 {
+		hub.broadcast(string(hub.partial))
+		hub.partial = nil
+	}
+	for ch := range hub.subs {
+		close(ch)
+	}
+	hub.subs = nil
+	hub.closed = true
+}
+
+func (h *outputHub) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.partial = append(h.partial, p...)
+	for {
+		i := bytes.IndexByte(h.partial, '\n')
+		if i < 0 {
+			break
+		}
+		h.broadcast(string(h.partial[:i]))
+		h.partial = h.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (h *outputHub) broadcast(line string) {
+	if len(h.history) >= hubHistoryLines {
+		h.history = h.history[1:]
+	}
+	h.history = append(h.history, line)
+	for ch := range h.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// subscribe returns the output so far and a channel for what follows, the
+// channel is nil if the task already finished.
+func (h *outputHub) subscribe() ([]string, chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil
+	}
+	ch := make(chan string, 256)
+	h.subs[ch] = struct{}{}
+	return append([]string(nil), h.history...), ch
+}
+
+func (h *outputHub) unsubscribe(ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func streamTask(c *gin.Context) {
+	taskId := c.Param("id")
+	var task Task
+	if err := db.First(&task, "task_id = ?", taskId).Error; err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// a task that is still waiting gets its hub once a worker picks it up
+	var history []string
+	var lines chan string
+	for lines == nil {
+		if hub := findOutputHub(taskId); hub != nil {
+			history, lines = hub.subscribe()
+			if lines != nil {
+				defer hub.unsubscribe(lines)
+				break
+			}
+		}
+		if err := db.First(&task, "task_id = ?", taskId).Error; err != nil || !task.Queued && task.Status != STATUS_WAITING && task.Status != STATUS_RUNNING {
+			c.SSEvent("done", statusText(task.Status))
+			c.Writer.Flush()
+			return
+		}
+		if task.Status == STATUS_RUNNING && (mode == MODE_WEB || task.Node != nodeName) {
+			streamTaskSteps(c, &task)
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	for _, line := range history {
+		c.SSEvent("message", line)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastProgress Progress
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ticker.C:
+			if p, ok := taskProgress(taskId); ok && p != lastProgress {
+				lastProgress = p
+				c.SSEvent("progress", p)
+			}
+			return true
+		case line, ok := <-lines:
+			if !ok {
+				db.First(&task, "task_id = ?", taskId)
+				c.SSEvent("done", statusText(task.Status))
+				return false
+			}
+			c.SSEvent("message", line)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// streamTaskSteps follows a task that runs in another process. Its output
+// and progress only exist there, what it saved of the ansible tasks it ran
+// is sent instead, as a step event each time a TaskStep changes.
+func streamTaskSteps(c *gin.Context, task *Task) {
+	taskId := task.TaskID
+	sent := map[uint]TaskStep{}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		var steps []TaskStep
+		db.Where("run_id = ? AND attempt = ?", task.RunID, task.Attempts).Order("number").Find(&steps)
+		for _, step := range steps {
+			if sent[step.ID] != step {
+				sent[step.ID] = step
+				c.SSEvent("step", step)
+			}
+		}
+		// a task waiting for a retry goes on with its next attempt
+		if !task.Queued && task.Status != STATUS_WAITING && task.Status != STATUS_RUNNING {
+			c.SSEvent("done", statusText(task.Status))
+			return false
+		}
+		select {
+		case <-ticker.C:
+			return db.First(task, "task_id = ?", taskId).Error == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+type taskEvent struct {
+	taskID string
+	name   string
+	data   string
+	done   bool
+}
+
+// streamRunningTasks multiplexes the live output of every running task, or
+// of those listed in ?tasks=id1,id2, as "[task_id name] line" messages.
+// Tasks that start while the stream is open join it with the lines they
+// wrote before being noticed, a done event is sent as each of them finishes.
+func streamRunningTasks(c *gin.Context) {
+	var only map[string]bool
+	if ids := strings.TrimSpace(c.Query("tasks")); ids != "" {
+		only = map[string]bool{}
+		for _, id := range strings.Split(ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				only[id] = true
+			}
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// the request context ends with the connection, which stops the
+	// forwarding goroutines and drops their subscriptions
+	ctx := c.Request.Context()
+	user := currentUser(c)
+	events := make(chan taskEvent, 256)
+	subscribed := map[string]bool{}
+	// the running tasks of other teams
+	hidden := map[string]bool{}
+	subscribeNew := func(replay bool) {
+		for _, id := range outputHubIDs() {
+			if subscribed[id] || hidden[id] || only != nil && !only[id] {
+				continue
+			}
+			if !canSeeTask(user, id) {
+				hidden[id] = true
+				continue
+			}
+			hub := findOutputHub(id)
+			if hub == nil {
+				continue
+			}
+			history, lines := hub.subscribe()
+			if lines == nil {
+				continue
+			}
+			subscribed[id] = true
+			var task Task
+			db.Select("name").Limit(1).Find(&task, "task_id = ?", id)
+			go func(id, name string) {
+				defer hub.unsubscribe(lines)
+				if replay {
+					for _, line := range history {
+						select {
+						case events <- taskEvent{taskID: id, name: name, data: line}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				for {
+					select {
+					case line, ok := <-lines:
+						// a rerun of a finished task gets subscribed again
+						event := taskEvent{taskID: id, name: name, data: line, done: !ok}
+						select {
+						case events <- event:
+						case <-ctx.Done():
+							return
+						}
+						if !ok {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(id, task.Name)
+		}
+	}
+	subscribeNew(false)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ticker.C:
+			subscribeNew(true)
+			return true
+		case event := <-events:
+			if !event.done {
+				c.SSEvent("message", "["+event.taskID+" "+event.name+"] "+event.data)
+				return true
+			}
+			delete(subscribed, event.taskID)
+			var task Task
+			db.Select("status").Limit(1).Find(&task, "task_id = ?", event.taskID)
+			c.SSEvent("done", event.taskID+" "+statusText(task.Status))
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamTaskOfAnotherNode(t *testing.T) {
+	setupTestDB(t)
+	task := Task{TaskID: "elsewhere", Status: STATUS_RUNNING, Node: "w1", RunID: 7, Attempts: 1}
+	db.Create(&task)
+	db.Create(&TaskStep{TaskID: task.ID, RunID: 7, Attempt: 1, Number: 1, Name: "install nginx"})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		db.Model(&Task{}).Where("id = ?", task.ID).Update("status", STATUS_SUCCEEDED)
+	}()
+
+	// the output is in w1, the steps it saved are streamed instead
+	r := gin.New()
+	r.GET("/stream/:id", streamTask)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream/elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(raw)
+	if !strings.Contains(body, "event:step") || !strings.Contains(body, "install nginx") {
+		t.Errorf("no step event in %q", body)
+	}
+	if !strings.Contains(body, "event:done\ndata:Succeeded") {
+		t.Errorf("no done event in %q", body)
+	}
+}
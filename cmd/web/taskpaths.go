@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const TASK_PATHS_CALLBACK = "task_paths"
+
+//go:embed plugins/callback/task_paths.py
+var taskPathsPlugin []byte
+
+// TaskPath is a line of task_paths.jsonl, written by the task_paths
+// callback plugin.
+type TaskPath struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Role string `json:"role"`
+}
+
+func taskPathsPluginDir() string {
+	return filepath.Join(rootDir, ".plugins", "callback")
+}
+
+// setupTaskPaths installs the callback plugin that records task paths,
+// it is only enabled with the task_paths config setting.
+func setupTaskPaths() error {
+	dir := taskPathsPluginDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, TASK_PATHS_CALLBACK+".py"), taskPathsPlugin, 0644)
+}
+
+// taskPathsEnv enables the plugin for a run of task.
+func taskPathsEnv(task *Task) map[string]string {
+	return map[string]string{
+		"ANSIBLE_CALLBACK_PLUGINS":  taskPathsPluginDir(),
+		"ANSIBLE_CALLBACKS_ENABLED": TASK_PATHS_CALLBACK,
+		"TASK_PATHS_FILE":           filepath.Join(rootDir, task.TaskID, "task_paths.jsonl"),
+	}
+}
+
+// readTaskPaths returns the recorded task paths by task id, it is empty if
+// the task ran without the plugin.
+func readTaskPaths(taskId string) map[string]TaskPath {
+	paths := map[string]TaskPath{}
+	f, err := os.Open(filepath.Join(rootDir, taskId, "task_paths.jsonl"))
+	if err != nil {
+		return paths
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var p TaskPath
+		if json.Unmarshal(scanner.Bytes(), &p) == nil && p.ID != "" {
+			paths[p.ID] = p
+		}
+	}
+	return paths
+}
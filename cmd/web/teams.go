@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DEFAULT_TEAM gets everything from before teams existed and the users
+// created without a team.
+const DEFAULT_TEAM = "default"
+
+// Team owns tasks, with their playbooks and inventories, library entries
+// and projects. Users see and run what belongs to the teams they are
+// members of, admins see everything.
+type Team struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	Name        string    `json:"name" gorm:"column:name;size:191;uniqueIndex"`
+	Description string    `json:"description" gorm:"column:description"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at"`
+	// Members are only loaded by apiShowTeam
+	Members []User `json:"members,omitempty" gorm:"-"`
+}
+
+type TeamMember struct {
+	TeamID uint `json:"team_id" gorm:"column:team_id;primaryKey"`
+	UserID uint `json:"user_id" gorm:"column:user_id;primaryKey;index"`
+}
+
+// TeamRequest creates or updates a team, a missing field is left as is.
+type TeamRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+var (
+	errTeamNotFound = withStatus(http.StatusNotFound, errors.New("team not found"))
+	errTeamExists   = withStatus(http.StatusConflict, errors.New("team already exists"))
+	errTeamInUse    = withStatus(http.StatusConflict, errors.New("team still owns tasks, library entries or projects"))
+	errNoTeam       = withStatus(http.StatusForbidden, errors.New("you aren't a member of any team"))
+	errNotMember    = withStatus(http.StatusForbidden, errors.New("you aren't a member of that team"))
+)
+
+// teamTables are the tables with a team_id column
+var teamTables = []string{"tasks", "playbooks", "inventories", "library_playbooks", "library_inventories", "projects"}
+
+// migrateTeams creates the default team on the first start with teams. It
+// gets the users and everything else that has no team yet.
+func migrateTeams() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Team{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			team := Team{Name: DEFAULT_TEAM, Description: "everything from before teams"}
+			if err := tx.Create(&team).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("INSERT INTO team_members (team_id, user_id) SELECT ?, id FROM users", team.ID).Error; err != nil {
+				return err
+			}
+		}
+		team, err := defaultTeam(tx)
+		if err != nil || team == nil {
+			return err
+		}
+		for _, table := range teamTables {
+			if err := tx.Exec("UPDATE "+table+" SET team_id = ? WHERE team_id = 0 OR team_id IS NULL", team.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// defaultTeam is nil once an admin deleted it.
+func defaultTeam(tx *gorm.DB) (*Team, error) {
+	var team Team
+	if err := tx.Where("name = ?", DEFAULT_TEAM).Limit(1).Find(&team).Error; err != nil {
+		return nil, err
+	}
+	if team.ID == 0 {
+		return nil, nil
+	}
+	return &team, nil
+}
+
+// memberTeams is the subquery of the teams of user.
+func memberTeams(user *User) *gorm.DB {
+	return db.Model(&TeamMember{}).Select("team_id").Where("user_id = ?", user.ID)
+}
+
+// inTeams is a scope that keeps the rows whose column is one of the teams
+// of the user of the request, e.g. tasks.team_id.
+func inTeams(c *gin.Context, column string) func(*gorm.DB) *gorm.DB {
+	user := currentUser(c)
+	return func(tx *gorm.DB) *gorm.DB {
+		if user.Admin {
+			return tx
+		}
+		return tx.Where(column+" IN (?)", memberTeams(user))
+	}
+}
+
+func isTeamMember(user *User, teamID uint) bool {
+	if user.Admin {
+		return true
+	}
+	var count int64
+	db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", teamID, user.ID).Count(&count)
+	return count > 0
+}
+
+// requestTeam is the team something user creates goes to, the first team
+// of the user unless it asks for one.
+func requestTeam(user *User, teamID uint) (uint, error) {
+	if teamID != 0 {
+		var team Team
+		if err := db.Limit(1).Find(&team, teamID).Error; err != nil {
+			return 0, err
+		}
+		if team.ID == 0 {
+			return 0, withStatus(http.StatusBadRequest, fmt.Errorf("unknown team %d", teamID))
+		}
+		if !isTeamMember(user, teamID) {
+			return 0, errNotMember
+		}
+		return teamID, nil
+	}
+	var member TeamMember
+	if err := db.Where("user_id = ?", user.ID).Order("team_id").Limit(1).Find(&member).Error; err != nil {
+		return 0, err
+	}
+	if member.TeamID != 0 {
+		return member.TeamID, nil
+	}
+	if !user.Admin {
+		return 0, errNoTeam
+	}
+	// admins see every team without being members
+	team, err := defaultTeam(db)
+	if err != nil {
+		return 0, err
+	}
+	if team == nil {
+		return 0, errNoTeam
+	}
+	return team.ID, nil
+}
+
+// referencedTeam is the team of the project or library entry req takes
+// its playbook or inventory from, 0 if there is none.
+func referencedTeam(req *TaskRequest) uint {
+	refs := []struct {
+		table string
+		id    uint
+	}{
+		{"projects", req.ProjectID},
+		{"library_playbooks", req.LibraryPlaybookID},
+		{"library_inventories", req.LibraryInventoryID},
+	}
+	for _, ref := range refs {
+		if ref.id == 0 {
+			continue
+		}
+		var teams []uint
+		db.Table(ref.table).Where("id = ?", ref.id).Limit(1).Pluck("team_id", &teams)
+		if len(teams) > 0 {
+			return teams[0]
+		}
+	}
+	return 0
+}
+
+// teamAccess hides the object of the :id parameter from users outside its
+// team, as if it didn't exist. column is the one the parameter matches.
+// Objects that don't exist are left to the handler.
+func teamAccess(table, column string, notFound error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		if user.Admin {
+			return
+		}
+		id := c.Param("id")
+		// /result/:id.xml and /result/:id.csv
+		if table == "tasks" {
+			id = strings.TrimSuffix(id, filepath.Ext(id))
+		}
+		var teams []uint
+		if err := db.Table(table).Where(column+" = ?", id).Limit(1).Pluck("team_id", &teams).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+		if len(teams) > 0 && !isTeamMember(user, teams[0]) {
+			apiError(c, notFound)
+		}
+	}
+}
+
+// canSeeTask is teamAccess for a single task outside of its routes.
+func canSeeTask(user *User, taskID string) bool {
+	if user.Admin {
+		return true
+	}
+	var count int64
+	db.Model(&Task{}).Where("task_id = ? AND team_id IN (?)", taskID, memberTeams(user)).Count(&count)
+	return count > 0
+}
+
+func findTeam(c *gin.Context) (*Team, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, errTeamNotFound
+	}
+	var team Team
+	if err := db.Limit(1).Find(&team, id).Error; err != nil {
+		return nil, err
+	}
+	if team.ID == 0 || !isTeamMember(currentUser(c), team.ID) {
+		return nil, errTeamNotFound
+	}
+	return &team, nil
+}
+
+func applyTeamRequest(team *Team, req *TeamRequest) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return withStatus(http.StatusBadRequest, errors.New("name is required"))
+		}
+		var count int64
+		if err := db.Model(&Team{}).Where("name = ? AND id <> ?", name, team.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errTeamExists
+		}
+		team.Name = name
+	}
+	if req.Description != nil {
+		team.Description = *req.Description
+	}
+	return nil
+}
+
+// apiListTeams lists the teams of the user, every team for admins.
+func apiListTeams(c *gin.Context) {
+	var teams []Team
+	page, err := listPage(c, db.Model(&Team{}).Scopes(inTeams(c, "teams.id")), &teams)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowTeam(c *gin.Context) {
+	team, err := findTeam(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := db.Where("id IN (?)", db.Model(&TeamMember{}).Select("user_id").Where("team_id = ?", team.ID)).
+		Order("name").Find(&team.Members).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	members := make([]*User, len(team.Members))
+	for i := range team.Members {
+		members[i] = &team.Members[i]
+	}
+	if err := loadRoles(members...); err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, team)
+}
+
+func apiCreateTeam(c *gin.Context) {
+	var req TeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if req.Name == nil {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("name is required")))
+		return
+	}
+	var team Team
+	if err := applyTeamRequest(&team, &req); err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := db.Create(&team).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Header("Location", "/api/v1/teams/"+strconv.FormatUint(uint64(team.ID), 10))
+	c.IndentedJSON(http.StatusCreated, team)
+}
+
+func apiUpdateTeam(c *gin.Context) {
+	var req TeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	team, err := findTeam(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := applyTeamRequest(team, &req); err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := db.Select("name", "description").Updates(team).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, team)
+}
+
+// apiDeleteTeam removes a team that owns nothing anymore.
+func apiDeleteTeam(c *gin.Context) {
+	team, err := findTeam(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	for _, table := range teamTables {
+		var count int64
+		if err := db.Table(table).Where("team_id = ?", team.ID).Count(&count).Error; err != nil {
+			apiError(c, err)
+			return
+		}
+		if count > 0 {
+			apiError(c, errTeamInUse)
+			return
+		}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ?", team.ID).Delete(&TeamMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Team{}, team.ID).Error
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func apiAddTeamMember(c *gin.Context) {
+	team, err := findTeam(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 0)
+	if err != nil {
+		apiError(c, errUserNotFound)
+		return
+	}
+	var count int64
+	if err := db.Model(&User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if count == 0 {
+		apiError(c, errUserNotFound)
+		return
+	}
+	member := TeamMember{TeamID: team.ID, UserID: uint(userID)}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func apiRemoveTeamMember(c *gin.Context) {
+	team, err := findTeam(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	tx := db.Where("team_id = ? AND user_id = ?", team.ID, c.Param("user_id")).Delete(&TeamMember{})
+	if tx.Error != nil {
+		apiError(c, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		apiError(c, errUserNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// joinTeams makes a new user a member of teams, of the default team if
+// there are none.
+func joinTeams(tx *gorm.DB, user *User, teams []uint) error {
+	if len(teams) == 0 {
+		team, err := defaultTeam(tx)
+		if err != nil || team == nil {
+			return err
+		}
+		teams = []uint{team.ID}
+	}
+	for _, id := range teams {
+		var count int64
+		if err := tx.Model(&Team{}).Where("id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return withStatus(http.StatusBadRequest, fmt.Errorf("unknown team %d", id))
+		}
+		if err := tx.Create(&TeamMember{TeamID: id, UserID: user.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// checkTaskTimeout validates the timeout of a task request.
+func checkTaskTimeout(timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 || d > maxTaskTimeout {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("timeout must be a duration up to %v like 1h", maxTaskTimeout))
+	}
+	return nil
+}
+
+// taskRunTimeout is the timeout of task, -timeout unless it sets one. A
+// timeout above a lowered -max-timeout is cut down to it.
+func taskRunTimeout(task *Task) time.Duration {
+	d, err := time.ParseDuration(task.Timeout)
+	if err != nil || d <= 0 {
+		return taskTimeout
+	}
+	if d > maxTaskTimeout {
+		return maxTaskTimeout
+	}
+	return d
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	tlsCert string
+	tlsKey  string
+	// tlsAutocert is a comma separated list of domains to get Let's Encrypt
+	// certificates for
+	tlsAutocert      string
+	tlsAutocertCache string
+	// tlsHTTPAddress serves the ACME http-01 challenge and redirects the
+	// rest to https
+	tlsHTTPAddress string
+)
+
+func tlsEnabled() bool {
+	return tlsCert != "" || tlsAutocert != ""
+}
+
+func checkTLSFlags() error {
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key go together")
+	}
+	if tlsCert != "" && tlsAutocert != "" {
+		return errors.New("-tls-cert and -tls-autocert exclude each other")
+	}
+	if tlsHTTPAddress != "" && !tlsEnabled() {
+		return errors.New("-tls-http needs -tls-cert or -tls-autocert")
+	}
+	return nil
+}
+
+func autocertDomains() []string {
+	var domains []string
+	for _, d := range strings.Split(tlsAutocert, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// setupTLS configures srv for HTTPS, with the certificate files or with
+// Let's Encrypt. The returned handler is what -tls-http serves.
+func setupTLS(srv *http.Server) http.Handler {
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsAutocert == "" {
+		return http.HandlerFunc(redirectHTTPS)
+	}
+	cache := tlsAutocertCache
+	if cache == "" {
+		cache = filepath.Join(rootDir, ".autocert")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(autocertDomains()...),
+		Cache:      autocert.DirCache(cache),
+	}
+	srv.TLSConfig = m.TLSConfig()
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	return m.HTTPHandler(nil)
+}
+
+// redirectHTTPS sends plain requests to the same host on the port of -s.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(address); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// serve runs srv on plain HTTP or HTTPS as the flags say.
+func serve(srv *http.Server) error {
+	if !tlsEnabled() {
+		return srv.ListenAndServe()
+	}
+	plain := setupTLS(srv)
+	if tlsHTTPAddress != "" {
+		go func() {
+			httpSrv := &http.Server{Addr: tlsHTTPAddress, Handler: plain, ReadHeaderTimeout: 10 * time.Second}
+			if err := httpSrv.ListenAndServe(); err != nil {
+				fatal("listen", "address", tlsHTTPAddress, "error", err)
+			}
+		}()
+	}
+	// with autocert the certificates come from TLSConfig.GetCertificate
+	return srv.ListenAndServeTLS(tlsCert, tlsKey)
+}
+
+// strictTransport tells browsers to stay on https once they got there.
+func strictTransport(c *gin.Context) {
+	if c.Request.TLS != nil {
+		c.Header("Strict-Transport-Security", "max-age=31536000")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TOKEN_PREFIX makes tokens easy to spot, in a leaked config for example
+const (
+	TOKEN_PREFIX         = "arw_"
+	TOKEN_TOUCH_INTERVAL = time.Minute
+)
+
+// Token is a personal API token. Only the SHA-256 of the token is stored,
+// the token itself is shown once when it is created.
+type Token struct {
+	ID         uint      `json:"id" gorm:"primarykey"`
+	UserID     uint      `json:"user_id" gorm:"column:user_id;index"`
+	Name       string    `json:"name" gorm:"column:name"`
+	Hash       string    `json:"-" gorm:"column:hash;size:64;uniqueIndex"`
+	Hint       string    `json:"hint" gorm:"column:hint"`
+	CreatedAt  time.Time `json:"created_at" gorm:"column:created_at"`
+	LastUsedAt time.Time `json:"last_used_at" gorm:"column:last_used_at"`
+	// zero ExpiresAt and RevokedAt mean never and not revoked
+	ExpiresAt time.Time `json:"expires_at" gorm:"column:expires_at"`
+	RevokedAt time.Time `json:"revoked_at" gorm:"column:revoked_at"`
+}
+
+// TokenRequest creates a token, ExpiresIn is a duration like "720h".
+type TokenRequest struct {
+	Name      string `json:"name"`
+	ExpiresIn string `json:"expires_in"`
+}
+
+var errTokenNotFound = withStatus(http.StatusNotFound, errors.New("token not found"))
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerUser returns the user of the token in the Authorization header, or
+// nil. ok is false if there is no such header.
+func bearerUser(c *gin.Context) (user *User, ok bool) {
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+	var token Token
+	err := db.Limit(1).Find(&token, "hash = ?", hashToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))).Error
+	if err != nil || token.ID == 0 || !token.RevokedAt.IsZero() {
+		return nil, true
+	}
+	now := time.Now()
+	if !token.ExpiresAt.IsZero() && now.After(token.ExpiresAt) {
+		return nil, true
+	}
+	// a busy script shouldn't mean a write per request
+	if now.Sub(token.LastUsedAt) > TOKEN_TOUCH_INTERVAL {
+		db.Model(&token).Update("last_used_at", now)
+	}
+	user = &User{}
+	if err := db.Limit(1).Find(user, token.UserID).Error; err != nil || user.ID == 0 {
+		return nil, true
+	}
+	if err := loadRoles(user); err != nil {
+		return nil, true
+	}
+	return user, true
+}
+
+func apiListTokens(c *gin.Context) {
+	var tokens []Token
+	page, err := listPage(c, db.Model(&Token{}).Where("user_id = ?", currentUser(c).ID), &tokens)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiCreateToken(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("name is required")))
+		return
+	}
+	now := time.Now()
+	token := Token{UserID: currentUser(c).ID, Name: req.Name, CreatedAt: now}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			apiError(c, withStatus(http.StatusBadRequest, errors.New("expires_in must be a positive duration like 720h")))
+			return
+		}
+		token.ExpiresAt = now.Add(d)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		apiError(c, err)
+		return
+	}
+	secret := TOKEN_PREFIX + hex.EncodeToString(buf)
+	token.Hash = hashToken(secret)
+	token.Hint = secret[:len(TOKEN_PREFIX)+4] + "..."
+	if err := db.Create(&token).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"token": secret, "info": token})
+}
+
+// apiRevokeToken revokes one of the user's tokens, admins may revoke any.
+func apiRevokeToken(c *gin.Context) {
+	user := currentUser(c)
+	query := db.Model(&Token{}).Where("id = ? AND revoked_at = ?", c.Param("id"), time.Time{})
+	if !user.Admin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	tx := query.Update("revoked_at", time.Now())
+	if tx.Error != nil {
+		apiError(c, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		apiError(c, errTokenNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
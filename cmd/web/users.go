@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	errAdminRequired = withStatus(http.StatusForbidden, errors.New("admin required"))
+	errUserNotFound  = withStatus(http.StatusNotFound, errors.New("user not found"))
+	errUserExists    = withStatus(http.StatusConflict, errors.New("user already exists"))
+	errLastAdmin     = withStatus(http.StatusConflict, errors.New("the last admin can't be removed"))
+)
+
+// UserRequest creates or updates a user, a missing field is left as is. New
+// users are operators unless Role says otherwise.
+type UserRequest struct {
+	Name     *string `json:"name"`
+	Password *string `json:"password"`
+	Role     *string `json:"role"`
+	// Email and NotifyEmail are the email notification preferences
+	Email       *string `json:"email"`
+	NotifyEmail *string `json:"notify_email"`
+	// Teams are the ids of the teams a new user joins, the default team if
+	// empty
+	Teams []uint `json:"teams"`
+}
+
+// findUser loads the user of the :id parameter, users other than admins
+// may only see themselves.
+func findUser(c *gin.Context) (*User, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, errUserNotFound
+	}
+	if current := currentUser(c); !current.Admin && current.ID != uint(id) {
+		return nil, errAdminRequired
+	}
+	var user User
+	if err := db.Limit(1).Find(&user, id).Error; err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errUserNotFound
+	}
+	if err := loadRoles(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func apiListUsers(c *gin.Context) {
+	var users []User
+	page, err := listPage(c, db.Model(&User{}), &users)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	ptrs := make([]*User, len(users))
+	for i := range users {
+		ptrs[i] = &users[i]
+	}
+	if err := loadRoles(ptrs...); err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowUser(c *gin.Context) {
+	user, err := findUser(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, user)
+}
+
+func apiCreateUser(c *gin.Context) {
+	var req UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if req.Name == nil || req.Password == nil {
+		apiError(c, withStatus(http.StatusBadRequest, errors.New("name and password are required")))
+		return
+	}
+	role := ROLE_OPERATOR
+	if req.Role != nil {
+		role = *req.Role
+	}
+	if err := checkRole(role); err != nil {
+		apiError(c, err)
+		return
+	}
+	var user User
+	if err := applyUserRequest(&user, &req); err != nil {
+		apiError(c, err)
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := joinTeams(tx, &user, req.Teams); err != nil {
+			return err
+		}
+		return setUserRole(tx, &user, role)
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Header("Location", "/api/v1/users/"+strconv.FormatUint(uint64(user.ID), 10))
+	c.IndentedJSON(http.StatusCreated, user)
+}
+
+func apiUpdateUser(c *gin.Context) {
+	var req UserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	user, err := findUser(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	changeRole := req.Role != nil && *req.Role != user.Role
+	if changeRole {
+		if !currentUser(c).Admin {
+			apiError(c, errAdminRequired)
+			return
+		}
+		if err := checkRole(*req.Role); err != nil {
+			apiError(c, err)
+			return
+		}
+		if user.Admin {
+			if err := checkNotLastAdmin(user); err != nil {
+				apiError(c, err)
+				return
+			}
+		}
+	}
+	if err := applyUserRequest(user, &req); err != nil {
+		apiError(c, err)
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("name", "password", "email", "notify_email").Updates(user).Error; err != nil {
+			return err
+		}
+		if changeRole {
+			return setUserRole(tx, user, *req.Role)
+		}
+		return nil
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, user)
+}
+
+func apiDeleteUser(c *gin.Context) {
+	user, err := findUser(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if user.ID == currentUser(c).ID {
+		apiError(c, withStatus(http.StatusConflict, errors.New("you can't delete yourself")))
+		return
+	}
+	if user.Admin {
+		if err := checkNotLastAdmin(user); err != nil {
+			apiError(c, err)
+			return
+		}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&Token{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&TeamMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// applyUserRequest copies the fields set in req to user, hashing the password.
+func applyUserRequest(user *User, req *UserRequest) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return withStatus(http.StatusBadRequest, errors.New("name is required"))
+		}
+		if name != user.Name {
+			var other User
+			if err := db.Limit(1).Find(&other, "name = ?", name).Error; err != nil {
+				return err
+			}
+			if other.ID != 0 {
+				return errUserExists
+			}
+		}
+		user.Name = name
+	}
+	if req.Password != nil {
+		if *req.Password == "" {
+			return withStatus(http.StatusBadRequest, errors.New("password is required"))
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.Password = string(hash)
+	}
+	if req.Email != nil {
+		email := strings.TrimSpace(*req.Email)
+		if email != "" {
+			addr, err := mail.ParseAddress(email)
+			if err != nil {
+				return withStatus(http.StatusBadRequest, fmt.Errorf("invalid email %q", email))
+			}
+			email = addr.Address
+		}
+		user.Email = email
+	}
+	if req.NotifyEmail != nil {
+		if err := checkEmailPreference(*req.NotifyEmail); err != nil {
+			return err
+		}
+		user.NotifyEmail = *req.NotifyEmail
+	}
+	return nil
+}
+
+// checkNotLastAdmin keeps at least one admin around to manage the others.
+func checkNotLastAdmin(user *User) error {
+	var count int64
+	err := db.Model(&User{}).Where("is_admin = ? AND id <> ?", true, user.ID).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apenella/go-ansible/v2/pkg/execute"
+	"github.com/apenella/go-ansible/v2/pkg/playbook"
+)
+
+const VALIDATE_TIMEOUT = time.Minute
+
+// validateTask checks the inventory and the playbook syntax of a task whose
+// files are written, so that mistakes show up when the task is created and
+// not when it runs. ctx is that of the request, the requirements of the
+// task are installed for the syntax check within VALIDATE_TIMEOUT too. The
+// error carries the ansible output.
+func validateTask(ctx context.Context, task *Task) error {
+	ctx, cancel := context.WithTimeout(ctx, VALIDATE_TIMEOUT)
+	defer cancel()
+
+	options, err := newPlaybookOptions(task)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	if _, err := resolveInventory(ctx, task, options); err != nil {
+		return err
+	}
+	if err := installRequirements(ctx, task, options); err != nil {
+		if ctx.Err() != nil {
+			return withStatus(http.StatusGatewayTimeout, fmt.Errorf("requirements were not installed within %v, try again later: %v", VALIDATE_TIMEOUT, err))
+		}
+		return withStatus(http.StatusBadRequest, err)
+	}
+	if task.AdHoc() {
+		return nil
+	}
+
+	options.SyntaxCheck = true
+	playbookCmd := playbook.NewAnsiblePlaybookCmd(
+		playbook.WithPlaybooks(task.Playbook.Path),
+		playbook.WithPlaybookOptions(options),
+	)
+	out, err := runValidation(ctx, task, playbookCmd, options, galaxyEnv(task), nil)
+	if err != nil {
+		return validationError("invalid playbook", out, err)
+	}
+	return nil
+}
+
+// runValidation runs cmd and returns its combined output, or only its
+// stderr when stdout is given somewhere else.
+func runValidation(ctx context.Context, task *Task, cmd execute.Commander, options *playbook.AnsiblePlaybookOptions, env map[string]string, stdout io.Writer) (string, error) {
+	taskCmd, cleanup := newTaskCommand(task, cmd, options)
+	defer cleanup()
+
+	var out bytes.Buffer
+	if stdout == nil {
+		stdout = &out
+	}
+	exec := execute.NewDefaultExecute(
+		execute.WithCmd(taskCmd),
+		execute.WithWrite(stdout),
+		execute.WithWriteError(&out),
+		execute.WithEnvVars(env),
+		execute.WithEnvVars(vaultIDEnv(task)),
+	)
+	err := exec.Execute(ctx)
+	return out.String(), err
+}
+
+// validationError reports the parser error of ansible, the warnings before
+// it are left out.
+func validationError(what, out string, err error) error {
+	out = strings.TrimSpace(out)
+	if i := strings.Index(out, "ERROR!"); i > 0 {
+		out = out[i:]
+	}
+	if out == "" {
+		out = err.Error()
+	}
+	return withStatus(http.StatusBadRequest, fmt.Errorf("%s:\n%s", what, out))
+}
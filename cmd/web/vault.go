@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var vaultIDLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func checkVaultPasswordScript(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// checkVaultIDs validates the vault_ids of the config, every label names a
+// password file or an executable that prints the password.
+func checkVaultIDs(ids map[string]string) error {
+	for label, path := range ids {
+		if !vaultIDLabelPattern.MatchString(label) {
+			return fmt.Errorf("vault id %q: bad label", label)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("vault id %q: %v", label, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("vault id %q: %s is not a regular file", label, path)
+		}
+	}
+	return nil
+}
+
+func (c *Config) vaultIDLabels() []string {
+	labels := make([]string, 0, len(c.VaultIDs))
+	for label := range c.VaultIDs {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// cleanVaultIDs checks that the requested vault ids are configured and
+// returns them as they are stored on the playbook, comma separated.
+func cleanVaultIDs(labels []string) (string, error) {
+	seen := map[string]bool{}
+	var list []string
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[label] {
+			continue
+		}
+		if _, ok := config.VaultIDs[label]; !ok {
+			return "", withStatus(http.StatusBadRequest, fmt.Errorf("unknown vault id %q", label))
+		}
+		seen[label] = true
+		list = append(list, label)
+	}
+	return strings.Join(list, ","), nil
+}
+
+func splitVaultIDs(ids string) []string {
+	if ids == "" {
+		return nil
+	}
+	return strings.Split(ids, ",")
+}
+
+// vaultIDFiles returns the password files of the vault ids the playbook of
+// task needs, in the order they were given.
+func vaultIDFiles(task *Task) ([]string, error) {
+	var files []string
+	for _, label := range splitVaultIDs(task.Playbook.VaultIDs) {
+		path, ok := config.VaultIDs[label]
+		if !ok {
+			return nil, fmt.Errorf("unknown vault id %q", label)
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// vaultIDEnv hands the vault ids to ansible like --vault-id label@file
+// for each of them. Unknown labels are left out, newPlaybookOptions has
+// refused the task already.
+func vaultIDEnv(task *Task) map[string]string {
+	var ids []string
+	for _, label := range splitVaultIDs(task.Playbook.VaultIDs) {
+		if path, ok := config.VaultIDs[label]; ok {
+			ids = append(ids, label+"@"+path)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return map[string]string{"ANSIBLE_VAULT_IDENTITY_LIST": strings.Join(ids, ",")}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// MAX_VERBOSITY is -vvvv
+const MAX_VERBOSITY = 4
+
+func checkVerbosity(verbosity int) error {
+	if verbosity < 0 || verbosity > MAX_VERBOSITY {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("verbosity must be between 0 and %d", MAX_VERBOSITY))
+	}
+	return nil
+}
+
+// verbosityEnv sets the verbosity of a run. It can't be a -v flag,
+// go-ansible drops those from quiet commands.
+func verbosityEnv(task *Task) map[string]string {
+	if task.Verbosity <= 0 {
+		return nil
+	}
+	return map[string]string{"ANSIBLE_VERBOSITY": strconv.Itoa(task.Verbosity)}
+}
+
+// verboseOutputWriter passes the jsonl lines of the output of a verbose run
+// to out and the rest, what ansible prints for the verbosity, to verbose.
+// Those lines would keep result.json from being parsed.
+type verboseOutputWriter struct {
+	out, verbose io.Writer
+	line         []byte
+}
+
+func (w *verboseOutputWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			break
+		}
+		w.line = append(w.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flush writes out what is left of the current line.
+func (w *verboseOutputWriter) flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	dst := w.verbose
+	if bytes.HasPrefix(bytes.TrimSpace(w.line), []byte("{")) {
+		dst = w.out
+	}
+	_, err := dst.Write(w.line)
+	w.line = w.line[:0]
+	return err
+}
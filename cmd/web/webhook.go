@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	results "github.com/apenella/go-ansible/v2/pkg/execute/result/json"
+)
+
+const (
+	WEBHOOK_TIMEOUT     = 10 * time.Second
+	WEBHOOK_RETRY_DELAY = 2 * time.Second
+	// the events a webhook is posted on
+	WEBHOOK_ON_FINISHED = "finished"
+	WEBHOOK_ON_FAILED   = "failed"
+)
+
+var webhookURL string
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// WebhookConfig is a webhook of the config, posted to for every task that
+// finishes or only for those that fail.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// On is finished or failed, finished if empty
+	On string `json:"on"`
+}
+
+// WebhookPayload is the JSON body posted to the webhooks when a task
+// finishes, Text is the rendered webhook notification template and Recap
+// the stats per host, empty if the task didn't run.
+type WebhookPayload struct {
+	NotificationData
+	Event string      `json:"event"`
+	Text  string      `json:"text"`
+	Recap []HostStats `json:"recap"`
+}
+
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+func checkWebhooks(hooks []*WebhookConfig) error {
+	for i, hook := range hooks {
+		if hook == nil {
+			return fmt.Errorf("webhook %d is empty", i)
+		}
+		if err := checkWebhookURL(hook.URL); err != nil {
+			return fmt.Errorf("webhook %d: %v", i, err)
+		}
+		switch hook.On {
+		case "":
+			hook.On = WEBHOOK_ON_FINISHED
+		case WEBHOOK_ON_FINISHED, WEBHOOK_ON_FAILED:
+		default:
+			return fmt.Errorf("webhook %d: unknown event %q, use %s or %s", i, hook.On, WEBHOOK_ON_FINISHED, WEBHOOK_ON_FAILED)
+		}
+	}
+	return nil
+}
+
+// webhookURLs returns where the outcome of task is posted to, -webhook
+// gets every task.
+func webhookURLs(task *Task) []string {
+	var urls []string
+	if webhookURL != "" {
+		urls = append(urls, webhookURL)
+	}
+	for _, hook := range config.Webhooks {
+		if hook.On == WEBHOOK_ON_FINISHED || taskFailed(task) {
+			urls = append(urls, hook.URL)
+		}
+	}
+	return urls
+}
+
+// readRecap returns the stats per host in the result.json of task.
+func readRecap(task *Task) []HostStats {
+	fd, err := os.Open(filepath.Join(rootDir, task.TaskID, "result.json"))
+	if err != nil {
+		return []HostStats{}
+	}
+	defer fd.Close()
+	res, err := results.ParseJSONResultsStream(fd)
+	if err != nil {
+		return []HostStats{}
+	}
+	stats := summarizeResults(res, nil).Stats
+	if stats == nil {
+		return []HostStats{}
+	}
+	return stats
+}
+
+// notifyWebhook posts the outcome of task in the background so a slow or
+// unavailable endpoint never holds up a worker. It does nothing without
+// -webhook or webhooks in the config.
+func notifyWebhook(task *Task, data NotificationData, recap []HostStats) {
+	urls := webhookURLs(task)
+	if len(urls) == 0 {
+		return
+	}
+	payload := WebhookPayload{NotificationData: data, Event: WEBHOOK_ON_FINISHED, Recap: recap}
+	if taskFailed(task) {
+		payload.Event = WEBHOOK_ON_FAILED
+	}
+	text, err := renderNotification(NOTIFY_WEBHOOK, payload.NotificationData)
+	if err != nil {
+		taskLogger("notify", task.TaskID).Error("failed to render webhook", "error", err)
+	}
+	payload.Text = text
+	body, err := json.Marshal(payload)
+	if err != nil {
+		taskLogger("notify", task.TaskID).Error("failed to encode webhook", "error", err)
+		return
+	}
+
+	for _, u := range urls {
+		go func(u string) {
+			err := postWebhook(u, body)
+			if err != nil {
+				time.Sleep(WEBHOOK_RETRY_DELAY)
+				err = postWebhook(u, body)
+			}
+			if err != nil {
+				taskLogger("notify", task.TaskID).Error("webhook failed", "url", u, "error", err)
+			}
+		}(u)
+	}
+}
+
+func postWebhook(u string, body []byte) error {
+	resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WORKER_IDLE     = "idle"
+	WORKER_RUNNING  = "running"
+	WORKER_DRAINING = "draining"
+	WORKER_DRAINED  = "drained"
+)
+
+type Worker struct {
+	ID     int       `json:"id"`
+	State  string    `json:"state"`
+	TaskID string    `json:"task_id,omitempty"`
+	Since  time.Time `json:"since"`
+
+	draining bool
+	// wake interrupts a worker waiting for a task after drain or resume
+	wake chan struct{}
+}
+
+var (
+	workersMu sync.Mutex
+	workers   = map[int]*Worker{}
+)
+
+func registerWorker(id int) *Worker {
+	w := &Worker{ID: id, State: WORKER_IDLE, Since: time.Now(), wake: make(chan struct{}, 1)}
+	workersMu.Lock()
+	workers[id] = w
+	workersMu.Unlock()
+	return w
+}
+
+func (w *Worker) setState(state, taskID string) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	if state == WORKER_RUNNING && w.draining {
+		state = WORKER_DRAINING
+	}
+	w.State = state
+	w.TaskID = taskID
+	w.Since = time.Now()
+}
+
+func (w *Worker) isDraining() bool {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	return w.draining
+}
+
+func (w *Worker) setDraining(draining bool) {
+	workersMu.Lock()
+	w.draining = draining
+	if w.State == WORKER_RUNNING && draining {
+		w.State = WORKER_DRAINING
+	} else if w.State == WORKER_DRAINING && !draining {
+		w.State = WORKER_RUNNING
+	}
+	workersMu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func snapshotWorkers() []Worker {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	list := make([]Worker, 0, len(workers))
+	for _, w := range workers {
+		list = append(list, Worker{ID: w.ID, State: w.State, TaskID: w.TaskID, Since: w.Since})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func findWorker(c *gin.Context) (*Worker, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	workersMu.Lock()
+	w, ok := workers[id]
+	workersMu.Unlock()
+	if err != nil || !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "worker not found"})
+		return nil, false
+	}
+	return w, true
+}
+
+func listWorkers(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, snapshotWorkers())
+}
+
+func showQueue(c *gin.Context) {
+	var queued int64
+	if err := db.Model(&Task{}).Scopes(inTeams(c, "tasks.team_id")).Where("queued = ?", true).Count(&queued).Error; err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	tasks := []queuedTask{}
+	for _, t := range snapshotQueue() {
+		if canSeeTask(currentUser(c), t.TaskID) {
+			tasks = append(tasks, t)
+		}
+	}
+	waiting := []queuedTask{}
+	for _, t := range snapshotLockWaiters() {
+		if canSeeTask(currentUser(c), t.TaskID) {
+			waiting = append(waiting, t)
+		}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"queued":           queued,
+		"tasks":            tasks,
+		"waiting_for_lock": waiting,
+		"workers":          snapshotWorkers(),
+	})
+}
+
+// drainWorker lets the worker finish its current task and stops it from
+// taking new ones until it is resumed.
+func drainWorker(c *gin.Context) {
+	if w, ok := findWorker(c); ok {
+		w.setDraining(true)
+		listWorkers(c)
+	}
+}
+
+func resumeWorker(c *gin.Context) {
+	if w, ok := findWorker(c); ok {
+		w.setDraining(false)
+		listWorkers(c)
+	}
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// the statuses of workflow runs and of their nodes
+const (
+	WORKFLOW_PENDING    = "pending"
+	WORKFLOW_RUNNING    = "running"
+	WORKFLOW_SUCCESSFUL = "successful"
+	WORKFLOW_FAILED     = "failed"
+	WORKFLOW_SKIPPED    = "skipped"
+	WORKFLOW_CANCELLED  = "cancelled"
+)
+
+// when a node runs after an upstream node
+const (
+	WORKFLOW_ON_SUCCESS = "success"
+	WORKFLOW_ON_FAILURE = "failure"
+	WORKFLOW_ON_ALWAYS  = "always"
+)
+
+const (
+	MAX_WORKFLOW_NODES = 100
+	// WORKFLOW_CHECK_INTERVAL is how often the scheduler looks at the
+	// running workflows
+	WORKFLOW_CHECK_INTERVAL = 2 * time.Second
+)
+
+// Workflow is a DAG of tasks, each run of a node is a run of its task. A
+// node runs once its upstream nodes ended the way it needs.
+type Workflow struct {
+	ID          uint           `json:"id" gorm:"primarykey"`
+	Name        string         `json:"name" gorm:"column:name"`
+	Description string         `json:"description" gorm:"column:description"`
+	Creator     string         `json:"creator" gorm:"column:creator"`
+	TeamID      uint           `json:"team_id" gorm:"column:team_id;index"`
+	Nodes       []WorkflowNode `json:"nodes" gorm:"column:nodes;serializer:json"`
+	CreatedAt   time.Time      `json:"created_at" gorm:"column:created_at"`
+	UpdatedAt   time.Time      `json:"updated_at" gorm:"column:updated_at"`
+}
+
+type WorkflowNode struct {
+	// Name is unique in the workflow
+	Name   string `json:"name"`
+	TaskID string `json:"task_id"`
+	// Needs are the upstream nodes, a node without any runs first
+	Needs []WorkflowEdge `json:"needs,omitempty"`
+}
+
+type WorkflowEdge struct {
+	Node string `json:"node"`
+	// On is success, failure or always, success if unset
+	On string `json:"on,omitempty"`
+}
+
+type WorkflowRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	// Nodes replace all nodes of the workflow
+	Nodes []WorkflowNode `json:"nodes"`
+	// TeamID is the team a new workflow goes to, the first of the user if 0
+	TeamID uint `json:"team_id"`
+}
+
+// WorkflowRun is one run of a workflow with the graph it had then.
+type WorkflowRun struct {
+	ID         uint           `json:"id" gorm:"primarykey"`
+	WorkflowID uint           `json:"workflow_id" gorm:"column:workflow_id;index"`
+	Number     uint           `json:"number" gorm:"column:number"`
+	UserID     uint           `json:"user_id" gorm:"column:user_id"`
+	Status     string         `json:"status" gorm:"column:status;index"`
+	Graph      []WorkflowNode `json:"graph" gorm:"column:graph;serializer:json"`
+	// CancelRequested keeps the nodes not started yet from starting
+	CancelRequested bool      `json:"cancel_requested" gorm:"column:cancel_requested"`
+	CreatedAt       time.Time `json:"created_at" gorm:"column:created_at"`
+	FinishedAt      time.Time `json:"finished_at" gorm:"column:finished_at"`
+	// NodeRuns and Counts are only loaded when a single run is shown
+	NodeRuns []WorkflowNodeRun `json:"node_runs,omitempty" gorm:"foreignKey:WorkflowRunID"`
+	Counts   map[string]int    `json:"counts,omitempty" gorm:"-"`
+}
+
+// WorkflowNodeRun is what became of a node in a workflow run, RunID is the
+// run of its task once it started.
+type WorkflowNodeRun struct {
+	ID            uint      `json:"id" gorm:"primarykey"`
+	WorkflowRunID uint      `json:"workflow_run_id" gorm:"column:workflow_run_id;index"`
+	Node          string    `json:"node" gorm:"column:node"`
+	TaskID        string    `json:"task_id" gorm:"column:task_id"`
+	RunID         uint      `json:"run_id" gorm:"column:run_id"`
+	Status        string    `json:"status" gorm:"column:status"`
+	Error         string    `json:"error" gorm:"column:error"`
+	StartedAt     time.Time `json:"started_at" gorm:"column:started_at"`
+	FinishedAt    time.Time `json:"finished_at" gorm:"column:finished_at"`
+}
+
+var (
+	errWorkflowNotFound    = withStatus(http.StatusNotFound, errors.New("workflow not found"))
+	errWorkflowRunNotFound = withStatus(http.StatusNotFound, errors.New("workflow run not found"))
+	errWorkflowBusy        = withStatus(http.StatusConflict, errors.New("workflow is running"))
+)
+
+// checkWorkflowNodes checks the names and edges of nodes, that their tasks
+// are ones user sees, and that they make no cycle.
+func checkWorkflowNodes(nodes []WorkflowNode, user *User) error {
+	if len(nodes) == 0 {
+		return errors.New("a workflow needs nodes")
+	}
+	if len(nodes) > MAX_WORKFLOW_NODES {
+		return fmt.Errorf("a workflow has at most %d nodes", MAX_WORKFLOW_NODES)
+	}
+	names := map[string]bool{}
+	for i := range nodes {
+		nodes[i].Name = strings.TrimSpace(nodes[i].Name)
+		nodes[i].TaskID = strings.TrimSpace(nodes[i].TaskID)
+		if nodes[i].Name == "" {
+			return errors.New("a node needs a name")
+		}
+		if names[nodes[i].Name] {
+			return fmt.Errorf("node %q is given twice", nodes[i].Name)
+		}
+		names[nodes[i].Name] = true
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		if !workflowTaskFound(user, node.TaskID) {
+			return fmt.Errorf("node %q: task %q not found", node.Name, node.TaskID)
+		}
+		for j := range node.Needs {
+			edge := &node.Needs[j]
+			if !names[edge.Node] {
+				return fmt.Errorf("node %q needs the unknown node %q", node.Name, edge.Node)
+			}
+			switch edge.On {
+			case "":
+				edge.On = WORKFLOW_ON_SUCCESS
+			case WORKFLOW_ON_SUCCESS, WORKFLOW_ON_FAILURE, WORKFLOW_ON_ALWAYS:
+			default:
+				return fmt.Errorf("node %q: on must be %s, %s or %s, not %q",
+					node.Name, WORKFLOW_ON_SUCCESS, WORKFLOW_ON_FAILURE, WORKFLOW_ON_ALWAYS, edge.On)
+			}
+		}
+	}
+	if name, ok := workflowCycle(nodes); ok {
+		return fmt.Errorf("node %q needs itself", name)
+	}
+	return nil
+}
+
+// workflowTaskFound tells whether user sees the task of a node, one in the
+// trash isn't run.
+func workflowTaskFound(user *User, taskID string) bool {
+	var count int64
+	db.Model(&Task{}).Where("task_id = ?", taskID).Count(&count)
+	return count > 0 && canSeeTask(user, taskID)
+}
+
+// workflowCycle finds a node that is upstream of itself.
+func workflowCycle(nodes []WorkflowNode) (string, bool) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	byName := map[string]*WorkflowNode{}
+	for i := range nodes {
+		byName[nodes[i].Name] = &nodes[i]
+	}
+	state := map[string]int{}
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			return true
+		case done:
+			return false
+		}
+		state[name] = visiting
+		for _, edge := range byName[name].Needs {
+			if visit(edge.Node) {
+				return true
+			}
+		}
+		state[name] = done
+		return false
+	}
+	for _, node := range nodes {
+		if visit(node.Name) {
+			return node.Name, true
+		}
+	}
+	return "", false
+}
+
+func findWorkflow(c *gin.Context) (*Workflow, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return nil, errWorkflowNotFound
+	}
+	var workflow Workflow
+	if err := db.Limit(1).Find(&workflow, id).Error; err != nil {
+		return nil, err
+	}
+	if workflow.ID == 0 {
+		return nil, errWorkflowNotFound
+	}
+	return &workflow, nil
+}
+
+func applyWorkflowRequest(workflow *Workflow, req *WorkflowRequest, user *User) error {
+	if req.Name != nil {
+		workflow.Name = strings.TrimSpace(*req.Name)
+	}
+	if workflow.Name == "" {
+		return errors.New("name is required")
+	}
+	if req.Description != nil {
+		workflow.Description = *req.Description
+	}
+	if req.Nodes != nil {
+		if err := checkWorkflowNodes(req.Nodes, user); err != nil {
+			return err
+		}
+		workflow.Nodes = req.Nodes
+	}
+	if workflow.Nodes == nil {
+		return errors.New("a workflow needs nodes")
+	}
+	return nil
+}
+
+func apiListWorkflows(c *gin.Context) {
+	var workflows []Workflow
+	query := db.Model(&Workflow{}).Scopes(inTeams(c, "workflows.team_id"))
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likePattern(q)
+		query = query.Where("name LIKE ? ESCAPE '!' OR description LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+	page, err := listPage(c, query, &workflows)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+func apiShowWorkflow(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, workflow)
+}
+
+func apiCreateWorkflow(c *gin.Context) {
+	var req WorkflowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	user := currentUser(c)
+	teamID, err := requestTeam(user, req.TeamID)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	workflow := Workflow{Creator: user.Name, TeamID: teamID}
+	if err := applyWorkflowRequest(&workflow, &req, user); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if err := db.Create(&workflow).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Header("Location", "/api/v1/workflows/"+strconv.FormatUint(uint64(workflow.ID), 10))
+	c.IndentedJSON(http.StatusCreated, workflow)
+}
+
+func apiUpdateWorkflow(c *gin.Context) {
+	var req WorkflowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	if err := applyWorkflowRequest(workflow, &req, currentUser(c)); err != nil {
+		apiError(c, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if err := db.Select("name", "description", "nodes", "updated_at").Updates(workflow).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, workflow)
+}
+
+// apiDeleteWorkflow deletes a workflow with its runs, the runs of its tasks
+// stay.
+func apiDeleteWorkflow(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	var running int64
+	if err := db.Model(&WorkflowRun{}).Where("workflow_id = ? AND status = ?", workflow.ID, WORKFLOW_RUNNING).Count(&running).Error; err != nil {
+		apiError(c, err)
+		return
+	}
+	if running > 0 {
+		apiError(c, errWorkflowBusy)
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		runs := tx.Model(&WorkflowRun{}).Select("id").Where("workflow_id = ?", workflow.ID)
+		if err := tx.Where("workflow_run_id IN (?)", runs).Delete(&WorkflowNodeRun{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("workflow_id = ?", workflow.ID).Delete(&WorkflowRun{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(workflow).Error
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// apiCreateWorkflowRun starts a workflow, the nodes without upstream nodes
+// are queued before the answer.
+func apiCreateWorkflowRun(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	user := currentUser(c)
+	for _, node := range workflow.Nodes {
+		if !workflowTaskFound(user, node.TaskID) {
+			apiError(c, withStatus(http.StatusBadRequest, fmt.Errorf("node %q: task %q not found", node.Name, node.TaskID)))
+			return
+		}
+	}
+	run := WorkflowRun{WorkflowID: workflow.ID, UserID: user.ID, Status: WORKFLOW_RUNNING, Graph: workflow.Nodes}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&WorkflowRun{}).Where("workflow_id = ?", workflow.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		run.Number = uint(count) + 1
+		for _, node := range workflow.Nodes {
+			run.NodeRuns = append(run.NodeRuns, WorkflowNodeRun{Node: node.Name, TaskID: node.TaskID, Status: WORKFLOW_PENDING})
+		}
+		return tx.Create(&run).Error
+	})
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	advanceWorkflowRun(&run)
+	shown, err := loadWorkflowRun(workflow.ID, run.ID)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/api/v1/workflows/%d/runs/%d", workflow.ID, run.ID))
+	c.IndentedJSON(http.StatusAccepted, shown)
+}
+
+func apiListWorkflowRuns(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	var runs []WorkflowRun
+	query := db.Model(&WorkflowRun{}).Where("workflow_id = ?", workflow.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	page, err := listPage(c, query, &runs)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// loadWorkflowRun loads a run of a workflow with its nodes and how many of
+// them are in each status.
+func loadWorkflowRun(workflowID uint, runID interface{}) (*WorkflowRun, error) {
+	var run WorkflowRun
+	err := db.Preload("NodeRuns", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Limit(1).Find(&run, "id = ? AND workflow_id = ?", runID, workflowID).Error
+	if err != nil {
+		return nil, err
+	}
+	if run.ID == 0 {
+		return nil, errWorkflowRunNotFound
+	}
+	run.Counts = map[string]int{}
+	for _, node := range run.NodeRuns {
+		run.Counts[node.Status]++
+	}
+	return &run, nil
+}
+
+func apiShowWorkflowRun(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	run, err := loadWorkflowRun(workflow.ID, c.Param("run_id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, run)
+}
+
+// apiCancelWorkflowRun keeps the nodes that didn't start from starting. The
+// tasks already running go on, cancel them to stop them.
+func apiCancelWorkflowRun(c *gin.Context) {
+	workflow, err := findWorkflow(c)
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	tx := db.Model(&WorkflowRun{}).
+		Where("id = ? AND workflow_id = ? AND status = ?", c.Param("run_id"), workflow.ID, WORKFLOW_RUNNING).
+		Update("cancel_requested", true)
+	if tx.Error != nil {
+		apiError(c, tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		apiError(c, withStatus(http.StatusConflict, errors.New("workflow run is not running")))
+		return
+	}
+	run, err := loadWorkflowRun(workflow.ID, c.Param("run_id"))
+	if err != nil {
+		apiError(c, err)
+		return
+	}
+	advanceWorkflowRun(run)
+	if run, err = loadWorkflowRun(workflow.ID, run.ID); err != nil {
+		apiError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, run)
+}
+
+// taskRunOutcome tells whether the task run of node is over and whether
+// it succeeded. A run waiting for a retry or requeued after an interruption
+// isn't over.
+func taskRunOutcome(node *WorkflowNodeRun) (done bool, succeeded bool, err error) {
+	var run Run
+	if err := db.Limit(1).Find(&run, node.RunID).Error; err != nil {
+		return false, false, err
+	}
+	if run.ID == 0 {
+		return true, false, errRunNotFound
+	}
+	if run.Status == STATUS_WAITING || run.Status == STATUS_RUNNING {
+		return false, false, nil
+	}
+	var task Task
+	if err := db.Unscoped().Select("queued", "run_id").Limit(1).Find(&task, "task_id = ?", node.TaskID).Error; err != nil {
+		return false, false, err
+	}
+	if task.Queued && task.RunID == run.ID {
+		return false, false, nil
+	}
+	if err := runFailure(run.Status, run.Error, run.FailedHosts, run.Unreachable, run.ExitCode); err != nil {
+		return true, false, err
+	}
+	return true, true, nil
+}
+
+// nodeReady tells whether node may start, or never will, from the node
+// runs of its upstream nodes.
+func nodeReady(node *WorkflowNode, runs map[string]*WorkflowNodeRun) (ready, skip bool) {
+	for _, edge := range node.Needs {
+		switch up := runs[edge.Node].Status; {
+		case up == WORKFLOW_PENDING || up == WORKFLOW_RUNNING:
+			return false, false
+		case up == WORKFLOW_SKIPPED:
+			return false, true
+		case edge.On == WORKFLOW_ON_SUCCESS && up != WORKFLOW_SUCCESSFUL:
+			return false, true
+		case edge.On == WORKFLOW_ON_FAILURE && up != WORKFLOW_FAILED:
+			return false, true
+		}
+	}
+	return true, false
+}
+
+// updateNodeRun stores the status of node if it still is from.
+func updateNodeRun(node *WorkflowNodeRun, from string) bool {
+	tx := db.Model(&WorkflowNodeRun{}).Where("id = ? AND status = ?", node.ID, from).
+		Updates(map[string]interface{}{
+			"status":      node.Status,
+			"error":       node.Error,
+			"run_id":      node.RunID,
+			"started_at":  node.StartedAt,
+			"finished_at": node.FinishedAt,
+		})
+	if tx.Error != nil {
+		logger("workflows").Error("failed to update node run", "workflow_run_id", node.WorkflowRunID, "node", node.Node, "error", tx.Error)
+		return false
+	}
+	return tx.RowsAffected > 0
+}
+
+// startNode runs the task of node as user. A task already queued or running
+// is waited for, the node stays pending.
+func startNode(node *WorkflowNodeRun, user *User) {
+	node.Status = WORKFLOW_RUNNING
+	node.StartedAt = time.Now()
+	if !updateNodeRun(node, WORKFLOW_PENDING) {
+		return
+	}
+	run, err := startTask(node.TaskID, user, RunRequest{})
+	switch {
+	case err == errTaskAlreadyQueued:
+		node.Status = WORKFLOW_PENDING
+		node.StartedAt = time.Time{}
+	case err != nil:
+		node.Status = WORKFLOW_FAILED
+		node.Error = err.Error()
+		node.FinishedAt = time.Now()
+	default:
+		node.RunID = run.ID
+	}
+	updateNodeRun(node, WORKFLOW_RUNNING)
+}
+
+// workflowRunStatus rolls the node runs up. A failed node fails the workflow
+// unless a node that runs on its failure, or always, ran.
+func workflowRunStatus(run *WorkflowRun, runs map[string]*WorkflowNodeRun) string {
+	handled := map[string]bool{}
+	for _, node := range run.Graph {
+		status := runs[node.Name].Status
+		if status != WORKFLOW_SUCCESSFUL && status != WORKFLOW_FAILED {
+			continue
+		}
+		for _, edge := range node.Needs {
+			if edge.On != WORKFLOW_ON_SUCCESS {
+				handled[edge.Node] = true
+			}
+		}
+	}
+	for name, node := range runs {
+		if node.Status == WORKFLOW_FAILED && !handled[name] {
+			return WORKFLOW_FAILED
+		}
+	}
+	if run.CancelRequested {
+		return WORKFLOW_CANCELLED
+	}
+	return WORKFLOW_SUCCESSFUL
+}
+
+// advanceWorkflowRun takes in the outcome of the running nodes of run,
+// starts or skips the nodes whose upstream nodes are over and finishes run
+// once all nodes are over.
+func advanceWorkflowRun(run *WorkflowRun) {
+	log := logger("workflows")
+	var nodeRuns []WorkflowNodeRun
+	if err := db.Where("workflow_run_id = ?", run.ID).Find(&nodeRuns).Error; err != nil {
+		log.Error("failed to load node runs", "workflow_run_id", run.ID, "error", err)
+		return
+	}
+	runs := map[string]*WorkflowNodeRun{}
+	for i := range nodeRuns {
+		runs[nodeRuns[i].Node] = &nodeRuns[i]
+	}
+	for _, node := range runs {
+		if node.Status != WORKFLOW_RUNNING || node.RunID == 0 {
+			continue
+		}
+		done, succeeded, err := taskRunOutcome(node)
+		if !done {
+			if err != nil {
+				log.Error("failed to check node run", "workflow_run_id", run.ID, "node", node.Node, "error", err)
+			}
+			continue
+		}
+		node.Status, node.FinishedAt = WORKFLOW_SUCCESSFUL, time.Now()
+		if !succeeded {
+			node.Status, node.Error = WORKFLOW_FAILED, err.Error()
+		}
+		updateNodeRun(node, WORKFLOW_RUNNING)
+	}
+
+	var user User
+	if err := db.Limit(1).Find(&user, run.UserID).Error; err != nil {
+		log.Error("failed to load workflow user", "workflow_run_id", run.ID, "error", err)
+		return
+	}
+	// a node that ends at once, failed or skipped, may decide the next ones
+	for changed := true; changed; {
+		changed = false
+		for i := range run.Graph {
+			node := runs[run.Graph[i].Name]
+			if node == nil || node.Status != WORKFLOW_PENDING {
+				continue
+			}
+			ready, skip := nodeReady(&run.Graph[i], runs)
+			switch {
+			case user.ID == 0:
+				node.Status, node.Error, node.FinishedAt = WORKFLOW_FAILED, "the user who ran the workflow is gone", time.Now()
+				if updateNodeRun(node, WORKFLOW_PENDING) {
+					changed = true
+				}
+			case skip || run.CancelRequested:
+				node.Status, node.FinishedAt = WORKFLOW_SKIPPED, time.Now()
+				if updateNodeRun(node, WORKFLOW_PENDING) {
+					changed = true
+				}
+			case ready:
+				startNode(node, &user)
+				changed = changed || node.Status != WORKFLOW_PENDING
+			}
+		}
+	}
+
+	for _, node := range runs {
+		if node.Status == WORKFLOW_PENDING || node.Status == WORKFLOW_RUNNING {
+			return
+		}
+	}
+	run.Status = workflowRunStatus(run, runs)
+	run.FinishedAt = time.Now()
+	err := db.Model(&WorkflowRun{}).Where("id = ? AND status = ?", run.ID, WORKFLOW_RUNNING).
+		Updates(map[string]interface{}{"status": run.Status, "finished_at": run.FinishedAt}).Error
+	if err != nil {
+		log.Error("failed to finish workflow run", "workflow_run_id", run.ID, "error", err)
+		return
+	}
+	log.Info("workflow run finished", "workflow_id", run.WorkflowID, "workflow_run_id", run.ID, "status", run.Status)
+}
+
+// advanceWorkflowRuns advances every running workflow run.
+func advanceWorkflowRuns() {
+	var runs []WorkflowRun
+	if err := db.Where("status = ?", WORKFLOW_RUNNING).Order("id").Find(&runs).Error; err != nil {
+		logger("workflows").Error("failed to list workflow runs", "error", err)
+		return
+	}
+	for i := range runs {
+		advanceWorkflowRun(&runs[i])
+	}
+}
+
+func startWorkflowScheduler() {
+	ticker := time.NewTicker(WORKFLOW_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		advanceWorkflowRuns()
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}